@@ -1,15 +1,18 @@
 package actions
 
 import (
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/index"
+	"github.com/thomiceli/opengist/internal/utils"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ActionStatus struct {
@@ -23,23 +26,52 @@ const (
 	SyncGistPreviews
 	ResetHooks
 	IndexGists
+	DeleteExpiredGists
+	DeleteUnverifiedUsers
+	PurgeTrashedGists
+	Backup
 )
 
+// lockTtl is how long an action can run before its lock is considered abandoned by replicas
+const lockTtl = time.Hour
+
 var (
 	mutex   sync.Mutex
 	actions = make(map[int]ActionStatus)
+
+	// instanceId identifies this instance among the replicas sharing the database
+	instanceId = fmt.Sprintf("%s-%d-%d", hostname(), os.Getpid(), time.Now().UnixNano())
 )
 
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+func lockName(actionType int) string {
+	return fmt.Sprintf("action-%d", actionType)
+}
+
 func updateActionStatus(actionType int, running bool) {
 	actions[actionType] = ActionStatus{
 		Running: running,
 	}
 }
 
+// IsRunning reports whether the action is running on this instance or on another replica
 func IsRunning(actionType int) bool {
 	mutex.Lock()
-	defer mutex.Unlock()
-	return actions[actionType].Running
+	running := actions[actionType].Running
+	mutex.Unlock()
+	if running {
+		return true
+	}
+
+	locked, err := db.IsJobLocked(lockName(actionType))
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot check the lock of the action")
+	}
+	return locked
 }
 
 func Run(actionType int) {
@@ -59,6 +91,22 @@ func Run(actionType int) {
 		mutex.Unlock()
 	}()
 
+	// another replica may be running it already
+	acquired, err := db.AcquireJobLock(lockName(actionType), instanceId, lockTtl)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot acquire the lock of the action")
+		return
+	}
+	if !acquired {
+		log.Info().Msg("Action already running on another instance")
+		return
+	}
+	defer func() {
+		if err := db.ReleaseJobLock(lockName(actionType), instanceId); err != nil {
+			log.Error().Err(err).Msg("Cannot release the lock of the action")
+		}
+	}()
+
 	var functionToRun func()
 	switch actionType {
 	case SyncReposFromFS:
@@ -73,6 +121,14 @@ func Run(actionType int) {
 		functionToRun = resetHooks
 	case IndexGists:
 		functionToRun = indexGists
+	case DeleteExpiredGists:
+		functionToRun = deleteExpiredGists
+	case DeleteUnverifiedUsers:
+		functionToRun = deleteUnverifiedUsers
+	case PurgeTrashedGists:
+		functionToRun = purgeTrashedGists
+	case Backup:
+		functionToRun = backup
 	default:
 		log.Error().Msg("Unknown action type")
 	}
@@ -107,12 +163,28 @@ func syncReposFromDB() {
 
 	for _, e := range entries {
 		path := strings.Split(e, string(os.PathSeparator))
-		gist, _ := db.GetGist(path[len(path)-2], path[len(path)-1])
+		// the repositories of a deleted user whose removal was interrupted
+		if strings.HasPrefix(path[len(path)-2], ".deleted-") {
+			if err := os.RemoveAll(filepath.Dir(e)); err != nil {
+				log.Error().Err(err).Msgf("Cannot delete directory %s", filepath.Dir(e))
+			}
+			continue
+		}
 
-		if gist.ID == 0 {
+		// the repositories of the gists in the trash are kept
+		exists, err := db.GistExists(path[len(path)-2], path[len(path)-1])
+		if err != nil {
+			log.Error().Err(err).Msgf("Cannot get gist %s/%s", path[len(path)-2], path[len(path)-1])
+			continue
+		}
+
+		if !exists {
 			if err := git.DeleteRepository(path[len(path)-2], path[len(path)-1]); err != nil {
 				log.Error().Err(err).Msgf("Cannot delete repository %s/%s", path[len(path)-2], path[len(path)-1])
 			}
+			if err := git.DeleteLfsObjects(path[len(path)-1]); err != nil {
+				log.Error().Err(err).Msgf("Cannot delete the Git LFS objects of %s/%s", path[len(path)-2], path[len(path)-1])
+			}
 		}
 	}
 }
@@ -175,3 +247,74 @@ func indexGists() {
 		}
 	}
 }
+
+func deleteExpiredGists() {
+	log.Info().Msg("Deleting expired gists...")
+	gists, err := db.GetAllExpiredGists()
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get expired gists")
+		return
+	}
+
+	for _, gist := range gists {
+		if err = gist.Delete(); err != nil {
+			log.Error().Err(err).Msgf("Cannot delete gist %d", gist.ID)
+			continue
+		}
+		gist.RemoveFromIndex()
+	}
+}
+
+func deleteUnverifiedUsers() {
+	log.Info().Msg("Deleting unverified users...")
+	// the verification link sent at registration is valid for 24 hours
+	users, err := db.GetUnverifiedUsersBefore(time.Now().Add(-24 * time.Hour).Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get unverified users")
+		return
+	}
+
+	for _, user := range users {
+		if err = user.Delete(); err != nil {
+			log.Error().Err(err).Msgf("Cannot delete user %d", user.ID)
+		}
+	}
+}
+
+// purgeTrashedGists deletes the gists kept in the trash for longer than the retention, all of them if the trash was
+// disabled since
+func purgeTrashedGists() {
+	log.Info().Msg("Purging trashed gists...")
+	gists, err := db.GetGistsTrashedBefore(time.Now().AddDate(0, 0, -config.C.TrashRetentionDays))
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot get trashed gists")
+		return
+	}
+
+	for _, gist := range gists {
+		if err = gist.Delete(); err != nil {
+			log.Error().Err(err).Msgf("Cannot delete gist %d", gist.ID)
+		}
+	}
+}
+
+// Schedule runs the action now and then at every interval, forever
+func Schedule(actionType int, interval time.Duration) {
+	for {
+		Run(actionType)
+		time.Sleep(interval)
+	}
+}
+
+// ScheduleCron runs the action at every time of the schedule, forever
+func ScheduleCron(actionType int, schedule *utils.CronSchedule) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warn().Msg("The schedule of the action never matches")
+			return
+		}
+		time.Sleep(time.Until(next))
+		Run(actionType)
+	}
+}
@@ -0,0 +1,246 @@
+package actions
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+const (
+	backupPrefix = "opengist-backup-"
+	backupSuffix = ".tar.gz"
+
+	// backupLockTimeout is how long a backup waits for the running pushes before failing
+	backupLockTimeout = 10 * time.Minute
+)
+
+// BackupStatus is the result of the last backup
+type BackupStatus struct {
+	Time    time.Time
+	Archive string // name of the archive in the backup directory, empty if the backup failed
+	Error   string
+}
+
+// lastBackup is the last backup made by this instance, guarded by mutex
+var lastBackup BackupStatus
+
+// BackupPath returns the directory where the backup archives are written
+func BackupPath() string {
+	if config.C.BackupPath != "" {
+		return config.C.BackupPath
+	}
+	return filepath.Join(config.GetHomeDir(), "backups")
+}
+
+// LastBackup returns the result of the last backup made by this instance, or the last archive of the backup directory
+// if none was made since it started
+func LastBackup() BackupStatus {
+	mutex.Lock()
+	status := lastBackup
+	mutex.Unlock()
+	if !status.Time.IsZero() {
+		return status
+	}
+
+	archives, err := backupArchives()
+	if err != nil || len(archives) == 0 {
+		return status
+	}
+	info, err := os.Stat(filepath.Join(BackupPath(), archives[len(archives)-1]))
+	if err != nil {
+		return status
+	}
+	return BackupStatus{Time: info.ModTime(), Archive: info.Name()}
+}
+
+func backup() {
+	log.Info().Msg("Backing up the database and the repositories...")
+	now := time.Now()
+	archive, err := createBackup(now)
+
+	status := BackupStatus{Time: now, Archive: archive}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	mutex.Lock()
+	lastBackup = status
+	mutex.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot back up the database and the repositories")
+		return
+	}
+	log.Info().Msgf("Backup written to %s", filepath.Join(BackupPath(), archive))
+
+	if err = pruneBackups(config.C.BackupRetention); err != nil {
+		log.Error().Err(err).Msg("Cannot delete the old backups")
+	}
+}
+
+// createBackup writes the database and the repositories to a new archive of the backup directory, and returns its
+// name. The archive is only given its name once complete, so that a failed backup never looks like a valid one.
+func createBackup(now time.Time) (string, error) {
+	dir := BackupPath()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := backupPrefix + now.UTC().Format("20060102-150405") + backupSuffix
+	tmp, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeBackup(tmp, dir)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return name, os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// writeBackup writes the archive of the database, the repositories and the Git LFS objects. The changes of the
+// repositories wait until it is done, so that none of them is copied half written.
+func writeBackup(w io.Writer, tmpDir string) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	unlock, err := git.LockForBackup(backupLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dbSnapshot, err := os.CreateTemp(tmpDir, ".tmp-db-*")
+	if err != nil {
+		return err
+	}
+	_ = dbSnapshot.Close()
+	defer os.Remove(dbSnapshot.Name())
+
+	if err = db.Backup(dbSnapshot.Name()); err != nil {
+		return err
+	}
+	if err = addToBackup(tarWriter, dbSnapshot.Name(), config.C.DBFilename); err != nil {
+		return err
+	}
+
+	if err = addToBackup(tarWriter, filepath.Join(config.GetHomeDir(), git.ReposDirectory), "repos"); err != nil {
+		return err
+	}
+	if err = addToBackup(tarWriter, git.LfsPath(), "lfs"); err != nil {
+		return err
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// addToBackup adds a file, or a directory and all its content, to the archive under the name given. A directory
+// which does not exist is left out.
+func addToBackup(tarWriter *tar.Writer, source string, name string) error {
+	err := filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// the Git LFS objects being uploaded
+		if path != source && strings.Contains(entry.Name(), ".tmp-") {
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, relative))
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tarWriter, file, header.Size)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// backupArchives returns the names of the archives of the backup directory, the oldest first
+func backupArchives() ([]string, error) {
+	entries, err := os.ReadDir(BackupPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var archives []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), backupPrefix) && strings.HasSuffix(entry.Name(), backupSuffix) {
+			archives = append(archives, entry.Name())
+		}
+	}
+	// the names end with the time of the backup
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// pruneBackups deletes the oldest archives of the backup directory to keep only the last ones, or all of them if
+// retention is 0
+func pruneBackups(retention int) error {
+	archives, err := backupArchives()
+	if err != nil || retention == 0 || len(archives) <= retention {
+		return err
+	}
+
+	for _, archive := range archives[:len(archives)-retention] {
+		if err = os.Remove(filepath.Join(BackupPath(), archive)); err != nil {
+			return err
+		}
+		log.Info().Msgf("Deleted the old backup %s", archive)
+	}
+	return nil
+}
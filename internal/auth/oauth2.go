@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
+)
+
+// OAuth2Provider is a goth provider for identity providers speaking plain OAuth2 with a userinfo endpoint,
+// configured entirely by its endpoints and the JSON fields of the userinfo response
+type OAuth2Provider struct {
+	ClientKey     string
+	Secret        string
+	CallbackURL   string
+	UserInfoURL   string
+	IDField       string
+	UsernameField string
+	EmailField    string
+	AvatarField   string
+	HTTPClient    *http.Client
+	config        *oauth2.Config
+	providerName  string
+}
+
+var _ goth.Provider = &OAuth2Provider{}
+
+func NewOAuth2Provider(name, clientKey, secret, callbackURL, authURL, tokenURL, userInfoURL string, scopes []string) *OAuth2Provider {
+	return &OAuth2Provider{
+		ClientKey:     clientKey,
+		Secret:        secret,
+		CallbackURL:   callbackURL,
+		UserInfoURL:   userInfoURL,
+		IDField:       "id",
+		UsernameField: "username",
+		EmailField:    "email",
+		AvatarField:   "avatar_url",
+		providerName:  name,
+		config: &oauth2.Config{
+			ClientID:     clientKey,
+			ClientSecret: secret,
+			RedirectURL:  callbackURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  authURL,
+				TokenURL: tokenURL,
+			},
+			Scopes: scopes,
+		},
+	}
+}
+
+func (p *OAuth2Provider) Name() string {
+	return p.providerName
+}
+
+func (p *OAuth2Provider) SetName(name string) {
+	p.providerName = name
+}
+
+func (p *OAuth2Provider) Client() *http.Client {
+	return goth.HTTPClientWithFallBack(p.HTTPClient)
+}
+
+func (p *OAuth2Provider) Debug(bool) {}
+
+func (p *OAuth2Provider) BeginAuth(state string) (goth.Session, error) {
+	return &OAuth2Session{
+		AuthURL: p.config.AuthCodeURL(state),
+	}, nil
+}
+
+func (p *OAuth2Provider) UnmarshalSession(data string) (goth.Session, error) {
+	s := &OAuth2Session{}
+	err := json.NewDecoder(strings.NewReader(data)).Decode(s)
+	return s, err
+}
+
+func (p *OAuth2Provider) FetchUser(session goth.Session) (goth.User, error) {
+	sess := session.(*OAuth2Session)
+	user := goth.User{
+		AccessToken:  sess.AccessToken,
+		RefreshToken: sess.RefreshToken,
+		ExpiresAt:    sess.ExpiresAt,
+		Provider:     p.Name(),
+	}
+
+	if user.AccessToken == "" {
+		return user, fmt.Errorf("%s cannot get user information without accessToken", p.providerName)
+	}
+
+	req, err := http.NewRequest("GET", p.UserInfoURL, nil)
+	if err != nil {
+		return user, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sess.AccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return user, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return user, fmt.Errorf("%s responded with a %d trying to fetch user information", p.providerName, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return user, err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&user.RawData); err != nil {
+		return user, err
+	}
+
+	user.UserID = jsonField(user.RawData, p.IDField)
+	user.NickName = jsonField(user.RawData, p.UsernameField)
+	user.Email = jsonField(user.RawData, p.EmailField)
+	user.AvatarURL = jsonField(user.RawData, p.AvatarField)
+
+	if user.UserID == "" {
+		return user, fmt.Errorf("%s: field %q not found in user information", p.providerName, p.IDField)
+	}
+
+	return user, nil
+}
+
+func (p *OAuth2Provider) RefreshTokenAvailable() bool {
+	return true
+}
+
+func (p *OAuth2Provider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	token := &oauth2.Token{RefreshToken: refreshToken}
+	ts := p.config.TokenSource(goth.ContextForClient(p.Client()), token)
+	return ts.Token()
+}
+
+// jsonField returns the value at a dot separated path (e.g. "data.user.id") of a decoded JSON object
+func jsonField(data map[string]interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	var value interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = object[key]; !ok {
+			return ""
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// OAuth2Session stores data during the auth process with a generic OAuth2 provider
+type OAuth2Session struct {
+	AuthURL      string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+var _ goth.Session = &OAuth2Session{}
+
+func (s OAuth2Session) GetAuthURL() (string, error) {
+	if s.AuthURL == "" {
+		return "", errors.New(goth.NoAuthUrlErrorMessage)
+	}
+	return s.AuthURL, nil
+}
+
+func (s *OAuth2Session) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	p := provider.(*OAuth2Provider)
+	token, err := p.config.Exchange(goth.ContextForClient(p.Client()), params.Get("code"))
+	if err != nil {
+		return "", err
+	}
+
+	if !token.Valid() {
+		return "", errors.New("invalid token received from provider")
+	}
+
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.ExpiresAt = token.Expiry
+	return token.AccessToken, err
+}
+
+func (s OAuth2Session) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func (s OAuth2Session) String() string {
+	return s.Marshal()
+}
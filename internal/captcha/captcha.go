@@ -0,0 +1,77 @@
+package captcha
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+// Provider is a CAPTCHA service, whose widget is rendered in the forms and whose answer is verified by the server
+type Provider struct {
+	ScriptUrl     string
+	WidgetClass   string
+	ResponseField string // form field filled by the widget with the answer
+	VerifyUrl     string
+}
+
+var providers = map[string]Provider{
+	"hcaptcha": {
+		ScriptUrl:     "https://js.hcaptcha.com/1/api.js",
+		WidgetClass:   "h-captcha",
+		ResponseField: "h-captcha-response",
+		VerifyUrl:     "https://api.hcaptcha.com/siteverify",
+	},
+	"recaptcha": {
+		ScriptUrl:     "https://www.google.com/recaptcha/api.js",
+		WidgetClass:   "g-recaptcha",
+		ResponseField: "g-recaptcha-response",
+		VerifyUrl:     "https://www.google.com/recaptcha/api/siteverify",
+	},
+	"turnstile": {
+		ScriptUrl:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		WidgetClass:   "cf-turnstile",
+		ResponseField: "cf-turnstile-response",
+		VerifyUrl:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+}
+
+// Current returns the provider set in the configuration, or nil if CAPTCHAs are disabled
+func Current() *Provider {
+	provider, ok := providers[config.C.CaptchaProvider]
+	if !ok || config.C.CaptchaSiteKey == "" || config.C.CaptchaSecret == "" {
+		return nil
+	}
+	return &provider
+}
+
+// Verify asks the provider whether the answer submitted by the user at remoteIp is valid
+func (p *Provider) Verify(response string, remoteIp string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+
+	resp, err := utils.HttpClient.PostForm(p.VerifyUrl, url.Values{
+		"secret":   {config.C.CaptchaSecret},
+		"response": {response},
+		"remoteip": {remoteIp},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("captcha verification: unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -3,17 +3,20 @@ package cli
 import (
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/actions"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/index"
-	"github.com/thomiceli/opengist/internal/memdb"
 	"github.com/thomiceli/opengist/internal/ssh"
+	"github.com/thomiceli/opengist/internal/storage"
+	"github.com/thomiceli/opengist/internal/utils"
 	"github.com/thomiceli/opengist/internal/web"
 	"github.com/urfave/cli/v2"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 )
 
 var CmdVersion = cli.Command{
@@ -32,6 +35,14 @@ var CmdStart = cli.Command{
 		Initialize(ctx)
 		go web.NewServer(os.Getenv("OG_DEV") == "1", path.Join(config.GetHomeDir(), "sessions")).Start()
 		go ssh.Start()
+		go actions.Schedule(actions.PurgeTrashedGists, time.Hour)
+		if config.C.BackupCron != "" {
+			schedule, err := utils.ParseCron(config.C.BackupCron)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid backup schedule")
+			}
+			go actions.ScheduleCron(actions.Backup, schedule)
+		}
 		select {}
 	},
 }
@@ -80,6 +91,15 @@ func Initialize(ctx *cli.Context) {
 			"Current git version: " + gitVersion)
 	}
 
+	utils.SetHttpClientOptions(time.Duration(config.C.HttpOutboundTimeout)*time.Second, config.C.HttpOutboundRetries)
+
+	if config.C.HttpCACerts != "" {
+		if err := utils.LoadCACerts(config.C.HttpCACerts); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load the CA certificates")
+		}
+		log.Info().Msg("Trusting the CA certificates from " + config.C.HttpCACerts)
+	}
+
 	homePath := config.GetHomeDir()
 	log.Info().Msg("Data directory: " + homePath)
 
@@ -104,9 +124,7 @@ func Initialize(ctx *cli.Context) {
 		log.Fatal().Err(err).Msg("Failed to initialize database")
 	}
 
-	if err := memdb.Setup(); err != nil {
-		log.Fatal().Err(err).Msg("Failed to initialize in memory database")
-	}
+	storage.Setup()
 
 	if config.C.IndexEnabled {
 		log.Info().Msg("Index directory: " + filepath.Join(homePath, config.C.IndexDirname))
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -26,46 +27,204 @@ var C *config
 type config struct {
 	LogLevel     string `yaml:"log-level" env:"OG_LOG_LEVEL"`
 	LogOutput    string `yaml:"log-output" env:"OG_LOG_OUTPUT"`
+	LogFormat    string `yaml:"log-format" env:"OG_LOG_FORMAT"`
 	ExternalUrl  string `yaml:"external-url" env:"OG_EXTERNAL_URL"`
 	OpengistHome string `yaml:"opengist-home" env:"OG_OPENGIST_HOME"`
 	DBFilename   string `yaml:"db-filename" env:"OG_DB_FILENAME"`
 	IndexEnabled bool   `yaml:"index.enabled" env:"OG_INDEX_ENABLED"`
 	IndexDirname string `yaml:"index.dirname" env:"OG_INDEX_DIRNAME"`
 
+	ForceCanonicalHost bool `yaml:"force-canonical-host" env:"OG_FORCE_CANONICAL_HOST"`
+
+	ReadOnlyMode             bool `yaml:"read-only-mode" env:"OG_READ_ONLY_MODE"`
+	ReadOnlyAllowAdminWrites bool `yaml:"read-only-allow-admin-writes" env:"OG_READ_ONLY_ALLOW_ADMIN_WRITES"`
+
 	GitDefaultBranch string `yaml:"git.default-branch" env:"OG_GIT_DEFAULT_BRANCH"`
 
+	LfsEnabled    bool   `yaml:"lfs.enabled" env:"OG_LFS_ENABLED"`
+	LfsObjectPath string `yaml:"lfs.object-path" env:"OG_LFS_OBJECT_PATH"`
+	LfsThreshold  int    `yaml:"lfs.threshold" env:"OG_LFS_THRESHOLD"`
+
+	GistDefaultFilename   string `yaml:"gist.default-filename" env:"OG_GIST_DEFAULT_FILENAME"`
+	GistCreateFromUrl     bool   `yaml:"gist.create-from-url" env:"OG_GIST_CREATE_FROM_URL"`
+	GistMaxExpiry         string `yaml:"gist.max-expiry" env:"OG_GIST_MAX_EXPIRY"`
+	DefaultGistVisibility string `yaml:"gist.default-visibility" env:"OG_GIST_DEFAULT_VISIBILITY"`
+	TrashRetentionDays    int    `yaml:"gist.trash-retention-days" env:"OG_GIST_TRASH_RETENTION_DAYS"`
+
+	ListingDensity string `yaml:"listing.density" env:"OG_LISTING_DENSITY"`
+	ListingColumns string `yaml:"listing.columns" env:"OG_LISTING_COLUMNS"`
+
+	EmbedTheme string `yaml:"embed.theme" env:"OG_EMBED_THEME"`
+
+	PostLogoutRedirect      string `yaml:"post-logout-redirect" env:"OG_POST_LOGOUT_REDIRECT"`
+	PostLogoutRedirectHosts string `yaml:"post-logout-redirect-hosts" env:"OG_POST_LOGOUT_REDIRECT_HOSTS"`
+
 	SqliteJournalMode string `yaml:"sqlite.journal-mode" env:"OG_SQLITE_JOURNAL_MODE"`
 
+	BackupCron      string `yaml:"backup.cron" env:"OG_BACKUP_CRON"`
+	BackupPath      string `yaml:"backup.path" env:"OG_BACKUP_PATH"`
+	BackupRetention int    `yaml:"backup.retention" env:"OG_BACKUP_RETENTION"`
+
+	StorageType        string `yaml:"storage.type" env:"OG_STORAGE_TYPE"`
+	StorageS3Endpoint  string `yaml:"storage.s3-endpoint" env:"OG_STORAGE_S3_ENDPOINT"`
+	StorageS3Bucket    string `yaml:"storage.s3-bucket" env:"OG_STORAGE_S3_BUCKET"`
+	StorageS3Region    string `yaml:"storage.s3-region" env:"OG_STORAGE_S3_REGION"`
+	StorageS3AccessKey string `yaml:"storage.s3-access-key" env:"OG_STORAGE_S3_ACCESS_KEY"`
+	StorageS3SecretKey string `yaml:"storage.s3-secret-key" env:"OG_STORAGE_S3_SECRET_KEY"`
+	StorageS3PathStyle bool   `yaml:"storage.s3-path-style" env:"OG_STORAGE_S3_PATH_STYLE"`
+
 	HttpHost string `yaml:"http.host" env:"OG_HTTP_HOST"`
 	HttpPort string `yaml:"http.port" env:"OG_HTTP_PORT"`
 	HttpGit  bool   `yaml:"http.git-enabled" env:"OG_HTTP_GIT_ENABLED"`
 
+	HttpSecureCookies  bool   `yaml:"http.secure-cookies" env:"OG_HTTP_SECURE_COOKIES"`
+	HttpCACerts        string `yaml:"http.ca-certs" env:"OG_HTTP_CA_CERTS"`
+	HttpTrustedProxies string `yaml:"http.trusted-proxies" env:"OG_HTTP_TRUSTED_PROXIES"`
+
+	HttpOutboundTimeout int `yaml:"http.outbound-timeout" env:"OG_HTTP_OUTBOUND_TIMEOUT"`
+	HttpOutboundRetries int `yaml:"http.outbound-retries" env:"OG_HTTP_OUTBOUND_RETRIES"`
+
 	SshGit            bool   `yaml:"ssh.git-enabled" env:"OG_SSH_GIT_ENABLED"`
 	SshHost           string `yaml:"ssh.host" env:"OG_SSH_HOST"`
 	SshPort           string `yaml:"ssh.port" env:"OG_SSH_PORT"`
 	SshExternalDomain string `yaml:"ssh.external-domain" env:"OG_SSH_EXTERNAL_DOMAIN"`
+	SshExternalPort   string `yaml:"ssh.external-port" env:"OG_SSH_EXTERNAL_PORT"`
 	SshKeygen         string `yaml:"ssh.keygen-executable" env:"OG_SSH_KEYGEN_EXECUTABLE"`
 
-	GithubClientKey string `yaml:"github.client-key" env:"OG_GITHUB_CLIENT_KEY"`
-	GithubSecret    string `yaml:"github.secret" env:"OG_GITHUB_SECRET"`
-
-	GitlabClientKey string `yaml:"gitlab.client-key" env:"OG_GITLAB_CLIENT_KEY"`
-	GitlabSecret    string `yaml:"gitlab.secret" env:"OG_GITLAB_SECRET"`
-	GitlabUrl       string `yaml:"gitlab.url" env:"OG_GITLAB_URL"`
-	GitlabName      string `yaml:"gitlab.name" env:"OG_GITLAB_NAME"`
-
-	GiteaClientKey string `yaml:"gitea.client-key" env:"OG_GITEA_CLIENT_KEY"`
-	GiteaSecret    string `yaml:"gitea.secret" env:"OG_GITEA_SECRET"`
-	GiteaUrl       string `yaml:"gitea.url" env:"OG_GITEA_URL"`
-	GiteaName      string `yaml:"gitea.name" env:"OG_GITEA_NAME"`
-
-	OIDCClientKey    string `yaml:"oidc.client-key" env:"OG_OIDC_CLIENT_KEY"`
-	OIDCSecret       string `yaml:"oidc.secret" env:"OG_OIDC_SECRET"`
-	OIDCDiscoveryUrl string `yaml:"oidc.discovery-url" env:"OG_OIDC_DISCOVERY_URL"`
-
-	CustomLogo    string       `yaml:"custom.logo" env:"OG_CUSTOM_LOGO"`
-	CustomFavicon string       `yaml:"custom.favicon" env:"OG_CUSTOM_FAVICON"`
-	StaticLinks   []StaticLink `yaml:"custom.static-links" env:"OG_CUSTOM_STATIC_LINK"`
+	GithubClientKey   string `yaml:"github.client-key" env:"OG_GITHUB_CLIENT_KEY"`
+	GithubSecret      string `yaml:"github.secret" env:"OG_GITHUB_SECRET"`
+	GithubAllowSignup bool   `yaml:"github.allow-signup" env:"OG_GITHUB_ALLOW_SIGNUP"`
+	GithubAllowLink   bool   `yaml:"github.allow-link" env:"OG_GITHUB_ALLOW_LINK"`
+	GithubButtonLabel string `yaml:"github.button-label" env:"OG_GITHUB_BUTTON_LABEL"`
+	GithubButtonIcon  string `yaml:"github.button-icon" env:"OG_GITHUB_BUTTON_ICON"`
+
+	GitlabClientKey   string `yaml:"gitlab.client-key" env:"OG_GITLAB_CLIENT_KEY"`
+	GitlabSecret      string `yaml:"gitlab.secret" env:"OG_GITLAB_SECRET"`
+	GitlabUrl         string `yaml:"gitlab.url" env:"OG_GITLAB_URL"`
+	GitlabName        string `yaml:"gitlab.name" env:"OG_GITLAB_NAME"`
+	GitlabAllowSignup bool   `yaml:"gitlab.allow-signup" env:"OG_GITLAB_ALLOW_SIGNUP"`
+	GitlabAllowLink   bool   `yaml:"gitlab.allow-link" env:"OG_GITLAB_ALLOW_LINK"`
+	GitlabButtonLabel string `yaml:"gitlab.button-label" env:"OG_GITLAB_BUTTON_LABEL"`
+	GitlabButtonIcon  string `yaml:"gitlab.button-icon" env:"OG_GITLAB_BUTTON_ICON"`
+
+	GiteaClientKey   string `yaml:"gitea.client-key" env:"OG_GITEA_CLIENT_KEY"`
+	GiteaSecret      string `yaml:"gitea.secret" env:"OG_GITEA_SECRET"`
+	GiteaUrl         string `yaml:"gitea.url" env:"OG_GITEA_URL"`
+	GiteaName        string `yaml:"gitea.name" env:"OG_GITEA_NAME"`
+	GiteaAllowSignup bool   `yaml:"gitea.allow-signup" env:"OG_GITEA_ALLOW_SIGNUP"`
+	GiteaAllowLink   bool   `yaml:"gitea.allow-link" env:"OG_GITEA_ALLOW_LINK"`
+	GiteaButtonLabel string `yaml:"gitea.button-label" env:"OG_GITEA_BUTTON_LABEL"`
+	GiteaButtonIcon  string `yaml:"gitea.button-icon" env:"OG_GITEA_BUTTON_ICON"`
+
+	BitbucketClientKey   string `yaml:"bitbucket.client-key" env:"OG_BITBUCKET_CLIENT_KEY"`
+	BitbucketSecret      string `yaml:"bitbucket.secret" env:"OG_BITBUCKET_SECRET"`
+	BitbucketAllowSignup bool   `yaml:"bitbucket.allow-signup" env:"OG_BITBUCKET_ALLOW_SIGNUP"`
+	BitbucketAllowLink   bool   `yaml:"bitbucket.allow-link" env:"OG_BITBUCKET_ALLOW_LINK"`
+	BitbucketButtonLabel string `yaml:"bitbucket.button-label" env:"OG_BITBUCKET_BUTTON_LABEL"`
+	BitbucketButtonIcon  string `yaml:"bitbucket.button-icon" env:"OG_BITBUCKET_BUTTON_ICON"`
+
+	MicrosoftClientKey   string `yaml:"microsoft.client-key" env:"OG_MICROSOFT_CLIENT_KEY"`
+	MicrosoftSecret      string `yaml:"microsoft.secret" env:"OG_MICROSOFT_SECRET"`
+	MicrosoftTenant      string `yaml:"microsoft.tenant" env:"OG_MICROSOFT_TENANT"`
+	MicrosoftAllowSignup bool   `yaml:"microsoft.allow-signup" env:"OG_MICROSOFT_ALLOW_SIGNUP"`
+	MicrosoftAllowLink   bool   `yaml:"microsoft.allow-link" env:"OG_MICROSOFT_ALLOW_LINK"`
+	MicrosoftButtonLabel string `yaml:"microsoft.button-label" env:"OG_MICROSOFT_BUTTON_LABEL"`
+	MicrosoftButtonIcon  string `yaml:"microsoft.button-icon" env:"OG_MICROSOFT_BUTTON_ICON"`
+
+	OIDCClientKey    string         `yaml:"oidc.client-key" env:"OG_OIDC_CLIENT_KEY"`
+	OIDCSecret       string         `yaml:"oidc.secret" env:"OG_OIDC_SECRET"`
+	OIDCDiscoveryUrl string         `yaml:"oidc.discovery-url" env:"OG_OIDC_DISCOVERY_URL"`
+	OIDCAllowSignup  bool           `yaml:"oidc.allow-signup" env:"OG_OIDC_ALLOW_SIGNUP"`
+	OIDCAllowLink    bool           `yaml:"oidc.allow-link" env:"OG_OIDC_ALLOW_LINK"`
+	OIDCButtonLabel  string         `yaml:"oidc.button-label" env:"OG_OIDC_BUTTON_LABEL"`
+	OIDCButtonIcon   string         `yaml:"oidc.button-icon" env:"OG_OIDC_BUTTON_ICON"`
+	OIDCKeysUrl      string         `yaml:"oidc.keys-url" env:"OG_OIDC_KEYS_URL"`
+	OIDCGroupsClaim  string         `yaml:"oidc.groups-claim" env:"OG_OIDC_GROUPS_CLAIM"`
+	OIDCAdminGroup   string         `yaml:"oidc.admin-group" env:"OG_OIDC_ADMIN_GROUP"`
+	OIDCProviders    []OIDCProvider `yaml:"oidc.providers" env:"OG_OIDC_PROVIDER"`
+
+	OAuth2ClientKey     string `yaml:"oauth2.client-key" env:"OG_OAUTH2_CLIENT_KEY"`
+	OAuth2Secret        string `yaml:"oauth2.secret" env:"OG_OAUTH2_SECRET"`
+	OAuth2Name          string `yaml:"oauth2.name" env:"OG_OAUTH2_NAME"`
+	OAuth2AuthorizeUrl  string `yaml:"oauth2.authorize-url" env:"OG_OAUTH2_AUTHORIZE_URL"`
+	OAuth2TokenUrl      string `yaml:"oauth2.token-url" env:"OG_OAUTH2_TOKEN_URL"`
+	OAuth2UserinfoUrl   string `yaml:"oauth2.userinfo-url" env:"OG_OAUTH2_USERINFO_URL"`
+	OAuth2Scopes        string `yaml:"oauth2.scopes" env:"OG_OAUTH2_SCOPES"`
+	OAuth2IdField       string `yaml:"oauth2.id-field" env:"OG_OAUTH2_ID_FIELD"`
+	OAuth2UsernameField string `yaml:"oauth2.username-field" env:"OG_OAUTH2_USERNAME_FIELD"`
+	OAuth2EmailField    string `yaml:"oauth2.email-field" env:"OG_OAUTH2_EMAIL_FIELD"`
+	OAuth2AvatarField   string `yaml:"oauth2.avatar-field" env:"OG_OAUTH2_AVATAR_FIELD"`
+	OAuth2AllowSignup   bool   `yaml:"oauth2.allow-signup" env:"OG_OAUTH2_ALLOW_SIGNUP"`
+	OAuth2AllowLink     bool   `yaml:"oauth2.allow-link" env:"OG_OAUTH2_ALLOW_LINK"`
+	OAuth2ButtonLabel   string `yaml:"oauth2.button-label" env:"OG_OAUTH2_BUTTON_LABEL"`
+	OAuth2ButtonIcon    string `yaml:"oauth2.button-icon" env:"OG_OAUTH2_BUTTON_ICON"`
+
+	SAMLName              string `yaml:"saml.name" env:"OG_SAML_NAME"`
+	SAMLIdPMetadataUrl    string `yaml:"saml.idp-metadata-url" env:"OG_SAML_IDP_METADATA_URL"`
+	SAMLEntityID          string `yaml:"saml.entity-id" env:"OG_SAML_ENTITY_ID"`
+	SAMLCertificate       string `yaml:"saml.certificate" env:"OG_SAML_CERTIFICATE"`
+	SAMLKey               string `yaml:"saml.key" env:"OG_SAML_KEY"`
+	SAMLUsernameAttribute string `yaml:"saml.username-attribute" env:"OG_SAML_USERNAME_ATTRIBUTE"`
+	SAMLEmailAttribute    string `yaml:"saml.email-attribute" env:"OG_SAML_EMAIL_ATTRIBUTE"`
+	SAMLAllowIdPInitiated bool   `yaml:"saml.allow-idp-initiated" env:"OG_SAML_ALLOW_IDP_INITIATED"`
+	SAMLAllowSignup       bool   `yaml:"saml.allow-signup" env:"OG_SAML_ALLOW_SIGNUP"`
+	SAMLAllowLink         bool   `yaml:"saml.allow-link" env:"OG_SAML_ALLOW_LINK"`
+	SAMLButtonLabel       string `yaml:"saml.button-label" env:"OG_SAML_BUTTON_LABEL"`
+	SAMLButtonIcon        string `yaml:"saml.button-icon" env:"OG_SAML_BUTTON_ICON"`
+
+	LinkAccountsByEmail bool `yaml:"oauth.link-accounts-by-email" env:"OG_OAUTH_LINK_ACCOUNTS_BY_EMAIL"`
+
+	SmtpHost              string `yaml:"smtp.host" env:"OG_SMTP_HOST"`
+	SmtpPort              string `yaml:"smtp.port" env:"OG_SMTP_PORT"`
+	SmtpUsername          string `yaml:"smtp.username" env:"OG_SMTP_USERNAME"`
+	SmtpPassword          string `yaml:"smtp.password" env:"OG_SMTP_PASSWORD"`
+	SmtpFrom              string `yaml:"smtp.from" env:"OG_SMTP_FROM"`
+	SmtpVerifyEmailChange bool   `yaml:"smtp.verify-email-change" env:"OG_SMTP_VERIFY_EMAIL_CHANGE"`
+	SmtpMagicLink         bool   `yaml:"smtp.magic-link" env:"OG_SMTP_MAGIC_LINK"`
+
+	RequireEmailVerification bool   `yaml:"require-email-verification" env:"OG_REQUIRE_EMAIL_VERIFICATION"`
+	RequireSignupApproval    bool   `yaml:"require-signup-approval" env:"OG_REQUIRE_SIGNUP_APPROVAL"`
+	PrivacyStrictSignup      bool   `yaml:"privacy-strict-signup" env:"OG_PRIVACY_STRICT_SIGNUP"`
+	UniqueEmails             bool   `yaml:"unique-emails" env:"OG_UNIQUE_EMAILS"`
+	RequireTwoFactor         bool   `yaml:"require-two-factor" env:"OG_REQUIRE_TWO_FACTOR"`
+	RequireTwoFactorSkips    int    `yaml:"require-two-factor-skips" env:"OG_REQUIRE_TWO_FACTOR_SKIPS"`
+	AllowedSignupDomains     string `yaml:"allowed-signup-domains" env:"OG_ALLOWED_SIGNUP_DOMAINS"`
+	ReservedUsernames        string `yaml:"reserved-usernames" env:"OG_RESERVED_USERNAMES"`
+
+	MaxLoginAttempts  int `yaml:"max-login-attempts" env:"OG_MAX_LOGIN_ATTEMPTS"`
+	RegisterRateLimit int `yaml:"register-rate-limit" env:"OG_REGISTER_RATE_LIMIT"`
+	ApiRateLimit      int `yaml:"api.rate-limit" env:"OG_API_RATE_LIMIT"`
+	ApiTokenRateLimit int `yaml:"api.token-rate-limit" env:"OG_API_TOKEN_RATE_LIMIT"`
+	ApiIpRateLimit    int `yaml:"api.ip-rate-limit" env:"OG_API_IP_RATE_LIMIT"`
+
+	CorsAllowedOrigins string `yaml:"api.cors-allowed-origins" env:"OG_API_CORS_ALLOWED_ORIGINS"`
+
+	UsernameChangeCooldown int `yaml:"username-change-cooldown" env:"OG_USERNAME_CHANGE_COOLDOWN"`
+
+	MinPasswordLength        int  `yaml:"password.min-length" env:"OG_PASSWORD_MIN_LENGTH"`
+	PasswordRequireMixedCase bool `yaml:"password.require-mixed-case" env:"OG_PASSWORD_REQUIRE_MIXED_CASE"`
+	PasswordRequireDigit     bool `yaml:"password.require-digit" env:"OG_PASSWORD_REQUIRE_DIGIT"`
+	PasswordRequireSymbol    bool `yaml:"password.require-symbol" env:"OG_PASSWORD_REQUIRE_SYMBOL"`
+	PasswordBreachCheck      bool `yaml:"password.breach-check" env:"OG_PASSWORD_BREACH_CHECK"`
+
+	CaptchaProvider string `yaml:"captcha.provider" env:"OG_CAPTCHA_PROVIDER"`
+	CaptchaSiteKey  string `yaml:"captcha.site-key" env:"OG_CAPTCHA_SITE_KEY"`
+	CaptchaSecret   string `yaml:"captcha.secret" env:"OG_CAPTCHA_SECRET"`
+
+	CustomLogo       string       `yaml:"custom.logo" env:"OG_CUSTOM_LOGO"`
+	CustomFavicon    string       `yaml:"custom.favicon" env:"OG_CUSTOM_FAVICON"`
+	CustomPoweredBy  bool         `yaml:"custom.powered-by" env:"OG_CUSTOM_POWERED_BY"`
+	CustomFooterText string       `yaml:"custom.footer-text" env:"OG_CUSTOM_FOOTER_TEXT"`
+	StaticLinks      []StaticLink `yaml:"custom.static-links" env:"OG_CUSTOM_STATIC_LINK"`
+
+	PrivacyNoOutbound bool `yaml:"privacy.no-outbound" env:"OG_PRIVACY_NO_OUTBOUND"`
+
+	AvatarSource           string `yaml:"avatar.source" env:"OG_AVATAR_SOURCE"`
+	DisableExternalAvatars bool   `yaml:"avatar.disable-external" env:"OG_AVATAR_DISABLE_EXTERNAL"`
+
+	WebhooksAllowPrivateNetwork bool `yaml:"webhooks.allow-private-network" env:"OG_WEBHOOKS_ALLOW_PRIVATE_NETWORK"`
+
+	AdminImpersonateAdmins bool `yaml:"admin.impersonate-admins" env:"OG_ADMIN_IMPERSONATE_ADMINS"`
 }
 
 type StaticLink struct {
@@ -73,21 +232,62 @@ type StaticLink struct {
 	Path string `yaml:"path" env:"OG_CUSTOM_STATIC_LINK_#_PATH"`
 }
 
+// OIDCProvider is an OpenID Connect provider logged in with at /oauth/oidc-<id>, in addition to the one set with the
+// oidc.* keys. It follows the oidc.* keys for the signup, the link of accounts, the SSH keys and the admin group.
+type OIDCProvider struct {
+	ID           string `yaml:"id" env:"OG_OIDC_PROVIDER_#_ID"`
+	Name         string `yaml:"name" env:"OG_OIDC_PROVIDER_#_NAME"`
+	ClientKey    string `yaml:"client-key" env:"OG_OIDC_PROVIDER_#_CLIENT_KEY"`
+	Secret       string `yaml:"secret" env:"OG_OIDC_PROVIDER_#_SECRET"`
+	DiscoveryUrl string `yaml:"discovery-url" env:"OG_OIDC_PROVIDER_#_DISCOVERY_URL"`
+	ButtonLabel  string `yaml:"button-label" env:"OG_OIDC_PROVIDER_#_BUTTON_LABEL"`
+	ButtonIcon   string `yaml:"button-icon" env:"OG_OIDC_PROVIDER_#_BUTTON_ICON"`
+}
+
 func configWithDefaults() (*config, error) {
 	c := &config{}
 
 	c.LogLevel = "warn"
 	c.LogOutput = "stdout,file"
+	c.LogFormat = "text"
 	c.OpengistHome = ""
 	c.DBFilename = "opengist.db"
 	c.IndexEnabled = true
 	c.IndexDirname = "opengist.index"
 
+	c.LfsThreshold = 1048576
+
+	c.GistDefaultFilename = "gistfile{n}.txt"
+	c.DefaultGistVisibility = "public"
+	c.TrashRetentionDays = 30
+
+	c.BackupRetention = 7
+
+	c.ListingDensity = "comfortable"
+	c.ListingColumns = "likes,forks,files"
+
+	c.EmbedTheme = "auto"
+
+	c.AvatarSource = "gravatar"
+
+	// the first path segments of the routes, which would hide the profile of a user with the same name
+	c.ReservedUsernames = "admin,administrator,root,admin-panel,all,api,assets,avatars,fetch-url,forgot-password," +
+		"gists,healthcheck,impersonate,init,login,logout,oauth,palette,preview,register,reset-password,search,settings," +
+		"tags,verify-email"
+
+	c.PostLogoutRedirect = "/all"
+
 	c.SqliteJournalMode = "WAL"
 
+	c.StorageType = "local"
+	c.StorageS3Region = "us-east-1"
+	c.StorageS3PathStyle = true
+
 	c.HttpHost = "0.0.0.0"
 	c.HttpPort = "6157"
 	c.HttpGit = true
+	c.HttpOutboundTimeout = 10
+	c.HttpOutboundRetries = 2
 
 	c.SshGit = true
 	c.SshHost = "0.0.0.0"
@@ -99,6 +299,48 @@ func configWithDefaults() (*config, error) {
 	c.GiteaUrl = "https://gitea.com"
 	c.GiteaName = "Gitea"
 
+	c.MicrosoftTenant = "common"
+
+	c.GithubAllowSignup = true
+	c.GithubAllowLink = true
+	c.GitlabAllowSignup = true
+	c.GitlabAllowLink = true
+	c.GiteaAllowSignup = true
+	c.GiteaAllowLink = true
+	c.BitbucketAllowSignup = true
+	c.BitbucketAllowLink = true
+	c.MicrosoftAllowSignup = true
+	c.MicrosoftAllowLink = true
+	c.OIDCAllowSignup = true
+	c.OIDCAllowLink = true
+	c.OAuth2AllowSignup = true
+	c.OAuth2AllowLink = true
+	c.SAMLAllowSignup = true
+	c.SAMLAllowLink = true
+
+	c.OIDCGroupsClaim = "groups"
+
+	c.OAuth2Name = "OAuth2"
+	c.OAuth2IdField = "id"
+	c.OAuth2UsernameField = "username"
+	c.OAuth2EmailField = "email"
+	c.OAuth2AvatarField = "avatar_url"
+
+	c.SAMLName = "SAML"
+	c.SAMLUsernameAttribute = "username"
+	c.SAMLEmailAttribute = "email"
+
+	c.SmtpPort = "587"
+	c.SmtpVerifyEmailChange = true
+
+	c.MaxLoginAttempts = 5
+	c.RegisterRateLimit = 10
+	c.RequireTwoFactorSkips = 3
+	c.ApiRateLimit = 1000
+	c.ApiIpRateLimit = 3000
+
+	c.CustomPoweredBy = true
+
 	return c, nil
 }
 
@@ -162,7 +404,7 @@ func InitLog() {
 
 		switch logOutputType {
 		case "stdout":
-			logWriters = append(logWriters, zerolog.NewConsoleWriter())
+			logWriters = append(logWriters, stdoutLogWriter())
 			defer func() { log.Debug().Msg("Logging to stdout") }()
 		case "file":
 			file, err := os.OpenFile(filepath.Join(GetHomeDir(), "log", "opengist.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -174,7 +416,7 @@ func InitLog() {
 		}
 	}
 	if len(logWriters) == 0 {
-		logWriters = append(logWriters, zerolog.NewConsoleWriter())
+		logWriters = append(logWriters, stdoutLogWriter())
 		defer func() { log.Warn().Msg("No valid log outputs, defaulting to stdout") }()
 	}
 
@@ -184,6 +426,18 @@ func InitLog() {
 	if !slices.Contains([]string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}, strings.ToLower(C.LogLevel)) {
 		log.Warn().Msg("Invalid log level: " + C.LogLevel)
 	}
+	if !slices.Contains([]string{"text", "json"}, strings.ToLower(C.LogFormat)) {
+		log.Warn().Msg("Invalid log format: " + C.LogFormat)
+	}
+}
+
+// stdoutLogWriter returns the writer of the logs to the standard output, human-friendly lines unless log-format asks
+// for JSON. The log file is always written as JSON.
+func stdoutLogWriter() io.Writer {
+	if strings.ToLower(C.LogFormat) == "json" {
+		return os.Stdout
+	}
+	return zerolog.NewConsoleWriter()
 }
 
 func CheckGitVersion(version string) (bool, error) {
@@ -266,6 +520,13 @@ func loadConfigFromEnv(c *config, out io.Writer) error {
 			}
 			v.Field(i).SetBool(boolVal)
 			envVars = append(envVars, tag)
+		case reflect.Int:
+			intVal, err := strconv.Atoi(envValue)
+			if err != nil {
+				return err
+			}
+			v.Field(i).SetInt(int64(intVal))
+			envVars = append(envVars, tag)
 		case reflect.Slice:
 			if v.Type().Field(i).Type.Elem().Kind() == reflect.Struct {
 				prefix := strings.ToUpper(tag) + "_"
@@ -279,6 +540,9 @@ func loadConfigFromEnv(c *config, out io.Writer) error {
 					for j := 0; j < elemValue.NumField() && allFieldsPresent; j++ {
 						elemField := elemValue.Type().Field(j)
 						envName := fmt.Sprintf("%s%d_%s", prefix, index, strings.ToUpper(elemField.Name))
+						if elemTag := elemField.Tag.Get("env"); elemTag != "" {
+							envName = strings.ReplaceAll(elemTag, "#", strconv.Itoa(index))
+						}
 						envValue, present := os.LookupEnv(envName)
 
 						if !present {
@@ -320,10 +584,48 @@ func loadConfigFromEnv(c *config, out io.Writer) error {
 }
 
 func checks(c *config) error {
-	if _, err := url.Parse(c.ExternalUrl); err != nil {
+	if c.ExternalUrl != "" {
+		externalUrl, err := url.Parse(c.ExternalUrl)
+		if err != nil {
+			return fmt.Errorf("external-url: %w", err)
+		}
+		if (externalUrl.Scheme != "http" && externalUrl.Scheme != "https") || externalUrl.Host == "" {
+			return fmt.Errorf("external-url: %q must be an absolute http or https URL", c.ExternalUrl)
+		}
+		if externalUrl.RawQuery != "" || externalUrl.Fragment != "" || externalUrl.User != nil {
+			return fmt.Errorf("external-url: %q must not have credentials, a query or a fragment", c.ExternalUrl)
+		}
+		// the paths are appended to the external url, which would otherwise give a double slash
+		c.ExternalUrl = strings.TrimRight(c.ExternalUrl, "/")
+	}
+
+	if c.ForceCanonicalHost && c.ExternalUrl == "" {
+		return fmt.Errorf("force-canonical-host: external-url must be set to redirect to its host")
+	}
+
+	if _, err := parseTrustedProxies(c.HttpTrustedProxies); err != nil {
 		return err
 	}
 
+	if c.HttpOutboundTimeout < 1 {
+		return fmt.Errorf("http.outbound-timeout: %d must be at least 1 second", c.HttpOutboundTimeout)
+	}
+
+	if c.HttpOutboundRetries < 0 {
+		return fmt.Errorf("http.outbound-retries: %d must be positive, or 0 to never retry", c.HttpOutboundRetries)
+	}
+
+	if c.SshExternalPort != "" {
+		if port, err := strconv.Atoi(c.SshExternalPort); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("ssh.external-port: %q must be a port number", c.SshExternalPort)
+		}
+	}
+
+	// the smaller files could not be told apart from the pointers to the objects
+	if c.LfsThreshold < 1024 {
+		return fmt.Errorf("lfs.threshold: %d must be at least 1024 bytes", c.LfsThreshold)
+	}
+
 	if _, err := url.Parse(c.GiteaUrl); err != nil {
 		return err
 	}
@@ -332,5 +634,246 @@ func checks(c *config) error {
 		return err
 	}
 
+	if _, err := url.Parse(c.OIDCKeysUrl); err != nil {
+		return err
+	}
+
+	oidcProviderIds := make(map[string]bool, len(c.OIDCProviders))
+	for i, provider := range c.OIDCProviders {
+		if provider.ID == "" || strings.Trim(provider.ID, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return fmt.Errorf("oidc.providers: the id %q of provider %d must only contain lowercase letters, digits and dashes", provider.ID, i)
+		}
+		if oidcProviderIds[provider.ID] {
+			return fmt.Errorf("oidc.providers: the id %q is used by several providers", provider.ID)
+		}
+		oidcProviderIds[provider.ID] = true
+
+		if provider.Name == "" || provider.ClientKey == "" || provider.Secret == "" || provider.DiscoveryUrl == "" {
+			return fmt.Errorf("oidc.providers: provider %q must have a name, a client-key, a secret and a discovery-url", provider.ID)
+		}
+		if discoveryUrl, err := url.Parse(provider.DiscoveryUrl); err != nil || !discoveryUrl.IsAbs() {
+			return fmt.Errorf("oidc.providers: the discovery-url of provider %q must be an absolute URL", provider.ID)
+		}
+		if !isButtonIcon(provider.ButtonIcon) {
+			return fmt.Errorf("oidc.providers: the button-icon of provider %q must be an absolute http or https URL, or a file of the custom directory", provider.ID)
+		}
+	}
+
+	for key, icon := range map[string]string{
+		"github.button-icon":    c.GithubButtonIcon,
+		"gitlab.button-icon":    c.GitlabButtonIcon,
+		"gitea.button-icon":     c.GiteaButtonIcon,
+		"bitbucket.button-icon": c.BitbucketButtonIcon,
+		"microsoft.button-icon": c.MicrosoftButtonIcon,
+		"oidc.button-icon":      c.OIDCButtonIcon,
+		"oauth2.button-icon":    c.OAuth2ButtonIcon,
+		"saml.button-icon":      c.SAMLButtonIcon,
+	} {
+		if !isButtonIcon(icon) {
+			return fmt.Errorf("%s: %q must be an absolute http or https URL, or a file of the custom directory", key, icon)
+		}
+	}
+
+	if _, err := url.Parse(c.SAMLIdPMetadataUrl); err != nil {
+		return err
+	}
+
+	if (c.SAMLCertificate == "") != (c.SAMLKey == "") {
+		return fmt.Errorf("saml.certificate and saml.key must be set together")
+	}
+
+	for _, u := range []string{c.OAuth2AuthorizeUrl, c.OAuth2TokenUrl, c.OAuth2UserinfoUrl} {
+		if _, err := url.Parse(u); err != nil {
+			return err
+		}
+	}
+
+	if c.GistMaxExpiry != "" && !utils.IsValidExpiry(c.GistMaxExpiry) {
+		return fmt.Errorf("gist.max-expiry: %q must be one of %s", c.GistMaxExpiry, strings.Join(utils.ExpiryOptions, ", "))
+	}
+
+	if !slices.Contains(utils.Visibilities, c.DefaultGistVisibility) {
+		return fmt.Errorf("gist.default-visibility: %q must be one of %s", c.DefaultGistVisibility, strings.Join(utils.Visibilities, ", "))
+	}
+
+	if c.TrashRetentionDays < 0 {
+		return fmt.Errorf("gist.trash-retention-days: %d must be positive, or 0 to disable the trash", c.TrashRetentionDays)
+	}
+
+	if c.BackupCron != "" {
+		if _, err := utils.ParseCron(c.BackupCron); err != nil {
+			return fmt.Errorf("backup.cron: %w", err)
+		}
+	}
+
+	if c.BackupRetention < 0 {
+		return fmt.Errorf("backup.retention: %d must be positive, or 0 to keep all the backups", c.BackupRetention)
+	}
+
+	if c.MaxLoginAttempts < 0 {
+		return fmt.Errorf("max-login-attempts: %d must be positive, or 0 to disable the lockout", c.MaxLoginAttempts)
+	}
+
+	if c.UsernameChangeCooldown < 0 {
+		return fmt.Errorf("username-change-cooldown: %d must be positive, or 0 to disable the cooldown", c.UsernameChangeCooldown)
+	}
+
+	if c.MinPasswordLength < 0 {
+		return fmt.Errorf("password.min-length: %d must be positive, or 0 to disable the minimum", c.MinPasswordLength)
+	}
+
+	if c.PrivacyStrictSignup && !c.RequireEmailVerification {
+		return fmt.Errorf("privacy-strict-signup: require-email-verification must be enabled to hide the existing accounts")
+	}
+
+	if c.RequireTwoFactorSkips < 0 {
+		return fmt.Errorf("require-two-factor-skips: %d must be positive, or 0 to require it right away", c.RequireTwoFactorSkips)
+	}
+
+	if c.RegisterRateLimit < 0 {
+		return fmt.Errorf("register-rate-limit: %d must be positive, or 0 to disable the limit", c.RegisterRateLimit)
+	}
+
+	if c.ApiRateLimit < 0 {
+		return fmt.Errorf("api.rate-limit: %d must be positive, or 0 to disable the limit", c.ApiRateLimit)
+	}
+
+	if c.ApiTokenRateLimit < 0 {
+		return fmt.Errorf("api.token-rate-limit: %d must be positive, or 0 to disable the limit", c.ApiTokenRateLimit)
+	}
+
+	if c.ApiIpRateLimit < 0 {
+		return fmt.Errorf("api.ip-rate-limit: %d must be positive, or 0 to disable the limit", c.ApiIpRateLimit)
+	}
+
+	var corsAnyOrigin, corsOrigins bool
+	for _, origin := range strings.Split(c.CorsAllowedOrigins, ",") {
+		switch origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin {
+		case "":
+		case "*":
+			corsAnyOrigin = true
+		default:
+			originUrl, err := url.Parse(origin)
+			if err != nil || (originUrl.Scheme != "http" && originUrl.Scheme != "https") || originUrl.Host == "" ||
+				originUrl.Path != "" || originUrl.RawQuery != "" || originUrl.User != nil {
+				return fmt.Errorf("api.cors-allowed-origins: %q must be an origin like https://example.com, or * for any origin", origin)
+			}
+			corsOrigins = true
+		}
+	}
+	// the listed origins can send credentials, which must never be allowed to any origin
+	if corsAnyOrigin && corsOrigins {
+		return fmt.Errorf("api.cors-allowed-origins: * cannot be combined with a list of origins")
+	}
+
+	switch c.CaptchaProvider {
+	case "":
+	case "hcaptcha", "recaptcha", "turnstile":
+		if c.CaptchaSiteKey == "" || c.CaptchaSecret == "" {
+			return fmt.Errorf("captcha.site-key and captcha.secret must be set to use a captcha")
+		}
+	default:
+		return fmt.Errorf("captcha.provider: %q must be either hcaptcha, recaptcha or turnstile", c.CaptchaProvider)
+	}
+
+	switch c.StorageType {
+	case "local":
+	case "s3":
+		if c.StorageS3Endpoint == "" || c.StorageS3Bucket == "" {
+			return fmt.Errorf("storage.s3-endpoint and storage.s3-bucket must be set to use the s3 storage")
+		}
+		if u, err := url.Parse(c.StorageS3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("storage.s3-endpoint: %q must be an HTTP or HTTPS URL", c.StorageS3Endpoint)
+		}
+	default:
+		return fmt.Errorf("storage.type: %q must be either local or s3", c.StorageType)
+	}
+
+	if !slices.Contains(utils.ListingDensities, c.ListingDensity) {
+		return fmt.Errorf("listing.density: %q must be one of %s", c.ListingDensity, strings.Join(utils.ListingDensities, ", "))
+	}
+
+	if _, err := utils.ParseListingColumns(c.ListingColumns); err != nil {
+		return fmt.Errorf("listing.columns: %w", err)
+	}
+
+	switch c.EmbedTheme {
+	case "auto", "light", "dark":
+	default:
+		return fmt.Errorf("embed.theme: %q must be one of auto, light, dark", c.EmbedTheme)
+	}
+
+	if !slices.Contains(utils.AvatarSources, c.AvatarSource) {
+		return fmt.Errorf("avatar.source: %q must be one of %s", c.AvatarSource, strings.Join(utils.AvatarSources, ", "))
+	}
+
+	// either a path on this instance or an absolute URL to one of the allowed hosts
+	redirectUrl, err := url.Parse(c.PostLogoutRedirect)
+	if err != nil {
+		return err
+	}
+	if redirectUrl.IsAbs() {
+		if redirectUrl.Scheme != "http" && redirectUrl.Scheme != "https" {
+			return fmt.Errorf("post-logout-redirect: unsupported scheme %q", redirectUrl.Scheme)
+		}
+		allowed := false
+		for _, host := range strings.Split(c.PostLogoutRedirectHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" && strings.EqualFold(host, redirectUrl.Hostname()) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("post-logout-redirect: the host of %q must be listed in post-logout-redirect-hosts", c.PostLogoutRedirect)
+		}
+	} else if !strings.HasPrefix(c.PostLogoutRedirect, "/") || strings.HasPrefix(c.PostLogoutRedirect, "//") ||
+		strings.HasPrefix(c.PostLogoutRedirect, "/\\") {
+		// the browsers read /\ as // too, both starting a URL of another host
+		return fmt.Errorf("post-logout-redirect: %q must be a path starting with / or an absolute URL", c.PostLogoutRedirect)
+	}
+
 	return nil
 }
+
+// TrustedProxies returns the networks of the reverse proxies allowed to set the address of the clients
+func TrustedProxies() []*net.IPNet {
+	proxies, _ := parseTrustedProxies(C.HttpTrustedProxies)
+	return proxies
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, proxy := range strings.Split(value, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("http.trusted-proxies: %q must be an IP address or a CIDR range", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("http.trusted-proxies: %q must be an IP address or a CIDR range", proxy)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// isButtonIcon reports whether the icon of a login button is an absolute http or https URL, or the name of a file of
+// the custom directory. No icon is valid too.
+func isButtonIcon(icon string) bool {
+	if !strings.Contains(icon, "://") {
+		return true
+	}
+	u, err := url.Parse(icon)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostLogoutRedirect(t *testing.T) {
+	c, err := configWithDefaults()
+	require.NoError(t, err)
+	require.NoError(t, checks(c))
+
+	for _, redirect := range []string{"/login", "/all?logged-out=1"} {
+		c.PostLogoutRedirect = redirect
+		require.NoError(t, checks(c), redirect)
+	}
+	for _, redirect := range []string{"login", "//evil.example.com/portal", "/\\evil.example.com/portal", "javascript:alert(1)"} {
+		c.PostLogoutRedirect = redirect
+		require.Error(t, checks(c), redirect)
+	}
+
+	// the external URLs must go to one of the allowed hosts
+	c.PostLogoutRedirect = "https://sso.example.com/portal"
+	require.Error(t, checks(c))
+
+	c.PostLogoutRedirectHosts = "auth.example.com, SSO.example.com"
+	require.NoError(t, checks(c))
+	c.PostLogoutRedirect = "https://sso.example.com:8443/portal"
+	require.NoError(t, checks(c))
+
+	for _, redirect := range []string{"https://evil.example.com/portal", "https://sso.example.com.evil.example/portal", "https://sso.example.com@evil.example/portal"} {
+		c.PostLogoutRedirect = redirect
+		require.Error(t, checks(c), redirect)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	c, err := configWithDefaults()
+	require.NoError(t, err)
+
+	c.HttpTrustedProxies = "127.0.0.1, 10.0.0.0/8,::1,fd00::/8"
+	require.NoError(t, checks(c))
+	proxies, err := parseTrustedProxies(c.HttpTrustedProxies)
+	require.NoError(t, err)
+	require.Len(t, proxies, 4)
+	require.Equal(t, "127.0.0.1/32", proxies[0].String())
+	require.Equal(t, "10.0.0.0/8", proxies[1].String())
+	require.Equal(t, "::1/128", proxies[2].String())
+
+	for _, proxies := range []string{"localhost", "10.0.0.0/33", "10.0.0.1,nginx"} {
+		c.HttpTrustedProxies = proxies
+		require.Error(t, checks(c), proxies)
+	}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"github.com/thomiceli/opengist/internal/config"
 	"gorm.io/gorm/clause"
 )
 
@@ -15,8 +16,15 @@ const (
 	SettingAllowGistsWithoutLogin = "allow-gists-without-login"
 	SettingDisableLoginForm       = "disable-login-form"
 	SettingDisableGravatar        = "disable-gravatar"
+	SettingReadOnlyMode           = "read-only-mode"
 )
 
+// SettingDisableOAuth returns the key of the setting disabling the login with an OAuth provider. It is not set until an
+// admin toggles it, so the providers are enabled by default.
+func SettingDisableOAuth(provider string) string {
+	return "disable-oauth-" + provider
+}
+
 func GetSetting(key string) (string, error) {
 	var setting AdminSetting
 	err := db.Where("key = ?", key).First(&setting).Error
@@ -64,6 +72,18 @@ func initAdminSettings(settings map[string]string) error {
 	return nil
 }
 
+// ReadOnlyMode reports whether the instance is in read-only mode, from the configuration or toggled by an admin
+func ReadOnlyMode() (bool, error) {
+	if config.C.ReadOnlyMode {
+		return true, nil
+	}
+	s, err := GetSetting(SettingReadOnlyMode)
+	if err != nil {
+		return false, err
+	}
+	return s == "1", nil
+}
+
 type DBAuthInfo struct{}
 
 func (auth DBAuthInfo) RequireLogin() (bool, error) {
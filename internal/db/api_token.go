@@ -0,0 +1,137 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ApiTokenScopeRead  = "read"
+	ApiTokenScopeWrite = "write"
+
+	// apiTokenPrefix starts every token, so that they can be recognized if leaked
+	apiTokenPrefix = "og_"
+)
+
+var ApiTokenScopes = []string{ApiTokenScopeRead, ApiTokenScopeWrite}
+
+// ApiToken authenticates the requests made to the API on behalf of a user. Only the hash of its secret is stored, the
+// token itself is shown once to the user when it is created. Its lookup is the public part of the token used to find it.
+type ApiToken struct {
+	ID         uint `gorm:"primaryKey"`
+	UserID     uint `gorm:"index"`
+	Name       string
+	Lookup     string `gorm:"uniqueIndex"`
+	Hash       string // SHA-256 hash of the secret
+	Scopes     string // comma separated
+	CreatedAt  int64
+	LastUsedAt int64
+	Requests   int64 // number of requests made to the API with the token
+
+	User User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
+}
+
+// CreateApiToken creates a token for the user with the scopes, and returns it along with its clear value
+func CreateApiToken(userId uint, name string, scopes []string) (*ApiToken, string, error) {
+	lookup := make([]byte, 8)
+	if _, err := rand.Read(lookup); err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	apiToken := &ApiToken{
+		UserID: userId,
+		Name:   name,
+		Lookup: hex.EncodeToString(lookup),
+		Scopes: strings.Join(scopes, ","),
+	}
+
+	secretHex := hex.EncodeToString(secret)
+	apiToken.Hash = hashApiTokenSecret(secretHex)
+
+	if err := db.Create(&apiToken).Error; err != nil {
+		return nil, "", err
+	}
+	return apiToken, apiTokenPrefix + apiToken.Lookup + "_" + secretHex, nil
+}
+
+// GetApiTokenByValue returns the token with its user matching the clear value. It fails with gorm.ErrRecordNotFound if
+// the value is malformed or does not match any token.
+func GetApiTokenByValue(value string) (*ApiToken, error) {
+	lookup, secret, ok := strings.Cut(strings.TrimPrefix(value, apiTokenPrefix), "_")
+	if !ok || !strings.HasPrefix(value, apiTokenPrefix) {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	apiToken := new(ApiToken)
+	if err := db.Preload("User").Where("lookup = ?", lookup).First(&apiToken).Error; err != nil {
+		return nil, err
+	}
+
+	hash := hashApiTokenSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(apiToken.Hash)) != 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return apiToken, nil
+}
+
+// hashApiTokenSecret returns the hash of the secret of a token to store. The secret being random, a fast hash is
+// enough, unlike a password which needs a slow one.
+func hashApiTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func GetApiTokensOfUser(userId uint) ([]*ApiToken, error) {
+	var apiTokens []*ApiToken
+	err := db.Where("user_id = ?", userId).Order("created_at desc").Find(&apiTokens).Error
+	return apiTokens, err
+}
+
+func DeleteApiTokenOfUser(apiTokenId uint, userId uint) error {
+	return db.Where("id = ? AND user_id = ?", apiTokenId, userId).Delete(&ApiToken{}).Error
+}
+
+func (apiToken *ApiToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(apiToken.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (apiToken *ApiToken) ScopesList() []string {
+	if apiToken.Scopes == "" {
+		return nil
+	}
+	return strings.Split(apiToken.Scopes, ",")
+}
+
+// Touch counts a request made with the token and updates its last use
+func (apiToken *ApiToken) Touch() error {
+	apiToken.LastUsedAt = time.Now().Unix()
+	apiToken.Requests++
+	return db.Model(&ApiToken{}).Where("id = ?", apiToken.ID).UpdateColumns(map[string]interface{}{
+		"last_used_at": apiToken.LastUsedAt,
+		"requests":     gorm.Expr("requests + 1"),
+	}).Error
+}
+
+func IsApiTokenScope(scope string) bool {
+	for _, s := range ApiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
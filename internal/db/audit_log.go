@@ -0,0 +1,113 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// The events recorded in the audit log
+const (
+	AuditLogin                 = "login"
+	AuditLoginFailed           = "login-failed"
+	AuditRegister              = "register"
+	AuditPasswordChange        = "password-change"
+	AuditPasswordReset         = "password-reset"
+	AuditOAuthLink             = "oauth-link"
+	AuditOAuthUnlink           = "oauth-unlink"
+	AuditAccountDelete         = "account-delete"
+	AuditAdminUserDelete       = "admin-user-delete"
+	AuditAdminUserRateLimit    = "admin-user-rate-limit"
+	AuditAdminUserAdmin        = "admin-user-admin"
+	AuditAdminUserDisable      = "admin-user-disable"
+	AuditAdminSignupApprove    = "admin-signup-approve"
+	AuditAdminSignupReject     = "admin-signup-reject"
+	AuditAdminGistDelete       = "admin-gist-delete"
+	AuditAdminGistHide         = "admin-gist-hide"
+	AuditAdminGistTransfer     = "admin-gist-transfer"
+	AuditAdminTemplateShare    = "admin-template-share"
+	AuditAdminSetting          = "admin-setting"
+	AuditAdminInvitationCreate = "admin-invitation-create"
+	AuditAdminInvitationDelete = "admin-invitation-delete"
+	AuditAdminAction           = "admin-action"
+	AuditAdminImpersonate      = "admin-impersonate"
+	AuditAdminImpersonateStop  = "admin-impersonate-stop"
+	AuditImpersonatedAction    = "impersonated-action"
+)
+
+var AuditEvents = []string{
+	AuditLogin, AuditLoginFailed, AuditRegister, AuditPasswordChange, AuditPasswordReset, AuditOAuthLink,
+	AuditOAuthUnlink, AuditAccountDelete, AuditAdminUserDelete, AuditAdminUserRateLimit, AuditAdminUserAdmin,
+	AuditAdminUserDisable, AuditAdminSignupApprove, AuditAdminSignupReject, AuditAdminGistDelete, AuditAdminGistHide,
+	AuditAdminGistTransfer, AuditAdminTemplateShare, AuditAdminSetting, AuditAdminInvitationCreate,
+	AuditAdminInvitationDelete, AuditAdminAction, AuditAdminImpersonate, AuditAdminImpersonateStop,
+	AuditImpersonatedAction,
+}
+
+// AuditLog is an authentication or administration event. The actor is kept by name so that the entries outlive the
+// accounts; its ID is 0 for the failed logins of unknown usernames.
+type AuditLog struct {
+	ID        uint   `gorm:"primaryKey"`
+	ActorID   uint   `gorm:"index"`
+	Actor     string `gorm:"index"`
+	Event     string `gorm:"index"`
+	Target    string
+	IP        string
+	CreatedAt int64 `gorm:"index"`
+}
+
+// AuditLogFilter selects the entries of the audit log, the zero value selects all of them
+type AuditLogFilter struct {
+	Event         string
+	Actor         string
+	IP            string
+	CreatedAfter  int64
+	CreatedBefore int64
+}
+
+func (filter AuditLogFilter) apply(query *gorm.DB) *gorm.DB {
+	if filter.Event != "" {
+		query = query.Where("event = ?", filter.Event)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor like ?", filter.Actor)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.CreatedAfter > 0 {
+		query = query.Where("created_at >= ?", filter.CreatedAfter)
+	}
+	if filter.CreatedBefore > 0 {
+		query = query.Where("created_at < ?", filter.CreatedBefore)
+	}
+	return query
+}
+
+func CreateAuditLog(entry *AuditLog) error {
+	return db.Create(entry).Error
+}
+
+// GetAuditLogs returns a page of the entries matching the filter, the most recent first
+func GetAuditLogs(filter AuditLogFilter, offset int) ([]*AuditLog, error) {
+	var entries []*AuditLog
+	err := filter.apply(db.Model(&AuditLog{})).
+		Limit(31).
+		Offset(offset * 30).
+		Order("id desc").
+		Find(&entries).Error
+
+	return entries, err
+}
+
+// ForEachAuditLog calls fn with all the entries matching the filter, the oldest first, loading them in batches
+func ForEachAuditLog(filter AuditLogFilter, fn func(entry *AuditLog) error) error {
+	var entries []*AuditLog
+	return filter.apply(db.Model(&AuditLog{})).
+		FindInBatches(&entries, 500, func(tx *gorm.DB, batch int) error {
+			for _, entry := range entries {
+				if err := fn(entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
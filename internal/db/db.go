@@ -42,7 +42,7 @@ func Setup(dbPath string, sharedCache bool) error {
 		return err
 	}
 
-	if err = db.AutoMigrate(&User{}, &Gist{}, &SSHKey{}, &AdminSetting{}, &Invitation{}); err != nil {
+	if err = db.AutoMigrate(&User{}, &Gist{}, &SSHKey{}, &AdminSetting{}, &Invitation{}, &UserDevice{}, &GistInitQueue{}, &JobLock{}, &EmailVerification{}, &LoginToken{}, &PasswordResetToken{}, &LoginAttempt{}, &Session{}, &UsernameRedirect{}, &WebAuthnCredential{}, &Tag{}, &ApiToken{}, &AuditLog{}, &Webhook{}, &WebhookDelivery{}, &OrganizationMember{}, &GistCollaborator{}); err != nil {
 		return err
 	}
 
@@ -50,6 +50,10 @@ func Setup(dbPath string, sharedCache bool) error {
 		return err
 	}
 
+	if err = setupUniqueEmails(config.C.UniqueEmails); err != nil {
+		return err
+	}
+
 	// Default admin setting values
 	return initAdminSettings(map[string]string{
 		SettingDisableSignup:          "0",
@@ -57,6 +61,7 @@ func Setup(dbPath string, sharedCache bool) error {
 		SettingAllowGistsWithoutLogin: "0",
 		SettingDisableLoginForm:       "0",
 		SettingDisableGravatar:        "0",
+		SettingReadOnlyMode:           "0",
 	})
 }
 
@@ -82,6 +87,11 @@ func IsUniqueConstraintViolation(err error) bool {
 	return false
 }
 
+// Backup writes a consistent copy of the database to path, which must not exist or be an empty file
+func Backup(path string) error {
+	return db.Exec("VACUUM INTO ?", path).Error
+}
+
 func Ping() error {
 	sql, err := db.DB()
 	if err != nil {
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var ErrEmailAlreadyUsed = errors.New("email already used by another account")
+
+// EmailVerification is an email address a user asked to change to, which is applied to the account only once
+// the link sent to this address is opened
+type EmailVerification struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"index"`
+	Email     string
+	Token     string `gorm:"uniqueIndex"`
+	ExpiresAt int64
+}
+
+func EmailUsedByOtherUser(email string, userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&User{}).
+		Where("email = ? AND id != ?", strings.ToLower(email), userId).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// uniqueEmailIndex makes the database refuse two accounts with the same email when config.C.UniqueEmails is set. The
+// accounts without an email are left out of it.
+const uniqueEmailIndex = "idx_users_unique_email"
+
+// DuplicateEmail is an email address used by several accounts, which must be resolved before the database can enforce
+// config.C.UniqueEmails
+type DuplicateEmail struct {
+	Email string
+	Users []*User
+}
+
+// setupUniqueEmails creates the unique index on the emails of the users if enabled, or drops it otherwise. It is not
+// created while some accounts share an email, those are listed by GetDuplicateEmails.
+func setupUniqueEmails(enabled bool) error {
+	if !enabled {
+		return db.Exec("DROP INDEX IF EXISTS " + uniqueEmailIndex).Error
+	}
+
+	duplicates, err := GetDuplicateEmails()
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		log.Warn().Msgf("%d email addresses are used by several accounts, resolve them from the admin panel so that the database can enforce unique emails", len(duplicates))
+		return nil
+	}
+
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + uniqueEmailIndex + " ON users(email) WHERE email <> ''").Error
+}
+
+// GetDuplicateEmails returns the email addresses used by several accounts, with these accounts
+func GetDuplicateEmails() ([]*DuplicateEmail, error) {
+	var emails []string
+	err := db.Model(&User{}).
+		Where("email <> ''").
+		Group("email").
+		Having("count(*) > 1").
+		Order("email asc").
+		Pluck("email", &emails).Error
+	if err != nil || len(emails) == 0 {
+		return nil, err
+	}
+
+	var users []*User
+	if err = db.Where("email IN ?", emails).Order("id asc").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]*DuplicateEmail, len(emails))
+	for i, email := range emails {
+		duplicates[i] = &DuplicateEmail{Email: email}
+		for _, user := range users {
+			if user.Email == email {
+				duplicates[i].Users = append(duplicates[i].Users, user)
+			}
+		}
+	}
+	return duplicates, nil
+}
+
+// IsEmailConstraintViolation reports whether the error comes from the unique index on the emails of the users
+func IsEmailConstraintViolation(err error) bool {
+	return IsUniqueConstraintViolation(err) && strings.Contains(err.Error(), "users.email")
+}
+
+// CreateEmailVerification replaces the pending email change of the user, if any, by a new one valid for ttl
+func CreateEmailVerification(userId uint, email string, ttl time.Duration) (*EmailVerification, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	verification := &EmailVerification{
+		UserID:    userId,
+		Email:     strings.ToLower(email),
+		Token:     hex.EncodeToString(token),
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&EmailVerification{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&verification).Error
+	})
+
+	return verification, err
+}
+
+// GetPendingEmailVerification returns the email change waiting for a confirmation of the user, or nil if there is none
+func GetPendingEmailVerification(userId uint) (*EmailVerification, error) {
+	var verifications []*EmailVerification
+	err := db.
+		Where("user_id = ? AND expires_at > ?", userId, time.Now().Unix()).
+		Limit(1).
+		Find(&verifications).Error
+	if err != nil || len(verifications) == 0 {
+		return nil, err
+	}
+	return verifications[0], nil
+}
+
+func GetEmailVerificationByToken(token string) (*EmailVerification, error) {
+	verification := new(EmailVerification)
+	err := db.
+		Where("token = ? AND expires_at > ?", token, time.Now().Unix()).
+		First(&verification).Error
+	return verification, err
+}
+
+func DeleteEmailVerifications(userId uint) error {
+	return db.Where("user_id = ?", userId).Delete(&EmailVerification{}).Error
+}
+
+// Confirm sets the verified email on the account and removes the verification. It fails with ErrEmailAlreadyUsed if
+// another account took the address in the meantime.
+func (v *EmailVerification) Confirm() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&User{}).
+			Where("email = ? AND id != ?", v.Email, v.UserID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrEmailAlreadyUsed
+		}
+
+		err = tx.Model(&User{}).
+			Where("id = ?", v.UserID).
+			Updates(map[string]interface{}{
+				"email":          v.Email,
+				"email_verified": true,
+				"md5_hash":       fmt.Sprintf("%x", md5.Sum([]byte(v.Email))),
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", v.UserID).Delete(&EmailVerification{}).Error
+	})
+}
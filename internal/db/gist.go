@@ -1,16 +1,22 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alecthomas/chroma/v2"
 	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/index"
 	"gorm.io/gorm"
@@ -69,16 +75,30 @@ type Gist struct {
 	Preview         string
 	PreviewFilename string
 	Description     string
-	Private         Visibility // 0: public, 1: unlisted, 2: private
-	UserID          uint
+	Private         Visibility `gorm:"index"` // 0: public, 1: unlisted, 2: private
+	UserID          uint       `gorm:"index"`
 	User            User
 	NbFiles         int
 	NbLikes         int
 	NbForks         int
-	CreatedAt       int64
+	Views           int64
+	Clones          int64    // clones and fetches over HTTP and SSH
+	LastViewedAt    int64    // 0: never viewed by someone else than its owner
+	LastClonedAt    int64    // 0: never cloned
+	Size            uint64   // total size of the files at HEAD, in bytes
+	FileOrder       []string `gorm:"serializer:json"` // filenames in the order arranged in the editor
+	CreatedAt       int64    `gorm:"index"`
 	UpdatedAt       int64
+	ExpiresAt       int64          // 0: never expires
+	PinnedAt        int64          // 0: not pinned to the profile of its owner
+	IsTemplate      bool           // new gists can be created from it, by its owner or by everyone if TemplateShared
+	TemplateShared  bool           // shared as a template with the whole instance by an admin
+	PasswordHash    string         // Argon2id hash of the password asked to view the gist, empty if it is not protected
+	SourceID        string         `gorm:"index"` // gist this one was imported from, e.g. "github:<id>"
+	DeletedAt       gorm.DeletedAt `gorm:"index"` // set while the gist is in the trash, see config.C.TrashRetentionDays
 
 	Likes    []User `gorm:"many2many:likes;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Tags     []Tag  `gorm:"many2many:gist_tags;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Forked   *Gist  `gorm:"foreignKey:ForkedID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL"`
 	ForkedID uint
 }
@@ -90,6 +110,11 @@ type Like struct {
 }
 
 func (gist *Gist) BeforeDelete(tx *gorm.DB) error {
+	// the counter was already decremented when the gist was moved to the trash
+	if gist.DeletedAt.Valid {
+		return nil
+	}
+
 	// Decrement fork counter if the gist was forked
 	err := tx.Model(&Gist{}).
 		Omit("updated_at").
@@ -98,9 +123,14 @@ func (gist *Gist) BeforeDelete(tx *gorm.DB) error {
 	return err
 }
 
+// notExpired is a scope leaving out the gists past their expiration date
+func notExpired(tx *gorm.DB) *gorm.DB {
+	return tx.Where("gists.expires_at = 0 or gists.expires_at > ?", time.Now().Unix())
+}
+
 func GetGist(user string, gistUuid string) (*Gist, error) {
 	gist := new(Gist)
-	err := db.Preload("User").Preload("Forked.User").
+	err := db.Preload("User").Preload("Forked.User").Preload("Tags", tagsOrder).
 		Where("(gists.uuid = ? OR gists.url = ?) AND users.username like ?", gistUuid, gistUuid, user).
 		Joins("join users on gists.user_id = users.id").
 		First(&gist).Error
@@ -110,61 +140,228 @@ func GetGist(user string, gistUuid string) (*Gist, error) {
 
 func GetGistByID(gistId string) (*Gist, error) {
 	gist := new(Gist)
-	err := db.Preload("User").Preload("Forked.User").
+	err := db.Preload("User").Preload("Forked.User").Preload("Tags", tagsOrder).
 		Where("gists.id = ?", gistId).
 		First(&gist).Error
 
 	return gist, err
 }
 
-func GetAllGistsForCurrentUser(currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
+// gistsOrder returns the ORDER BY clause of the gist listings, sorted by a counter or by a date like the created one
+func gistsOrder(sort string, order string) string {
+	switch sort {
+	case "views":
+		return "gists.views " + order + ", gists.id " + order
+	case "likes":
+		return "gists.nb_likes " + order + ", gists.id " + order
+	case "clones":
+		return "gists.clones " + order + ", gists.id " + order
+	}
+	return "gists." + sort + "_at " + order
+}
+
+func GetAllGistsForCurrentUser(currentUserId uint, tag string, offset int, sort string, order string) ([]*Gist, error) {
 	var gists []*Gist
 	err := db.Preload("User").Preload("Forked.User").
 		Where("gists.private = 0 or gists.user_id = ?", currentUserId).
+		Scopes(notExpired, withTag(tag)).
 		Limit(11).
 		Offset(offset * 10).
-		Order(sort + "_at " + order).
+		Order(gistsOrder(sort, order)).
 		Find(&gists).Error
 
 	return gists, err
 }
 
-func GetAllGists(offset int) ([]*Gist, error) {
+// AdminGistFilter selects the gists listed in the admin panel, the zero value lists all of them
+type AdminGistFilter struct {
+	Owner         string
+	Visibility    *Visibility
+	Language      string
+	MinSize       uint64
+	CreatedAfter  int64
+	CreatedBefore int64
+	Sort          string // created, updated, likes, forks, size or id
+	Order         string // asc or desc
+}
+
+var adminGistSorts = map[string]string{
+	"id":      "gists.id",
+	"created": "gists.created_at",
+	"updated": "gists.updated_at",
+	"likes":   "gists.nb_likes",
+	"forks":   "gists.nb_forks",
+	"size":    "gists.size",
+}
+
+func GetAllGistsForAdmin(filter AdminGistFilter, offset int) ([]*Gist, error) {
+	query := db.Preload("User")
+
+	if filter.Owner != "" {
+		query = query.Where("gists.user_id IN (?)", db.Model(&User{}).Select("id").Where("username like ?", filter.Owner))
+	}
+	if filter.Visibility != nil {
+		query = query.Where("gists.private = ?", *filter.Visibility)
+	}
+	if filter.Language != "" {
+		patterns := languageFilenamePatterns(filter.Language)
+		if len(patterns) == 0 {
+			return []*Gist{}, nil
+		}
+
+		conditions := make([]string, len(patterns))
+		values := make([]interface{}, len(patterns))
+		for i, pattern := range patterns {
+			conditions[i] = "gists.preview_filename LIKE ?"
+			values[i] = pattern
+		}
+		query = query.Where(strings.Join(conditions, " OR "), values...)
+	}
+	if filter.MinSize > 0 {
+		query = query.Where("gists.size >= ?", filter.MinSize)
+	}
+	if filter.CreatedAfter > 0 {
+		query = query.Where("gists.created_at >= ?", filter.CreatedAfter)
+	}
+	if filter.CreatedBefore > 0 {
+		query = query.Where("gists.created_at < ?", filter.CreatedBefore)
+	}
+
+	sort, ok := adminGistSorts[filter.Sort]
+	if !ok {
+		sort = adminGistSorts["id"]
+	}
+	order := "asc"
+	if filter.Order == "desc" {
+		order = "desc"
+	}
+
 	var gists []*Gist
-	err := db.Preload("User").
+	err := query.
 		Limit(11).
 		Offset(offset * 10).
-		Order("id asc").
+		Order(sort + " " + order).
+		Order("gists.id " + order).
 		Find(&gists).Error
 
 	return gists, err
 }
 
+// languageFilenamePatterns returns the LIKE patterns matching the names of the files of a language, as the language
+// of a gist is the one of its preview file
+func languageFilenamePatterns(language string) []string {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		return nil
+	}
+
+	var patterns []string
+	for _, glob := range lexer.Config().Filenames {
+		// patterns with character classes cannot be expressed with LIKE
+		if strings.ContainsAny(glob, "[]?%_") {
+			continue
+		}
+		patterns = append(patterns, strings.ReplaceAll(glob, "*", "%"))
+	}
+	return patterns
+}
+
+// TransferTo gives the gist to another user, its repository must be moved to the directory of the new owner
+func (gist *Gist) TransferTo(user *User) error {
+	moved := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// the new owner chooses the gists pinned to their profile
+		err := tx.Model(&Gist{}).
+			Where("id = ?", gist.ID).
+			UpdateColumns(map[string]interface{}{
+				"user_id":   user.ID,
+				"pinned_at": 0,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		// moved last, the transaction is rolled back if it fails
+		if err = git.MoveRepository(gist.User.Username, user.Username, gist.Uuid); err != nil {
+			return err
+		}
+		moved = true
+		return nil
+	})
+	if err != nil {
+		if moved {
+			// the commit failed
+			_ = git.MoveRepository(user.Username, gist.User.Username, gist.Uuid)
+		}
+		return err
+	}
+
+	gist.UserID = user.ID
+	gist.User = *user
+	gist.PinnedAt = 0
+	return nil
+}
+
+// GistURLExistsForUser reports whether one of the gists of the user already uses the custom URL
+func GistURLExistsForUser(url string, userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&Gist{}).Where("url = ? AND user_id = ?", url, userId).Count(&count).Error
+	return count > 0, err
+}
+
+// GistSourceExistsForUser reports whether the user already imported the gist identified by sourceId
+func GistSourceExistsForUser(sourceId string, userId uint) (bool, error) {
+	var count int64
+	err := db.Model(&Gist{}).Where("source_id = ? AND user_id = ?", sourceId, userId).Count(&count).Error
+	return count > 0, err
+}
+
 func GetAllGistsFromSearch(currentUserId uint, query string, offset int, sort string, order string) ([]*Gist, error) {
 	var gists []*Gist
 	err := db.Preload("User").Preload("Forked.User").
-		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
+		Where("((gists.private = 0) or (gists.private > 0 and (gists.user_id = ? or gists.user_id in (?))))", currentUserId,
+			organizationIdsOfUser(currentUserId)).
+		Scopes(notExpired).
 		Where("gists.title like ? or gists.description like ?", "%"+query+"%", "%"+query+"%").
 		Limit(11).
 		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
+		Order(gistsOrder(sort, order)).
 		Find(&gists).Error
 
 	return gists, err
 }
 
+// gistsFromUserStatement selects the gists of a user. The ones of an organization which are not public are listed to
+// its members.
 func gistsFromUserStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 	return db.Preload("User").Preload("Forked.User").
-		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
+		Where("((gists.private = 0) or (gists.private > 0 and (gists.user_id = ? or gists.user_id in (?))))", currentUserId,
+			organizationIdsOfUser(currentUserId)).
+		Scopes(notExpired).
 		Where("users.id = ?", fromUserId).
 		Joins("join users on gists.user_id = users.id")
 }
 
-func GetAllGistsFromUser(fromUserId uint, currentUserId uint, offset int, sort string, order string) ([]*Gist, error) {
+func GetAllGistsFromUser(fromUserId uint, currentUserId uint, tag string, offset int, sort string, order string) ([]*Gist, error) {
 	var gists []*Gist
-	err := gistsFromUserStatement(fromUserId, currentUserId).Limit(11).
+	err := gistsFromUserStatement(fromUserId, currentUserId).Preload("Tags", tagsOrder).Scopes(withTag(tag)).Limit(11).
 		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
+		// the pinned gists come first, in the order they were pinned
+		Order("gists.pinned_at = 0, gists.pinned_at").
+		Order(gistsOrder(sort, order)).
+		Find(&gists).Error
+
+	return gists, err
+}
+
+// GetRecentPublicGistsFromUser returns the last public gists created by a user, for their feeds
+func GetRecentPublicGistsFromUser(fromUserId uint, limit int) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Preload("User").Preload("Tags", tagsOrder).
+		Where("gists.user_id = ? and gists.private = ?", fromUserId, PublicVisibility).
+		Scopes(notExpired).
+		Order("gists.created_at desc, gists.id desc").
+		Limit(limit).
 		Find(&gists).Error
 
 	return gists, err
@@ -176,9 +373,13 @@ func CountAllGistsFromUser(fromUserId uint, currentUserId uint) (int64, error) {
 	return count, err
 }
 
+// likedStatement selects the gists liked by a user. The unlisted gists they liked are only listed to themselves, the
+// others not knowing their URL.
 func likedStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 	return db.Preload("User").Preload("Forked.User").
-		Where("((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
+		Where("(gists.private = 0 or gists.user_id = ? or (gists.private = ? and likes.user_id = ?))",
+			currentUserId, UnlistedVisibility, currentUserId).
+		Scopes(notExpired).
 		Where("likes.user_id = ?", fromUserId).
 		Joins("join likes on gists.id = likes.gist_id").
 		Joins("join users on likes.user_id = users.id")
@@ -188,7 +389,7 @@ func GetAllGistsLikedByUser(fromUserId uint, currentUserId uint, offset int, sor
 	var gists []*Gist
 	err := likedStatement(fromUserId, currentUserId).Limit(11).
 		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
+		Order(gistsOrder(sort, order)).
 		Find(&gists).Error
 	return gists, err
 }
@@ -203,6 +404,7 @@ func forkedStatement(fromUserId uint, currentUserId uint) *gorm.DB {
 	return db.Preload("User").Preload("Forked.User").
 		Where("gists.forked_id is not null and ((gists.private = 0) or (gists.private > 0 and gists.user_id = ?))", currentUserId).
 		Where("gists.user_id = ?", fromUserId).
+		Scopes(notExpired).
 		Joins("join users on gists.user_id = users.id")
 }
 
@@ -210,7 +412,7 @@ func GetAllGistsForkedByUser(fromUserId uint, currentUserId uint, offset int, so
 	var gists []*Gist
 	err := forkedStatement(fromUserId, currentUserId).Limit(11).
 		Offset(offset * 10).
-		Order("gists." + sort + "_at " + order).
+		Order(gistsOrder(sort, order)).
 		Find(&gists).Error
 	return gists, err
 }
@@ -221,6 +423,15 @@ func CountAllGistsForkedByUser(fromUserId uint, currentUserId uint) (int64, erro
 	return count, err
 }
 
+func GetAllGistsOfUser(userId uint) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Preload("User").
+		Where("user_id = ?", userId).
+		Find(&gists).Error
+
+	return gists, err
+}
+
 func GetAllGistsRows() ([]*Gist, error) {
 	var gists []*Gist
 	err := db.Table("gists").
@@ -230,12 +441,28 @@ func GetAllGistsRows() ([]*Gist, error) {
 	return gists, err
 }
 
-func GetAllGistsVisibleByUser(userId uint) ([]uint, error) {
+func GetAllExpiredGists() ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Preload("User").
+		Where("gists.expires_at <> 0 and gists.expires_at <= ?", time.Now().Unix()).
+		Find(&gists).Error
+
+	return gists, err
+}
+
+// GetAllGistsVisibleByUser returns the ids of the gists the user can search: their own ones and the public gists of
+// others, unless they are protected by a password. If visibility is not nil, only the gists having it are returned.
+func GetAllGistsVisibleByUser(userId uint, visibility *Visibility) ([]uint, error) {
 	var gists []uint
 
-	err := db.Table("gists").
-		Where("gists.private = 0 or gists.user_id = ?", userId).
-		Pluck("gists.id", &gists).Error
+	tx := db.Table("gists").
+		Where("gists.deleted_at is null").
+		Where("gists.user_id = ? or (gists.private = 0 and gists.password_hash = '')", userId).
+		Scopes(notExpired)
+	if visibility != nil {
+		tx = tx.Where("gists.private = ?", *visibility)
+	}
+	err := tx.Pluck("gists.id", &gists).Error
 
 	return gists, err
 }
@@ -254,6 +481,185 @@ func (gist *Gist) Create() error {
 	return db.Omit("forked_id").Create(&gist).Error
 }
 
+// MaxPinnedGists is the number of gists a user can pin to their profile
+const MaxPinnedGists = 6
+
+func CountPinnedGistsOfUser(userId uint) (int64, error) {
+	var count int64
+	err := db.Model(&Gist{}).Where("user_id = ? AND pinned_at > 0", userId).Count(&count).Error
+	return count, err
+}
+
+// SetPinned pins the gist to the profile of its owner or unpins it, without changing its update date
+func (gist *Gist) SetPinned(pinned bool) error {
+	gist.PinnedAt = 0
+	if pinned {
+		gist.PinnedAt = time.Now().Unix()
+	}
+	return db.Model(gist).UpdateColumn("pinned_at", gist.PinnedAt).Error
+}
+
+// SetTemplate marks the gist as a template or not, without changing its update date
+func (gist *Gist) SetTemplate(isTemplate bool) error {
+	gist.IsTemplate = isTemplate
+	return db.Model(gist).UpdateColumn("is_template", gist.IsTemplate).Error
+}
+
+// SetTemplateShared shares the template with the whole instance or keeps it to its owner, without changing its update
+// date
+func (gist *Gist) SetTemplateShared(shared bool) error {
+	gist.TemplateShared = shared
+	return db.Model(gist).UpdateColumn("template_shared", gist.TemplateShared).Error
+}
+
+// CanUseAsTemplate returns whether the user can create a gist from this one
+func (gist *Gist) CanUseAsTemplate(user *User) bool {
+	if !gist.IsTemplate || gist.IsExpired() {
+		return false
+	}
+	return gist.TemplateShared || (user != nil && gist.UserID == user.ID)
+}
+
+// GetTemplatesForUser returns the templates of the user and the ones shared with the whole instance
+func GetTemplatesForUser(userId uint) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Preload("User").
+		Scopes(notExpired).
+		Where("gists.is_template = ? and (gists.user_id = ? or gists.template_shared = ?)", true, userId, true).
+		Order("gists.title, gists.id").
+		Find(&gists).Error
+	return gists, err
+}
+
+// GetGistsAccessibleByUser returns the gists of the user, the ones of their organizations and the ones they
+// collaborate on, the last updated first
+func GetGistsAccessibleByUser(userId uint, offset int, limit int) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Preload("User").
+		Scopes(notExpired).
+		Where("gists.user_id = ? or gists.user_id in (?) or gists.id in (?)", userId, organizationIdsOfUser(userId),
+			db.Model(&GistCollaborator{}).Select("gist_id").Where("user_id = ?", userId)).
+		Order("gists.updated_at desc, gists.id desc").
+		Limit(limit).
+		Offset(offset).
+		Find(&gists).Error
+	return gists, err
+}
+
+// GistSearchResult is a gist matching a search, with the first line of its files containing the query if there is one
+type GistSearchResult struct {
+	Gist     *Gist
+	Filename string
+	Line     int
+	Snippet  string
+}
+
+// SearchGistsOfUser searches the title, the description and the files of the gists owned by the user, whatever their
+// visibility, the last updated first. The files are not stored in the database, so they are searched in the repositories
+// of the gists.
+func SearchGistsOfUser(userId uint, query string, offset int, limit int) ([]*GistSearchResult, error) {
+	const batchSize = 50
+
+	var results []*GistSearchResult
+	skipped := 0
+	for batchOffset := 0; ; batchOffset += batchSize {
+		var gists []*Gist
+		err := db.Preload("User").
+			Scopes(notExpired).
+			Where("gists.user_id = ?", userId).
+			Order("gists.updated_at desc, gists.id desc").
+			Limit(batchSize).
+			Offset(batchOffset).
+			Find(&gists).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, gist := range gists {
+			result, err := gist.search(query)
+			if err != nil {
+				return nil, err
+			}
+			if result == nil {
+				continue
+			}
+
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			results = append(results, result)
+			if len(results) == limit {
+				return results, nil
+			}
+		}
+
+		if len(gists) < batchSize {
+			return results, nil
+		}
+	}
+}
+
+// search returns the gist as a search result if its title, its description or one of its files contains the query
+func (gist *Gist) search(query string) (*GistSearchResult, error) {
+	matches, err := git.Grep(gist.User.Username, gist.Uuid, "HEAD", query, 1)
+	if err != nil {
+		// gists without commits have no files
+		var revErr *git.RevisionNotFoundError
+		if !errors.As(err, &revErr) {
+			return nil, err
+		}
+	}
+
+	if len(matches) > 0 {
+		return &GistSearchResult{
+			Gist:     gist,
+			Filename: matches[0].Filename,
+			Line:     matches[0].Line,
+			Snippet:  searchSnippet(matches[0].Content, query),
+		}, nil
+	}
+
+	lowerQuery := strings.ToLower(query)
+	if strings.Contains(strings.ToLower(gist.Title), lowerQuery) ||
+		strings.Contains(strings.ToLower(gist.Description), lowerQuery) {
+		return &GistSearchResult{Gist: gist}, nil
+	}
+	return nil, nil
+}
+
+// searchSnippet shortens a long line to the part around the query
+func searchSnippet(line string, query string) string {
+	const before, after = 60, 140
+
+	line = strings.TrimSpace(line)
+	if len(line) <= before+after {
+		return line
+	}
+
+	start := 0
+	// the case folding may change the length of the line, the snippet then starts with it
+	if lower := strings.ToLower(line); len(lower) == len(line) {
+		start = max(strings.Index(lower, strings.ToLower(query))-before, 0)
+	}
+	end := min(start+before+after, len(line))
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end--
+	}
+
+	snippet := line[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(line) {
+		snippet += "…"
+	}
+	return snippet
+}
+
 func (gist *Gist) CreateForked() error {
 	return db.Create(&gist).Error
 }
@@ -266,15 +672,104 @@ func (gist *Gist) UpdateNoTimestamps() error {
 	return db.Omit("forked_id", "updated_at").Save(&gist).Error
 }
 
+// SetGistsVisibility changes the visibility of several gists of a user at once, and returns the number of
+// gists whose visibility changed. Nothing is changed if one of the gists does not belong to the user.
+func SetGistsVisibility(userId uint, gistIds []uint, visibility Visibility) (int64, error) {
+	var changed int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var owned int64
+		if err := tx.Model(&Gist{}).
+			Where("id IN ?", gistIds).
+			Where("user_id = ?", userId).
+			Count(&owned).Error; err != nil {
+			return err
+		}
+
+		if owned != int64(len(gistIds)) {
+			return gorm.ErrRecordNotFound
+		}
+
+		res := tx.Model(&Gist{}).
+			Where("id IN ?", gistIds).
+			Where("private <> ?", visibility).
+			UpdateColumn("private", visibility)
+		changed = res.RowsAffected
+		return res.Error
+	})
+
+	return changed, err
+}
+
 func (gist *Gist) Delete() error {
 	err := gist.DeleteRepository()
 	if err != nil {
 		return err
 	}
 
+	return db.Unscoped().Delete(&gist).Error
+}
+
+// Trash moves the gist to the trash, its repository is kept until it is purged or the gist is restored
+func (gist *Gist) Trash() error {
 	return db.Delete(&gist).Error
 }
 
+// Restore takes the gist out of the trash
+func (gist *Gist) Restore() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&gist).Omit("updated_at").Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		gist.DeletedAt = gorm.DeletedAt{}
+
+		return tx.Model(&Gist{}).
+			Omit("updated_at").
+			Where("id = ?", gist.ForkedID).
+			UpdateColumn("nb_forks", gorm.Expr("nb_forks + 1")).Error
+	})
+}
+
+// GetTrashedGistsOfUser returns the gists of the user in the trash, the last deleted first
+func GetTrashedGistsOfUser(userId uint) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Unscoped().Preload("User").
+		Where("user_id = ? AND deleted_at is not null", userId).
+		Order("deleted_at desc").
+		Find(&gists).Error
+
+	return gists, err
+}
+
+func GetTrashedGistOfUser(userId uint, gistId uint) (*Gist, error) {
+	gist := new(Gist)
+	err := db.Unscoped().Preload("User").
+		Where("id = ? AND user_id = ? AND deleted_at is not null", gistId, userId).
+		First(&gist).Error
+
+	return gist, err
+}
+
+// GetGistsTrashedBefore returns the gists moved to the trash before the date, to be purged
+func GetGistsTrashedBefore(date time.Time) ([]*Gist, error) {
+	var gists []*Gist
+	err := db.Unscoped().Preload("User").
+		Where("deleted_at is not null AND deleted_at < ?", date).
+		Find(&gists).Error
+
+	return gists, err
+}
+
+// GistExists reports whether the gist is in the database, in the trash or not
+func GistExists(user string, gistUuid string) (bool, error) {
+	var count int64
+	err := db.Unscoped().Model(&Gist{}).
+		Joins("join users on gists.user_id = users.id").
+		Where("gists.uuid = ? AND users.username like ?", gistUuid, user).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
 func (gist *Gist) SetLastActiveNow() error {
 	return db.Model(&Gist{}).
 		Where("id = ?", gist.ID).
@@ -299,6 +794,22 @@ func (gist *Gist) RemoveUserLike(user *User) error {
 	return db.Model(&gist).Omit("updated_at").Association("Likes").Delete(user)
 }
 
+// IncrementGistViews adds a view to the gist and sets when it was last viewed, without changing its update date
+func IncrementGistViews(gistId uint) error {
+	return db.Model(&Gist{}).Where("id = ?", gistId).UpdateColumns(map[string]interface{}{
+		"views":          gorm.Expr("views + 1"),
+		"last_viewed_at": time.Now().Unix(),
+	}).Error
+}
+
+// IncrementGistClones adds a clone to the gist and sets when it was last cloned, without changing its update date
+func IncrementGistClones(gistId uint) error {
+	return db.Model(&Gist{}).Where("id = ?", gistId).UpdateColumns(map[string]interface{}{
+		"clones":         gorm.Expr("clones + 1"),
+		"last_cloned_at": time.Now().Unix(),
+	}).Error
+}
+
 func (gist *Gist) IncrementForkCount() error {
 	return db.Model(&gist).Omit("updated_at").Update("nb_forks", gist.NbForks+1).Error
 }
@@ -326,6 +837,7 @@ func (gist *Gist) GetForks(currentUserId uint, offset int) ([]*Gist, error) {
 	err := db.Model(&gist).Preload("User").
 		Where("forked_id = ?", gist.ID).
 		Where("(gists.private = 0) or (gists.private > 0 and gists.user_id = ?)", currentUserId).
+		Scopes(notExpired).
 		Limit(11).
 		Offset(offset * 10).
 		Order("updated_at desc").
@@ -334,8 +846,38 @@ func (gist *Gist) GetForks(currentUserId uint, offset int) ([]*Gist, error) {
 	return gists, err
 }
 
+// IsExpired reports whether the gist is past its expiration date, it is then handled as if it did not exist
+func (gist *Gist) IsExpired() bool {
+	return gist.ExpiresAt != 0 && gist.ExpiresAt <= time.Now().Unix()
+}
+
+func (gist *Gist) IsProtected() bool {
+	return gist.PasswordHash != ""
+}
+
+// IsEmbeddable reports whether the gist can be embedded in other websites, which is the case of public gists only
+func (gist *Gist) IsEmbeddable() bool {
+	return gist.Private == PublicVisibility && !gist.IsProtected()
+}
+
+// CanWrite reports whether the user edits the files of the gist, as one of the users managing it or as a collaborator
 func (gist *Gist) CanWrite(user *User) bool {
-	return !(user == nil) && (gist.UserID == user.ID)
+	if user == nil {
+		return false
+	}
+	return gist.CanManage(user) || IsGistCollaborator(gist.ID, user.ID)
+}
+
+// CanManage reports whether the user changes the settings of the gist and deletes it, as its owner
+func (gist *Gist) CanManage(user *User) bool {
+	if user == nil {
+		return false
+	}
+	if gist.UserID == user.ID {
+		return true
+	}
+	// the gists of an organization are managed by all its members
+	return gist.User.IsOrganization && IsOrganizationMember(gist.UserID, user.ID)
 }
 
 func (gist *Gist) InitRepository() error {
@@ -343,7 +885,10 @@ func (gist *Gist) InitRepository() error {
 }
 
 func (gist *Gist) DeleteRepository() error {
-	return git.DeleteRepository(gist.User.Username, gist.Uuid)
+	if err := git.DeleteRepository(gist.User.Username, gist.Uuid); err != nil {
+		return err
+	}
+	return git.DeleteLfsObjects(gist.Uuid)
 }
 
 func (gist *Gist) Files(revision string, truncate bool) ([]*git.File, error) {
@@ -358,17 +903,42 @@ func (gist *Gist) Files(revision string, truncate bool) ([]*git.File, error) {
 
 	var files []*git.File
 	for _, fileCat := range filesCat {
-		files = append(files, &git.File{
+		file := &git.File{
 			Filename:  fileCat.Name,
 			Size:      fileCat.Size,
 			HumanSize: humanize.IBytes(fileCat.Size),
 			Content:   fileCat.Content,
 			Truncated: fileCat.Truncated,
-		})
+		}
+		if err = gist.resolveLfsFile(file, truncate); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
 	}
+
+	position := gist.filePositions()
+	sort.SliceStable(files, func(i, j int) bool {
+		return position(files[i].Filename) < position(files[j].Filename)
+	})
 	return files, err
 }
 
+// filePositions returns a function giving the position of a file in the gist. Files missing from the saved
+// order, like the ones pushed with Git, come last and keep their order from the repository.
+func (gist *Gist) filePositions() func(filename string) int {
+	positions := make(map[string]int, len(gist.FileOrder))
+	for i, filename := range gist.FileOrder {
+		positions[filename] = i
+	}
+
+	return func(filename string) int {
+		if i, ok := positions[filename]; ok {
+			return i
+		}
+		return len(positions)
+	}
+}
+
 func (gist *Gist) File(revision string, filename string, truncate bool) (*git.File, error) {
 	content, truncated, err := git.GetFileContent(gist.User.Username, gist.Uuid, revision, filename, truncate)
 
@@ -384,13 +954,41 @@ func (gist *Gist) File(revision string, filename string, truncate bool) (*git.Fi
 		return nil, err
 	}
 
-	return &git.File{
+	file := &git.File{
 		Filename:  filename,
 		Size:      size,
 		HumanSize: humanize.IBytes(size),
 		Content:   content,
 		Truncated: truncated,
-	}, err
+	}
+	return file, gist.resolveLfsFile(file, truncate)
+}
+
+// FileReader returns a reader of the content of a file at a revision along with its size, or a nil reader if the
+// revision or the file do not exist
+func (gist *Gist) FileReader(revision string, filename string) (io.ReadCloser, uint64, error) {
+	size, err := git.GetFileSize(gist.User.Username, gist.Uuid, revision, filename)
+	if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 128 {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if size <= git.LfsPointerMaxSize {
+		// the file may be the pointer to a Git LFS object, whose content is sent instead
+		content, _, err := git.GetFileContent(gist.User.Username, gist.Uuid, revision, filename, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pointer, ok := git.ParseLfsPointer(content); ok && git.LfsObjectExists(gist.Uuid, pointer.Oid) {
+			object, err := git.OpenLfsObject(gist.Uuid, pointer.Oid)
+			return object, uint64(pointer.Size), err
+		}
+		return io.NopCloser(strings.NewReader(content)), size, nil
+	}
+
+	reader, err := git.OpenFileContent(gist.User.Username, gist.Uuid, revision, filename)
+	return reader, size, err
 }
 
 func (gist *Gist) FileNames(revision string) ([]string, error) {
@@ -401,17 +999,62 @@ func (gist *Gist) Log(skip int) ([]*git.Commit, error) {
 	return git.GetLog(gist.User.Username, gist.Uuid, skip)
 }
 
+func (gist *Gist) Commits(max int) ([]*git.Commit, error) {
+	return git.GetCommits(gist.User.Username, gist.Uuid, max)
+}
+
+func (gist *Gist) Diff(from string, to string) ([]git.File, error) {
+	return git.GetDiff(gist.User.Username, gist.Uuid, from, to)
+}
+
+func (gist *Gist) Commit(revision string) (string, time.Time, error) {
+	return git.GetCommit(gist.User.Username, gist.Uuid, revision)
+}
+
 func (gist *Gist) NbCommits() (string, error) {
 	return git.CountCommits(gist.User.Username, gist.Uuid)
 }
 
 func (gist *Gist) AddAndCommitFiles(files *[]FileDTO) error {
-	if err := git.CloneTmp(gist.User.Username, gist.Uuid, gist.Uuid, gist.User.Email, true); err != nil {
+	renames := fileRenames(*files)
+	if err := git.CloneTmp(gist.User.Username, gist.Uuid, gist.Uuid, gist.User.Email, len(renames) == 0); err != nil {
 		return err
 	}
 
+	renamed := false
+	if len(renames) > 0 {
+		// the files are renamed in a commit of their own, so that git follows them whatever the changes made to their
+		// content
+		var err error
+		if renamed, err = gist.commitRenames(renames); err != nil {
+			return err
+		}
+		if err = git.RemoveFiles(gist.Uuid); err != nil {
+			return err
+		}
+	}
+
+	var filenames, lfsFilenames []string
 	for _, file := range *files {
-		if err := git.SetFileContent(gist.Uuid, file.Filename, file.Content); err != nil {
+		content, lfs, err := gist.commitContent(file.Filename, file.Content)
+		if err != nil {
+			return err
+		}
+		if err = git.SetFileContent(gist.Uuid, file.Filename, content); err != nil {
+			return err
+		}
+
+		filenames = append(filenames, file.Filename)
+		if file.OriginalFilename != "" {
+			filenames = append(filenames, file.OriginalFilename)
+		}
+		if lfs {
+			lfsFilenames = append(lfsFilenames, file.Filename)
+		}
+	}
+
+	if config.C.LfsEnabled {
+		if err := git.SetLfsAttributes(gist.Uuid, filenames, lfsFilenames); err != nil {
 			return err
 		}
 	}
@@ -420,6 +1063,17 @@ func (gist *Gist) AddAndCommitFiles(files *[]FileDTO) error {
 		return err
 	}
 
+	if renamed {
+		// the names of the files may be the only change
+		changed, err := git.HasChanges(gist.Uuid)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return git.Push(gist.Uuid)
+		}
+	}
+
 	if err := git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email); err != nil {
 		return err
 	}
@@ -427,28 +1081,116 @@ func (gist *Gist) AddAndCommitFiles(files *[]FileDTO) error {
 	return git.Push(gist.Uuid)
 }
 
+// fileRenames returns the new names of the files renamed by an edit, by their former names
+func fileRenames(files []FileDTO) map[string]string {
+	renames := make(map[string]string)
+	for _, file := range files {
+		if file.OriginalFilename != "" && file.OriginalFilename != file.Filename {
+			renames[file.OriginalFilename] = file.Filename
+		}
+	}
+	return renames
+}
+
+// commitRenames commits the renaming of the files of the gist which are still in it, and reports whether there was any
+func (gist *Gist) commitRenames(renames map[string]string) (bool, error) {
+	existing, err := git.GetFilesOfRepository(gist.User.Username, gist.Uuid, "HEAD")
+	if err != nil {
+		return false, err
+	}
+	for src := range renames {
+		if !slices.Contains(existing, src) {
+			delete(renames, src)
+		}
+	}
+	if len(renames) == 0 {
+		return false, nil
+	}
+
+	if err = git.RenameFiles(gist.Uuid, renames); err != nil {
+		return false, err
+	}
+	if err = git.AddAll(gist.Uuid); err != nil {
+		return false, err
+	}
+	return true, git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email)
+}
+
 func (gist *Gist) AddAndCommitFile(file *FileDTO) error {
 	if err := git.CloneTmp(gist.User.Username, gist.Uuid, gist.Uuid, gist.User.Email, false); err != nil {
 		return err
 	}
 
-	if err := git.SetFileContent(gist.Uuid, file.Filename, file.Content); err != nil {
+	content, lfs, err := gist.commitContent(file.Filename, file.Content)
+	if err != nil {
+		return err
+	}
+	if err = git.SetFileContent(gist.Uuid, file.Filename, content); err != nil {
 		return err
 	}
 
-	if err := git.AddAll(gist.Uuid); err != nil {
+	if config.C.LfsEnabled {
+		var lfsFilenames []string
+		if lfs {
+			lfsFilenames = []string{file.Filename}
+		}
+		if err = git.SetLfsAttributes(gist.Uuid, []string{file.Filename}, lfsFilenames); err != nil {
+			return err
+		}
+	}
+
+	if err = git.AddAll(gist.Uuid); err != nil {
 		return err
 	}
 
-	if err := git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email); err != nil {
+	if err = git.CommitRepository(gist.Uuid, gist.User.Username, gist.User.Email); err != nil {
 		return err
 	}
 
 	return git.Push(gist.Uuid)
 }
 
+// commitContent returns the content to commit for a file, which is the pointer to a Git LFS object for the files
+// above lfs.threshold when Git LFS is enabled, and reports whether it is one
+func (gist *Gist) commitContent(filename string, content string) (string, bool, error) {
+	if !config.C.LfsEnabled || len(content) < config.C.LfsThreshold || filename == ".gitattributes" {
+		return content, false, nil
+	}
+
+	pointer, err := git.StoreLfsObject(gist.Uuid, content)
+	if err != nil {
+		return "", false, err
+	}
+	return pointer.String(), true, nil
+}
+
+// resolveLfsFile replaces the content of a file committed as a Git LFS pointer by the content of its object, if the
+// object is stored
+func (gist *Gist) resolveLfsFile(file *git.File, truncate bool) error {
+	if file.Size > git.LfsPointerMaxSize || file.Truncated {
+		return nil
+	}
+	pointer, ok := git.ParseLfsPointer(file.Content)
+	if !ok || !git.LfsObjectExists(gist.Uuid, pointer.Oid) {
+		return nil
+	}
+
+	content, truncated, err := git.ReadLfsObject(gist.Uuid, pointer, truncate)
+	if err != nil {
+		return err
+	}
+	file.Content = content
+	file.Truncated = truncated
+	file.Size = uint64(pointer.Size)
+	file.HumanSize = humanize.IBytes(file.Size)
+	return nil
+}
+
 func (gist *Gist) ForkClone(username string, uuid string) error {
-	return git.ForkClone(gist.User.Username, gist.Uuid, username, uuid)
+	if err := git.ForkClone(gist.User.Username, gist.Uuid, username, uuid); err != nil {
+		return err
+	}
+	return git.CopyLfsObjects(gist.Uuid, uuid)
 }
 
 func (gist *Gist) UpdateServerInfo() error {
@@ -466,6 +1208,15 @@ func (gist *Gist) UpdatePreviewAndCount(withTimestampUpdate bool) error {
 	}
 	gist.NbFiles = len(filesStr)
 
+	if gist.Size, err = git.GetFilesSize(gist.User.Username, gist.Uuid, "HEAD"); err != nil {
+		return err
+	}
+
+	position := gist.filePositions()
+	sort.SliceStable(filesStr, func(i, j int) bool {
+		return position(filesStr[i]) < position(filesStr[j])
+	})
+
 	if len(filesStr) == 0 {
 		gist.Preview = ""
 		gist.PreviewFilename = ""
@@ -511,6 +1262,19 @@ func (gist *Gist) Identifier() string {
 	return gist.Uuid
 }
 
+// PreviewLanguage returns the language of the file shown in the preview of the gist
+func (gist *Gist) PreviewLanguage() string {
+	var lexer chroma.Lexer
+	if lexer = lexers.Get(gist.PreviewFilename); lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	if lexer.Config().Name == "fallback" || lexer.Config().Name == "plaintext" {
+		return "Text"
+	}
+	return lexer.Config().Name
+}
+
 func (gist *Gist) GetLanguagesFromFiles() ([]string, error) {
 	files, err := gist.Files("HEAD", true)
 	if err != nil {
@@ -519,20 +1283,23 @@ func (gist *Gist) GetLanguagesFromFiles() ([]string, error) {
 
 	languages := make([]string, 0, len(files))
 	for _, file := range files {
-		var lexer chroma.Lexer
-		if lexer = lexers.Get(file.Filename); lexer == nil {
-			lexer = lexers.Fallback
-		}
+		languages = append(languages, fileLanguage(file.Filename))
+	}
 
-		fileType := lexer.Config().Name
-		if lexer.Config().Name == "fallback" || lexer.Config().Name == "plaintext" {
-			fileType = "Text"
-		}
+	return languages, nil
+}
 
-		languages = append(languages, fileType)
+// fileLanguage returns the language of a file detected from its name, "Text" if there is none
+func fileLanguage(filename string) string {
+	var lexer chroma.Lexer
+	if lexer = lexers.Get(filename); lexer == nil {
+		lexer = lexers.Fallback
 	}
 
-	return languages, nil
+	if lexer.Config().Name == "fallback" || lexer.Config().Name == "plaintext" {
+		return "Text"
+	}
+	return lexer.Config().Name
 }
 
 // -- DTO -- //
@@ -544,6 +1311,9 @@ type GistDTO struct {
 	Files       []FileDTO `validate:"min=1,dive"`
 	Name        []string  `form:"name"`
 	Content     []string  `form:"content"`
+	Protected   bool      `form:"protected"`
+	Password    string    `validate:"max=128" form:"password"`
+	Tags        string    `validate:"max=500" form:"tags"`
 	VisibilityDTO
 }
 
@@ -554,6 +1324,8 @@ type VisibilityDTO struct {
 type FileDTO struct {
 	Filename string `validate:"excludes=\x2f,excludes=\x5c,max=255"`
 	Content  string `validate:"required"`
+
+	OriginalFilename string // name of the file before the gist is edited, empty for a new file
 }
 
 func (dto *GistDTO) ToGist() *Gist {
@@ -598,15 +1370,16 @@ func (gist *Gist) ToIndexedGist() (*index.Gist, error) {
 	}
 
 	indexedGist := &index.Gist{
-		GistID:     gist.ID,
-		Username:   gist.User.Username,
-		Title:      gist.Title,
-		Content:    wholeContent,
-		Filenames:  fileNames,
-		Extensions: exts,
-		Languages:  langs,
-		CreatedAt:  gist.CreatedAt,
-		UpdatedAt:  gist.UpdatedAt,
+		GistID:      gist.ID,
+		Username:    gist.User.Username,
+		Title:       gist.Title,
+		Description: gist.Description,
+		Content:     wholeContent,
+		Filenames:   fileNames,
+		Extensions:  exts,
+		Languages:   langs,
+		CreatedAt:   gist.CreatedAt,
+		UpdatedAt:   gist.UpdatedAt,
 	}
 
 	return indexedGist, nil
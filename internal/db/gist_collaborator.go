@@ -0,0 +1,37 @@
+package db
+
+// GistCollaborator allows a user to edit a gist they do not own, on the web and by pushing to its repository. Only the
+// owner manages the gist itself: its visibility, its password, its collaborators and its deletion.
+type GistCollaborator struct {
+	GistID    uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"primaryKey;index"`
+	CreatedAt int64
+
+	Gist Gist `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:GistID"`
+	User User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
+}
+
+func AddGistCollaborator(gistId uint, userId uint) error {
+	return db.Save(&GistCollaborator{GistID: gistId, UserID: userId}).Error
+}
+
+func RemoveGistCollaborator(gistId uint, userId uint) error {
+	return db.Where("gist_id = ? AND user_id = ?", gistId, userId).Delete(&GistCollaborator{}).Error
+}
+
+// GetGistCollaborators returns the collaborators of the gist, with their user
+func GetGistCollaborators(gistId uint) ([]*GistCollaborator, error) {
+	var collaborators []*GistCollaborator
+	err := db.Preload("User").
+		Joins("join users on users.id = gist_collaborators.user_id").
+		Where("gist_collaborators.gist_id = ?", gistId).
+		Order("users.username").
+		Find(&collaborators).Error
+	return collaborators, err
+}
+
+func IsGistCollaborator(gistId uint, userId uint) bool {
+	var count int64
+	err := db.Model(&GistCollaborator{}).Where("gist_id = ? AND user_id = ?", gistId, userId).Count(&count).Error
+	return err == nil && count > 0
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// GistInitQueue links a user to the gist created by the first request of a push to /init, so that the following
+// request of the push, which may be served by another replica, finds it
+type GistInitQueue struct {
+	UserID uint `gorm:"primaryKey"`
+	GistID uint
+}
+
+func AddInitGistToQueue(gistId uint, userId uint) error {
+	return db.Save(&GistInitQueue{UserID: userId, GistID: gistId}).Error
+}
+
+// GetInitGistAndDelete returns the gist queued for the user and removes it from the queue, or nil if there is none
+func GetInitGistAndDelete(userId uint) (*Gist, error) {
+	var gist *Gist
+	err := db.Transaction(func(tx *gorm.DB) error {
+		queued := new(GistInitQueue)
+		if err := tx.Where("user_id = ?", userId).First(&queued).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		if err := tx.Delete(&queued).Error; err != nil {
+			return err
+		}
+
+		gist = new(Gist)
+		return tx.Preload("User").Where("id = ?", queued.GistID).First(&gist).Error
+	})
+
+	return gist, err
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// JobLock is held by the instance running a background job, so that replicas sharing the database do not run the
+// same job at the same time. A lock not released before ExpiresAt, e.g. if the instance crashed, can be taken again.
+type JobLock struct {
+	Name      string `gorm:"primaryKey"`
+	Owner     string
+	ExpiresAt int64
+}
+
+// AcquireJobLock takes the lock of the job for ttl and returns true, or returns false if another owner holds it
+func AcquireJobLock(name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "job_locks.expires_at <= ? OR job_locks.owner = ?", Vars: []interface{}{now.Unix(), owner}},
+		}},
+	}).Create(&JobLock{Name: name, Owner: owner, ExpiresAt: now.Add(ttl).Unix()})
+
+	return result.RowsAffected == 1, result.Error
+}
+
+func ReleaseJobLock(name string, owner string) error {
+	return db.Where("name = ? AND owner = ?", name, owner).Delete(&JobLock{}).Error
+}
+
+// IsJobLocked reports whether a job is currently run by any instance
+func IsJobLocked(name string) (bool, error) {
+	var count int64
+	err := db.Model(&JobLock{}).
+		Where("name = ? AND expires_at > ?", name, time.Now().Unix()).
+		Count(&count).Error
+	return count > 0, err
+}
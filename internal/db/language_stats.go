@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	"github.com/thomiceli/opengist/internal/git"
+	"gorm.io/gorm"
+)
+
+// maxLanguageStats is the number of languages shown on a profile, the others being grouped under "Other"
+const maxLanguageStats = 8
+
+// LanguageStat is the share of a language in the files of the gists of a user, measured in bytes
+type LanguageStat struct {
+	Language string
+	Size     uint64
+	Percent  float64
+}
+
+// Color returns a color for the language, the same language always getting the same one
+func (stat *LanguageStat) Color() string {
+	if stat.Language == "Other" {
+		return "#9ca3af"
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(stat.Language))
+	return hslToHex(float64(h.Sum32()%360), 0.6, 0.5)
+}
+
+// languageStatsStatement selects the gists counted in the language stats of a user, only the public ones if the stats
+// are shown to someone who cannot see the others
+func languageStatsStatement(userId uint, publicOnly bool) *gorm.DB {
+	tx := db.Model(&Gist{}).Scopes(notExpired).Where("gists.user_id = ?", userId)
+	if publicOnly {
+		tx = tx.Where("gists.private = 0")
+	}
+	return tx
+}
+
+// GetLanguageStatsVersion returns a value changing whenever a gist counted in the language stats of the user is
+// created, updated, deleted or changes visibility, including by a push, so the stats can be kept until it changes
+func GetLanguageStatsVersion(userId uint, publicOnly bool) (string, error) {
+	var version struct {
+		Count      int64
+		SumID      uint64
+		SumSize    uint64
+		MaxUpdated int64
+	}
+	err := languageStatsStatement(userId, publicOnly).
+		Select("count(*) as count, coalesce(sum(gists.id), 0) as sum_id, coalesce(sum(gists.size), 0) as sum_size, " +
+			"coalesce(max(gists.updated_at), 0) as max_updated").
+		Scan(&version).Error
+	return fmt.Sprintf("%d:%d:%d:%d", version.Count, version.SumID, version.SumSize, version.MaxUpdated), err
+}
+
+// GetLanguageStatsOfUser computes the share of each language in the files of the gists of the user, the most used
+// first. It reads every repository, the result is meant to be cached.
+func GetLanguageStatsOfUser(userId uint, publicOnly bool) ([]*LanguageStat, error) {
+	var gists []*Gist
+	if err := languageStatsStatement(userId, publicOnly).Preload("User").Find(&gists).Error; err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]uint64)
+	var total uint64
+	for _, gist := range gists {
+		files, err := gist.Files("HEAD", true)
+		if err != nil {
+			// gists without commits have no files
+			var revErr *git.RevisionNotFoundError
+			if errors.As(err, &revErr) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, file := range files {
+			sizes[fileLanguage(file.Filename)] += file.Size
+			total += file.Size
+		}
+	}
+
+	if total == 0 {
+		return nil, nil
+	}
+
+	stats := make([]*LanguageStat, 0, len(sizes))
+	for language, size := range sizes {
+		stats = append(stats, &LanguageStat{Language: language, Size: size})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Size != stats[j].Size {
+			return stats[i].Size > stats[j].Size
+		}
+		return stats[i].Language < stats[j].Language
+	})
+
+	if len(stats) > maxLanguageStats {
+		other := &LanguageStat{Language: "Other"}
+		for _, stat := range stats[maxLanguageStats-1:] {
+			other.Size += stat.Size
+		}
+		stats = append(stats[:maxLanguageStats-1], other)
+	}
+
+	for _, stat := range stats {
+		stat.Percent = float64(stat.Size) * 100 / float64(total)
+	}
+	return stats, nil
+}
+
+func hslToHex(h float64, s float64, l float64) string {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round((r+m)*255)), uint8(math.Round((g+m)*255)),
+		uint8(math.Round((b+m)*255)))
+}
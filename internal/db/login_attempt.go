@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginAttempt counts the recent failed logins of a username or of an IP address, to lock it out after too many
+type LoginAttempt struct {
+	Key         string `gorm:"primaryKey"` // "user:<username>" or "ip:<address>"
+	Failures    int
+	LockedUntil int64
+	UpdatedAt   int64 `gorm:"index"`
+}
+
+// IsLoginLocked reports whether one of the keys is locked out, and until when
+func IsLoginLocked(keys ...string) (bool, int64, error) {
+	var attempts []*LoginAttempt
+	err := db.
+		Where("key IN ? AND locked_until > ?", keys, time.Now().Unix()).
+		Order("locked_until desc").
+		Find(&attempts).Error
+	if err != nil || len(attempts) == 0 {
+		return false, 0, err
+	}
+	return true, attempts[0].LockedUntil, nil
+}
+
+// RecordLoginFailure counts a failed login for the key, the failures older than window are forgotten. After max
+// failures, the key is locked out for lockout and its counter starts again.
+func RecordLoginFailure(key string, max int, window time.Duration, lockout time.Duration) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		// the keys without failures for a day are not needed anymore
+		if err := tx.Where("updated_at < ? AND locked_until < ?", now.Add(-24*time.Hour).Unix(), now.Unix()).
+			Delete(&LoginAttempt{}).Error; err != nil {
+			return err
+		}
+
+		attempt := &LoginAttempt{Key: key}
+		if err := tx.Where("key = ?", key).Limit(1).Find(&attempt).Error; err != nil {
+			return err
+		}
+
+		if attempt.UpdatedAt < now.Add(-window).Unix() {
+			attempt.Failures = 0
+		}
+		attempt.Failures++
+		if attempt.Failures >= max {
+			attempt.Failures = 0
+			attempt.LockedUntil = now.Add(lockout).Unix()
+		}
+
+		return tx.Save(&attempt).Error
+	})
+}
+
+func ResetLoginAttempts(keys ...string) error {
+	return db.Where("key IN ?", keys).Delete(&LoginAttempt{}).Error
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginToken is a single-use token sent by email to log a user in without a password. Used tokens are kept until
+// they expire to count the links recently sent to the user.
+type LoginToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	Token     string `gorm:"uniqueIndex"`
+	CreatedAt int64
+	ExpiresAt int64
+	UsedAt    int64
+}
+
+// CreateLoginToken creates a token for the user valid for ttl, and removes the expired ones of the user
+func CreateLoginToken(userId uint, ttl time.Duration) (*LoginToken, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	loginToken := &LoginToken{
+		UserID:    userId,
+		Token:     hex.EncodeToString(token),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND expires_at <= ?", userId, now.Unix()).Delete(&LoginToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&loginToken).Error
+	})
+
+	return loginToken, err
+}
+
+func CountLoginTokensSince(userId uint, since time.Time) (int64, error) {
+	var count int64
+	err := db.Model(&LoginToken{}).
+		Where("user_id = ? AND created_at > ?", userId, since.Unix()).
+		Count(&count).Error
+	return count, err
+}
+
+// UseLoginToken marks the token as used and returns its user. It fails with gorm.ErrRecordNotFound if the token
+// does not exist, has expired or was already used.
+func UseLoginToken(token string) (*User, error) {
+	now := time.Now().Unix()
+	user := new(User)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		loginToken := new(LoginToken)
+		if err := tx.Where("token = ? AND used_at = 0 AND expires_at > ?", token, now).First(&loginToken).Error; err != nil {
+			return err
+		}
+
+		// the condition on used_at prevents two concurrent requests from both using the token
+		result := tx.Model(&LoginToken{}).
+			Where("id = ? AND used_at = 0", loginToken.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return tx.Where("id = ?", loginToken.UserID).First(&user).Error
+	})
+
+	return user, err
+}
@@ -29,6 +29,7 @@ func ApplyMigrations(db *gorm.DB) error {
 	}{
 		{1, v1_modifyConstraintToSSHKeys},
 		{2, v2_lowercaseEmails},
+		{3, v3_verifyExistingUsers},
 		// Add more migrations here as needed
 	}
 
@@ -101,3 +102,9 @@ func v2_lowercaseEmails(db *gorm.DB) error {
 	copySQL := `UPDATE users SET email = lower(email);`
 	return db.Exec(copySQL).Error
 }
+
+func v3_verifyExistingUsers(db *gorm.DB) error {
+	// Accounts created before the email verification are not locked out when it is enabled
+	updateSQL := `UPDATE users SET email_verified = 1;`
+	return db.Exec(updateSQL).Error
+}
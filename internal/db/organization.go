@@ -0,0 +1,137 @@
+package db
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// The roles of the members of an organization. The owners manage its members and transfer gists into it, all the
+// members write its gists.
+const (
+	OrganizationRoleOwner  = "owner"
+	OrganizationRoleMember = "member"
+)
+
+var OrganizationRoles = []string{OrganizationRoleOwner, OrganizationRoleMember}
+
+// OrganizationDTO is the organization a user creates, its name is taken from the same namespace as the usernames
+type OrganizationDTO struct {
+	Name string `form:"name" validate:"required,max=24,alphanumdash,notreserved"`
+}
+
+// OrganizationMember gives a user a role in an organization. An organization is a User with IsOrganization set, so that
+// its gists live under its name like the ones of the users. It has no password nor provider, nobody can log in as it.
+type OrganizationMember struct {
+	OrganizationID uint `gorm:"primaryKey"`
+	UserID         uint `gorm:"primaryKey;index"`
+	Role           string
+	CreatedAt      int64
+
+	Organization User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:OrganizationID"`
+	User         User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
+}
+
+func IsOrganizationRole(role string) bool {
+	return role == OrganizationRoleOwner || role == OrganizationRoleMember
+}
+
+// CreateOrganization creates an organization, its creator being its first owner
+func CreateOrganization(name string, owner *User) (*User, error) {
+	organization := &User{
+		Username:       name,
+		IsOrganization: true,
+		EmailVerified:  true,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(organization).Error; err != nil {
+			return err
+		}
+		return tx.Create(&OrganizationMember{
+			OrganizationID: organization.ID,
+			UserID:         owner.ID,
+			Role:           OrganizationRoleOwner,
+		}).Error
+	})
+	return organization, err
+}
+
+func GetOrganizationByName(name string) (*User, error) {
+	organization := new(User)
+	err := db.
+		Where("username like ? and is_organization = ?", name, true).
+		First(&organization).Error
+	return organization, err
+}
+
+// GetOrganizationsOfUser returns the memberships of the user, with their organization
+func GetOrganizationsOfUser(userId uint) ([]*OrganizationMember, error) {
+	var members []*OrganizationMember
+	err := db.Preload("Organization").
+		Joins("join users on users.id = organization_members.organization_id").
+		Where("organization_members.user_id = ?", userId).
+		Order("users.username").
+		Find(&members).Error
+	return members, err
+}
+
+// GetOrganizationsOwnedByUser returns the organizations the user can transfer gists into
+func GetOrganizationsOwnedByUser(userId uint) ([]*User, error) {
+	var organizations []*User
+	err := db.
+		Joins("join organization_members on users.id = organization_members.organization_id").
+		Where("organization_members.user_id = ? and organization_members.role = ?", userId, OrganizationRoleOwner).
+		Order("users.username").
+		Find(&organizations).Error
+	return organizations, err
+}
+
+func GetOrganizationMembers(organizationId uint) ([]*OrganizationMember, error) {
+	var members []*OrganizationMember
+	err := db.Preload("User").
+		Joins("join users on users.id = organization_members.user_id").
+		Where("organization_members.organization_id = ?", organizationId).
+		Order("organization_members.role desc, users.username").
+		Find(&members).Error
+	return members, err
+}
+
+// GetOrganizationRole returns the role of the user in the organization, or an empty string if they are not a member
+func GetOrganizationRole(organizationId uint, userId uint) (string, error) {
+	member := new(OrganizationMember)
+	err := db.Where("organization_id = ? and user_id = ?", organizationId, userId).First(member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return member.Role, err
+}
+
+// organizationIdsOfUser is a subquery of the IDs of the organizations the user is a member of
+func organizationIdsOfUser(userId uint) *gorm.DB {
+	return db.Model(&OrganizationMember{}).Select("organization_id").Where("user_id = ?", userId)
+}
+
+func IsOrganizationMember(organizationId uint, userId uint) bool {
+	role, err := GetOrganizationRole(organizationId, userId)
+	return err == nil && role != ""
+}
+
+// SetOrganizationMember adds the user to the organization with the role, or changes their role if they are a member
+func SetOrganizationMember(organizationId uint, userId uint, role string) error {
+	return db.Where(OrganizationMember{OrganizationID: organizationId, UserID: userId}).
+		Assign(OrganizationMember{Role: role}).
+		FirstOrCreate(&OrganizationMember{}).Error
+}
+
+func RemoveOrganizationMember(organizationId uint, userId uint) error {
+	return db.Where("organization_id = ? and user_id = ?", organizationId, userId).Delete(&OrganizationMember{}).Error
+}
+
+func CountOrganizationOwners(organizationId uint) (int64, error) {
+	var count int64
+	err := db.Model(&OrganizationMember{}).
+		Where("organization_id = ? and role = ?", organizationId, OrganizationRoleOwner).
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PasswordResetToken is sent by email to a user who lost its password, to set a new one
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	Token     string `gorm:"uniqueIndex"`
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+// CreatePasswordResetToken creates a token for the user valid for ttl, and removes the expired ones of the user
+func CreatePasswordResetToken(userId uint, ttl time.Duration) (*PasswordResetToken, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	resetToken := &PasswordResetToken{
+		UserID:    userId,
+		Token:     hex.EncodeToString(token),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND expires_at <= ?", userId, now.Unix()).Delete(&PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&resetToken).Error
+	})
+
+	return resetToken, err
+}
+
+func CountPasswordResetTokensSince(userId uint, since time.Time) (int64, error) {
+	var count int64
+	err := db.Model(&PasswordResetToken{}).
+		Where("user_id = ? AND created_at > ?", userId, since.Unix()).
+		Count(&count).Error
+	return count, err
+}
+
+func GetPasswordResetToken(token string) (*PasswordResetToken, error) {
+	resetToken := new(PasswordResetToken)
+	err := db.
+		Where("token = ? AND expires_at > ?", token, time.Now().Unix()).
+		First(&resetToken).Error
+	return resetToken, err
+}
+
+// ResetPassword sets the password hash on the account of the token, and removes all the reset tokens of the account.
+// It fails with gorm.ErrRecordNotFound if the token was used in the meantime.
+func (t *PasswordResetToken) ResetPassword(passwordHash string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ?", t.ID).Delete(&PasswordResetToken{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		err := tx.Model(&User{}).
+			Where("id = ?", t.UserID).
+			Update("password", passwordHash).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", t.UserID).Delete(&PasswordResetToken{}).Error
+	})
+}
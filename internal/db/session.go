@@ -0,0 +1,78 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Session is a browser logged in to an account. Its token is kept in the cookie session, so that the session can be
+// listed in the settings of the user and revoked from another browser.
+type Session struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"index"`
+	Token      string `gorm:"uniqueIndex"`
+	IP         string
+	UserAgent  string
+	CreatedAt  int64
+	LastSeenAt int64
+}
+
+func CreateSession(userId uint, ip string, userAgent string) (*Session, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		UserID:     userId,
+		Token:      hex.EncodeToString(token),
+		IP:         ip,
+		UserAgent:  userAgent,
+		LastSeenAt: time.Now().Unix(),
+	}
+
+	return session, db.Create(&session).Error
+}
+
+func GetSessionByToken(token string) (*Session, error) {
+	session := new(Session)
+	err := db.Where("token = ?", token).First(&session).Error
+	return session, err
+}
+
+func GetSessionsOfUser(userId uint) ([]*Session, error) {
+	var sessions []*Session
+	err := db.Where("user_id = ?", userId).Order("last_seen_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+func DeleteSessionOfUser(sessionId uint, userId uint) error {
+	return db.Where("id = ? AND user_id = ?", sessionId, userId).Delete(&Session{}).Error
+}
+
+func DeleteSessionByToken(token string) error {
+	return db.Where("token = ?", token).Delete(&Session{}).Error
+}
+
+// DeleteSessionsOfUser revokes all the sessions of the user but the one with the token keptToken, if not empty
+func DeleteSessionsOfUser(userId uint, keptToken string) error {
+	return db.Where("user_id = ? AND token != ?", userId, keptToken).Delete(&Session{}).Error
+}
+
+// Touch updates the last activity of the session, at most once every 5 minutes to spare database writes
+func (s *Session) Touch(ip string, userAgent string) error {
+	now := time.Now()
+	if now.Unix()-s.LastSeenAt < int64((5*time.Minute).Seconds()) && s.IP == ip {
+		return nil
+	}
+
+	s.IP = ip
+	s.UserAgent = userAgent
+	s.LastSeenAt = now.Unix()
+	return db.Model(&s).Updates(map[string]interface{}{
+		"ip":           ip,
+		"user_agent":   userAgent,
+		"last_seen_at": s.LastSeenAt,
+	}).Error
+}
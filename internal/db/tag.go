@@ -0,0 +1,102 @@
+package db
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MaxGistTags  = 10
+	MaxTagLength = 32
+)
+
+type Tag struct {
+	ID   uint   `gorm:"primaryKey"`
+	Name string `gorm:"uniqueIndex"`
+}
+
+// ParseTags returns the tags of a comma separated list, lowercased and trimmed, with their inner spaces replaced by
+// dashes. Empty and duplicated tags are left out.
+func ParseTags(list string) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// SetTags replaces the tags of the gist, creating the ones which do not exist yet
+func (gist *Gist) SetTags(names []string) error {
+	tags := make([]Tag, 0, len(names))
+	if len(names) > 0 {
+		for _, name := range names {
+			tags = append(tags, Tag{Name: name})
+		}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error; err != nil {
+			return err
+		}
+		tags = tags[:0]
+		if err := db.Where("name in ?", names).Order("name").Find(&tags).Error; err != nil {
+			return err
+		}
+	}
+
+	gist.Tags = tags
+	return db.Model(gist).Association("Tags").Replace(tags)
+}
+
+// TagsList returns the tags of the gist as a comma separated list, as they are entered in the gist form
+func (gist *Gist) TagsList() string {
+	names := make([]string, 0, len(gist.Tags))
+	for _, tag := range gist.Tags {
+		names = append(names, tag.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// tagsOrder sorts the preloaded tags of a gist by name
+func tagsOrder(tx *gorm.DB) *gorm.DB {
+	return tx.Order("tags.name")
+}
+
+// withTag is a scope keeping the gists having the tag, or all of them if the tag is empty
+func withTag(tag string) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if tag == "" {
+			return tx
+		}
+		return tx.Where("gists.id in (?)", db.Table("gist_tags").
+			Select("gist_tags.gist_id").
+			Joins("join tags on tags.id = gist_tags.tag_id").
+			Where("tags.name = ?", tag))
+	}
+}
+
+// GetTagsStartingWith returns the names of the tags starting with prefix used by gists visible to the user, to
+// suggest them while typing
+func GetTagsStartingWith(prefix string, currentUserId uint, limit int) ([]string, error) {
+	var names []string
+	err := db.Table("tags").
+		Distinct("tags.name").
+		Joins("join gist_tags on gist_tags.tag_id = tags.id").
+		Joins("join gists on gists.id = gist_tags.gist_id").
+		Where("tags.name like ? escape '\\'", escapeLike(prefix)+"%").
+		Where("gists.private = 0 or gists.user_id = ?", currentUserId).
+		Where("gists.deleted_at is null").
+		Order("tags.name").
+		Limit(limit).
+		Pluck("tags.name", &names).Error
+	return names, err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -1,28 +1,71 @@
 package db
 
 import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/git"
 	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        uint   `gorm:"primaryKey"`
-	Username  string `gorm:"uniqueIndex"`
-	Password  string
-	IsAdmin   bool
-	CreatedAt int64
-	Email     string
-	MD5Hash   string // for gravatar, if no Email is specified, the value is random
-	AvatarURL string
-	GithubID  string
-	GitlabID  string
-	GiteaID   string
-	OIDCID    string `gorm:"column:oidc_id"`
+	ID          uint   `gorm:"primaryKey"`
+	Username    string `gorm:"uniqueIndex"`
+	Password    string
+	IsAdmin     bool
+	CreatedAt   int64
+	Email       string
+	MD5Hash     string // for gravatar, if no Email is specified, the value is random
+	AvatarURL   string
+	GithubID    string
+	GitlabID    string
+	GiteaID     string
+	OIDCID      string `gorm:"column:oidc_id"`
+	OAuth2ID    string `gorm:"column:oauth2_id"`
+	MicrosoftID string
+	BitbucketID string
+	SAMLID      string `gorm:"column:saml_id"`
+
+	CustomAvatar bool // an avatar was uploaded, see storage.S
+
+	EmailVerified     bool // false until the link sent at registration is opened, see config.C.RequireEmailVerification
+	TOTPEnabled       bool
+	TOTPSecret        string
+	TOTPRecoveryCodes []string `gorm:"serializer:json"` // Argon2id hashes of the recovery codes not used yet
+	TOTPLastStep      int64    // time step of the last code accepted, the codes of this step and the previous ones are refused
+
+	TwoFactorSkips int // times the user postponed setting up two-factor authentication, see config.C.RequireTwoFactor
+
+	UsernameChangedAt int64
+
+	NotifyNewLogin    bool
+	DefaultExpiry     string // preselected expiry of the gists created by the user, empty for never
+	DefaultVisibility string // preselected visibility of the gists created by the user, empty to use the instance default
+	ListingDensity    string // empty to use the instance default
+	ListingColumns    string // empty to use the instance default
+	PreferredTheme    string // light or dark, empty to follow the color scheme of the system
+	HighlightTheme    string // chroma style of the code, empty for the default light and dark ones
+	CloneProtocol     string // http or ssh, the clone URL shown first on the gists, empty for the embed script
+
+	ApiRateLimit *int // requests per hour allowed to the API, set by the admins; nil for the instance default, 0 for none
+
+	IsOrganization bool // owns gists on behalf of its members, see OrganizationMember
+
+	Disabled bool // set by the admins, the user cannot log in anymore but their gists are kept
+
+	PendingApproval bool // signed up while signups require the approval of an admin, cannot log in until approved
 
 	Gists   []Gist   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
 	SSHKeys []SSHKey `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
 	Liked   []Gist   `gorm:"many2many:likes;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 }
 
+// AfterCreate gives up the username to the new user if it was the former username of another one
+func (user *User) AfterCreate(tx *gorm.DB) error {
+	return tx.Where("username = ?", strings.ToLower(user.Username)).Delete(&UsernameRedirect{}).Error
+}
+
 func (user *User) BeforeDelete(tx *gorm.DB) error {
 	// Decrement likes counter for all gists liked by this user
 	// The likes will be automatically deleted by the foreign key constraint
@@ -45,7 +88,7 @@ func (user *User) BeforeDelete(tx *gorm.DB) error {
 		Where("id IN (?)", tx.
 			Select("forked_id").
 			Table("gists").
-			Where("user_id = ?", user.ID),
+			Where("user_id = ? AND deleted_at is null", user.ID),
 		).
 		UpdateColumn("nb_forks", gorm.Expr("nb_forks - 1")).
 		Error
@@ -58,8 +101,70 @@ func (user *User) BeforeDelete(tx *gorm.DB) error {
 		return err
 	}
 
+	err = tx.Where("user_id = ?", user.ID).Delete(&UserDevice{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&EmailVerification{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&LoginToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&PasswordResetToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&UsernameRedirect{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&WebAuthnCredential{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&ApiToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ? or organization_id = ?", user.ID, user.ID).Delete(&OrganizationMember{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ? OR gist_id IN (?)", user.ID, tx.Model(&Gist{}).Select("id").Where("user_id = ?", user.ID)).
+		Delete(&GistCollaborator{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("webhook_id IN (?)", tx.Model(&Webhook{}).Select("id").Where("user_id = ?", user.ID)).
+		Delete(&WebhookDelivery{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("user_id = ?", user.ID).Delete(&Webhook{}).Error
+	if err != nil {
+		return err
+	}
+
 	// Delete all gists created by this user
-	return tx.Where("user_id = ?", user.ID).Delete(&Gist{}).Error
+	return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&Gist{}).Error
 }
 
 func UserExists(username string) (bool, error) {
@@ -87,6 +192,43 @@ func GetUserByUsername(username string) (*User, error) {
 	return user, err
 }
 
+func GetUserByEmail(email string) (*User, error) {
+	user := new(User)
+	err := db.
+		Where("email = ?", strings.ToLower(strings.TrimSpace(email))).
+		First(&user).Error
+	return user, err
+}
+
+// GetUnverifiedUsersBefore returns the accounts whose email was never verified, created before the timestamp
+func GetUnverifiedUsersBefore(timestamp int64) ([]*User, error) {
+	var users []*User
+	err := db.
+		Where("email_verified = ? AND created_at < ?", false, timestamp).
+		Find(&users).Error
+	return users, err
+}
+
+func GetUsersByIds(userIds []uint) ([]*User, error) {
+	var users []*User
+	err := db.Where("id in ?", userIds).Order("id asc").Find(&users).Error
+	return users, err
+}
+
+// GetPendingUsers returns the users waiting for an admin to approve their signup, the oldest first
+func GetPendingUsers() ([]*User, error) {
+	var users []*User
+	err := db.Where("pending_approval = ?", true).Order("id asc").Find(&users).Error
+	return users, err
+}
+
+// CountAdmins returns the number of admins who can still log in
+func CountAdmins() (int64, error) {
+	var count int64
+	err := db.Model(&User{}).Where("is_admin = ? AND disabled = ?", true, false).Count(&count).Error
+	return count, err
+}
+
 func GetUserById(userId uint) (*User, error) {
 	user := new(User)
 	err := db.
@@ -149,6 +291,21 @@ func GetUserByProvider(id string, provider string) (*User, error) {
 		err = db.Where("gitea_id = ?", id).First(&user).Error
 	case "openid-connect":
 		err = db.Where("oidc_id = ?", id).First(&user).Error
+	case "oauth2":
+		err = db.Where("oauth2_id = ?", id).First(&user).Error
+	case "microsoft":
+		err = db.Where("microsoft_id = ?", id).First(&user).Error
+	case "bitbucket":
+		err = db.Where("bitbucket_id = ?", id).First(&user).Error
+	case "saml":
+		err = db.Where("saml_id = ?", id).First(&user).Error
+	default:
+		// the OpenID Connect providers of oidc.providers, whose ids are prefixed by their name
+		if strings.HasPrefix(provider, "oidc-") {
+			err = db.Where("oidc_id = ?", id).First(&user).Error
+		} else {
+			err = gorm.ErrRecordNotFound
+		}
 	}
 
 	return user, err
@@ -162,14 +319,156 @@ func (user *User) Update() error {
 	return db.Save(&user).Error
 }
 
+// Rename changes the username of the user and moves their repositories, keeping the former username to redirect its
+// URLs. The username is not changed if the repositories cannot be moved.
+func (user *User) Rename(username string) error {
+	oldUsername := user.Username
+	now := time.Now().Unix()
+	moved := false
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// a former username is given up to whoever takes it, including its former owner
+		err := tx.Where("username = ?", strings.ToLower(username)).Delete(&UsernameRedirect{}).Error
+		if err != nil {
+			return err
+		}
+
+		if !strings.EqualFold(oldUsername, username) {
+			err = tx.Save(&UsernameRedirect{Username: strings.ToLower(oldUsername), UserID: user.ID, CreatedAt: now}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&User{}).
+			Where("id = ?", user.ID).
+			Updates(map[string]interface{}{
+				"username":            username,
+				"username_changed_at": now,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		// moved last, the transaction is rolled back if it fails
+		if err = git.MoveUserRepositories(oldUsername, username); err != nil {
+			return err
+		}
+		moved = true
+		return nil
+	})
+	if err != nil {
+		if moved {
+			// the commit failed
+			_ = git.MoveUserRepositories(username, oldUsername)
+		}
+		return err
+	}
+
+	user.Username = username
+	user.UsernameChangedAt = now
+	return nil
+}
+
+// Delete deletes the user with their gists, and the repositories of the gists, the ones in the trash included
 func (user *User) Delete() error {
-	return db.Delete(&user).Error
+	cleanup, err := user.DeleteDeferringCleanup()
+	if err != nil {
+		return err
+	}
+	return cleanup()
+}
+
+// DeleteDeferringCleanup deletes the user with their gists, and returns the removal of the gists from the index and
+// of their repositories from the disk, which can run in the background
+func (user *User) DeleteDeferringCleanup() (func() error, error) {
+	var gists []Gist
+	if err := db.Unscoped().Select("id", "uuid").Where("user_id = ?", user.ID).Find(&gists).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Delete(&user).Error; err != nil {
+		return nil, err
+	}
+
+	repositories, err := git.DetachUserRepositories(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		for _, gist := range gists {
+			(&Gist{ID: gist.ID}).RemoveFromIndex()
+			if err := git.DeleteLfsObjects(gist.Uuid); err != nil {
+				return err
+			}
+		}
+		if repositories == "" {
+			return nil
+		}
+		return os.RemoveAll(repositories)
+	}, nil
 }
 
 func (user *User) SetAdmin() error {
 	return db.Model(&user).Update("is_admin", true).Error
 }
 
+func (user *User) RevokeAdmin() error {
+	return db.Model(&user).Update("is_admin", false).Error
+}
+
+// CanLogIn reports whether the user is allowed to log in, and to use their git credentials and tokens
+func (user *User) CanLogIn() bool {
+	return !user.Disabled && !user.PendingApproval
+}
+
+// Approve allows the user waiting for the approval of their signup to log in
+func (user *User) Approve() error {
+	if err := db.Model(&user).Update("pending_approval", false).Error; err != nil {
+		return err
+	}
+	user.PendingApproval = false
+	return nil
+}
+
+// SetDisabled prevents the user from logging in, or allows them again. Disabling the user revokes their sessions.
+func (user *User) SetDisabled(disabled bool) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("disabled", disabled).Error; err != nil {
+			return err
+		}
+		if disabled {
+			return tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error
+		}
+		return nil
+	})
+	if err == nil {
+		user.Disabled = disabled
+	}
+	return err
+}
+
+// UseTOTPStep records that a code of the time step was accepted. It reports false if a code of this step, or of a
+// later one, was already accepted, which is checked in the same query so that a code cannot be used twice at once.
+func (user *User) UseTOTPStep(step int64) (bool, error) {
+	result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	return true, nil
+}
+
+// SetApiRateLimit overrides the API rate limit of the instance for the user, nil to go back to it
+func (user *User) SetApiRateLimit(limit *int) error {
+	user.ApiRateLimit = limit
+	return db.Model(&user).Update("api_rate_limit", limit).Error
+}
+
 func (user *User) HasLiked(gist *Gist) (bool, error) {
 	association := db.Model(&gist).Where("user_id = ?", user.ID).Association("Likes")
 	if association.Error != nil {
@@ -188,9 +487,18 @@ func (user *User) DeleteProviderID(provider string) error {
 		"gitlab":         "gitlab_id",
 		"gitea":          "gitea_id",
 		"openid-connect": "oidc_id",
+		"oauth2":         "oauth2_id",
+		"microsoft":      "microsoft_id",
+		"bitbucket":      "bitbucket_id",
+		"saml":           "saml_id",
 	}
 
-	if providerIDField, ok := providerIDFields[provider]; ok {
+	providerIDField, ok := providerIDFields[provider]
+	if !ok && strings.HasPrefix(provider, "oidc-") {
+		providerIDField, ok = "oidc_id", true
+	}
+
+	if ok {
 		return db.Model(&user).
 			Update(providerIDField, nil).
 			Update("avatar_url", nil).
@@ -207,9 +515,15 @@ type UserDTO struct {
 	Password string `form:"password" validate:"required"`
 }
 
+// PasswordDTO is a new password chosen by a user, checked against the password policy of the instance
+type PasswordDTO struct {
+	Password string `validate:"required,passwordlength,passwordcase,passworddigit,passwordsymbol,notbreached"`
+}
+
 func (dto *UserDTO) ToUser() *User {
 	return &User{
-		Username: dto.Username,
-		Password: dto.Password,
+		Username:      dto.Username,
+		Password:      dto.Password,
+		EmailVerified: true,
 	}
 }
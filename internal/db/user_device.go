@@ -0,0 +1,48 @@
+package db
+
+import (
+	"time"
+)
+
+// UserDevice is a device (IP address and user agent) a user has logged in from
+type UserDevice struct {
+	ID         uint `gorm:"primaryKey"`
+	UserID     uint `gorm:"index"`
+	User       User `validate:"-"`
+	IP         string
+	UserAgent  string
+	CreatedAt  int64
+	LastSeenAt int64
+}
+
+func CountUserDevices(userId uint) (int64, error) {
+	var count int64
+	err := db.Model(&UserDevice{}).
+		Where("user_id = ?", userId).
+		Count(&count).Error
+	return count, err
+}
+
+// RecordUserDevice saves the device used by a user to log in, and returns true if
+// the device was not known yet
+func RecordUserDevice(userId uint, ip string, userAgent string) (bool, error) {
+	device := new(UserDevice)
+	err := db.
+		Where("user_id = ? AND ip = ? AND user_agent = ?", userId, ip, userAgent).
+		Limit(1).
+		Find(&device).Error
+	if err != nil {
+		return false, err
+	}
+
+	if device.ID != 0 {
+		return false, db.Model(&device).Update("last_seen_at", time.Now().Unix()).Error
+	}
+
+	return true, db.Create(&UserDevice{
+		UserID:     userId,
+		IP:         ip,
+		UserAgent:  userAgent,
+		LastSeenAt: time.Now().Unix(),
+	}).Error
+}
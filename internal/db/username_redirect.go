@@ -0,0 +1,19 @@
+package db
+
+// UsernameRedirect is a former username of a user, kept so that the URLs using it are redirected to the current
+// username. It is given up if another user takes the username.
+type UsernameRedirect struct {
+	Username  string `gorm:"primaryKey"` // lowercase
+	UserID    uint   `gorm:"index"`
+	CreatedAt int64
+}
+
+// GetUserByOldUsername returns the user who was formerly named username
+func GetUserByOldUsername(username string) (*User, error) {
+	user := new(User)
+	err := db.
+		Joins("join username_redirects on username_redirects.user_id = users.id").
+		Where("username_redirects.username = lower(?)", username).
+		First(&user).Error
+	return user, err
+}
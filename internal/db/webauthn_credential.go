@@ -0,0 +1,72 @@
+package db
+
+import (
+	"encoding/base64"
+	"time"
+)
+
+// WebAuthnCredential is a passkey registered by a user to log in without a password
+type WebAuthnCredential struct {
+	ID           uint `gorm:"primaryKey"`
+	UserID       uint `gorm:"index"`
+	Name         string
+	CredentialID string `gorm:"uniqueIndex"` // base64url encoded
+	PublicKey    []byte // COSE encoded
+	SignCount    uint32
+	CreatedAt    int64
+	LastUsedAt   int64
+}
+
+func (*WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+func CreateWebAuthnCredential(userId uint, name string, credentialId []byte, publicKey []byte, signCount uint32) error {
+	return db.Create(&WebAuthnCredential{
+		UserID:       userId,
+		Name:         name,
+		CredentialID: base64.RawURLEncoding.EncodeToString(credentialId),
+		PublicKey:    publicKey,
+		SignCount:    signCount,
+	}).Error
+}
+
+func GetWebAuthnCredentialsOfUser(userId uint) ([]*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	err := db.Where("user_id = ?", userId).Order("created_at asc").Find(&credentials).Error
+	return credentials, err
+}
+
+func CountWebAuthnCredentialsOfUser(userId uint) (int64, error) {
+	var count int64
+	err := db.Model(&WebAuthnCredential{}).Where("user_id = ?", userId).Count(&count).Error
+	return count, err
+}
+
+func GetWebAuthnCredentialByCredentialID(credentialId []byte) (*WebAuthnCredential, error) {
+	credential := new(WebAuthnCredential)
+	err := db.
+		Where("credential_id = ?", base64.RawURLEncoding.EncodeToString(credentialId)).
+		First(&credential).Error
+	return credential, err
+}
+
+func DeleteWebAuthnCredentialOfUser(credentialId uint, userId uint) error {
+	return db.Where("id = ? AND user_id = ?", credentialId, userId).Delete(&WebAuthnCredential{}).Error
+}
+
+// RawCredentialID returns the credential ID as given by the authenticator
+func (c *WebAuthnCredential) RawCredentialID() []byte {
+	id, _ := base64.RawURLEncoding.DecodeString(c.CredentialID)
+	return id
+}
+
+// Used records a login with the credential and the new signature counter of its authenticator
+func (c *WebAuthnCredential) Used(signCount uint32) error {
+	c.SignCount = signCount
+	c.LastUsedAt = time.Now().Unix()
+	return db.Model(&c).Updates(map[string]interface{}{
+		"sign_count":   c.SignCount,
+		"last_used_at": c.LastUsedAt,
+	}).Error
+}
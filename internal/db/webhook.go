@@ -0,0 +1,148 @@
+package db
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// The events sent to the webhooks
+const (
+	WebhookEventPing        = "ping"
+	WebhookEventGistCreated = "gist.created"
+	WebhookEventGistUpdated = "gist.updated"
+	WebhookEventGistDeleted = "gist.deleted"
+)
+
+// WebhookEvents are the events a webhook can subscribe to, it always receives the pings
+var WebhookEvents = []string{WebhookEventGistCreated, WebhookEventGistUpdated, WebhookEventGistDeleted}
+
+// webhookDeliveriesKept is the number of deliveries logged for each webhook, the older ones are deleted
+const webhookDeliveriesKept = 50
+
+// Webhook receives a JSON POST request when one of the gists of its user has one of its events. The payloads are
+// signed with its secret, so it needs to be stored in clear.
+type Webhook struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"index"`
+	URL       string
+	Secret    string // key of the HMAC-SHA256 signature of the payloads
+	Events    string // comma separated
+	CreatedAt int64
+
+	User User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:UserID"`
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook, logged for debugging
+type WebhookDelivery struct {
+	ID         uint `gorm:"primaryKey"`
+	WebhookID  uint `gorm:"index"`
+	UUID       string
+	Event      string
+	Attempt    int    // 1 for the first attempt, then incremented for each retry
+	StatusCode int    // 0 if no response was received
+	Error      string // why the delivery failed, empty if it succeeded
+	Duration   int64  // milliseconds
+	CreatedAt  int64
+
+	Webhook Webhook `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;foreignKey:WebhookID"`
+}
+
+func CreateWebhook(userId uint, url string, secret string, events []string) (*Webhook, error) {
+	webhook := &Webhook{
+		UserID: userId,
+		URL:    url,
+		Secret: secret,
+		Events: strings.Join(events, ","),
+	}
+	return webhook, db.Create(&webhook).Error
+}
+
+func GetWebhooksOfUser(userId uint) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := db.Where("user_id = ?", userId).Order("created_at desc").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func GetWebhookOfUser(webhookId uint, userId uint) (*Webhook, error) {
+	webhook := new(Webhook)
+	err := db.Where("id = ? AND user_id = ?", webhookId, userId).First(&webhook).Error
+	return webhook, err
+}
+
+// GetWebhooksForEvent returns the webhooks of the user subscribed to the event
+func GetWebhooksForEvent(userId uint, event string) ([]*Webhook, error) {
+	webhooks, err := GetWebhooksOfUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	subscribed := webhooks[:0]
+	for _, webhook := range webhooks {
+		if webhook.HasEvent(event) {
+			subscribed = append(subscribed, webhook)
+		}
+	}
+	return subscribed, nil
+}
+
+func DeleteWebhookOfUser(webhookId uint, userId uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("webhook_id IN (?)", tx.Model(&Webhook{}).Select("id").Where("id = ? AND user_id = ?", webhookId, userId)).
+			Delete(&WebhookDelivery{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("id = ? AND user_id = ?", webhookId, userId).Delete(&Webhook{}).Error
+	})
+}
+
+func (webhook *Webhook) HasEvent(event string) bool {
+	for _, e := range strings.Split(webhook.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (webhook *Webhook) EventsList() []string {
+	if webhook.Events == "" {
+		return nil
+	}
+	return strings.Split(webhook.Events, ",")
+}
+
+// GetDeliveries returns the last deliveries of the webhook, the most recent first
+func (webhook *Webhook) GetDeliveries() ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := db.Where("webhook_id = ?", webhook.ID).Order("id desc").Limit(webhookDeliveriesKept).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// CreateWebhookDelivery logs the delivery, and forgets the oldest ones of its webhook
+func CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	if err := db.Create(&delivery).Error; err != nil {
+		return err
+	}
+
+	return db.Where("webhook_id = ? AND id NOT IN (?)", delivery.WebhookID, db.Model(&WebhookDelivery{}).
+		Select("id").
+		Where("webhook_id = ?", delivery.WebhookID).
+		Order("id desc").
+		Limit(webhookDeliveriesKept),
+	).Delete(&WebhookDelivery{}).Error
+}
+
+func (delivery *WebhookDelivery) Succeeded() bool {
+	return delivery.Error == ""
+}
+
+func IsWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func Enabled() bool {
+	return config.C.SmtpHost != "" && config.C.SmtpFrom != ""
+}
+
+// Send sends a plain text email using the SMTP server from the configuration.
+// STARTTLS is used automatically if the server supports it.
+func Send(to string, subject string, body string) error {
+	if !Enabled() {
+		return fmt.Errorf("email sending is not configured")
+	}
+
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if config.C.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", config.C.SmtpUsername, config.C.SmtpPassword, config.C.SmtpHost)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + config.C.SmtpFrom,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	}, "\r\n")
+
+	return smtp.SendMail(net.JoinHostPort(config.C.SmtpHost, config.C.SmtpPort), auth, config.C.SmtpFrom, []string{to}, []byte(msg))
+}
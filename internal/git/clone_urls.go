@@ -0,0 +1,44 @@
+package git
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// CloneUrls returns the HTTP and SSH URLs to clone a gist, empty if the protocol is disabled. baseHttpUrl is the
+// external URL of Opengist, or the one the request was made to. The SSH host is the one of ssh.external-domain, or
+// else the one of baseHttpUrl, and the port is the one of ssh.external-port, or else ssh.port.
+func CloneUrls(baseHttpUrl string, user string, gist string) (httpUrl string, sshUrl string) {
+	if config.C.HttpGit {
+		httpUrl = strings.TrimSuffix(baseHttpUrl, "/") + "/" + user + "/" + gist + ".git"
+	}
+
+	if config.C.SshGit {
+		host := config.C.SshExternalDomain
+		if host == "" {
+			if u, err := url.Parse(baseHttpUrl); err == nil {
+				host = u.Hostname()
+			}
+		}
+
+		port := config.C.SshExternalPort
+		if port == "" {
+			port = config.C.SshPort
+		}
+
+		if port == "22" {
+			if strings.Contains(host, ":") {
+				// IPv6 addresses are enclosed in brackets in the scp-like syntax too
+				host = "[" + host + "]"
+			}
+			sshUrl = host + ":" + user + "/" + gist + ".git"
+		} else {
+			sshUrl = "ssh://" + net.JoinHostPort(host, port) + "/" + user + "/" + gist + ".git"
+		}
+	}
+
+	return httpUrl, sshUrl
+}
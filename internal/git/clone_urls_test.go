@@ -0,0 +1,130 @@
+package git
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+func TestCloneUrls(t *testing.T) {
+	require.NoError(t, config.InitConfig("", io.Discard))
+
+	tests := []struct {
+		name           string
+		baseHttpUrl    string
+		httpGit        bool
+		sshGit         bool
+		externalDomain string
+		sshPort        string
+		externalPort   string
+		httpUrl        string
+		sshUrl         string
+	}{
+		{
+			name:        "default ports",
+			baseHttpUrl: "http://localhost:6157",
+			httpGit:     true,
+			sshGit:      true,
+			sshPort:     "2222",
+			httpUrl:     "http://localhost:6157/thomas/gist1.git",
+			sshUrl:      "ssh://localhost:2222/thomas/gist1.git",
+		},
+		{
+			name:        "standard SSH port",
+			baseHttpUrl: "https://gists.example.com",
+			httpGit:     true,
+			sshGit:      true,
+			sshPort:     "22",
+			httpUrl:     "https://gists.example.com/thomas/gist1.git",
+			sshUrl:      "gists.example.com:thomas/gist1.git",
+		},
+		{
+			name:        "external URL with a path",
+			baseHttpUrl: "https://example.com/gists/",
+			httpGit:     true,
+			sshGit:      true,
+			sshPort:     "2222",
+			httpUrl:     "https://example.com/gists/thomas/gist1.git",
+			sshUrl:      "ssh://example.com:2222/thomas/gist1.git",
+		},
+		{
+			name:           "external domain",
+			baseHttpUrl:    "https://gists.example.com",
+			httpGit:        true,
+			sshGit:         true,
+			sshPort:        "2222",
+			externalDomain: "ssh.example.com",
+			httpUrl:        "https://gists.example.com/thomas/gist1.git",
+			sshUrl:         "ssh://ssh.example.com:2222/thomas/gist1.git",
+		},
+		{
+			name:         "external port behind a proxy",
+			baseHttpUrl:  "https://gists.example.com",
+			httpGit:      true,
+			sshGit:       true,
+			sshPort:      "2222",
+			externalPort: "22",
+			httpUrl:      "https://gists.example.com/thomas/gist1.git",
+			sshUrl:       "gists.example.com:thomas/gist1.git",
+		},
+		{
+			name:           "external domain and port",
+			baseHttpUrl:    "http://10.0.0.2:6157",
+			httpGit:        true,
+			sshGit:         true,
+			sshPort:        "2222",
+			externalPort:   "2022",
+			externalDomain: "ssh.example.com",
+			httpUrl:        "http://10.0.0.2:6157/thomas/gist1.git",
+			sshUrl:         "ssh://ssh.example.com:2022/thomas/gist1.git",
+		},
+		{
+			name:        "IPv6 host",
+			baseHttpUrl: "http://[::1]:6157",
+			httpGit:     true,
+			sshGit:      true,
+			sshPort:     "2222",
+			httpUrl:     "http://[::1]:6157/thomas/gist1.git",
+			sshUrl:      "ssh://[::1]:2222/thomas/gist1.git",
+		},
+		{
+			name:        "IPv6 host on the standard SSH port",
+			baseHttpUrl: "http://[::1]:6157",
+			httpGit:     true,
+			sshGit:      true,
+			sshPort:     "22",
+			httpUrl:     "http://[::1]:6157/thomas/gist1.git",
+			sshUrl:      "[::1]:thomas/gist1.git",
+		},
+		{
+			name:        "SSH disabled",
+			baseHttpUrl: "https://gists.example.com",
+			httpGit:     true,
+			sshPort:     "2222",
+			httpUrl:     "https://gists.example.com/thomas/gist1.git",
+		},
+		{
+			name:        "HTTP disabled",
+			baseHttpUrl: "https://gists.example.com",
+			sshGit:      true,
+			sshPort:     "2222",
+			sshUrl:      "ssh://gists.example.com:2222/thomas/gist1.git",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.C.HttpGit = tt.httpGit
+			config.C.SshGit = tt.sshGit
+			config.C.SshExternalDomain = tt.externalDomain
+			config.C.SshPort = tt.sshPort
+			config.C.SshExternalPort = tt.externalPort
+
+			httpUrl, sshUrl := CloneUrls(tt.baseHttpUrl, "thomas", "gist1")
+			require.Equal(t, tt.httpUrl, httpUrl)
+			require.Equal(t, tt.sshUrl, sshUrl)
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -21,8 +22,34 @@ import (
 
 var (
 	ReposDirectory = "repos"
+
+	// reposLock is held for reading by the changes of the repositories, and for writing while a backup copies them
+	reposLock sync.RWMutex
 )
 
+// LockForWrite marks a change of the repositories, which waits for the end of a running backup. The returned function
+// must be called once the change is done.
+func LockForWrite() func() {
+	reposLock.RLock()
+	return reposLock.RUnlock
+}
+
+// LockForBackup waits for the running changes of the repositories and blocks the new ones, so that the repositories
+// can be copied without any partial write, until the returned function is called. It does not queue before the new
+// changes while waiting, since a push can last as long as its client sends it, and gives up after timeout.
+func LockForBackup(timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	for !reposLock.TryLock() {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the repositories are still being changed after %s", timeout)
+		}
+		time.Sleep(backupLockInterval)
+	}
+	return reposLock.Unlock, nil
+}
+
+const backupLockInterval = 100 * time.Millisecond
+
 const truncateLimit = 2 << 18
 const diffSize = 2 << 12
 const maxFilesPerDiffCommit = 10
@@ -64,6 +91,8 @@ func TmpRepositoriesPath() string {
 }
 
 func InitRepository(user string, gist string) error {
+	defer LockForWrite()()
+
 	repositoryPath := RepositoryPath(user, gist)
 
 	var args []string
@@ -266,6 +295,76 @@ func GetFileContent(user string, gist string, revision string, filename string,
 	return content, truncated, nil
 }
 
+// fileContentReader reads the output of the git command printing the content of a file, closing it waits for the
+// command to end
+type fileContentReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *fileContentReader) Close() error {
+	_ = r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// OpenFileContent returns a reader of the whole content of a file at a revision, for it to be streamed without
+// holding it in memory. The reader must be closed.
+func OpenFileContent(user string, gist string, revision string, filename string) (io.ReadCloser, error) {
+	cmd := exec.Command(
+		"git",
+		"cat-file",
+		"blob",
+		revision+":"+filename,
+	)
+	cmd.Dir = RepositoryPath(user, gist)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &fileContentReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// GetFilesSize returns the total size in bytes of the files of a revision
+func GetFilesSize(user string, gist string, revision string) (uint64, error) {
+	repositoryPath := RepositoryPath(user, gist)
+
+	cmd := exec.Command(
+		"git",
+		"ls-tree",
+		"-l",
+		"--",
+		revision,
+	)
+	cmd.Dir = repositoryPath
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	// each line is "<mode> <type> <object> <size>\t<file>"
+	var total uint64
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Fields(strings.SplitN(line, "\t", 2)[0])
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+
+		size, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
 func GetFileSize(user string, gist string, revision string, filename string) (uint64, error) {
 	repositoryPath := RepositoryPath(user, gist)
 
@@ -285,6 +384,111 @@ func GetFileSize(user string, gist string, revision string, filename string) (ui
 	return strconv.ParseUint(strings.TrimSuffix(string(stdout), "\n"), 10, 64)
 }
 
+// GrepMatch is a line of a file containing the searched text
+type GrepMatch struct {
+	Filename string
+	Line     int
+	Content  string
+}
+
+// Grep returns the lines of the text files of a revision containing the query, ignoring the case, and at most max
+// of them
+func Grep(user string, gist string, revision string, query string, max int) ([]*GrepMatch, error) {
+	repositoryPath := RepositoryPath(user, gist)
+
+	cmd := exec.Command(
+		"git",
+		"grep",
+		"-I",
+		"-i",
+		"-n",
+		"-z",
+		"-F",
+		"-e", query,
+		revision,
+		"--",
+	)
+	cmd.Dir = repositoryPath
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			// no line matches
+			if exiterr.ExitCode() == 1 {
+				return nil, nil
+			}
+			if exiterr.ExitCode() == 128 {
+				return nil, &RevisionNotFoundError{}
+			}
+		}
+		return nil, err
+	}
+
+	var matches []*GrepMatch
+	for _, line := range strings.Split(string(stdout), "\n") {
+		// each line is "<revision>:<file>\0<line number>\0<content>"
+		parts := strings.SplitN(line, "\x00", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		number, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+
+		matches = append(matches, &GrepMatch{
+			Filename: strings.TrimPrefix(parts[0], revision+":"),
+			Line:     number,
+			Content:  parts[2],
+		})
+		if len(matches) == max {
+			break
+		}
+	}
+
+	return matches, nil
+}
+
+// GetCommit returns the hash and the commit date of the commit a revision points to
+func GetCommit(user string, gist string, revision string) (string, time.Time, error) {
+	if strings.HasPrefix(revision, "-") {
+		return "", time.Time{}, &RevisionNotFoundError{}
+	}
+
+	repositoryPath := RepositoryPath(user, gist)
+
+	cmd := exec.Command(
+		"git",
+		"log",
+		"-1",
+		"--format=%H %ct",
+		revision,
+		"--",
+	)
+	cmd.Dir = repositoryPath
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 128 {
+			return "", time.Time{}, &RevisionNotFoundError{}
+		}
+		return "", time.Time{}, err
+	}
+
+	hash, timestamp, found := strings.Cut(strings.TrimSpace(string(stdout)), " ")
+	if !found {
+		return "", time.Time{}, &RevisionNotFoundError{}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return hash, time.Unix(unix, 0), nil
+}
+
 func GetLog(user string, gist string, skip int) ([]*Commit, error) {
 	repositoryPath := RepositoryPath(user, gist)
 
@@ -318,6 +522,71 @@ func GetLog(user string, gist string, skip int) ([]*Commit, error) {
 	return parseLog(stdout, maxFilesPerDiffCommit, diffSize)
 }
 
+// GetCommits returns the last commits of the repository, without their changes
+func GetCommits(user string, gist string, max int) ([]*Commit, error) {
+	cmd := exec.Command(
+		"git",
+		"--no-pager",
+		"log",
+		"-n",
+		strconv.Itoa(max),
+		"--format=format:%H %at %aN",
+		"HEAD",
+		"--",
+	)
+	cmd.Dir = RepositoryPath(user, gist)
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		// no commits yet
+		if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 128 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var commits []*Commit
+	for _, line := range strings.Split(strings.TrimSpace(string(stdout)), "\n") {
+		hash, rest, _ := strings.Cut(line, " ")
+		timestamp, author, _ := strings.Cut(rest, " ")
+		if hash == "" {
+			continue
+		}
+		commits = append(commits, &Commit{Hash: hash, Timestamp: timestamp, AuthorName: author})
+	}
+	return commits, nil
+}
+
+// GetDiff returns the changes of the files between two revisions, which must be commit hashes
+func GetDiff(user string, gist string, from string, to string) ([]File, error) {
+	cmd := exec.Command(
+		"git",
+		"--no-pager",
+		"diff",
+		"--no-color",
+		"-M",
+		from,
+		to,
+		"--",
+	)
+	cmd.Dir = RepositoryPath(user, gist)
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// the diff is parsed as the changes of a single commit
+	commits, err := parseLog(io.MultiReader(strings.NewReader("c "+to+"\n"), stdout), maxFilesPerDiffCommit, diffSize)
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil || len(commits) == 0 {
+		return []File{}, err
+	}
+
+	return commits[0].Files, nil
+}
+
 func CloneTmp(user string, gist string, gistTmpId string, email string, remove bool) error {
 	repositoryPath := RepositoryPath(user, gist)
 
@@ -355,6 +624,8 @@ func CloneTmp(user string, gist string, gistTmpId string, email string, remove b
 }
 
 func ForkClone(userSrc string, gistSrc string, userDst string, gistDst string) error {
+	defer LockForWrite()()
+
 	repositoryPathSrc := RepositoryPath(userSrc, gistSrc)
 	repositoryPathDst := RepositoryPath(userDst, gistDst)
 
@@ -372,6 +643,47 @@ func SetFileContent(gistTmpId string, filename string, content string) error {
 	return os.WriteFile(filepath.Join(repositoryPath, filename), []byte(content), 0644)
 }
 
+// RenameFiles renames the files of the temporary repository, from the keys of renames to their values. The files
+// are moved aside first, so that two files can swap their names.
+func RenameFiles(gistTmpId string, renames map[string]string) error {
+	repositoryPath := TmpRepositoryPath(gistTmpId)
+
+	moved := make(map[string]string, len(renames))
+	i := 0
+	for src, dst := range renames {
+		tmp := filepath.Join(repositoryPath, fmt.Sprintf(".opengist-rename-%d", i))
+		if err := os.Rename(filepath.Join(repositoryPath, src), tmp); err != nil {
+			return err
+		}
+		moved[tmp] = dst
+		i++
+	}
+
+	for tmp, dst := range moved {
+		if err := os.Rename(tmp, filepath.Join(repositoryPath, dst)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFiles removes the files of the temporary repository, to write the new ones of a gist which is edited
+func RemoveFiles(gistTmpId string) error {
+	return removeFilesExceptGit(TmpRepositoryPath(gistTmpId))
+}
+
+// HasChanges reports whether the files of the temporary repository differ from its last commit
+func HasChanges(gistTmpId string) (bool, error) {
+	cmd := exec.Command("git", "status", "--porcelain")
+	cmd.Dir = TmpRepositoryPath(gistTmpId)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
+
 func AddAll(gistTmpId string) error {
 	tmpPath := TmpRepositoryPath(gistTmpId)
 
@@ -405,6 +717,8 @@ func CommitRepository(gistTmpId string, authorName string, authorEmail string) e
 }
 
 func Push(gistTmpId string) error {
+	defer LockForWrite()()
+
 	tmpRepositoryPath := TmpRepositoryPath(gistTmpId)
 	cmd := exec.Command(
 		"git",
@@ -419,11 +733,64 @@ func Push(gistTmpId string) error {
 	return os.RemoveAll(tmpRepositoryPath)
 }
 
+// MoveRepository moves the repository of a gist to the directory of another user
+func MoveRepository(userSrc string, userDst string, gist string) error {
+	defer LockForWrite()()
+
+	destination := RepositoryPath(userDst, gist)
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	return os.Rename(RepositoryPath(userSrc, gist), destination)
+}
+
+// MoveUserRepositories moves the repositories of a user to the directory of their new username
+func MoveUserRepositories(userSrc string, userDst string) error {
+	defer LockForWrite()()
+
+	source := filepath.Join(config.GetHomeDir(), ReposDirectory, strings.ToLower(userSrc))
+	destination := filepath.Join(config.GetHomeDir(), ReposDirectory, strings.ToLower(userDst))
+	if source == destination {
+		return nil
+	}
+
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(destination); !os.IsNotExist(err) {
+		return fmt.Errorf("cannot move the repositories of %s, %s already exists", userSrc, destination)
+	}
+	return os.Rename(source, destination)
+}
+
+// DetachUserRepositories moves the repositories of a user out of their directory, so that a new user taking their
+// username starts without them, and returns the directory to delete, empty if the user had no repositories. The
+// directories left behind by a crash are removed by the sync of the repositories from the database.
+func DetachUserRepositories(user string) (string, error) {
+	defer LockForWrite()()
+
+	source := filepath.Join(config.GetHomeDir(), ReposDirectory, strings.ToLower(user))
+	destination := filepath.Join(config.GetHomeDir(), ReposDirectory,
+		fmt.Sprintf(".deleted-%s-%d", strings.ToLower(user), time.Now().UnixNano()))
+
+	if err := os.Rename(source, destination); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return destination, nil
+}
+
 func DeleteRepository(user string, gist string) error {
+	defer LockForWrite()()
+
 	return os.RemoveAll(RepositoryPath(user, gist))
 }
 
 func UpdateServerInfo(user string, gist string) error {
+	defer LockForWrite()()
+
 	repositoryPath := RepositoryPath(user, gist)
 
 	cmd := exec.Command("git", "update-server-info")
@@ -470,7 +837,9 @@ func GcRepos() error {
 
 			cmd := exec.Command("git", "gc")
 			cmd.Dir = repoPath
+			unlock := LockForWrite()
 			err = cmd.Run()
+			unlock()
 			if err != nil {
 				log.Warn().Err(err).Msg("Cannot run git gc for repository " + repoPath)
 				continue
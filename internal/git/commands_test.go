@@ -8,6 +8,7 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestInitDeleteRepository(t *testing.T) {
@@ -50,6 +51,14 @@ func TestCommits(t *testing.T) {
 	nbCommits, err = CountCommits("thomas", "gist1")
 	require.NoError(t, err, "Could not count commits")
 	require.Equal(t, "2", nbCommits, "Repository should have 2 commits")
+
+	hash, date, err := GetCommit("thomas", "gist1", "HEAD")
+	require.NoError(t, err, "Could not get the HEAD commit")
+	require.Equal(t, LastHashOfCommit(t, "thomas", "gist1"), hash, "Commit hash is not the HEAD one")
+	require.False(t, date.IsZero(), "Commit date should be set")
+
+	_, _, err = GetCommit("thomas", "gist1", "unknown")
+	require.IsType(t, &RevisionNotFoundError{}, err, "Unknown revision should not be found")
 }
 
 func TestContent(t *testing.T) {
@@ -67,6 +76,10 @@ hate Opengist`,
 	require.NoError(t, err, "Could not get files of repository")
 	require.Subset(t, []string{"my_file.txt", "my_other_file.txt", "rip.txt"}, files, "Files are not correct")
 
+	size, err := GetFilesSize("thomas", "gist1", "HEAD")
+	require.NoError(t, err, "Could not get size of files")
+	require.Equal(t, uint64(44), size, "Size of files is not correct")
+
 	content, truncated, err := GetFileContent("thomas", "gist1", "HEAD", "my_file.txt", false)
 	require.NoError(t, err, "Could not get content")
 	require.False(t, truncated, "Content should not be truncated")
@@ -240,3 +253,32 @@ func TestGitInitBranchNames(t *testing.T) {
 	require.NoError(t, err, "Could not run git command")
 	require.Equal(t, "refs/heads/main", strings.TrimSpace(string(out)), "Repository should have main branch as default")
 }
+
+func TestLockForBackup(t *testing.T) {
+	unlockPush := LockForWrite()
+
+	// a push in progress makes the backup give up, without blocking the other changes meanwhile
+	backupErr := make(chan error)
+	go func() {
+		_, err := LockForBackup(500 * time.Millisecond)
+		backupErr <- err
+	}()
+	time.Sleep(2 * backupLockInterval)
+
+	locked := make(chan struct{})
+	go func() {
+		LockForWrite()()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("A change waits for the backup")
+	}
+	require.Error(t, <-backupErr)
+
+	unlockPush()
+	unlock, err := LockForBackup(time.Second)
+	require.NoError(t, err)
+	unlock()
+}
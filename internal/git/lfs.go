@@ -0,0 +1,245 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// LfsPointerMaxSize is the size above which a file cannot be a Git LFS pointer
+const LfsPointerMaxSize = 1024
+
+const lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+
+var lfsOidRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ErrLfsObjectMismatch is returned when the content of an uploaded Git LFS object does not match its oid or its size
+var ErrLfsObjectMismatch = errors.New("the content does not match the oid and the size of the object")
+
+// LfsPointer is the content committed in place of a file stored with Git LFS
+type LfsPointer struct {
+	Oid  string
+	Size int64
+}
+
+func (p *LfsPointer) String() string {
+	return fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, p.Oid, p.Size)
+}
+
+// ParseLfsPointer returns the pointer a file content is, if it is one
+func ParseLfsPointer(content string) (*LfsPointer, bool) {
+	if len(content) > LfsPointerMaxSize || !strings.HasPrefix(content, "version "+lfsPointerVersion+"\n") {
+		return nil, false
+	}
+
+	pointer := &LfsPointer{Size: -1}
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n")[1:] {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			pointer.Oid, _ = strings.CutPrefix(value, "sha256:")
+		case "size":
+			pointer.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+
+	if !IsLfsOid(pointer.Oid) || pointer.Size < 0 {
+		return nil, false
+	}
+	return pointer, true
+}
+
+// IsLfsOid reports whether the oid of a Git LFS object is a valid SHA-256 hash
+func IsLfsOid(oid string) bool {
+	return lfsOidRegex.MatchString(oid)
+}
+
+// LfsPath returns the directory holding the Git LFS objects of all the gists
+func LfsPath() string {
+	if config.C.LfsObjectPath != "" {
+		return config.C.LfsObjectPath
+	}
+	return filepath.Join(config.GetHomeDir(), "lfs")
+}
+
+// LfsObjectsPath returns the directory holding the Git LFS objects of a gist, which does not depend on the name of
+// its owner
+func LfsObjectsPath(gist string) string {
+	return filepath.Join(LfsPath(), gist)
+}
+
+func LfsObjectPath(gist string, oid string) string {
+	return filepath.Join(LfsObjectsPath(gist), oid[0:2], oid[2:4], oid)
+}
+
+func LfsObjectExists(gist string, oid string) bool {
+	fi, err := os.Stat(LfsObjectPath(gist, oid))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// StoreLfsObject stores a file content as a Git LFS object of the gist, and returns the pointer to commit in its place
+func StoreLfsObject(gist string, content string) (*LfsPointer, error) {
+	sum := sha256.Sum256([]byte(content))
+	pointer := &LfsPointer{Oid: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+
+	return pointer, WriteLfsObject(gist, pointer, strings.NewReader(content))
+}
+
+// WriteLfsObject stores a Git LFS object of the gist read from r, which is checked against the pointer before being
+// kept. An object already stored is left as it is.
+func WriteLfsObject(gist string, pointer *LfsPointer, r io.Reader) error {
+	objectPath := LfsObjectPath(gist, pointer.Oid)
+	if LfsObjectExists(gist, pointer.Oid) {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(objectPath), pointer.Oid+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, pointer.Size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if size != pointer.Size || hex.EncodeToString(hash.Sum(nil)) != pointer.Oid {
+		return ErrLfsObjectMismatch
+	}
+
+	return os.Rename(tmp.Name(), objectPath)
+}
+
+// OpenLfsObject returns a reader of a Git LFS object of the gist. The reader must be closed.
+func OpenLfsObject(gist string, oid string) (*os.File, error) {
+	return os.Open(LfsObjectPath(gist, oid))
+}
+
+// ReadLfsObject returns the content of the Git LFS object a pointer refers to, truncated like the files of the
+// repositories if asked to
+func ReadLfsObject(gist string, pointer *LfsPointer, truncate bool) (string, bool, error) {
+	file, err := OpenLfsObject(gist, pointer.Oid)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	var maxBytes int64 = -1
+	if truncate {
+		maxBytes = truncateLimit
+	}
+	return truncateCommandOutput(file, maxBytes)
+}
+
+// CopyLfsObjects copies the Git LFS objects of a gist to another one, when it is forked
+func CopyLfsObjects(gistSrc string, gistDst string) error {
+	src := LfsObjectsPath(gistSrc)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !IsLfsOid(d.Name()) {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return WriteLfsObject(gistDst, &LfsPointer{Oid: d.Name(), Size: fi.Size()}, file)
+	})
+}
+
+func DeleteLfsObjects(gist string) error {
+	return os.RemoveAll(LfsObjectsPath(gist))
+}
+
+// lfsAttributesLine returns the line of .gitattributes storing a file of the gist with Git LFS
+func lfsAttributesLine(filename string) string {
+	var pattern strings.Builder
+	pattern.WriteString("/")
+	for _, r := range filename {
+		switch r {
+		case ' ':
+			pattern.WriteString("[[:space:]]")
+		case '*', '?', '[', '\\':
+			pattern.WriteRune('\\')
+			pattern.WriteRune(r)
+		default:
+			pattern.WriteRune(r)
+		}
+	}
+	return pattern.String() + " filter=lfs diff=lfs merge=lfs -text"
+}
+
+// SetLfsAttributes marks the files of the temporary repository stored with Git LFS in its .gitattributes, for the
+// git-lfs client to fetch their objects. The lines Opengist added for the other files written are removed, the ones
+// written by the users are kept.
+func SetLfsAttributes(gistTmpId string, filenames []string, lfsFilenames []string) error {
+	attributesPath := filepath.Join(TmpRepositoryPath(gistTmpId), ".gitattributes")
+	content, err := os.ReadFile(attributesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	generated := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		generated[lfsAttributesLine(filename)] = true
+	}
+	missing := make(map[string]bool, len(lfsFilenames))
+	for _, filename := range lfsFilenames {
+		missing[lfsAttributesLine(filename)] = true
+	}
+
+	var lines []string
+	if len(content) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			if missing[line] {
+				delete(missing, line)
+			} else if generated[line] {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, filename := range lfsFilenames {
+		if line := lfsAttributesLine(filename); missing[line] {
+			delete(missing, line)
+			lines = append(lines, line)
+		}
+	}
+
+	if strings.TrimSpace(strings.Join(lines, "")) == "" {
+		if err = os.Remove(attributesPath); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.WriteFile(attributesPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
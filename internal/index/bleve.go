@@ -8,6 +8,7 @@ import (
 	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
 	"github.com/blevesearch/bleve/v2/analysis/token/unicodenorm"
 	"github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/v2/search/highlight/highlighter/html"
 	"github.com/blevesearch/bleve/v2/search/query"
 	"github.com/thomiceli/opengist/internal/config"
 	"strconv"
@@ -32,6 +33,7 @@ func Open(indexFilename string) error {
 
 	docMapping := bleve.NewDocumentMapping()
 	docMapping.AddFieldMappingsAt("GistID", bleve.NewNumericFieldMapping())
+	docMapping.AddFieldMappingsAt("Description", bleve.NewTextFieldMapping())
 	docMapping.AddFieldMappingsAt("Content", bleve.NewTextFieldMapping())
 
 	mapping := bleve.NewIndexMapping()
@@ -82,9 +84,11 @@ func RemoveFromIndex(gistID uint) error {
 	return bleveIndex.Delete(strconv.Itoa(int(gistID)))
 }
 
-func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []uint, page int) ([]uint, uint64, map[string]int, error) {
-	if !Enabled() {
-		return nil, 0, nil, nil
+// SearchGists returns a page of the ids of the gists matching the query among gistsIds, with the number of hits, the
+// number of gists by language and, for the gists whose content matched, an HTML snippet highlighting the match
+func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []uint, page int) ([]uint, uint64, map[string]int, map[uint]string, error) {
+	if !Enabled() || len(gistsIds) == 0 {
+		return nil, 0, nil, nil, nil
 	}
 
 	var err error
@@ -92,26 +96,27 @@ func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []u
 	if queryStr != "" {
 		contentQuery := bleve.NewMatchPhraseQuery(queryStr)
 		contentQuery.FieldVal = "Content"
-		indexerQuery = contentQuery
+		// the description is indexed as written, without its Markdown rendered
+		descriptionQuery := bleve.NewMatchPhraseQuery(queryStr)
+		descriptionQuery.FieldVal = "Description"
+		indexerQuery = bleve.NewDisjunctionQuery(contentQuery, descriptionQuery)
 	} else {
 		contentQuery := bleve.NewMatchAllQuery()
 		indexerQuery = contentQuery
 	}
 
-	if len(gistsIds) > 0 {
-		repoQueries := make([]query.Query, 0, len(gistsIds))
-
-		truee := true
-		for _, id := range gistsIds {
-			f := float64(id)
-			qq := bleve.NewNumericRangeInclusiveQuery(&f, &f, &truee, &truee)
-			qq.SetField("GistID")
-			repoQueries = append(repoQueries, qq)
-		}
+	repoQueries := make([]query.Query, 0, len(gistsIds))
 
-		indexerQuery = bleve.NewConjunctionQuery(bleve.NewDisjunctionQuery(repoQueries...), indexerQuery)
+	truee := true
+	for _, id := range gistsIds {
+		f := float64(id)
+		qq := bleve.NewNumericRangeInclusiveQuery(&f, &f, &truee, &truee)
+		qq.SetField("GistID")
+		repoQueries = append(repoQueries, qq)
 	}
 
+	indexerQuery = bleve.NewConjunctionQuery(bleve.NewDisjunctionQuery(repoQueries...), indexerQuery)
+
 	addQuery := func(field, value string) {
 		if value != "" && value != "." {
 			q := bleve.NewMatchPhraseQuery(value)
@@ -135,15 +140,25 @@ func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []u
 	s.AddFacet("languageFacet", languageFacet)
 	s.Fields = []string{"GistID"}
 	s.IncludeLocations = false
+	if queryStr != "" {
+		// the HTML highlighter escapes the content around the <mark> tags
+		s.Highlight = bleve.NewHighlightWithStyle(html.Name)
+		s.Highlight.AddField("Content")
+	}
 
 	results, err := bleveIndex.Search(s)
 	if err != nil {
-		return nil, 0, nil, err
+		return nil, 0, nil, nil, err
 	}
 
 	gistIds := make([]uint, 0, len(results.Hits))
+	highlights := make(map[uint]string)
 	for _, hit := range results.Hits {
-		gistIds = append(gistIds, uint(hit.Fields["GistID"].(float64)))
+		gistId := uint(hit.Fields["GistID"].(float64))
+		gistIds = append(gistIds, gistId)
+		if fragments := hit.Fragments["Content"]; len(fragments) > 0 {
+			highlights[gistId] = fragments[0]
+		}
 	}
 
 	languageCounts := make(map[string]int)
@@ -153,5 +168,5 @@ func SearchGists(queryStr string, queryMetadata SearchGistMetadata, gistsIds []u
 		}
 	}
 
-	return gistIds, results.Total, languageCounts, nil
+	return gistIds, results.Total, languageCounts, highlights, nil
 }
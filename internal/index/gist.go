@@ -1,15 +1,16 @@
 package index
 
 type Gist struct {
-	GistID     uint
-	Username   string
-	Title      string
-	Content    string
-	Filenames  []string
-	Extensions []string
-	Languages  []string
-	CreatedAt  int64
-	UpdatedAt  int64
+	GistID      uint
+	Username    string
+	Title       string
+	Description string
+	Content     string
+	Filenames   []string
+	Extensions  []string
+	Languages   []string
+	CreatedAt   int64
+	UpdatedAt   int64
 }
 
 type SearchGistMetadata struct {
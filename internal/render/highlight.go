@@ -34,9 +34,6 @@ func HighlightFile(file *git.File) (RenderedFile, error) {
 
 	style := newStyle()
 	lexer := newLexer(file.Filename)
-	if lexer.Config().Name == "markdown" {
-		return MarkdownFile(file)
-	}
 
 	formatter := html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
 
@@ -65,6 +62,13 @@ func HighlightFile(file *git.File) (RenderedFile, error) {
 	rendered.Lines = lines
 	rendered.Type = parseFileTypeName(*lexer.Config())
 
+	// the highlighted lines are kept for the source view of the Markdown files
+	if IsMarkdown(file.Filename) {
+		markdown, err := MarkdownFile(file)
+		rendered.HTML, rendered.Type = markdown.HTML, markdown.Type
+		return rendered, err
+	}
+
 	return rendered, err
 }
 
@@ -107,7 +111,7 @@ func HighlightGistPreview(gist *db.Gist) (RenderedGist, error) {
 
 	style := newStyle()
 	lexer := newLexer(gist.PreviewFilename)
-	if lexer.Config().Name == "markdown" {
+	if IsMarkdown(gist.PreviewFilename) {
 		return MarkdownGistPreview(gist)
 	}
 
@@ -140,6 +144,11 @@ func HighlightGistPreview(gist *db.Gist) (RenderedGist, error) {
 	return rendered, err
 }
 
+// IsMarkdown tells if the file is rendered as Markdown, from the extensions known by the lexer (.md, .mkd, .markdown)
+func IsMarkdown(filename string) bool {
+	return newLexer(filename).Config().Name == "markdown"
+}
+
 func parseFileTypeName(config chroma.Config) string {
 	fileType := config.Name
 	if fileType == "fallback" || fileType == "plaintext" {
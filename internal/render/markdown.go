@@ -48,6 +48,20 @@ func MarkdownString(content string) (string, error) {
 	return buf.String(), err
 }
 
+// MarkdownDescription renders the description of a gist, in which only the links, the emphasis and the inline code
+// are kept
+func MarkdownDescription(description string) (string, error) {
+	var buf bytes.Buffer
+	md := goldmark.New(goldmark.WithExtensions(extension.Linkify, extension.Strikethrough))
+	if err := md.Convert([]byte(description), &buf); err != nil {
+		return "", err
+	}
+
+	return SanitizeDescription(buf.String())
+}
+
+// newMarkdown returns the renderer of the Markdown written by the users. It is left in its safe mode, which omits the
+// raw HTML and the links with a dangerous scheme like javascript:, so the output can be shown as is.
 func newMarkdown() goldmark.Markdown {
 	return goldmark.New(
 		goldmark.WithExtensions(
@@ -0,0 +1,106 @@
+package render
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// descriptionElements are the elements kept in the descriptions of the gists, with the attributes allowed on them
+var descriptionElements = map[atom.Atom][]string{
+	atom.P:      nil,
+	atom.Br:     nil,
+	atom.A:      {"href"},
+	atom.Em:     nil,
+	atom.Strong: nil,
+	atom.Del:    nil,
+	atom.Code:   nil,
+}
+
+// droppedElements are removed along with their content, the other elements not allowed are replaced by their content
+var droppedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Template: true,
+	atom.Noscript: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+	atom.Svg:      true,
+	atom.Math:     true,
+}
+
+var safeUrlSchemes = []string{"http", "https", "mailto"}
+
+// SanitizeDescription keeps only the links, the emphasis and the inline code of the HTML of a description. The links
+// must have an http, https or mailto URL, and all the other attributes are removed.
+func SanitizeDescription(content string) (string, error) {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, node := range nodes {
+		sanitizeNode(&sb, node)
+	}
+	return sb.String(), nil
+}
+
+func sanitizeNode(sb *strings.Builder, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		sb.WriteString(html.EscapeString(node.Data))
+		return
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return
+	}
+
+	if droppedElements[node.DataAtom] {
+		return
+	}
+
+	attributes, ok := descriptionElements[node.DataAtom]
+	if !ok {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			sanitizeNode(sb, child)
+		}
+		return
+	}
+
+	sb.WriteString("<" + node.Data)
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" || !slices.Contains(attributes, attr.Key) {
+			continue
+		}
+		if attr.Key == "href" && !isSafeUrl(attr.Val) {
+			continue
+		}
+		sb.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+	}
+	if node.DataAtom == atom.A {
+		sb.WriteString(` rel="nofollow noopener noreferrer"`)
+	}
+	sb.WriteString(">")
+
+	if node.DataAtom == atom.Br {
+		return
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		sanitizeNode(sb, child)
+	}
+	sb.WriteString("</" + node.Data + ">")
+}
+
+func isSafeUrl(value string) bool {
+	u, err := url.Parse(strings.TrimSpace(value))
+	return err == nil && slices.Contains(safeUrlSchemes, strings.ToLower(u.Scheme))
+}
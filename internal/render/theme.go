@@ -0,0 +1,53 @@
+package render
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// HighlightThemeClass is set on the html element of the pages of a user who chose a highlight theme, so that its rules
+// take precedence over the ones of the default light and dark themes
+const HighlightThemeClass = "highlight-theme"
+
+var highlightThemesCSS sync.Map
+
+// HighlightThemes returns the names of the themes the code can be highlighted with, sorted
+func HighlightThemes() []string {
+	return styles.Names()
+}
+
+func IsHighlightTheme(name string) bool {
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// HighlightThemeCSS returns the stylesheet of a highlight theme, scoped to the pages having HighlightThemeClass
+func HighlightThemeCSS(name string) (string, error) {
+	if css, ok := highlightThemesCSS.Load(name); ok {
+		return css.(string), nil
+	}
+
+	var buf bytes.Buffer
+	if err := html.New(html.WithClasses(true)).WriteCSS(&buf, styles.Get(name)); err != nil {
+		return "", err
+	}
+
+	var css strings.Builder
+	for _, line := range strings.Split(buf.String(), "\n") {
+		// the code is not rendered with a background element
+		if strings.HasPrefix(line, "/* Background */") {
+			continue
+		}
+		// the rendered markdown shares the chroma class with the code, its background is left to the page
+		line = strings.Replace(line, "*/ .chroma {", "*/ .chroma:not(.markdown) {", 1)
+		css.WriteString(strings.ReplaceAll(line, ".chroma", "html."+HighlightThemeClass+" .chroma"))
+		css.WriteString("\n")
+	}
+
+	highlightThemesCSS.Store(name, css.String())
+	return css.String(), nil
+}
@@ -25,6 +25,17 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 		return errors.New("invalid command")
 	}
 
+	if verb == "receive-pack" {
+		readOnly, err := db.ReadOnlyMode()
+		if err != nil {
+			errorSsh("Failed to get the read-only mode", err)
+			return errors.New("internal server error")
+		}
+		if readOnly {
+			return errors.New("the instance is in read-only mode for a maintenance, try again later")
+		}
+	}
+
 	repoFullName := strings.ToLower(strings.Trim(args, "'"))
 	repoFields := strings.SplitN(repoFullName, "/", 2)
 	if len(repoFields) != 2 {
@@ -36,6 +47,12 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 
 	gist, err := db.GetGist(userName, gistName)
 	if err != nil {
+		// the path may use a former username
+		if user, userErr := db.GetUserByOldUsername(userName); userErr == nil {
+			gist, err = db.GetGist(user.Username, gistName)
+		}
+	}
+	if err != nil || gist.IsExpired() {
 		return errors.New("gist not found")
 	}
 
@@ -47,24 +64,43 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 	// Check for the key if :
 	// - user wants to push the gist
 	// - user wants to clone a private gist
+	// - user wants to clone a gist protected by a password, which only its owner can do over SSH
 	// - gist is not found (obfuscation)
 	// - admin setting to require login is set to true
 	if verb == "receive-pack" ||
 		gist.Private == db.PrivateVisibility ||
+		gist.IsProtected() ||
 		gist.ID == 0 ||
 		!allowUnauthenticated {
 
 		var userToCheckPermissions *db.User
-		if gist.Private != db.PrivateVisibility && verb == "upload-pack" {
+		if gist.Private != db.PrivateVisibility && !gist.IsProtected() && verb == "upload-pack" {
 			userToCheckPermissions, _ = db.GetUserFromSSHKey(key)
+		} else if gist.User.IsOrganization {
+			// the gists of an organization are accessed with the keys of its members
+			userToCheckPermissions, _ = db.GetUserFromSSHKey(key)
+			if !gist.CanWrite(userToCheckPermissions) {
+				log.Warn().Str("event", db.AuditLoginFailed).Str("method", "ssh").Str("ip", ip).Msg("Invalid SSH authentication attempt")
+				return errors.New("gist not found")
+			}
 		} else {
 			userToCheckPermissions = &gist.User
+			// the collaborators of the gist use their own keys
+			if collaborator, err := db.GetUserFromSSHKey(key); err == nil &&
+				collaborator.ID != gist.UserID && gist.CanWrite(collaborator) {
+				userToCheckPermissions = collaborator
+			}
+		}
+
+		if !userToCheckPermissions.CanLogIn() {
+			log.Warn().Str("event", db.AuditLoginFailed).Str("method", "ssh").Str("ip", ip).Str("username", userToCheckPermissions.Username).Msg("SSH authentication attempt of a disabled or pending user")
+			return errors.New("gist not found")
 		}
 
 		pubKey, err := db.SSHKeyExistsForUser(key, userToCheckPermissions.ID)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.Warn().Msg("Invalid SSH authentication attempt from " + ip)
+				log.Warn().Str("event", db.AuditLoginFailed).Str("method", "ssh").Str("ip", ip).Msg("Invalid SSH authentication attempt")
 				return errors.New("gist not found")
 			}
 			errorSsh("Failed to get user by SSH key id", err)
@@ -82,6 +118,10 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
+	if verb == "receive-pack" {
+		defer git.LockForWrite()()
+	}
+
 	if err = cmd.Start(); err != nil {
 		errorSsh("Failed to start git command", err)
 		return errors.New("internal server error")
@@ -107,6 +147,15 @@ func runGitCommand(ch ssh.Channel, gitCmd string, key string, ip string) error {
 		gist.AddInIndex()
 	}
 
+	// the clone is counted in the background, not to keep the client waiting
+	if verb == "upload-pack" && gist.ID != 0 {
+		go func() {
+			if err := db.IncrementGistClones(gist.ID); err != nil {
+				log.Error().Err(err).Msgf("Cannot count a clone of gist %s", gist.Uuid)
+			}
+		}()
+	}
+
 	return nil
 }
 
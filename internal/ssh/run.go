@@ -30,7 +30,7 @@ func Start() {
 					return nil, err
 				}
 
-				log.Warn().Msg("Invalid SSH authentication attempt from " + conn.RemoteAddr().String())
+				log.Warn().Str("event", db.AuditLoginFailed).Str("method", "ssh").Str("ip", conn.RemoteAddr().String()).Msg("Invalid SSH authentication attempt")
 				return nil, errors.New("unknown public key")
 			}
 			return &ssh.Permissions{Extensions: map[string]string{"key": strKey}}, nil
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+// S3 stores the objects in a bucket of an S3 compatible service (AWS, MinIO, Garage...).
+// Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // bucket in the path of the URL instead of in the host name, required by most self-hosted services
+}
+
+func (s *S3) Put(key string, content io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest("PUT", key, content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Delete(key string) error {
+	req, err := s.newRequest("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if resp != nil {
+		return resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3) newRequest(method string, key string, body io.Reader) (*http.Request, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	objectPath := cleaned
+	objectUrl := *endpoint
+	if s.PathStyle {
+		objectPath = s.Bucket + "/" + cleaned
+	} else {
+		objectUrl.Host = s.Bucket + "." + endpoint.Host
+	}
+	objectUrl.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + objectPath
+	objectUrl.RawPath = strings.TrimSuffix(endpoint.EscapedPath(), "/") + "/" + s3Escape(objectPath)
+
+	return http.NewRequest(method, objectUrl.String(), body)
+}
+
+// do signs and sends the request, the body of the response must be closed if no error is returned
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := utils.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 404 {
+		_ = resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, message)
+	}
+
+	return resp, nil
+}
+
+// sign adds the Authorization header of AWS Signature Version 4. The payload is not signed, so that objects
+// can be streamed.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signV4(req, "s3", s.Region, s.AccessKey, s.SecretKey, "UNSIGNED-PAYLOAD", "X-Amz-Content-Sha256", "X-Amz-Date")
+}
+
+// signV4 adds the Authorization header of AWS Signature Version 4 to a request carrying its X-Amz-Date header. The
+// host and the headers given are signed, and payloadHash is the hex encoded SHA-256 of the body.
+func signV4(req *http.Request, service string, region string, accessKey string, secretKey string, payloadHash string, headers ...string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	signedHeaders := []string{"host"}
+	for _, header := range headers {
+		signedHeaders = append(signedHeaders, strings.ToLower(header))
+	}
+	sort.Strings(signedHeaders)
+	var canonicalHeaders strings.Builder
+	for _, header := range signedHeaders {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(header + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSha256(signingKey(secretKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+func signingKey(secretKey string, date string, region string, service string) []byte {
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	return hmacSha256(key, "aws4_request")
+}
+
+// canonicalQuery encodes the query parameters sorted by name, then by value
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{queryEscape(name), queryEscape(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+
+	encoded := make([]string, 0, len(params))
+	for _, param := range params {
+		encoded = append(encoded, param[0]+"="+param[1])
+	}
+	return strings.Join(encoded, "&")
+}
+
+func queryEscape(value string) string {
+	return strings.ReplaceAll(s3Escape(value), "/", "%2F")
+}
+
+// s3Escape encodes a path the way the signature expects it: every byte but the unreserved characters of
+// RFC 3986 and the slashes
+func s3Escape(path string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(path) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// ErrNotFound is returned by Get when no object is stored under the key
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps the files generated or uploaded through Opengist (avatars, exports, preview images...).
+// Keys are slash separated paths, e.g. "avatars/1.png". The git repositories of the gists are not stored there.
+type Storage interface {
+	Put(key string, content io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+var S Storage
+
+// Setup opens the storage backend set in the configuration, whose options are checked when it is loaded
+func Setup() {
+	if config.C.StorageType == "s3" {
+		S = &S3{
+			Endpoint:  config.C.StorageS3Endpoint,
+			Bucket:    config.C.StorageS3Bucket,
+			Region:    config.C.StorageS3Region,
+			AccessKey: config.C.StorageS3AccessKey,
+			SecretKey: config.C.StorageS3SecretKey,
+			PathStyle: config.C.StorageS3PathStyle,
+		}
+		return
+	}
+	S = &Local{Root: filepath.Join(config.GetHomeDir(), "storage")}
+}
+
+// cleanKey rejects the keys which would escape the storage root once joined to it
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return cleaned, nil
+}
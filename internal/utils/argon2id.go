@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"golang.org/x/crypto/argon2"
 	"strings"
+	"sync"
 )
 
 type Argon2ID struct {
@@ -44,6 +45,18 @@ func (a Argon2ID) Hash(plain string) (string, error) {
 	), nil
 }
 
+// dummyHash is verified in place of the password of the users who do not exist or have no password
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := Argon2id.Hash("opengist")
+	return hash
+})
+
+// VerifyDummy takes as long as Verify with an actual hash, so that the time of a failed login does not tell whether
+// the account exists
+func (a Argon2ID) VerifyDummy(plain string) {
+	_, _ = a.Verify(plain, dummyHash())
+}
+
 func (a Argon2ID) Verify(plain, hash string) (bool, error) {
 	if hash == "" {
 		return false, nil
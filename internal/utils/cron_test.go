@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// a Friday
+	now := time.Date(2026, 10, 16, 14, 37, 20, 0, time.UTC)
+
+	next := func(spec string) time.Time {
+		schedule, err := ParseCron(spec)
+		require.NoError(t, err, spec)
+		return schedule.Next(now)
+	}
+
+	require.Equal(t, time.Date(2026, 10, 16, 14, 38, 0, 0, time.UTC), next("* * * * *"))
+	require.Equal(t, time.Date(2026, 10, 16, 14, 45, 0, 0, time.UTC), next("*/15 * * * *"))
+	require.Equal(t, time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC), next("0 3 * * *"))
+	require.Equal(t, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), next("@daily"))
+	require.Equal(t, time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC), next("@hourly"))
+	require.Equal(t, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), next("@weekly"))
+	require.Equal(t, time.Date(2026, 10, 18, 4, 30, 0, 0, time.UTC), next("30 4 * * 7"))
+	require.Equal(t, time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC), next("0 9 * * 1-5"))
+	require.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), next("0 0 1 * *"))
+	require.Equal(t, time.Date(2027, 2, 28, 12, 0, 0, 0, time.UTC), next("0 12 28 2 *"))
+	require.Equal(t, time.Date(2026, 10, 16, 18, 5, 0, 0, time.UTC), next("5 6,18 * * *"))
+
+	// the day of the month or the day of the week when both are set
+	require.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), next("0 0 20 * 1"))
+
+	// a date which never comes
+	require.True(t, next("0 0 31 2 *").IsZero())
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "@often"} {
+		_, err := ParseCron(spec)
+		require.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import "time"
+
+// ExpiryOptions are the lifetimes a gist can be given, from the shortest to the longest.
+// An empty value means the gist never expires.
+var ExpiryOptions = []string{"1h", "1d", "1w", "1M", "1y"}
+
+var expiryDurations = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+	"1w": 7 * 24 * time.Hour,
+	"1M": 30 * 24 * time.Hour,
+	"1y": 365 * 24 * time.Hour,
+}
+
+// IsValidExpiry reports whether the value is one of ExpiryOptions or empty
+func IsValidExpiry(expiry string) bool {
+	_, ok := expiryDurations[expiry]
+	return ok || expiry == ""
+}
+
+// ClampExpiry returns the expiry, or max if the expiry is longer than max. An empty max means there is no limit.
+func ClampExpiry(expiry string, max string) string {
+	if !IsValidExpiry(expiry) {
+		expiry = ""
+	}
+	if max == "" {
+		return expiry
+	}
+	if expiry == "" || expiryDurations[expiry] > expiryDurations[max] {
+		return max
+	}
+	return expiry
+}
+
+// AllowedExpiries returns the expiry options not longer than max, "" (never) included only if there is no max
+func AllowedExpiries(max string) []string {
+	if max == "" {
+		return append([]string{""}, ExpiryOptions...)
+	}
+
+	var allowed []string
+	for _, option := range ExpiryOptions {
+		if expiryDurations[option] <= expiryDurations[max] {
+			allowed = append(allowed, option)
+		}
+	}
+	return allowed
+}
+
+// ExpiresAt returns the unix time at which a gist created now with this expiry expires, or 0 if it never expires
+func ExpiresAt(expiry string) int64 {
+	duration, ok := expiryDurations[expiry]
+	if !ok {
+		return 0
+	}
+	return time.Now().Add(duration).Unix()
+}
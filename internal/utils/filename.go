@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+// matches a "filename: name.ext" comment on the first line of a file, e.g. "// filename: main.go" or "# filename: run.sh"
+var filenameHintRegex = regexp.MustCompile(`^\s*(?://|#|--|;|/\*|<!--)\s*filename:\s*([^\s/\\]+?)\s*(?:\*/|-->)?\s*$`)
+
+// FilenameHint returns the filename given in a "filename:" comment on the first line of the content, if any
+func FilenameHint(content string) string {
+	firstLine, _, _ := strings.Cut(content, "\n")
+	matches := filenameHintRegex.FindStringSubmatch(strings.TrimRight(firstLine, "\r"))
+	if matches == nil || matches[1] == "." || matches[1] == ".." {
+		return ""
+	}
+	return matches[1]
+}
+
+// DetectExtension guesses the extension of a file from its content, without the leading dot.
+// It returns "txt" if the language cannot be detected.
+func DetectExtension(content string) string {
+	if lexer := lexers.Analyse(content); lexer != nil {
+		for _, glob := range lexer.Config().Filenames {
+			if ext := strings.TrimPrefix(glob, "*."); ext != glob && !strings.ContainsAny(ext, "*?[") {
+				return ext
+			}
+		}
+	}
+	return "txt"
+}
+
+// DefaultFilename returns the name of a file submitted without one, from a pattern where {n} is replaced by
+// the index of the nameless file and {ext} by the extension detected from the content.
+// A "filename:" hint in the content takes precedence over the pattern. The name returned is not in taken.
+func DefaultFilename(pattern string, n int, content string, taken map[string]bool) string {
+	if hint := FilenameHint(content); hint != "" && !taken[hint] {
+		return hint
+	}
+
+	if !strings.Contains(pattern, "{n}") {
+		// without a counter the pattern cannot be made unique, so one is appended to the base name
+		ext := path.Ext(pattern)
+		pattern = strings.TrimSuffix(pattern, ext) + "{n}" + ext
+	}
+
+	pattern = strings.ReplaceAll(pattern, "{ext}", DetectExtension(content))
+	for ; ; n++ {
+		name := strings.ReplaceAll(pattern, "{n}", strconv.Itoa(n))
+		if !taken[name] {
+			return name
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const httpTimeout = 10 * time.Second
+
+// HttpClient is used for the requests made by Opengist to the hosts set in its configuration (OAuth providers, ...).
+// It has its own transport, so that the certificates of LoadCACerts are not trusted by the rest of the process.
+var HttpClient = &http.Client{
+	Timeout:   httpTimeout,
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+}
+
+// httpRetries is how many times DoWithRetries sends a request again when it fails
+var httpRetries = 2
+
+// httpRetryDelay is the delay before the first retry of DoWithRetries, doubled for each of the next ones
+var httpRetryDelay = 500 * time.Millisecond
+
+// SetHttpClientOptions sets the timeout of the requests of HttpClient, and how many times DoWithRetries sends them
+// again
+func SetHttpClientOptions(timeout time.Duration, retries int) {
+	HttpClient.Timeout = timeout
+	httpRetries = retries
+}
+
+// DoWithRetries sends a request with HttpClient, and sends it again with a growing delay while it fails or gets a
+// server error. It is meant for the lookups made on behalf of the users, like their avatars and SSH keys, which are
+// skipped when they fail. The request must not have a body.
+func DoWithRetries(req *http.Request) (*http.Response, error) {
+	delay := httpRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := HttpClient.Do(req.Clone(req.Context()))
+		retry := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !retry || attempt >= httpRetries {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// GetWithRetries sends a GET request to the URL with DoWithRetries
+func GetWithRetries(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DoWithRetries(req)
+}
+
+// PublicHttpClient is used for the requests to URLs given by users. It refuses to connect to loopback, private
+// and link-local addresses, so users cannot reach the services of the network Opengist is running in.
+var PublicHttpClient = &http.Client{
+	Timeout: httpTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: httpTimeout,
+			Control: denyNonPublicAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   httpTimeout,
+		ResponseHeaderTimeout: httpTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("stopped after 5 redirects")
+		}
+		return nil
+	},
+}
+
+var ErrNonPublicAddress = errors.New("connecting to a non public address is not allowed")
+
+// nonPublicNetworks are the ranges not routed on the internet which are not covered by the methods of net.IP
+var nonPublicNetworks = []net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}, // shared address space of carrier-grade NATs
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)}, // benchmarking
+}
+
+// denyNonPublicAddress is checked once the host is resolved, right before connecting to it
+func denyNonPublicAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return ErrNonPublicAddress
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return ErrNonPublicAddress
+		}
+	}
+	return nil
+}
+
+// LoadCACerts adds the PEM certificates of a file, or of all the files of a directory, to the system ones trusted
+// for the outbound TLS connections of the clients of this package.
+func LoadCACerts(path string) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		files = files[:0]
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	loaded := 0
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if pool.AppendCertsFromPEM(pem) {
+			loaded++
+		} else if !info.IsDir() {
+			return fmt.Errorf("no PEM certificate found in %s", file)
+		}
+	}
+
+	if loaded == 0 {
+		return fmt.Errorf("no PEM certificate found in %s", path)
+	}
+
+	tlsConfig := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	HttpClient.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	PublicHttpClient.Transport.(*http.Transport).TLSClientConfig = tlsConfig.Clone()
+	return nil
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetWithRetries(t *testing.T) {
+	defaultDelay := httpRetryDelay
+	httpRetryDelay = time.Millisecond
+	defer func() { httpRetryDelay = defaultDelay }()
+	defer SetHttpClientOptions(httpTimeout, 2)
+
+	var calls, failures int
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	get := func(failing int) int {
+		calls, failures = 0, failing
+		resp, err := GetWithRetries(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the server errors are retried until the request succeeds
+	require.Equal(t, 200, get(2))
+	require.Equal(t, 3, calls)
+
+	// the last response is returned once all the retries failed
+	require.Equal(t, 503, get(3))
+	require.Equal(t, 3, calls)
+
+	SetHttpClientOptions(httpTimeout, 0)
+	require.Equal(t, 503, get(1))
+	require.Equal(t, 1, calls)
+
+	// the client errors are not retried
+	SetHttpClientOptions(httpTimeout, 2)
+	status = http.StatusNotFound
+	require.Equal(t, 404, get(1))
+	require.Equal(t, 1, calls)
+
+	// a provider which does not answer in time fails the request
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer hanging.Close()
+
+	SetHttpClientOptions(50*time.Millisecond, 1)
+	start := time.Now()
+	_, err := GetWithRetries(hanging.URL)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestLoadCACerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer func() {
+		HttpClient.Transport.(*http.Transport).TLSClientConfig = nil
+		PublicHttpClient.Transport.(*http.Transport).TLSClientConfig = nil
+	}()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(certFile, certPem, 0600))
+	invalidFile := filepath.Join(t.TempDir(), "invalid.pem")
+	require.NoError(t, os.WriteFile(invalidFile, []byte("-----BEGIN CERTIFICATE-----\nnot base64\n-----END CERTIFICATE-----\n"), 0600))
+
+	get := func(client *http.Client) error {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	require.Error(t, get(HttpClient))
+
+	require.Error(t, LoadCACerts(invalidFile))
+	require.Error(t, LoadCACerts(filepath.Join(dir, "missing.pem")))
+	require.Error(t, LoadCACerts(t.TempDir()))
+	require.Error(t, get(HttpClient))
+
+	require.NoError(t, LoadCACerts(certFile))
+	require.NoError(t, get(HttpClient))
+	// the other clients of the process do not trust it
+	require.Error(t, get(&http.Client{Timeout: httpTimeout}))
+
+	// the files of a directory which are not certificates are skipped
+	HttpClient.Transport.(*http.Transport).TLSClientConfig = nil
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("CA certificates of the company"), 0600))
+	require.NoError(t, LoadCACerts(dir))
+	require.NoError(t, get(HttpClient))
+}
+
+func TestDenyNonPublicAddress(t *testing.T) {
+	denied := []string{
+		"127.0.0.1:80", "[::1]:80", "0.0.0.0:80", "10.1.2.3:443", "172.16.0.1:443", "192.168.1.1:443",
+		"169.254.169.254:80", "[fe80::1]:80", "[fd00::1]:443", "100.64.0.1:443", "100.127.255.255:443",
+		"198.18.0.1:443", "198.19.255.255:443", "[::ffff:100.64.0.1]:443", "[::ffff:127.0.0.1]:80",
+	}
+	for _, address := range denied {
+		require.ErrorIs(t, denyNonPublicAddress("tcp", address, nil), ErrNonPublicAddress, address)
+	}
+
+	allowed := []string{"1.1.1.1:443", "100.63.255.255:443", "100.128.0.1:443", "198.17.255.255:443", "198.20.0.1:443", "[2606:4700::1111]:443"}
+	for _, address := range allowed {
+		require.NoError(t, denyNonPublicAddress("tcp", address, nil), address)
+	}
+}
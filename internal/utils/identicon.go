@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// AvatarSources are where the avatars of the users without an uploaded or an OAuth provider one come from
+var AvatarSources = []string{"gravatar", "libravatar", "identicon", "disabled"}
+
+const (
+	identiconCells    = 5
+	identiconCellSize = 40
+	identiconMargin   = 25
+)
+
+// Identicon draws a 5x5 symmetric pattern from an MD5 hex hash as a PNG image, the same hash giving the same image
+func Identicon(hash string) ([]byte, error) {
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != 16 {
+		return nil, errors.New("the identicon hash must be an MD5 hex hash")
+	}
+
+	// the color is taken from the end of the hash, the pattern from its beginning
+	fg := color.NRGBA{R: sum[13]/2 + 64, G: sum[14]/2 + 64, B: sum[15]/2 + 64, A: 255}
+	bg := color.NRGBA{R: 240, G: 240, B: 240, A: 255}
+
+	size := identiconCells*identiconCellSize + 2*identiconMargin
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{bg, fg})
+
+	// only the 3 first columns are drawn from the hash, the 2 last mirror the 2 first
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < (identiconCells+1)/2; col++ {
+			nibble := sum[(row*3+col)/2]
+			if (row*3+col)%2 == 0 {
+				nibble >>= 4
+			}
+			if nibble&1 == 0 {
+				continue
+			}
+			fillIdenticonCell(img, row, col)
+			fillIdenticonCell(img, row, identiconCells-1-col)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func fillIdenticonCell(img *image.Paletted, row int, col int) {
+	x0 := identiconMargin + col*identiconCellSize
+	y0 := identiconMargin + row*identiconCellSize
+	for y := y0; y < y0+identiconCellSize; y++ {
+		for x := x0; x < x0+identiconCellSize; x++ {
+			img.SetColorIndex(x, y, 1)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ListingColumns are the metadata that can be shown for each gist of the listings
+var ListingColumns = []string{"likes", "forks", "files", "language", "created"}
+
+// Themes are the color schemes of the UI a user can choose instead of the one of their system
+var Themes = []string{"light", "dark"}
+
+// CloneProtocols are the protocols of the clone URL a user can have shown first on the gists
+var CloneProtocols = []string{"http", "ssh"}
+
+// ListingDensities are the layouts of the listings, compact ones leave out the code previews
+var ListingDensities = []string{"comfortable", "compact"}
+
+// ParseListingColumns parses a comma separated list of ListingColumns, "none" meaning no column at all
+func ParseListingColumns(columns string) ([]string, error) {
+	parsed := make([]string, 0, len(ListingColumns))
+	if strings.TrimSpace(columns) == "none" {
+		return parsed, nil
+	}
+
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		if !slices.Contains(ListingColumns, column) {
+			return nil, fmt.Errorf("unknown listing column %q", column)
+		}
+		if !slices.Contains(parsed, column) {
+			parsed = append(parsed, column)
+		}
+	}
+	return parsed, nil
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// PasswordRules are the rules the new passwords of the users must follow
+type PasswordRules struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	BreachCheck      bool
+}
+
+// PasswordPolicy returns the rules of the instance. The configuration cannot be read from this package, so it is set
+// by the web server.
+var PasswordPolicy = func() PasswordRules {
+	return PasswordRules{}
+}
+
+// PwnedPasswordsUrl is the range API of Have I Been Pwned, only the first 5 characters of the SHA-1 hash of a
+// password are sent to it
+var PwnedPasswordsUrl = "https://api.pwnedpasswords.com/range/"
+
+func validatePasswordLength(fl validator.FieldLevel) bool {
+	return len([]rune(fl.Field().String())) >= PasswordPolicy().MinLength
+}
+
+func validatePasswordCase(fl validator.FieldLevel) bool {
+	if !PasswordPolicy().RequireMixedCase {
+		return true
+	}
+	password := fl.Field().String()
+	return strings.IndexFunc(password, unicode.IsUpper) >= 0 && strings.IndexFunc(password, unicode.IsLower) >= 0
+}
+
+func validatePasswordDigit(fl validator.FieldLevel) bool {
+	return !PasswordPolicy().RequireDigit || strings.IndexFunc(fl.Field().String(), unicode.IsDigit) >= 0
+}
+
+func validatePasswordSymbol(fl validator.FieldLevel) bool {
+	return !PasswordPolicy().RequireSymbol || strings.IndexFunc(fl.Field().String(), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	}) >= 0
+}
+
+func validateNotBreached(fl validator.FieldLevel) bool {
+	if !PasswordPolicy().BreachCheck {
+		return true
+	}
+
+	breached, err := IsPasswordBreached(fl.Field().String())
+	if err != nil {
+		// the users are not kept from choosing a password while the service cannot be reached
+		log.Warn().Err(err).Msg("Cannot check if the password was breached")
+		return true
+	}
+	return !breached
+}
+
+// IsPasswordBreached reports whether the password appears in the known data breaches, using the k-anonymity model of
+// Have I Been Pwned
+func IsPasswordBreached(password string) (bool, error) {
+	hash := fmt.Sprintf("%X", sha1.Sum([]byte(password)))
+	prefix, suffix := hash[:5], hash[5:]
+
+	resp, err := HttpClient.Get(PwnedPasswordsUrl + prefix)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// each line is the suffix of a hash and the number of times it was seen, "SUFFIX:COUNT"
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lineSuffix, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if found && strings.EqualFold(lineSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
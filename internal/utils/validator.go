@@ -16,6 +16,11 @@ func NewValidator() *OpengistValidator {
 	_ = v.RegisterValidation("notreserved", validateReservedKeywords)
 	_ = v.RegisterValidation("alphanumdash", validateAlphaNumDash)
 	_ = v.RegisterValidation("alphanumdashorempty", validateAlphaNumDashOrEmpty)
+	_ = v.RegisterValidation("passwordlength", validatePasswordLength)
+	_ = v.RegisterValidation("passwordcase", validatePasswordCase)
+	_ = v.RegisterValidation("passworddigit", validatePasswordDigit)
+	_ = v.RegisterValidation("passwordsymbol", validatePasswordSymbol)
+	_ = v.RegisterValidation("notbreached", validateNotBreached)
 	return &OpengistValidator{v}
 }
 
@@ -46,24 +51,41 @@ func ValidationMessages(err *error, locale *i18n.Locale) string {
 		case "min":
 			messages[i] = locale.String("validation.not-enough", e.Field())
 		case "notreserved":
-			messages[i] = locale.String("validation.invalid", e.Field())
+			messages[i] = locale.String("validation.reserved", e.Field())
+		case "passwordlength":
+			messages[i] = locale.String("validation.password-too-short", PasswordPolicy().MinLength)
+		case "passwordcase":
+			messages[i] = locale.String("validation.password-mixed-case")
+		case "passworddigit":
+			messages[i] = locale.String("validation.password-digit")
+		case "passwordsymbol":
+			messages[i] = locale.String("validation.password-symbol")
+		case "notbreached":
+			messages[i] = locale.String("validation.password-breached")
 		}
 	}
 
 	return strings.Join(messages, " ; ")
 }
 
-func validateReservedKeywords(fl validator.FieldLevel) bool {
-	name := fl.Field().String()
+// ReservedUsernames returns the names the users and the organizations cannot take. The configuration cannot be read
+// from this package, so it is set by the web server.
+var ReservedUsernames = func() []string {
+	return nil
+}
 
-	restrictedNames := map[string]struct{}{}
-	for _, restrictedName := range []string{"assets", "register", "login", "logout", "settings", "admin-panel", "all", "search", "init", "healthcheck", "preview"} {
-		restrictedNames[restrictedName] = struct{}{}
+// IsReservedUsername reports whether the name is reserved, whatever its case
+func IsReservedUsername(name string) bool {
+	for _, reserved := range ReservedUsernames() {
+		if strings.EqualFold(reserved, name) {
+			return true
+		}
 	}
+	return false
+}
 
-	// if the name is not in the restricted names, it is valid
-	_, ok := restrictedNames[name]
-	return !ok
+func validateReservedKeywords(fl validator.FieldLevel) bool {
+	return !IsReservedUsername(fl.Field().String())
 }
 
 func validateAlphaNumDash(fl validator.FieldLevel) bool {
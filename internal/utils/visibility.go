@@ -0,0 +1,4 @@
+package utils
+
+// Visibilities are the names of the visibilities a gist can be given, from the most to the least open
+var Visibilities = []string{"public", "unlisted", "private"}
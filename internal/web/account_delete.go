@@ -0,0 +1,140 @@
+package web
+
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+const (
+	// session key holding the provider the user signs in again with before deleting their account
+	accountDeleteReauthSessionKey = "accountDeleteReauth"
+	// session key holding when the user signed in again with the provider
+	accountDeleteReauthAtSessionKey = "accountDeleteReauthAt"
+	// accountDeleteReauthTtl is how long the user has to delete their account once signed in again
+	accountDeleteReauthTtl = 5 * time.Minute
+)
+
+// accountDelete shows the confirmation of the deletion of the account, asking for the password of the user, or for
+// them to sign in again with one of their providers if they have none
+func accountDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	var providers []namedProvider
+	for _, provider := range allOAuthProviders() {
+		if isProviderLinked(user, provider) && isOAuthProviderEnabled(ctx, provider) {
+			providers = append(providers, namedProvider{Provider: provider, Name: oauthProviderName(provider)})
+		}
+	}
+
+	keepsAdmin, err := keepsAnAdmin([]*db.User{user})
+	if err != nil {
+		return errorRes(500, "Cannot count admins", err)
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "settings.delete-account"))
+	setData(ctx, "hasPassword", user.Password != "")
+	setData(ctx, "providers", providers)
+	setData(ctx, "reauthenticated", isAccountDeleteReauthenticated(ctx))
+	setData(ctx, "lastAdmin", !keepsAdmin)
+	return html(ctx, "settings_account_delete.html")
+}
+
+// accountDeleteProcess deletes the account of the user once they confirmed their identity and typed their username.
+// The gists are deleted from the disk and the index in the background.
+func accountDeleteProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	if ok, err := keepsAnAdmin([]*db.User{user}); err != nil || !ok {
+		if err != nil {
+			return errorRes(500, "Cannot count admins", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.delete-account-last-admin"), "error")
+		return redirect(ctx, "/settings/account/delete")
+	}
+
+	if ctx.FormValue("username") != user.Username {
+		addFlash(ctx, tr(ctx, "flash.user.delete-account-wrong-username"), "error")
+		return redirect(ctx, "/settings/account/delete")
+	}
+
+	if user.Password != "" {
+		ok, err := utils.Argon2id.Verify(ctx.FormValue("password"), user.Password)
+		if err != nil {
+			return errorRes(500, "Cannot check password", err)
+		}
+		if !ok {
+			authWarn(ctx, "account-delete-failed", user.Username).Msg("Invalid password to delete the account")
+			addFlash(ctx, tr(ctx, "flash.user.delete-account-wrong-password"), "error")
+			return redirect(ctx, "/settings/account/delete")
+		}
+	} else if !isAccountDeleteReauthenticated(ctx) {
+		addFlash(ctx, tr(ctx, "flash.user.delete-account-reauth"), "error")
+		return redirect(ctx, "/settings/account/delete")
+	}
+
+	cleanup, err := user.DeleteDeferringCleanup()
+	if err != nil {
+		return errorRes(500, "Cannot delete this user", err)
+	}
+	deleteAvatar(user)
+	audit(ctx, db.AuditAccountDelete, user, "")
+
+	go func(username string) {
+		if err := cleanup(); err != nil {
+			log.Error().Err(err).Msg("Cannot delete the repositories of " + username)
+		}
+	}(user.Username)
+
+	deleteSession(ctx)
+	deleteCsrfCookie(ctx)
+	addFlash(ctx, tr(ctx, "flash.user.account-deleted"), "success")
+	return redirect(ctx, "/all")
+}
+
+// startAccountDeleteReauth marks the session of the logged user so that signing in again with the provider confirms
+// the deletion of their account. Only a provider linked to the user can be used.
+func startAccountDeleteReauth(ctx echo.Context, provider string) bool {
+	currUser := getUserLogged(ctx)
+	if currUser == nil || !isProviderLinked(currUser, provider) {
+		return false
+	}
+
+	sess := getSession(ctx)
+	sess.Values[accountDeleteReauthSessionKey] = provider
+	delete(sess.Values, accountDeleteReauthAtSessionKey)
+	saveSession(sess, ctx)
+	return true
+}
+
+func popAccountDeleteReauth(ctx echo.Context) string {
+	sess := getSession(ctx)
+	provider, _ := sess.Values[accountDeleteReauthSessionKey].(string)
+	if provider != "" {
+		delete(sess.Values, accountDeleteReauthSessionKey)
+		saveSession(sess, ctx)
+	}
+	return provider
+}
+
+// accountDeleteReauthCallback records that the logged user signed in again, if they did with their own account
+func accountDeleteReauthCallback(ctx echo.Context, currUser *db.User, provider string, providerUserId string) error {
+	user, err := db.GetUserByProvider(providerUserId, provider)
+	if err != nil || user.ID != currUser.ID {
+		addFlash(ctx, tr(ctx, "flash.user.delete-account-wrong-account"), "error")
+		return redirect(ctx, "/settings/account/delete")
+	}
+
+	sess := getSession(ctx)
+	sess.Values[accountDeleteReauthAtSessionKey] = time.Now().Unix()
+	saveSession(sess, ctx)
+	return redirect(ctx, "/settings/account/delete")
+}
+
+func isAccountDeleteReauthenticated(ctx echo.Context) bool {
+	at, ok := getSession(ctx).Values[accountDeleteReauthAtSessionKey].(int64)
+	return ok && time.Since(time.Unix(at, 0)) < accountDeleteReauthTtl
+}
@@ -1,13 +1,20 @@
 package web
 
 import (
+	"errors"
+	"github.com/dustin/go-humanize"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/actions"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/email"
 	"github.com/thomiceli/opengist/internal/git"
+	"gorm.io/gorm"
+	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -41,12 +48,24 @@ func adminIndex(ctx echo.Context) error {
 	}
 	setData(ctx, "countKeys", countKeys)
 
+	if config.C.UniqueEmails {
+		duplicateEmails, err := db.GetDuplicateEmails()
+		if err != nil {
+			return errorRes(500, "Cannot get duplicate emails", err)
+		}
+		setData(ctx, "duplicateEmails", duplicateEmails)
+	}
+
 	setData(ctx, "syncReposFromFS", actions.IsRunning(actions.SyncReposFromFS))
 	setData(ctx, "syncReposFromDB", actions.IsRunning(actions.SyncReposFromDB))
 	setData(ctx, "gitGcRepos", actions.IsRunning(actions.GitGcRepos))
 	setData(ctx, "syncGistPreviews", actions.IsRunning(actions.SyncGistPreviews))
 	setData(ctx, "resetHooks", actions.IsRunning(actions.ResetHooks))
 	setData(ctx, "indexGists", actions.IsRunning(actions.IndexGists))
+	setData(ctx, "deleteExpiredGists", actions.IsRunning(actions.DeleteExpiredGists))
+	setData(ctx, "deleteUnverifiedUsers", actions.IsRunning(actions.DeleteUnverifiedUsers))
+	setData(ctx, "backup", actions.IsRunning(actions.Backup))
+	setData(ctx, "lastBackup", actions.LastBackup())
 	return html(ctx, "admin_index.html")
 }
 
@@ -73,19 +92,164 @@ func adminGists(ctx echo.Context) error {
 	setData(ctx, "adminHeaderPage", "gists")
 	pageInt := getPage(ctx)
 
+	filter, params, err := adminGistFilter(ctx)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
 	var data []*db.Gist
-	var err error
-	if data, err = db.GetAllGists(pageInt - 1); err != nil {
+	if data, err = db.GetAllGistsForAdmin(filter, pageInt-1); err != nil {
 		return errorRes(500, "Cannot get gists", err)
 	}
 
-	if err = paginate(ctx, data, pageInt, 10, "data", "admin-panel/gists", 1); err != nil {
+	urlParams := ""
+	if len(params) > 0 {
+		urlParams = "&" + params.Encode()
+	}
+	if err = paginate(ctx, data, pageInt, 10, "data", "admin-panel/gists", 1, urlParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
+	setData(ctx, "filter", params)
 	return html(ctx, "admin_gists.html")
 }
 
+// adminGistFilter reads the filters of the admin gists page from the query, and returns them along with the
+// parameters set, to keep them in the pagination links
+func adminGistFilter(ctx echo.Context) (db.AdminGistFilter, url.Values, error) {
+	var filter db.AdminGistFilter
+	params := url.Values{}
+	for _, name := range []string{"owner", "visibility", "language", "min-size", "from", "to", "sort", "order"} {
+		if value := strings.TrimSpace(ctx.QueryParam(name)); value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	filter.Owner = params.Get("owner")
+	filter.Language = params.Get("language")
+	filter.Sort = params.Get("sort")
+	filter.Order = params.Get("order")
+
+	if params.Has("visibility") {
+		visibility, err := db.ParseVisibility(params.Get("visibility"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.Visibility = &visibility
+	}
+
+	if params.Has("min-size") {
+		size, err := humanize.ParseBytes(params.Get("min-size"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.MinSize = size
+	}
+
+	// dates of the form inputs, the end date is included
+	if params.Has("from") {
+		from, err := time.Parse(time.DateOnly, params.Get("from"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.CreatedAfter = from.Unix()
+	}
+	if params.Has("to") {
+		to, err := time.Parse(time.DateOnly, params.Get("to"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.CreatedBefore = to.AddDate(0, 0, 1).Unix()
+	}
+
+	return filter, params, nil
+}
+
+func adminGistHide(ctx echo.Context) error {
+	gist, err := db.GetGistByID(ctx.Param("gist"))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve gist", err)
+	}
+
+	gist.Private = db.PrivateVisibility
+	if err = gist.UpdateNoTimestamps(); err != nil {
+		return errorRes(500, "Cannot hide this gist", err)
+	}
+
+	gist.AddInIndex()
+	audit(ctx, db.AuditAdminGistHide, nil, gist.User.Username+"/"+gist.Identifier())
+
+	addFlash(ctx, tr(ctx, "flash.admin.gist-hidden"), "success")
+	return redirect(ctx, "/admin-panel/gists")
+}
+
+// adminGistShareTemplate shares a template with the whole instance, or keeps it to its owner again
+func adminGistShareTemplate(ctx echo.Context) error {
+	gist, err := db.GetGistByID(ctx.Param("gist"))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve gist", err)
+	}
+
+	if !gist.IsTemplate {
+		addFlash(ctx, tr(ctx, "flash.admin.gist-not-template"), "error")
+		return redirect(ctx, "/admin-panel/gists")
+	}
+
+	if err = gist.SetTemplateShared(!gist.TemplateShared); err != nil {
+		return errorRes(500, "Cannot share this template", err)
+	}
+	audit(ctx, db.AuditAdminTemplateShare, nil, gist.User.Username+"/"+gist.Identifier())
+
+	if gist.TemplateShared {
+		addFlash(ctx, tr(ctx, "flash.admin.template-shared"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.admin.template-unshared"), "success")
+	}
+	return redirect(ctx, "/admin-panel/gists")
+}
+
+func adminGistTransfer(ctx echo.Context) error {
+	gist, err := db.GetGistByID(ctx.Param("gist"))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve gist", err)
+	}
+
+	user, err := db.GetUserByUsername(strings.TrimSpace(ctx.FormValue("username")))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot retrieve user", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.admin.gist-transfer-unknown-user"), "error")
+		return redirect(ctx, "/admin-panel/gists")
+	}
+
+	if user.ID == gist.UserID {
+		return redirect(ctx, "/admin-panel/gists")
+	}
+
+	if gist.URL != "" {
+		exists, err := db.GistURLExistsForUser(gist.URL, user.ID)
+		if err != nil {
+			return errorRes(500, "Cannot check the gist URL", err)
+		}
+		if exists {
+			addFlash(ctx, tr(ctx, "flash.admin.gist-transfer-url-exists"), "error")
+			return redirect(ctx, "/admin-panel/gists")
+		}
+	}
+
+	from := gist.User.Username + "/" + gist.Identifier()
+	if err = gist.TransferTo(user); err != nil {
+		return errorRes(500, "Cannot transfer this gist", err)
+	}
+
+	gist.AddInIndex()
+	audit(ctx, db.AuditAdminGistTransfer, nil, from+" -> "+user.Username)
+
+	addFlash(ctx, tr(ctx, "flash.admin.gist-transferred", user.Username), "success")
+	return redirect(ctx, "/admin-panel/gists")
+}
+
 func adminUserDelete(ctx echo.Context) error {
 	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
 	user, err := db.GetUserById(uint(userId))
@@ -93,14 +257,289 @@ func adminUserDelete(ctx echo.Context) error {
 		return errorRes(500, "Cannot retrieve user", err)
 	}
 
+	if ok, err := keepsAnAdmin([]*db.User{user}); err != nil || !ok {
+		if err != nil {
+			return errorRes(500, "Cannot count admins", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.admin.users-last-admin"), "error")
+		return redirect(ctx, "/admin-panel/users")
+	}
+
 	if err := user.Delete(); err != nil {
 		return errorRes(500, "Cannot delete this user", err)
 	}
+	deleteAvatar(user)
+	audit(ctx, db.AuditAdminUserDelete, nil, user.Username)
 
 	addFlash(ctx, tr(ctx, "flash.admin.user-deleted"), "success")
 	return redirect(ctx, "/admin-panel/users")
 }
 
+// adminUsersBulk applies an action to the users selected in the list. The users and the action are first shown to the
+// admin, who has to confirm them.
+func adminUsersBulk(ctx echo.Context) error {
+	action := ctx.FormValue("action")
+	switch action {
+	case "delete", "grant-admin", "revoke-admin", "disable", "enable":
+	default:
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+
+	var userIds []uint
+	for _, id := range ctx.Request().PostForm["user"] {
+		userId, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.invalid-number"), err)
+		}
+		userIds = append(userIds, uint(userId))
+	}
+
+	users, err := db.GetUsersByIds(userIds)
+	if err != nil {
+		return errorRes(500, "Cannot retrieve users", err)
+	}
+	if len(users) == 0 {
+		addFlash(ctx, tr(ctx, "flash.admin.users-none-selected"), "error")
+		return redirect(ctx, "/admin-panel/users")
+	}
+
+	if action == "delete" || action == "revoke-admin" || action == "disable" {
+		if ok, err := keepsAnAdmin(users); err != nil || !ok {
+			if err != nil {
+				return errorRes(500, "Cannot count admins", err)
+			}
+			addFlash(ctx, tr(ctx, "flash.admin.users-last-admin"), "error")
+			return redirect(ctx, "/admin-panel/users")
+		}
+	}
+
+	if ctx.FormValue("confirm") != "1" {
+		setData(ctx, "htmlTitle", trH(ctx, "admin.users")+" - "+trH(ctx, "admin.admin_panel"))
+		setData(ctx, "adminHeaderPage", "users")
+		setData(ctx, "users", users)
+		setData(ctx, "action", action)
+		return html(ctx, "admin_users_bulk.html")
+	}
+
+	for _, user := range users {
+		switch action {
+		case "delete":
+			if err = user.Delete(); err != nil {
+				return errorRes(500, "Cannot delete this user", err)
+			}
+			deleteAvatar(user)
+			audit(ctx, db.AuditAdminUserDelete, nil, user.Username)
+		case "grant-admin":
+			if err = user.SetAdmin(); err != nil {
+				return errorRes(500, "Cannot grant admin rights", err)
+			}
+			audit(ctx, db.AuditAdminUserAdmin, nil, user.Username+"=true")
+		case "revoke-admin":
+			if err = user.RevokeAdmin(); err != nil {
+				return errorRes(500, "Cannot revoke admin rights", err)
+			}
+			audit(ctx, db.AuditAdminUserAdmin, nil, user.Username+"=false")
+		case "disable", "enable":
+			if err = user.SetDisabled(action == "disable"); err != nil {
+				return errorRes(500, "Cannot disable this user", err)
+			}
+			audit(ctx, db.AuditAdminUserDisable, nil, user.Username+"="+strconv.FormatBool(user.Disabled))
+		}
+	}
+
+	addFlash(ctx, tr(ctx, "flash.admin.users-bulk-"+action, len(users)), "success")
+	return redirect(ctx, "/admin-panel/users")
+}
+
+// adminUserDisable prevents the user from logging in, or allows them again
+func adminUserDisable(ctx echo.Context) error {
+	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve user", err)
+	}
+
+	disabled := ctx.FormValue("disabled") == "true"
+	if disabled {
+		if ok, err := keepsAnAdmin([]*db.User{user}); err != nil || !ok {
+			if err != nil {
+				return errorRes(500, "Cannot count admins", err)
+			}
+			addFlash(ctx, tr(ctx, "flash.admin.users-last-admin"), "error")
+			return redirect(ctx, "/admin-panel/users")
+		}
+	}
+
+	if err = user.SetDisabled(disabled); err != nil {
+		return errorRes(500, "Cannot disable this user", err)
+	}
+	audit(ctx, db.AuditAdminUserDisable, nil, user.Username+"="+strconv.FormatBool(disabled))
+
+	if disabled {
+		addFlash(ctx, tr(ctx, "flash.admin.user-disabled", user.Username), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.admin.user-enabled", user.Username), "success")
+	}
+	return redirect(ctx, "/admin-panel/users")
+}
+
+// adminSignups lists the accounts waiting for an admin to approve their signup
+func adminSignups(ctx echo.Context) error {
+	users, err := db.GetPendingUsers()
+	if err != nil {
+		return errorRes(500, "Cannot get pending users", err)
+	}
+
+	setData(ctx, "htmlTitle", trH(ctx, "admin.signups")+" - "+trH(ctx, "admin.admin_panel"))
+	setData(ctx, "adminHeaderPage", "signups")
+	setData(ctx, "users", users)
+	setData(ctx, "emailEnabled", email.Enabled())
+	return html(ctx, "admin_signups.html")
+}
+
+func pendingUser(ctx echo.Context) (*db.User, error) {
+	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !user.PendingApproval) {
+		return nil, notFound("User not found")
+	} else if err != nil {
+		return nil, errorRes(500, "Cannot retrieve user", err)
+	}
+	return user, nil
+}
+
+// adminSignupApprove allows the account to log in, and tells its user by email if asked
+func adminSignupApprove(ctx echo.Context) error {
+	user, err := pendingUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = user.Approve(); err != nil {
+		return errorRes(500, "Cannot approve this user", err)
+	}
+	audit(ctx, db.AuditAdminSignupApprove, nil, user.Username)
+
+	if ctx.FormValue("notify") == "1" && user.Email != "" && email.Enabled() {
+		subject := tr(ctx, "email.signup-approved.subject")
+		body := tr(ctx, "email.signup-approved.body", user.Username, urlJoin(getData(ctx, "baseHttpUrl").(string), "/login"))
+		go func(to string) {
+			if err := email.Send(to, subject, body); err != nil {
+				log.Error().Err(err).Msg("Cannot send signup approval")
+			}
+		}(user.Email)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.admin.signup-approved", user.Username), "success")
+	return redirect(ctx, "/admin-panel/signups")
+}
+
+// adminSignupReject deletes the account waiting for the approval of its signup
+func adminSignupReject(ctx echo.Context) error {
+	user, err := pendingUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = user.Delete(); err != nil {
+		return errorRes(500, "Cannot delete this user", err)
+	}
+	deleteAvatar(user)
+	audit(ctx, db.AuditAdminSignupReject, nil, user.Username)
+
+	addFlash(ctx, tr(ctx, "flash.admin.signup-rejected", user.Username), "success")
+	return redirect(ctx, "/admin-panel/signups")
+}
+
+// keepsAnAdmin reports whether an admin able to log in remains once the users are deleted, disabled or no longer
+// admins
+func keepsAnAdmin(users []*db.User) (bool, error) {
+	count, err := db.CountAdmins()
+	if err != nil {
+		return false, err
+	}
+	for _, user := range users {
+		if user.IsAdmin && !user.Disabled {
+			count--
+		}
+	}
+	return count > 0, nil
+}
+
+// adminUserApiRateLimit overrides the API rate limit of the instance for the user, an empty limit going back to it
+func adminUserApiRateLimit(ctx echo.Context) error {
+	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve user", err)
+	}
+
+	var limit *int
+	value := strings.TrimSpace(ctx.FormValue("limit"))
+	if value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			addFlash(ctx, tr(ctx, "flash.admin.user-api-rate-limit-invalid"), "error")
+			return redirect(ctx, "/admin-panel/users")
+		}
+		limit = &n
+	} else {
+		value = "default"
+	}
+
+	if err = user.SetApiRateLimit(limit); err != nil {
+		return errorRes(500, "Cannot set the API rate limit", err)
+	}
+	audit(ctx, db.AuditAdminUserRateLimit, nil, user.Username+"="+value)
+
+	addFlash(ctx, tr(ctx, "flash.admin.user-api-rate-limit-set", user.Username), "success")
+	return redirect(ctx, "/admin-panel/users")
+}
+
+// adminUserImpersonate makes the admin browse as the user, the session staying the one of the admin
+func adminUserImpersonate(ctx echo.Context) error {
+	admin := getUserLogged(ctx)
+	userId, _ := strconv.ParseUint(ctx.Param("user"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		return errorRes(500, "Cannot retrieve user", err)
+	}
+
+	if !canImpersonate(admin, user) {
+		addFlash(ctx, tr(ctx, "flash.admin.user-impersonate-forbidden"), "error")
+		return redirect(ctx, "/admin-panel/users")
+	}
+
+	sess := getSession(ctx)
+	sess.Values["impersonatedUser"] = user.ID
+	saveSession(sess, ctx)
+	audit(ctx, db.AuditAdminImpersonate, admin, user.Username)
+
+	addFlash(ctx, tr(ctx, "flash.admin.user-impersonated", user.Username), "success")
+	return redirect(ctx, "/")
+}
+
+func stopImpersonating(ctx echo.Context) error {
+	impersonator := getImpersonator(ctx)
+	if impersonator == nil {
+		return redirect(ctx, "/")
+	}
+
+	sess := getSession(ctx)
+	delete(sess.Values, "impersonatedUser")
+	saveSession(sess, ctx)
+	audit(ctx, db.AuditAdminImpersonateStop, impersonator, getUserLogged(ctx).Username)
+
+	return redirect(ctx, "/admin-panel/users")
+}
+
+// canImpersonate reports whether the admin can browse as the user. The other admins can only be impersonated if the
+// configuration allows it, and the organizations cannot be logged in as.
+func canImpersonate(admin *db.User, user *db.User) bool {
+	return admin.IsAdmin && admin.ID != user.ID && !user.IsOrganization &&
+		(!user.IsAdmin || config.C.AdminImpersonateAdmins)
+}
+
 func adminGistDelete(ctx echo.Context) error {
 	gist, err := db.GetGistByID(ctx.Param("gist"))
 	if err != nil {
@@ -116,6 +555,7 @@ func adminGistDelete(ctx echo.Context) error {
 	}
 
 	gist.RemoveFromIndex()
+	audit(ctx, db.AuditAdminGistDelete, nil, gist.User.Username+"/"+gist.Identifier())
 
 	addFlash(ctx, tr(ctx, "flash.admin.gist-deleted"), "success")
 	return redirect(ctx, "/admin-panel/gists")
@@ -124,42 +564,70 @@ func adminGistDelete(ctx echo.Context) error {
 func adminSyncReposFromFS(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.sync-fs"), "success")
 	go actions.Run(actions.SyncReposFromFS)
+	audit(ctx, db.AuditAdminAction, nil, "sync-fs")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminSyncReposFromDB(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.sync-db"), "success")
 	go actions.Run(actions.SyncReposFromDB)
+	audit(ctx, db.AuditAdminAction, nil, "sync-db")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminGcRepos(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.git-gc"), "success")
 	go actions.Run(actions.GitGcRepos)
+	audit(ctx, db.AuditAdminAction, nil, "gc-repos")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminSyncGistPreviews(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.sync-previews"), "success")
 	go actions.Run(actions.SyncGistPreviews)
+	audit(ctx, db.AuditAdminAction, nil, "sync-previews")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminResetHooks(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.reset-hooks"), "success")
 	go actions.Run(actions.ResetHooks)
+	audit(ctx, db.AuditAdminAction, nil, "reset-hooks")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminIndexGists(ctx echo.Context) error {
 	addFlash(ctx, tr(ctx, "flash.admin.index-gists"), "success")
 	go actions.Run(actions.IndexGists)
+	audit(ctx, db.AuditAdminAction, nil, "index-gists")
+	return redirect(ctx, "/admin-panel")
+}
+
+func adminDeleteExpiredGists(ctx echo.Context) error {
+	addFlash(ctx, tr(ctx, "flash.admin.delete-expired-gists"), "success")
+	go actions.Run(actions.DeleteExpiredGists)
+	audit(ctx, db.AuditAdminAction, nil, "delete-expired-gists")
+	return redirect(ctx, "/admin-panel")
+}
+
+func adminDeleteUnverifiedUsers(ctx echo.Context) error {
+	addFlash(ctx, tr(ctx, "flash.admin.delete-unverified-users"), "success")
+	go actions.Run(actions.DeleteUnverifiedUsers)
+	audit(ctx, db.AuditAdminAction, nil, "delete-unverified-users")
+	return redirect(ctx, "/admin-panel")
+}
+
+func adminBackup(ctx echo.Context) error {
+	addFlash(ctx, tr(ctx, "flash.admin.backup"), "success")
+	go actions.Run(actions.Backup)
+	audit(ctx, db.AuditAdminAction, nil, "backup")
 	return redirect(ctx, "/admin-panel")
 }
 
 func adminConfig(ctx echo.Context) error {
 	setData(ctx, "htmlTitle", trH(ctx, "admin.configuration")+" - "+trH(ctx, "admin.admin_panel"))
 	setData(ctx, "adminHeaderPage", "config")
+	setData(ctx, "oauthProviders", configuredOAuthProviders(ctx))
 
 	return html(ctx, "admin_config.html")
 }
@@ -171,6 +639,7 @@ func adminSetConfig(ctx echo.Context) error {
 	if err := db.UpdateSetting(key, value); err != nil {
 		return errorRes(500, "Cannot set setting", err)
 	}
+	audit(ctx, db.AuditAdminSetting, nil, key+"="+value)
 
 	return ctx.JSON(200, map[string]interface{}{
 		"success": true,
@@ -212,6 +681,7 @@ func adminInvitationsCreate(ctx echo.Context) error {
 	if err := invitation.Create(); err != nil {
 		return errorRes(500, "Cannot create invitation", err)
 	}
+	audit(ctx, db.AuditAdminInvitationCreate, nil, invitation.Code)
 
 	addFlash(ctx, tr(ctx, "flash.admin.invitation-created"), "success")
 	return redirect(ctx, "/admin-panel/invitations")
@@ -227,6 +697,7 @@ func adminInvitationsDelete(ctx echo.Context) error {
 	if err := invitation.Delete(); err != nil {
 		return errorRes(500, "Cannot delete this invitation", err)
 	}
+	audit(ctx, db.AuditAdminInvitationDelete, nil, invitation.Code)
 
 	addFlash(ctx, tr(ctx, "flash.admin.invitation-deleted"), "success")
 	return redirect(ctx, "/admin-panel/invitations")
@@ -0,0 +1,373 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/utils"
+	"gorm.io/gorm"
+)
+
+const apiPrefix = "/api/v1"
+
+type apiGist struct {
+	Owner       string    `json:"owner"`
+	ID          string    `json:"id"`
+	Uuid        string    `json:"uuid"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
+	Tags        []string  `json:"tags"`
+	HtmlURL     string    `json:"html_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Files       []apiFile `json:"files,omitempty"`
+}
+
+type apiFile struct {
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+// apiGistRequest is the body of the requests creating or updating a gist. The fields left out are not changed by an
+// update, and the files given replace all the files of the gist.
+type apiGistRequest struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	URL         *string   `json:"url"`
+	Visibility  *string   `json:"visibility"`
+	Expiry      *string   `json:"expiry"`
+	Tags        []string  `json:"tags"`
+	Files       []apiFile `json:"files"`
+}
+
+func isApiRequest(ctx echo.Context) bool {
+	return strings.HasPrefix(ctx.Request().URL.Path, apiPrefix+"/")
+}
+
+// apiAuth authenticates the request with the API token of the Authorization header and logs its user in. The cookie
+// session is ignored, as the API is not protected against CSRF.
+func apiAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		setData(ctx, "userLogged", nil)
+		setData(ctx, "impersonator", nil)
+
+		value, ok := strings.CutPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || value == "" {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return errorRes(401, tr(ctx, "error.api-token-required"), nil)
+		}
+
+		apiToken, err := db.GetApiTokenByValue(strings.TrimSpace(value))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return errorRes(401, tr(ctx, "error.api-token-invalid"), nil)
+			}
+			return errorRes(500, "Cannot get API token", err)
+		}
+
+		if !apiToken.User.CanLogIn() {
+			return errorRes(403, tr(ctx, "error.account-disabled"), nil)
+		}
+
+		if err = apiToken.Touch(); err != nil {
+			log.Error().Err(err).Msg("Cannot update API token")
+		}
+
+		setData(ctx, "apiToken", apiToken)
+		setData(ctx, "userLogged", &apiToken.User)
+		return next(ctx)
+	}
+}
+
+// apiScope makes the routes require a token with the scope
+func apiScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !getData(ctx, "apiToken").(*db.ApiToken).HasScope(scope) {
+				return errorRes(403, tr(ctx, "error.api-token-scope", scope), nil)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// apiGistInit loads the gist of the route, with the same access rules as the web pages. The password of a protected
+// gist cannot be given to the API, so only its owner can read it.
+func apiGistInit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		currUser := getUserLogged(ctx)
+
+		gist, err := db.GetGist(ctx.Param("user"), ctx.Param("gistname"))
+		if err != nil {
+			return notFound("Gist not found")
+		}
+
+		if gist.Private == db.PrivateVisibility && !gist.CanWrite(currUser) {
+			return notFound("Gist not found")
+		}
+
+		if gist.IsExpired() {
+			return notFound("Gist not found")
+		}
+
+		if gist.IsProtected() && !gist.CanWrite(currUser) {
+			return errorRes(403, tr(ctx, "error.api-gist-protected"), nil)
+		}
+
+		setData(ctx, "gist", gist)
+		return next(ctx)
+	}
+}
+
+func apiWritePermission(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if !getData(ctx, "gist").(*db.Gist).CanWrite(getUserLogged(ctx)) {
+			return errorRes(403, tr(ctx, "error.forbidden"), nil)
+		}
+		return next(ctx)
+	}
+}
+
+// apiManagePermission keeps the deletion and the settings of the gist to the users managing it, not its collaborators
+func apiManagePermission(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if !getData(ctx, "gist").(*db.Gist).CanManage(getUserLogged(ctx)) {
+			return errorRes(403, tr(ctx, "error.forbidden"), nil)
+		}
+		return next(ctx)
+	}
+}
+
+func apiListGists(ctx echo.Context) error {
+	fromUser, err := db.GetUserByUsername(ctx.Param("user"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notFound("User not found")
+		}
+		return errorRes(500, "Error fetching user", err)
+	}
+
+	pageInt := getPage(ctx)
+	if pageInt < 1 {
+		pageInt = 1
+	}
+
+	gists, err := db.GetAllGistsFromUser(fromUser.ID, getUserLogged(ctx).ID, ctx.QueryParam("tag"), pageInt-1, "created", "desc")
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	if len(gists) > 10 {
+		gists = gists[:10]
+		ctx.Response().Header().Set("Link", fmt.Sprintf(`<%s%s/users/%s/gists?page=%d>; rel="next"`,
+			getData(ctx, "baseHttpUrl").(string), apiPrefix, fromUser.Username, pageInt+1))
+	}
+
+	res := make([]apiGist, 0, len(gists))
+	for _, gist := range gists {
+		res = append(res, toApiGist(ctx, gist, nil))
+	}
+	return ctx.JSON(200, res)
+}
+
+func apiGetGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	files, err := apiGistFiles(gist)
+	if err != nil {
+		return errorRes(500, "Error fetching files", err)
+	}
+	return ctx.JSON(200, toApiGist(ctx, gist, files))
+}
+
+func apiCreateGist(ctx echo.Context) error {
+	return apiSaveGist(ctx, nil)
+}
+
+func apiUpdateGist(ctx echo.Context) error {
+	return apiSaveGist(ctx, getData(ctx, "gist").(*db.Gist))
+}
+
+// apiSaveGist creates a gist from the request if gist is nil, or updates it otherwise
+func apiSaveGist(ctx echo.Context, gist *db.Gist) error {
+	isCreate := gist == nil
+	user := getUserLogged(ctx)
+
+	req := new(apiGistRequest)
+	if err := ctx.Bind(req); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if !isCreate && (req.URL != nil || req.Visibility != nil) && !gist.CanManage(user) {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	dto := new(db.GistDTO)
+	if isCreate {
+		dto.Private = defaultVisibility(user)
+	} else {
+		dto.Title, dto.Description, dto.URL, dto.Private = gist.Title, gist.Description, gist.URL, gist.Private
+		dto.Tags = gist.TagsList()
+	}
+	if req.Title != nil {
+		dto.Title = *req.Title
+	}
+	if req.Description != nil {
+		dto.Description = *req.Description
+	}
+	if req.URL != nil {
+		dto.URL = *req.URL
+	}
+	if req.Visibility != nil {
+		visibility, err := db.ParseVisibility(*req.Visibility)
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.bad-request"), err)
+		}
+		dto.Private = visibility
+	}
+	if req.Tags != nil {
+		dto.Tags = strings.Join(req.Tags, ",")
+	}
+
+	var files []db.FileDTO
+	if req.Files != nil || isCreate {
+		takenNames := make(map[string]bool)
+		for _, file := range req.Files {
+			takenNames[strings.TrimSpace(file.Filename)] = true
+		}
+
+		fileCounter := 0
+		for _, file := range req.Files {
+			name := strings.TrimSpace(file.Filename)
+			if name == "" {
+				fileCounter += 1
+				name = utils.DefaultFilename(config.C.GistDefaultFilename, fileCounter, file.Content, takenNames)
+				takenNames[name] = true
+			}
+			files = append(files, db.FileDTO{Filename: name, Content: file.Content})
+		}
+	} else {
+		// the files are kept as they are
+		gistFiles, err := apiGistFiles(gist)
+		if err != nil {
+			return errorRes(500, "Error fetching files", err)
+		}
+		for _, file := range gistFiles {
+			files = append(files, db.FileDTO{Filename: file.Filename, Content: file.Content})
+		}
+	}
+	dto.Files = files
+
+	if err := ctx.Validate(dto); err != nil {
+		return errorRes(400, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), err)
+	}
+
+	tags := db.ParseTags(dto.Tags)
+	if message := tagsError(ctx, tags); message != "" {
+		return errorRes(400, message, nil)
+	}
+
+	if isCreate {
+		gist = dto.ToGist()
+
+		uuidGist, err := uuid.NewRandom()
+		if err != nil {
+			return errorRes(500, "Error creating an UUID", err)
+		}
+		gist.Uuid = strings.Replace(uuidGist.String(), "-", "", -1)
+
+		gist.UserID = user.ID
+		gist.User = *user
+
+		expiry := user.DefaultExpiry
+		if req.Expiry != nil {
+			if !utils.IsValidExpiry(*req.Expiry) {
+				return errorRes(400, tr(ctx, "error.bad-request"), nil)
+			}
+			expiry = *req.Expiry
+		}
+		gist.ExpiresAt = utils.ExpiresAt(utils.ClampExpiry(expiry, config.C.GistMaxExpiry))
+	} else {
+		gist = dto.ToExistingGist(gist)
+		gist.Private = dto.Private
+	}
+
+	if gist.Title == "" {
+		gist.Title = files[0].Filename
+	}
+
+	if err := saveGist(gist, files, tags, isCreate); err != nil {
+		return errorRes(500, "Error saving the gist", err)
+	}
+	triggerSaveWebhooks(ctx, gist, isCreate)
+
+	code := 200
+	if isCreate {
+		code = 201
+	}
+	return ctx.JSON(code, toApiGist(ctx, gist, apiFilesOf(files)))
+}
+
+func apiDeleteGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	if err := trashGist(ctx, gist); err != nil {
+		return errorRes(500, "Error deleting this gist", err)
+	}
+
+	return ctx.NoContent(204)
+}
+
+func apiGistFiles(gist *db.Gist) ([]apiFile, error) {
+	// a gist without commits has no files
+	gistFiles, err := gist.Files("HEAD", false)
+	if _, ok := err.(*git.RevisionNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	files := make([]apiFile, 0, len(gistFiles))
+	for _, file := range gistFiles {
+		files = append(files, apiFile{Filename: file.Filename, Content: file.Content})
+	}
+	return files, nil
+}
+
+func apiFilesOf(dtos []db.FileDTO) []apiFile {
+	files := make([]apiFile, 0, len(dtos))
+	for _, file := range dtos {
+		files = append(files, apiFile{Filename: file.Filename, Content: file.Content})
+	}
+	return files
+}
+
+func toApiGist(ctx echo.Context, gist *db.Gist, files []apiFile) apiGist {
+	tags := make([]string, 0, len(gist.Tags))
+	for _, tag := range gist.Tags {
+		tags = append(tags, tag.Name)
+	}
+
+	return apiGist{
+		Owner:       gist.User.Username,
+		ID:          gist.Identifier(),
+		Uuid:        gist.Uuid,
+		Title:       gist.Title,
+		Description: gist.Description,
+		Visibility:  gist.VisibilityStr(),
+		Tags:        tags,
+		HtmlURL:     getData(ctx, "baseHttpUrl").(string) + "/" + gist.User.Username + "/" + gist.Identifier(),
+		CreatedAt:   time.Unix(gist.CreatedAt, 0).UTC(),
+		UpdatedAt:   time.Unix(gist.UpdatedAt, 0).UTC(),
+		Files:       files,
+	}
+}
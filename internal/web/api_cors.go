@@ -0,0 +1,60 @@
+package web
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/thomiceli/opengist/internal/config"
+)
+
+// apiCorsOrigins returns the origins allowed to call the API from a browser, * standing for any origin
+func apiCorsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(config.C.CorsAllowedOrigins, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func isApiPath(path string) bool {
+	return path == apiPrefix || strings.HasPrefix(path, apiPrefix+"/")
+}
+
+// webCors lets any website read the pages of the instance, like the JSON of the gists, without the cookies of its
+// users. The API has its own policy, see apiCors.
+func webCors() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(ctx echo.Context) bool {
+			return isApiPath(ctx.Request().URL.Path)
+		},
+	})
+}
+
+// apiCors applies the policy of api.cors-allowed-origins to the API. It runs before the routing, for the preflight
+// requests to be answered without a token. The listed origins can send credentials, while * allows any origin
+// without them. With no origin, the API can only be called by the pages of the instance.
+func apiCors() echo.MiddlewareFunc {
+	origins := apiCorsOrigins()
+	if len(origins) == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(ctx echo.Context) bool {
+			return !isApiPath(ctx.Request().URL.Path)
+		},
+		AllowOrigins:     origins,
+		AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPatch, http.MethodDelete},
+		AllowHeaders:     []string{echo.HeaderAuthorization, echo.HeaderContentType},
+		ExposeHeaders:    []string{"Link", "Retry-After", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+		AllowCredentials: !slices.Contains(origins, "*"),
+		MaxAge:           600,
+	})
+}
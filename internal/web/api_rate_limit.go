@@ -0,0 +1,151 @@
+package web
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// apiRateWindow is the period over which the requests to the API are counted
+const apiRateWindow = time.Hour
+
+// apiLimits counts the requests made to the API, it is reset with the server
+var apiLimits *apiLimiter
+
+// apiLimiter counts the requests of each user and token in fixed windows of an hour. The counts are kept in memory, so
+// each replica of the instance enforces the limits on its own.
+type apiLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*apiWindow
+	cleaned time.Time
+}
+
+type apiWindow struct {
+	start time.Time
+	count int
+}
+
+type apiLimit struct {
+	key   string
+	limit int // 0 for no limit
+}
+
+func newApiLimiter() *apiLimiter {
+	return &apiLimiter{windows: make(map[string]*apiWindow)}
+}
+
+// window returns the current window of the key, starting a new one if the previous has ended
+func (l *apiLimiter) window(key string, now time.Time) *apiWindow {
+	// the windows ended are not needed anymore
+	if now.Sub(l.cleaned) > apiRateWindow {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= apiRateWindow {
+				delete(l.windows, k)
+			}
+		}
+		l.cleaned = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= apiRateWindow {
+		w = &apiWindow{start: now}
+		l.windows[key] = w
+	}
+	return w
+}
+
+// take counts a request against all the limits, unless one of them is reached. It returns the number of requests left
+// and the end of the window of the tightest limit, or of the limit reached.
+func (l *apiLimiter) take(now time.Time, limits ...apiLimit) (remaining int, reset time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	remaining = -1
+	windows := make([]*apiWindow, len(limits))
+	for i, limit := range limits {
+		windows[i] = l.window(limit.key, now)
+		if limit.limit <= 0 {
+			continue
+		}
+
+		left := limit.limit - windows[i].count
+		if left <= 0 {
+			return 0, windows[i].start.Add(apiRateWindow), false
+		}
+		if remaining == -1 || left-1 < remaining {
+			remaining, reset = left-1, windows[i].start.Add(apiRateWindow)
+		}
+	}
+
+	for _, w := range windows {
+		w.count++
+	}
+	return remaining, reset, true
+}
+
+// usage returns the number of requests counted for the key in the current window
+func (l *apiLimiter) usage(key string, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w, ok := l.windows[key]; ok && now.Sub(w.start) < apiRateWindow {
+		return w.count
+	}
+	return 0
+}
+
+func apiUserLimitKey(user *db.User) string {
+	return "user:" + strconv.FormatUint(uint64(user.ID), 10)
+}
+
+func apiTokenLimitKey(apiToken *db.ApiToken) string {
+	return "token:" + strconv.FormatUint(uint64(apiToken.ID), 10)
+}
+
+// apiUserRateLimit returns the number of requests per hour allowed to the user, 0 for no limit
+func apiUserRateLimit(user *db.User) int {
+	if user.ApiRateLimit != nil {
+		return *user.ApiRateLimit
+	}
+	return config.C.ApiRateLimit
+}
+
+// apiRateLimit rejects the requests over the limits of their token or of its user. The headers tell the clients how
+// many requests they have left, and when they can try again once the limit is reached.
+func apiRateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		apiToken := getData(ctx, "apiToken").(*db.ApiToken)
+		userLimit := apiUserRateLimit(&apiToken.User)
+
+		now := time.Now()
+		remaining, reset, ok := apiLimits.take(now,
+			apiLimit{key: apiUserLimitKey(&apiToken.User), limit: userLimit},
+			apiLimit{key: apiTokenLimitKey(apiToken), limit: config.C.ApiTokenRateLimit},
+		)
+
+		header := ctx.Response().Header()
+		if !ok {
+			log.Warn().Msgf("API rate limit exceeded for user %s with token %d", apiToken.User.Username, apiToken.ID)
+			header.Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			header.Set("X-RateLimit-Remaining", "0")
+			header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			return errorRes(429, tr(ctx, "error.api-rate-limited"), nil)
+		}
+
+		if remaining >= 0 {
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		}
+		return next(ctx)
+	}
+}
+
+// apiIpRateLimited answers the requests over the limit of their IP address, which is checked before their token
+func apiIpRateLimited(ctx echo.Context) error {
+	return errorRes(429, tr(ctx, "error.api-rate-limited"), nil)
+}
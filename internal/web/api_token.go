@@ -0,0 +1,98 @@
+package web
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+const apiTokenNameMaxLen = 64
+
+func userApiTokens(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	apiTokens, err := db.GetApiTokensOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get API tokens", err)
+	}
+
+	// the value of a new token is shown once, right after its creation
+	sess := getSession(ctx)
+	if value, ok := sess.Values["newApiToken"].(string); ok {
+		delete(sess.Values, "newApiToken")
+		saveSession(sess, ctx)
+		setData(ctx, "newApiToken", value)
+	}
+
+	// the usage in the current window of the rate limits, "in the last hour" being close enough for the users
+	now := time.Now()
+	apiTokenUsage := make(map[uint]int, len(apiTokens))
+	for _, apiToken := range apiTokens {
+		apiTokenUsage[apiToken.ID] = apiLimits.usage(apiTokenLimitKey(apiToken), now)
+	}
+
+	setData(ctx, "apiUsage", apiLimits.usage(apiUserLimitKey(user), now))
+	setData(ctx, "apiRateLimit", apiUserRateLimit(user))
+	setData(ctx, "apiTokenUsage", apiTokenUsage)
+	setData(ctx, "apiTokens", apiTokens)
+	setData(ctx, "apiTokenScopes", db.ApiTokenScopes)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.api-tokens"))
+	return html(ctx, "settings_api_tokens.html")
+}
+
+func apiTokenCreate(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	if err := ctx.Request().ParseForm(); err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
+	scopes := make([]string, 0, len(db.ApiTokenScopes))
+	for _, scope := range ctx.Request().PostForm["scopes"] {
+		if db.IsApiTokenScope(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		addFlash(ctx, tr(ctx, "flash.user.api-token-no-scope"), "error")
+		return redirect(ctx, "/settings/api-tokens")
+	}
+
+	name := strings.TrimSpace(ctx.FormValue("name"))
+	if name == "" {
+		name = "API token"
+	}
+	if runes := []rune(name); len(runes) > apiTokenNameMaxLen {
+		name = string(runes[:apiTokenNameMaxLen])
+	}
+
+	_, value, err := db.CreateApiToken(user.ID, name, scopes)
+	if err != nil {
+		return errorRes(500, "Cannot create API token", err)
+	}
+
+	sess := getSession(ctx)
+	sess.Values["newApiToken"] = value
+	saveSession(sess, ctx)
+
+	addFlash(ctx, tr(ctx, "flash.user.api-token-created"), "success")
+	return redirect(ctx, "/settings/api-tokens")
+}
+
+func apiTokenDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	apiTokenId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings/api-tokens")
+	}
+
+	if err = db.DeleteApiTokenOfUser(uint(apiTokenId), user.ID); err != nil {
+		return errorRes(500, "Cannot delete API token", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.api-token-deleted"), "success")
+	return redirect(ctx, "/settings/api-tokens")
+}
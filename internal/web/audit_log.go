@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/csv"
+	"errors"
+	"html/template"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// audit records an event in the audit log. The actor is the user logged in unless one is given, as for the logins,
+// or the admin impersonating them. A failure is only logged, since the action itself is already done.
+func audit(ctx echo.Context, event string, actor *db.User, target string) {
+	if actor == nil {
+		actor = getUserLogged(ctx)
+		if impersonator := getImpersonator(ctx); impersonator != nil {
+			target = strings.TrimSpace(target + " (as " + actor.Username + ")")
+			actor = impersonator
+		}
+	}
+
+	entry := &db.AuditLog{
+		Event:  event,
+		Target: target,
+		IP:     ctx.RealIP(),
+	}
+	if actor != nil {
+		entry.ActorID = actor.ID
+		entry.Actor = actor.Username
+	}
+
+	if err := db.CreateAuditLog(entry); err != nil {
+		log.Error().Err(err).Msg("Cannot record audit log event " + event)
+	}
+}
+
+// authWarn starts a warning about a refused authentication, with the fields to parse and alert on: the event, the IP
+// address, and the username tried if any
+func authWarn(ctx echo.Context, event string, username string) *zerolog.Event {
+	entry := log.Warn().Str("event", event).Str("ip", ctx.RealIP())
+	if username != "" {
+		entry = entry.Str("username", username)
+	}
+	return entry
+}
+
+// auditImpersonation records the requests changing something made by an admin impersonating a user, with the admin
+// as actor
+func auditImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		method := ctx.Request().Method
+		if getImpersonator(ctx) != nil && method != "GET" && method != "HEAD" && ctx.Path() != "/impersonate/stop" {
+			audit(ctx, db.AuditImpersonatedAction, nil, method+" "+ctx.Request().URL.Path)
+		}
+		return next(ctx)
+	}
+}
+
+func adminAuditLog(ctx echo.Context) error {
+	setData(ctx, "htmlTitle", trH(ctx, "admin.audit-log")+" - "+trH(ctx, "admin.admin_panel"))
+	setData(ctx, "adminHeaderPage", "audit-log")
+	pageInt := getPage(ctx)
+
+	filter, params, err := adminAuditLogFilter(ctx)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
+	var data []*db.AuditLog
+	if data, err = db.GetAuditLogs(filter, pageInt-1); err != nil {
+		return errorRes(500, "Cannot get audit log", err)
+	}
+
+	urlParams := ""
+	if len(params) > 0 {
+		urlParams = "&" + params.Encode()
+	}
+	if err = paginate(ctx, data, pageInt, 30, "data", "admin-panel/audit-log", 1, urlParams); err != nil {
+		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
+	}
+
+	exportUrl := "admin-panel/audit-log/export"
+	if len(params) > 0 {
+		exportUrl += "?" + params.Encode()
+	}
+
+	setData(ctx, "filter", params)
+	setData(ctx, "exportUrl", template.URL(exportUrl))
+	setData(ctx, "events", db.AuditEvents)
+	return html(ctx, "admin_audit_log.html")
+}
+
+func adminAuditLogExport(ctx echo.Context) error {
+	filter, _, err := adminAuditLogFilter(ctx)
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
+	ctx.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	ctx.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit-log.csv"`)
+	ctx.Response().WriteHeader(200)
+
+	w := csv.NewWriter(ctx.Response())
+	if err = w.Write([]string{"id", "date", "event", "actor_id", "actor", "target", "ip"}); err != nil {
+		return err
+	}
+
+	err = db.ForEachAuditLog(filter, func(entry *db.AuditLog) error {
+		return w.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			time.Unix(entry.CreatedAt, 0).UTC().Format(time.RFC3339),
+			entry.Event,
+			strconv.FormatUint(uint64(entry.ActorID), 10),
+			csvSafe(entry.Actor),
+			csvSafe(entry.Target),
+			entry.IP,
+		})
+	})
+	if err != nil {
+		// the status is already sent, the file is left truncated
+		log.Error().Err(err).Msg("Cannot export audit log")
+		return nil
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// adminAuditLogFilter reads the filters of the audit log page from the query, and returns them along with the
+// parameters set, to keep them in the pagination and export links
+func adminAuditLogFilter(ctx echo.Context) (db.AuditLogFilter, url.Values, error) {
+	var filter db.AuditLogFilter
+	params := url.Values{}
+	for _, name := range []string{"event", "actor", "ip", "from", "to"} {
+		if value := strings.TrimSpace(ctx.QueryParam(name)); value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	filter.Event = params.Get("event")
+	filter.Actor = params.Get("actor")
+	filter.IP = params.Get("ip")
+
+	if filter.Event != "" && !slices.Contains(db.AuditEvents, filter.Event) {
+		return filter, params, errors.New("unknown event")
+	}
+
+	// dates of the form inputs, the end date is included
+	if params.Has("from") {
+		from, err := time.Parse(time.DateOnly, params.Get("from"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.CreatedAfter = from.Unix()
+	}
+	if params.Has("to") {
+		to, err := time.Parse(time.DateOnly, params.Get("to"))
+		if err != nil {
+			return filter, params, err
+		}
+		filter.CreatedBefore = to.AddDate(0, 0, 1).Unix()
+	}
+
+	return filter, params, nil
+}
+
+// csvSafe prevents the values chosen by the users, like the usernames of the failed logins, from being run as
+// formulas by the spreadsheets opening the export
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
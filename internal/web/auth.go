@@ -3,40 +3,85 @@ package web
 import (
 	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/azureadv2"
+	"github.com/markbates/goth/providers/bitbucket"
 	"github.com/markbates/goth/providers/gitea"
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/gitlab"
 	"github.com/markbates/goth/providers/openidConnect"
+	"github.com/pquerna/otp/totp"
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/auth"
+	"github.com/thomiceli/opengist/internal/captcha"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/email"
 	"github.com/thomiceli/opengist/internal/i18n"
 	"github.com/thomiceli/opengist/internal/utils"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 	"gorm.io/gorm"
 	"io"
+	"math"
 	"net/http"
+	"net/mail"
 	"net/url"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 )
 
 const (
-	GitHubProvider = "github"
-	GitLabProvider = "gitlab"
-	GiteaProvider  = "gitea"
-	OpenIDConnect  = "openid-connect"
+	GitHubProvider    = "github"
+	GitLabProvider    = "gitlab"
+	GiteaProvider     = "gitea"
+	MicrosoftProvider = "microsoft"
+	BitbucketProvider = "bitbucket"
+	OpenIDConnect     = "openid-connect"
+	OAuth2Provider    = "oauth2"
+	SAMLProvider      = "saml"
 )
 
+// bitbucketApiUrl is the API of Bitbucket Cloud, the only one supported by its goth provider
+const bitbucketApiUrl = "https://api.bitbucket.org/2.0"
+
+// oauthProviders are the OAuth providers users can log in with, in the order they are shown
+var oauthProviders = []string{GitHubProvider, GitLabProvider, GiteaProvider, BitbucketProvider, MicrosoftProvider, OpenIDConnect, OAuth2Provider, SAMLProvider}
+
+// oauthProviderSetting is an OAuth provider as listed in the admin panel, to enable or disable it
+type oauthProviderSetting struct {
+	Name       string
+	SettingKey string
+	Disabled   bool
+}
+
+// namedProvider is an OAuth provider with the name it is shown with
+type namedProvider struct {
+	Provider string
+	Name     string
+}
+
+// session key holding the id_token of an OpenID Connect login
+const oidcIdTokenKey = "oidcIdToken"
+
 var title = cases.Title(language.English)
 
 func register(ctx echo.Context) error {
+	return registerWithCode(ctx, 200)
+}
+
+func registerWithCode(ctx echo.Context, status int) error {
 	disableSignup := getData(ctx, "DisableSignup")
 	disableForm := getData(ctx, "DisableLoginForm")
 
@@ -48,13 +93,115 @@ func register(ctx echo.Context) error {
 			disableSignup = false
 		}
 	}
+	// nobody can sign up while the instance is in read-only mode, even with an invitation
+	if isReadOnly(ctx) {
+		disableSignup = true
+	}
 
 	setData(ctx, "title", trH(ctx, "auth.new-account"))
 	setData(ctx, "htmlTitle", trH(ctx, "auth.new-account"))
 	setData(ctx, "disableForm", disableForm)
 	setData(ctx, "disableSignup", disableSignup)
 	setData(ctx, "isLoginPage", false)
-	return html(ctx, "auth_form.html")
+	setData(ctx, "requireEmail", requireEmailVerification())
+	setData(ctx, "signupDomains", strings.Join(signupDomains(), ", "))
+	setData(ctx, "captcha", captcha.Current())
+	return htmlWithCode(ctx, status, "auth_form.html")
+}
+
+func registerRateLimited(ctx echo.Context) error {
+	addFlash(ctx, tr(ctx, "flash.auth.register-rate-limited"), "error")
+	return registerWithCode(ctx, 429)
+}
+
+func requireEmailVerification() bool {
+	return config.C.RequireEmailVerification && email.Enabled()
+}
+
+// strictSignup reports whether the registration form hides which usernames and email addresses are taken. It needs
+// the email verification, so that the answer is the same whether an account is created or not.
+func strictSignup() bool {
+	return config.C.PrivacyStrictSignup && requireEmailVerification()
+}
+
+// notifySignupAttempt tells the owners of the accounts with the username or the email address given to the
+// registration form that someone tried to sign up with them
+func notifySignupAttempt(ctx echo.Context, username string, address string) {
+	recipients := make(map[string]string)
+	if user, err := db.GetUserByUsername(username); err == nil && user.Email != "" {
+		recipients[user.Email] = user.Username
+	}
+	if user, err := db.GetUserByEmail(address); err == nil {
+		recipients[user.Email] = user.Username
+	}
+
+	baseUrl := getData(ctx, "baseHttpUrl").(string)
+	subject := tr(ctx, "email.signup-attempt.subject")
+	for to, name := range recipients {
+		body := tr(ctx, "email.signup-attempt.body", name, urlJoin(baseUrl, "/login"), urlJoin(baseUrl, "/forgot-password"))
+		go func(to string) {
+			if err := email.Send(to, subject, body); err != nil {
+				log.Error().Err(err).Msg("Cannot send signup attempt notification")
+			}
+		}(to)
+	}
+}
+
+// signupNeedsApproval reports whether a new account waits for an admin to approve it, which is never the case of the
+// first one as there is no admin yet
+func signupNeedsApproval() (bool, error) {
+	if !config.C.RequireSignupApproval {
+		return false, nil
+	}
+	nbUsers, err := db.CountAll(&db.User{})
+	return nbUsers > 0, err
+}
+
+// passwordPolicy returns the rules of the configuration the new passwords must follow
+func passwordPolicy() utils.PasswordRules {
+	return utils.PasswordRules{
+		MinLength:        config.C.MinPasswordLength,
+		RequireMixedCase: config.C.PasswordRequireMixedCase,
+		RequireDigit:     config.C.PasswordRequireDigit,
+		RequireSymbol:    config.C.PasswordRequireSymbol,
+		BreachCheck:      config.C.PasswordBreachCheck,
+	}
+}
+
+// signupDomains returns the email domains allowed to create an account, or nil if any is
+func signupDomains() []string {
+	var domains []string
+	for _, domain := range strings.Split(config.C.AllowedSignupDomains, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, strings.TrimPrefix(domain, "@"))
+		}
+	}
+	return domains
+}
+
+// reservedUsernames returns the names the users and the organizations cannot take
+func reservedUsernames() []string {
+	var names []string
+	for _, name := range strings.Split(config.C.ReservedUsernames, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isSignupEmailAllowed reports whether an account can be created with the email address
+func isSignupEmailAllowed(address string) bool {
+	domains := signupDomains()
+	if len(domains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	return slices.Contains(domains, strings.ToLower(strings.TrimSpace(address[at+1:])))
 }
 
 func processRegister(ctx echo.Context) error {
@@ -78,6 +225,9 @@ func processRegister(ctx echo.Context) error {
 
 	setData(ctx, "title", trH(ctx, "auth.new-account"))
 	setData(ctx, "htmlTitle", trH(ctx, "auth.new-account"))
+	setData(ctx, "requireEmail", requireEmailVerification())
+	setData(ctx, "signupDomains", strings.Join(signupDomains(), ", "))
+	setData(ctx, "captcha", captcha.Current())
 
 	sess := getSession(ctx)
 
@@ -86,18 +236,87 @@ func processRegister(ctx echo.Context) error {
 		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
 	}
 
+	if isHoneypotFilled(ctx) {
+		return redirect(ctx, "/register")
+	}
+
+	if !checkCaptcha(ctx) {
+		return html(ctx, "auth_form.html")
+	}
+
 	if err := ctx.Validate(dto); err != nil {
 		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
 		return html(ctx, "auth_form.html")
 	}
 
-	if exists, err := db.UserExists(dto.Username); err != nil || exists {
+	usernameTaken, err := db.UserExists(dto.Username)
+	if err != nil {
+		return errorRes(500, "Cannot check for user", err)
+	}
+	if usernameTaken && !strictSignup() {
 		addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
 		return html(ctx, "auth_form.html")
 	}
 
+	if err := ctx.Validate(&db.PasswordDTO{Password: dto.Password}); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return html(ctx, "auth_form.html")
+	}
+
 	user := dto.ToUser()
 
+	// the account can only be used once the link sent to this address is opened, except the first one
+	var verifiedEmail string
+	emailTaken := false
+	if requireEmailVerification() || len(signupDomains()) > 0 {
+		address := strings.ToLower(strings.TrimSpace(ctx.FormValue("email")))
+		if _, err := mail.ParseAddress(address); err != nil {
+			addFlash(ctx, tr(ctx, "flash.auth.invalid-email"), "error")
+			return html(ctx, "auth_form.html")
+		}
+
+		if !isSignupEmailAllowed(address) {
+			addFlash(ctx, tr(ctx, "flash.auth.signup-domain-not-allowed", strings.Join(signupDomains(), ", ")), "error")
+			return html(ctx, "auth_form.html")
+		}
+
+		if emailTaken, err = db.EmailUsedByOtherUser(address, 0); err != nil {
+			return errorRes(500, "Cannot check email", err)
+		}
+		if emailTaken && !strictSignup() {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return html(ctx, "auth_form.html")
+		}
+
+		if usernameTaken || emailTaken {
+			// the answer is the same as for a new account, the owners of the existing ones are told by email instead
+			utils.Argon2id.VerifyDummy(dto.Password)
+			authWarn(ctx, "signup-existing-account", dto.Username).Msg("Signup with the username or the email of an existing account")
+			notifySignupAttempt(ctx, dto.Username, address)
+			addFlash(ctx, tr(ctx, "flash.auth.account-verification-sent", address), "success")
+			return redirect(ctx, "/login")
+		}
+
+		nbUsers, err := db.CountAll(&db.User{})
+		if err != nil {
+			return errorRes(500, "Cannot count users", err)
+		}
+		if nbUsers == 0 || !requireEmailVerification() {
+			user.Email = address
+			user.MD5Hash = fmt.Sprintf("%x", md5.Sum([]byte(address)))
+		} else {
+			verifiedEmail = address
+			user.EmailVerified = false
+		}
+	}
+
+	// the invitations are given by the admins, the accounts created with them are approved already
+	if invitation.ID == 0 || !invitation.IsUsable() {
+		if user.PendingApproval, err = signupNeedsApproval(); err != nil {
+			return errorRes(500, "Cannot count users", err)
+		}
+	}
+
 	password, err := utils.Argon2id.Hash(user.Password)
 	if err != nil {
 		return errorRes(500, "Cannot hash password", err)
@@ -105,6 +324,10 @@ func processRegister(ctx echo.Context) error {
 	user.Password = password
 
 	if err = user.Create(); err != nil {
+		if db.IsEmailConstraintViolation(err) {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return html(ctx, "auth_form.html")
+		}
 		return errorRes(500, "Cannot create user", err)
 	}
 
@@ -120,20 +343,179 @@ func processRegister(ctx echo.Context) error {
 		}
 	}
 
-	sess.Values["user"] = user.ID
+	audit(ctx, db.AuditRegister, user, "password")
+
+	if !user.EmailVerified {
+		verification, err := db.CreateEmailVerification(user.ID, verifiedEmail, emailVerificationTtl)
+		if err != nil {
+			return errorRes(500, "Cannot create email verification", err)
+		}
+
+		subject := tr(ctx, "email.verify-account.subject")
+		body := tr(ctx, "email.verify-account.body",
+			user.Username,
+			urlJoin(getData(ctx, "baseHttpUrl").(string), "/verify-email", verification.Token),
+		)
+
+		go func(to string) {
+			if err := email.Send(to, subject, body); err != nil {
+				log.Error().Err(err).Msg("Cannot send account verification")
+			}
+		}(verifiedEmail)
+
+		addFlash(ctx, tr(ctx, "flash.auth.account-verification-sent", verifiedEmail), "success")
+		return redirect(ctx, "/login")
+	}
+
+	if user.PendingApproval {
+		addFlash(ctx, tr(ctx, "flash.auth.account-created-pending-approval"), "success")
+		return redirect(ctx, "/login")
+	}
+
+	recordLoginDevice(ctx, user)
+
+	if err := setSessionUser(ctx, sess, user.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
 	saveSession(sess, ctx)
 
 	return redirect(ctx, "/")
 }
 
+const (
+	loginAttemptsWindow = 15 * time.Minute
+	loginLockout        = 15 * time.Minute
+	// an IP address can be shared by several users, it is locked out after more failures than a username
+	loginAttemptsIpFactor = 4
+)
+
+// loginAttemptKeys returns the keys counting the failed logins of the username and of the IP address of the request
+func loginAttemptKeys(ctx echo.Context, username string) []string {
+	return []string{"user:" + strings.ToLower(username), "ip:" + ctx.RealIP()}
+}
+
+// loginLocked reports whether one of the keys is locked out by failed logins
+func loginLocked(keys ...string) (bool, error) {
+	if config.C.MaxLoginAttempts <= 0 {
+		return false, nil
+	}
+
+	locked, _, err := db.IsLoginLocked(keys...)
+	return locked, err
+}
+
+func recordLoginFailure(keys []string) {
+	if config.C.MaxLoginAttempts <= 0 {
+		return
+	}
+
+	if err := db.RecordLoginFailure(keys[0], config.C.MaxLoginAttempts, loginAttemptsWindow, loginLockout); err != nil {
+		log.Error().Err(err).Msg("Cannot record failed login")
+	}
+	if err := db.RecordLoginFailure(keys[1], config.C.MaxLoginAttempts*loginAttemptsIpFactor, loginAttemptsWindow, loginLockout); err != nil {
+		log.Error().Err(err).Msg("Cannot record failed login")
+	}
+}
+
+// emailVerificationTtl is also the time after which the accounts not verified can be deleted
+const emailVerificationTtl = 24 * time.Hour
+
+func verifyEmail(ctx echo.Context) error {
+	verification, err := db.GetEmailVerificationByToken(ctx.Param("token"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get email verification", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	user, err := db.GetUserById(verification.UserID)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	// the changes of email of verified accounts are confirmed from the settings, by the logged-in user
+	if user.EmailVerified {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	if err = verification.Confirm(); err != nil {
+		if errors.Is(err, db.ErrEmailAlreadyUsed) {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return redirect(ctx, "/login")
+		}
+		return errorRes(500, "Cannot verify email", err)
+	}
+
+	if user.PendingApproval {
+		addFlash(ctx, tr(ctx, "flash.auth.account-verified-pending-approval"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.auth.account-verified"), "success")
+	}
+	return redirect(ctx, "/login")
+}
+
+// canLogIn reports whether the user is allowed to log in, flashing the reason when they are not
+func canLogIn(ctx echo.Context, user *db.User) bool {
+	switch {
+	case user.PendingApproval:
+		addFlash(ctx, tr(ctx, "flash.auth.account-pending-approval"), "error")
+	case user.Disabled:
+		addFlash(ctx, tr(ctx, "flash.auth.account-disabled"), "error")
+	default:
+		return true
+	}
+	return false
+}
+
 func login(ctx echo.Context) error {
+	// the sign-in buttons must not be used to manage the linked accounts, which is done in the settings
+	if getUserLogged(ctx) != nil {
+		return redirect(ctx, "/")
+	}
+
 	setData(ctx, "title", trH(ctx, "auth.login"))
 	setData(ctx, "htmlTitle", trH(ctx, "auth.login"))
 	setData(ctx, "disableForm", getData(ctx, "DisableLoginForm"))
 	setData(ctx, "isLoginPage", true)
+	setData(ctx, "magicLink", magicLinkEnabled())
+	setData(ctx, "forgotPassword", email.Enabled())
+	setData(ctx, "captcha", captcha.Current())
 	return html(ctx, "auth_form.html")
 }
 
+// honeypotField is a field of the login and registration forms hidden to the users, which only bots fill
+const honeypotField = "website"
+
+// isHoneypotFilled reports whether the form was submitted by a bot, and logs it
+func isHoneypotFilled(ctx echo.Context) bool {
+	if ctx.FormValue(honeypotField) == "" {
+		return false
+	}
+	authWarn(ctx, "honeypot", "").Msg("Form honeypot filled")
+	return true
+}
+
+// checkCaptcha verifies the answer to the CAPTCHA submitted with the form, if one is configured, and adds an error
+// flash if it is not valid
+func checkCaptcha(ctx echo.Context) bool {
+	provider := captcha.Current()
+	if provider == nil {
+		return true
+	}
+
+	ok, err := provider.Verify(ctx.FormValue(provider.ResponseField), ctx.RealIP())
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot verify captcha")
+	}
+	if !ok {
+		addFlash(ctx, tr(ctx, "flash.auth.captcha-failed"), "error")
+	}
+	return ok
+}
+
 func processLogin(ctx echo.Context) error {
 	if getData(ctx, "DisableLoginForm") == true {
 		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
@@ -148,27 +530,83 @@ func processLogin(ctx echo.Context) error {
 	}
 	password := dto.Password
 
+	if isHoneypotFilled(ctx) {
+		return redirect(ctx, "/login")
+	}
+
+	if !checkCaptcha(ctx) {
+		return redirect(ctx, "/login")
+	}
+
+	attemptKeys := loginAttemptKeys(ctx, dto.Username)
+	if config.C.MaxLoginAttempts > 0 {
+		locked, until, err := db.IsLoginLocked(attemptKeys...)
+		if err != nil {
+			return errorRes(500, "Cannot check for login lockout", err)
+		}
+		if locked {
+			authWarn(ctx, "login-locked", dto.Username).Msg("Locked out login attempt")
+			addFlash(ctx, tr(ctx, "flash.auth.login-locked", int(math.Ceil(time.Until(time.Unix(until, 0)).Minutes()))), "error")
+			return redirect(ctx, "/login")
+		}
+	}
+
 	var user *db.User
 
 	if user, err = db.GetUserByUsername(dto.Username); err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return errorRes(500, "Cannot get user", err)
 		}
-		log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+		utils.Argon2id.VerifyDummy(password)
+		authWarn(ctx, db.AuditLoginFailed, dto.Username).Str("method", "password").Msg("Invalid login attempt")
+		audit(ctx, db.AuditLoginFailed, &db.User{Username: dto.Username}, "password")
+		recordLoginFailure(attemptKeys)
 		addFlash(ctx, tr(ctx, "flash.auth.invalid-credentials"), "error")
 		return redirect(ctx, "/login")
 	}
 
+	if user.Password == "" {
+		// the accounts created with an OAuth provider have no password
+		utils.Argon2id.VerifyDummy(password)
+	}
+
 	if ok, err := utils.Argon2id.Verify(password, user.Password); !ok {
 		if err != nil {
 			return errorRes(500, "Cannot check for password", err)
 		}
-		log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+		authWarn(ctx, db.AuditLoginFailed, dto.Username).Str("method", "password").Msg("Invalid login attempt")
+		audit(ctx, db.AuditLoginFailed, user, "password")
+		recordLoginFailure(attemptKeys)
 		addFlash(ctx, tr(ctx, "flash.auth.invalid-credentials"), "error")
 		return redirect(ctx, "/login")
 	}
 
-	sess.Values["user"] = user.ID
+	if !canLogIn(ctx, user) {
+		return redirect(ctx, "/login")
+	}
+
+	if !user.EmailVerified {
+		addFlash(ctx, tr(ctx, "flash.auth.account-not-verified"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	// the failed logins are only forgotten once the second factor is verified too, by completeSecondFactorLogin
+	if ok, err := hasTwoFactor(user); err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	} else if ok {
+		return startTotpLogin(ctx, user)
+	}
+
+	if err = db.ResetLoginAttempts(attemptKeys...); err != nil {
+		log.Error().Err(err).Msg("Cannot reset failed logins")
+	}
+
+	recordLoginDevice(ctx, user)
+	audit(ctx, db.AuditLogin, user, "password")
+
+	if err := setSessionUser(ctx, sess, user.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
 	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
 	saveSession(sess, ctx)
 	deleteCsrfCookie(ctx)
@@ -176,199 +614,1112 @@ func processLogin(ctx echo.Context) error {
 	return redirect(ctx, "/")
 }
 
-func oauthCallback(ctx echo.Context) error {
-	user, err := gothic.CompleteUserAuth(ctx.Response(), ctx.Request())
-	if err != nil {
-		return errorRes(400, tr(ctx, "error.complete-oauth-login", err.Error()), err)
+const (
+	magicLinkTtl = 15 * time.Minute
+	// number of links which can be sent to an account within magicLinkTtl
+	magicLinkMaxPerEmail = 3
+)
+
+func magicLinkEnabled() bool {
+	return config.C.SmtpMagicLink && email.Enabled()
+}
+
+func loginEmail(ctx echo.Context) error {
+	if !magicLinkEnabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
+	}
+	if getUserLogged(ctx) != nil {
+		return redirect(ctx, "/")
 	}
 
-	currUser := getUserLogged(ctx)
-	if currUser != nil {
-		// if user is logged in, link account to user and update its avatar URL
-		updateUserProviderInfo(currUser, user.Provider, user)
+	setData(ctx, "title", trH(ctx, "auth.magic-link"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.magic-link"))
+	return html(ctx, "auth_magic_link.html")
+}
 
-		if err = currUser.Update(); err != nil {
-			return errorRes(500, "Cannot update user "+title.String(user.Provider)+" id", err)
-		}
+func processLoginEmail(ctx echo.Context) error {
+	if !magicLinkEnabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
+	}
 
-		addFlash(ctx, tr(ctx, "flash.auth.account-linked-oauth", title.String(user.Provider)), "success")
-		return redirect(ctx, "/settings")
+	// the response is the same whether the address is known or not, so that it cannot be used to find accounts
+	sent := func() error {
+		addFlash(ctx, tr(ctx, "flash.auth.magic-link-sent"), "success")
+		return redirect(ctx, "/login")
 	}
 
-	// if user is not in database, create it
-	userDB, err := db.GetUserByProvider(user.UserID, user.Provider)
-	if err != nil {
-		if getData(ctx, "DisableSignup") == true {
-			return errorRes(403, tr(ctx, "error.signup-disabled"), nil)
-		}
+	address := strings.TrimSpace(ctx.FormValue("email"))
+	if address == "" {
+		return sent()
+	}
 
+	user, err := db.GetUserByEmail(address)
+	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return errorRes(500, "Cannot get user", err)
 		}
+		authWarn(ctx, "magic-link-unknown-email", "").Msg("Login link asked for an unknown email")
+		return sent()
+	}
 
-		userDB = &db.User{
-			Username: user.NickName,
-			Email:    user.Email,
-			MD5Hash:  fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(user.Email))))),
-		}
-
-		// set provider id and avatar URL
-		updateUserProviderInfo(userDB, user.Provider, user)
+	nbSent, err := db.CountLoginTokensSince(user.ID, time.Now().Add(-magicLinkTtl))
+	if err != nil {
+		return errorRes(500, "Cannot count login links", err)
+	}
+	if nbSent >= magicLinkMaxPerEmail {
+		authWarn(ctx, "magic-link-throttled", user.Username).Msg("Too many login links asked")
+		return sent()
+	}
 
-		if err = userDB.Create(); err != nil {
-			if db.IsUniqueConstraintViolation(err) {
-				addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
-				return redirect(ctx, "/login")
-			}
+	loginToken, err := db.CreateLoginToken(user.ID, magicLinkTtl)
+	if err != nil {
+		return errorRes(500, "Cannot create login link", err)
+	}
 
-			return errorRes(500, "Cannot create user", err)
+	subject := tr(ctx, "email.magic-link.subject")
+	body := tr(ctx, "email.magic-link.body",
+		user.Username,
+		urlJoin(getData(ctx, "baseHttpUrl").(string), "/login/email", loginToken.Token),
+		int(magicLinkTtl.Minutes()),
+		ctx.RealIP(),
+	)
+
+	go func(to string) {
+		if err := email.Send(to, subject, body); err != nil {
+			log.Error().Err(err).Msg("Cannot send login link")
 		}
+	}(user.Email)
 
-		if userDB.ID == 1 {
-			if err = userDB.SetAdmin(); err != nil {
-				return errorRes(500, "Cannot set user admin", err)
-			}
-		}
+	return sent()
+}
 
-		var resp *http.Response
-		switch user.Provider {
-		case GitHubProvider:
-			resp, err = http.Get("https://github.com/" + user.NickName + ".keys")
-		case GitLabProvider:
-			resp, err = http.Get(urlJoin(config.C.GitlabUrl, user.NickName+".keys"))
-		case GiteaProvider:
-			resp, err = http.Get(urlJoin(config.C.GiteaUrl, user.NickName+".keys"))
-		case OpenIDConnect:
-			err = errors.New("cannot get keys from OIDC provider")
-		}
+// loginEmailToken asks to confirm the login instead of using the link right away, as some mail clients open the links
+// of the emails to scan them
+func loginEmailToken(ctx echo.Context) error {
+	if !magicLinkEnabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
+	}
 
-		if err == nil {
-			defer resp.Body.Close()
+	setData(ctx, "title", trH(ctx, "auth.magic-link"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.magic-link"))
+	setData(ctx, "magicLinkToken", ctx.Param("token"))
+	return html(ctx, "auth_magic_link.html")
+}
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				addFlash(ctx, tr(ctx, "flash.auth.user-sshkeys-not-retrievable"), "error")
-				log.Error().Err(err).Msg("Could not get user keys")
-			}
+func processLoginEmailToken(ctx echo.Context) error {
+	if !magicLinkEnabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
+	}
 
-			keys := strings.Split(string(body), "\n")
-			if len(keys[len(keys)-1]) == 0 {
-				keys = keys[:len(keys)-1]
-			}
-			for _, key := range keys {
-				sshKey := db.SSHKey{
-					Title:   "Added from " + user.Provider,
-					Content: key,
-					User:    *userDB,
-				}
-
-				if err = sshKey.Create(); err != nil {
-					addFlash(ctx, tr(ctx, "flash.auth.user-sshkeys-not-created"), "error")
-					log.Error().Err(err).Msg("Could not create ssh key")
-				}
-			}
+	user, err := db.UseLoginToken(ctx.Param("token"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot use login link", err)
 		}
+		authWarn(ctx, db.AuditLoginFailed, "").Str("method", "magic-link").Msg("Invalid login link used")
+		audit(ctx, db.AuditLoginFailed, &db.User{}, "magic-link")
+		addFlash(ctx, tr(ctx, "flash.auth.magic-link-invalid"), "error")
+		return redirect(ctx, "/login")
 	}
 
+	if !canLogIn(ctx, user) {
+		return redirect(ctx, "/login")
+	}
+
+	if ok, err := hasTwoFactor(user); err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	} else if ok {
+		return startTotpLogin(ctx, user)
+	}
+
+	recordLoginDevice(ctx, user)
+	audit(ctx, db.AuditLogin, user, "magic-link")
+
 	sess := getSession(ctx)
-	sess.Values["user"] = userDB.ID
+	if err := setSessionUser(ctx, sess, user.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
+	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
 	saveSession(sess, ctx)
 	deleteCsrfCookie(ctx)
 
 	return redirect(ctx, "/")
 }
 
-func oauth(ctx echo.Context) error {
-	provider := ctx.Param("provider")
+const passwordResetTtl = time.Hour
 
-	httpProtocol := "http"
-	if ctx.Request().TLS != nil || ctx.Request().Header.Get("X-Forwarded-Proto") == "https" {
-		httpProtocol = "https"
+func forgotPassword(ctx echo.Context) error {
+	if !email.Enabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
 	}
-
-	var opengistUrl string
-	if config.C.ExternalUrl != "" {
-		opengistUrl = config.C.ExternalUrl
-	} else {
-		opengistUrl = httpProtocol + "://" + ctx.Request().Host
+	if getUserLogged(ctx) != nil {
+		return redirect(ctx, "/settings")
 	}
 
-	switch provider {
-	case GitHubProvider:
-		goth.UseProviders(
-			github.New(
-				config.C.GithubClientKey,
-				config.C.GithubSecret,
-				urlJoin(opengistUrl, "/oauth/github/callback"),
-			),
-		)
-
-	case GitLabProvider:
-		goth.UseProviders(
-			gitlab.NewCustomisedURL(
-				config.C.GitlabClientKey,
-				config.C.GitlabSecret,
-				urlJoin(opengistUrl, "/oauth/gitlab/callback"),
-				urlJoin(config.C.GitlabUrl, "/oauth/authorize"),
-				urlJoin(config.C.GitlabUrl, "/oauth/token"),
-				urlJoin(config.C.GitlabUrl, "/api/v4/user"),
-			),
-		)
+	setData(ctx, "title", trH(ctx, "auth.forgot-password"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.forgot-password"))
+	return html(ctx, "auth_password_reset.html")
+}
 
-	case GiteaProvider:
-		goth.UseProviders(
-			gitea.NewCustomisedURL(
-				config.C.GiteaClientKey,
-				config.C.GiteaSecret,
-				urlJoin(opengistUrl, "/oauth/gitea/callback"),
-				urlJoin(config.C.GiteaUrl, "/login/oauth/authorize"),
-				urlJoin(config.C.GiteaUrl, "/login/oauth/access_token"),
-				urlJoin(config.C.GiteaUrl, "/api/v1/user"),
-			),
-		)
-	case OpenIDConnect:
-		oidcProvider, err := openidConnect.New(
-			config.C.OIDCClientKey,
-			config.C.OIDCSecret,
-			urlJoin(opengistUrl, "/oauth/openid-connect/callback"),
-			config.C.OIDCDiscoveryUrl,
-			"openid",
-			"email",
-			"profile",
-		)
+func processForgotPassword(ctx echo.Context) error {
+	if !email.Enabled() || getData(ctx, "DisableLoginForm") == true {
+		return notFound("Page not found")
+	}
 
-		if err != nil {
-			return errorRes(500, "Cannot create OIDC provider", err)
-		}
+	// the response is the same whether the account exists or not, so that it cannot be used to find accounts
+	sent := func() error {
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-sent"), "success")
+		return redirect(ctx, "/login")
+	}
 
-		goth.UseProviders(oidcProvider)
+	account := strings.TrimSpace(ctx.FormValue("account"))
+	if account == "" {
+		return sent()
 	}
 
-	currUser := getUserLogged(ctx)
+	user, err := db.GetUserByUsername(account)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user, err = db.GetUserByEmail(account)
+	}
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get user", err)
+		}
+		authWarn(ctx, "password-reset-unknown-account", "").Msg("Password reset asked for an unknown account")
+		return sent()
+	}
+	if user.Email == "" {
+		authWarn(ctx, "password-reset-no-email", user.Username).Msg("Password reset asked for a user without email")
+		return sent()
+	}
+
+	nbSent, err := db.CountPasswordResetTokensSince(user.ID, time.Now().Add(-passwordResetTtl))
+	if err != nil {
+		return errorRes(500, "Cannot count password reset links", err)
+	}
+	// a few links per hour are enough to recover from an email lost or sent to spam
+	if nbSent >= 3 {
+		authWarn(ctx, "password-reset-throttled", user.Username).Msg("Too many password resets asked")
+		return sent()
+	}
+
+	resetToken, err := db.CreatePasswordResetToken(user.ID, passwordResetTtl)
+	if err != nil {
+		return errorRes(500, "Cannot create password reset link", err)
+	}
+
+	subject := tr(ctx, "email.password-reset.subject")
+	body := tr(ctx, "email.password-reset.body",
+		user.Username,
+		urlJoin(getData(ctx, "baseHttpUrl").(string), "/reset-password", resetToken.Token),
+		ctx.RealIP(),
+	)
+
+	go func(to string) {
+		if err := email.Send(to, subject, body); err != nil {
+			log.Error().Err(err).Msg("Cannot send password reset link")
+		}
+	}(user.Email)
+
+	return sent()
+}
+
+func resetPassword(ctx echo.Context) error {
+	if _, err := db.GetPasswordResetToken(ctx.Param("token")); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get password reset link", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	}
+
+	setData(ctx, "title", trH(ctx, "auth.reset-password"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.reset-password"))
+	setData(ctx, "resetToken", ctx.Param("token"))
+	return html(ctx, "auth_password_reset.html")
+}
+
+func processResetPassword(ctx echo.Context) error {
+	resetToken, err := db.GetPasswordResetToken(ctx.Param("token"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get password reset link", err)
+		}
+		authWarn(ctx, "password-reset-invalid", "").Msg("Invalid password reset link used")
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	}
+
+	user, err := db.GetUserById(resetToken.UserID)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	dto := &db.PasswordDTO{Password: ctx.FormValue("password")}
+	if err = ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/reset-password/"+resetToken.Token)
+	}
+
+	password, err := utils.Argon2id.Hash(dto.Password)
+	if err != nil {
+		return errorRes(500, "Cannot hash password", err)
+	}
+
+	if err = resetToken.ResetPassword(password); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot reset password", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.auth.password-reset-invalid"), "error")
+		return redirect(ctx, "/forgot-password")
+	}
+
+	if ctx.FormValue("logout-sessions") != "" {
+		if err = db.DeleteSessionsOfUser(user.ID, ""); err != nil {
+			return errorRes(500, "Cannot revoke sessions", err)
+		}
+	}
+
+	audit(ctx, db.AuditPasswordReset, user, "")
+
+	addFlash(ctx, tr(ctx, "flash.auth.password-reset"), "success")
+	return redirect(ctx, "/login")
+}
+
+// session keys holding the id_token of an OpenID Connect login, and its provider, until its second factor is verified
+const (
+	totpOidcIdTokenKey  = "totpOidcIdToken"
+	totpOidcProviderKey = "totpOidcProvider"
+)
+
+const (
+	totpLoginTtl         = 5 * time.Minute
+	totpLoginMaxAttempts = 5
+	totpRecoveryCodes    = 10
+	totpPeriod           = 30 // seconds, the default of the authenticator apps
+)
+
+// startTotpLogin keeps the user whose password was checked in the session, until their second factor is verified, a
+// code by processLoginTotp or a passkey by processLoginSecondFactorPasskey
+func startTotpLogin(ctx echo.Context, user *db.User) error {
+	sess := getSession(ctx)
+	setTotpLoginUser(sess, user)
+	saveSession(sess, ctx)
+
+	return redirect(ctx, "/login/totp")
+}
+
+func setTotpLoginUser(sess *sessions.Session, user *db.User) {
+	sess.Values["totpUser"] = user.ID
+	sess.Values["totpUntil"] = time.Now().Add(totpLoginTtl).Unix()
+	sess.Values["totpAttempts"] = 0
+	// the id_token of a login left unfinished
+	delete(sess.Values, totpOidcIdTokenKey)
+	delete(sess.Values, totpOidcProviderKey)
+}
+
+func clearTotpLogin(ctx echo.Context) {
+	sess := getSession(ctx)
+	delete(sess.Values, "totpUser")
+	delete(sess.Values, "totpUntil")
+	delete(sess.Values, "totpAttempts")
+	delete(sess.Values, totpOidcIdTokenKey)
+	delete(sess.Values, totpOidcProviderKey)
+	saveSession(sess, ctx)
+}
+
+// getTotpLoginUser returns the user waiting for the second factor, or nil if there is none or if it took too long
+func getTotpLoginUser(ctx echo.Context) (*db.User, error) {
+	sess := getSession(ctx)
+	userId, ok := sess.Values["totpUser"].(uint)
+	if !ok {
+		return nil, nil
+	}
+	if until, ok := sess.Values["totpUntil"].(int64); !ok || time.Now().Unix() > until {
+		clearTotpLogin(ctx)
+		return nil, nil
+	}
+
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			clearTotpLogin(ctx)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func loginTotp(ctx echo.Context) error {
+	user, err := getTotpLoginUser(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if user == nil {
+		return redirect(ctx, "/login")
+	}
+
+	passkeys, err := db.CountWebAuthnCredentialsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	setData(ctx, "totpEnabled", user.TOTPEnabled)
+	setData(ctx, "hasPasskeys", passkeys > 0)
+	setData(ctx, "title", trH(ctx, "auth.totp"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.totp"))
+	return html(ctx, "auth_totp.html")
+}
+
+func processLoginTotp(ctx echo.Context) error {
+	user, err := getTotpLoginUser(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if user == nil {
+		return redirect(ctx, "/login")
+	}
+
+	if !canLogIn(ctx, user) {
+		clearTotpLogin(ctx)
+		return redirect(ctx, "/login")
+	}
+
+	// the failed codes count as failed logins, the lockout cannot be escaped by starting new logins
+	attemptKeys := loginAttemptKeys(ctx, user.Username)
+	if config.C.MaxLoginAttempts > 0 {
+		locked, until, err := db.IsLoginLocked(attemptKeys...)
+		if err != nil {
+			return errorRes(500, "Cannot check for login lockout", err)
+		}
+		if locked {
+			clearTotpLogin(ctx)
+			authWarn(ctx, "login-locked", user.Username).Msg("Locked out login attempt")
+			addFlash(ctx, tr(ctx, "flash.auth.login-locked", int(math.Ceil(time.Until(time.Unix(until, 0)).Minutes()))), "error")
+			return redirect(ctx, "/login")
+		}
+	}
+
+	ok, err := checkTotpCode(user, ctx.FormValue("code"))
+	if err != nil {
+		return errorRes(500, "Cannot check two-factor code", err)
+	}
+
+	sess := getSession(ctx)
+	if !ok {
+		authWarn(ctx, db.AuditLoginFailed, user.Username).Str("method", "totp").Msg("Invalid two-factor code")
+		audit(ctx, db.AuditLoginFailed, user, "totp")
+		recordLoginFailure(attemptKeys)
+
+		attempts, _ := sess.Values["totpAttempts"].(int)
+		if attempts+1 >= totpLoginMaxAttempts {
+			clearTotpLogin(ctx)
+			addFlash(ctx, tr(ctx, "flash.auth.totp-too-many-attempts"), "error")
+			return redirect(ctx, "/login")
+		}
+		sess.Values["totpAttempts"] = attempts + 1
+		saveSession(sess, ctx)
+
+		addFlash(ctx, tr(ctx, "flash.auth.totp-invalid-code"), "error")
+		return redirect(ctx, "/login/totp")
+	}
+
+	return completeSecondFactorLogin(ctx, user, "totp")
+}
+
+// completeSecondFactorLogin logs in the user whose second factor was verified with the method given
+func completeSecondFactorLogin(ctx echo.Context, user *db.User, method string) error {
+	if err := db.ResetLoginAttempts(loginAttemptKeys(ctx, user.Username)...); err != nil {
+		log.Error().Err(err).Msg("Cannot reset failed logins")
+	}
+
+	recordLoginDevice(ctx, user)
+	audit(ctx, db.AuditLogin, user, method)
+
+	sess := getSession(ctx)
+	delete(sess.Values, "totpUser")
+	delete(sess.Values, "totpUntil")
+	delete(sess.Values, "totpAttempts")
+	if err := setSessionUser(ctx, sess, user.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
+	if idToken, ok := sess.Values[totpOidcIdTokenKey]; ok {
+		sess.Values[oidcIdTokenKey] = idToken
+		sess.Values[oidcProviderKey] = sess.Values[totpOidcProviderKey]
+		delete(sess.Values, totpOidcIdTokenKey)
+		delete(sess.Values, totpOidcProviderKey)
+	}
+	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return redirect(ctx, "/")
+}
+
+// checkTotpCode verifies a code of the authenticator app of the user, or one of its recovery codes, which is then
+// removed
+func checkTotpCode(user *db.User, code string) (bool, error) {
+	// recovery codes are shown with a dash, which is optional
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if code == "" || user.TOTPSecret == "" {
+		return false, nil
+	}
+
+	// a code is refused once used, even within the time it is valid
+	if step, ok := totpCodeStep(code, user.TOTPSecret, time.Now()); ok {
+		return user.UseTOTPStep(step)
+	}
+
+	// each recovery code is an Argon2id hash to check, only the inputs looking like one are tried
+	if !totpRecoveryCodeRegex.MatchString(code) {
+		return false, nil
+	}
+
+	for i, hash := range user.TOTPRecoveryCodes {
+		ok, err := utils.Argon2id.Verify(code, hash)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			user.TOTPRecoveryCodes = append(user.TOTPRecoveryCodes[:i:i], user.TOTPRecoveryCodes[i+1:]...)
+			return true, user.Update()
+		}
+	}
+
+	return false, nil
+}
+
+// totpRecoveryCodeRegex matches a recovery code once its dash is removed
+var totpRecoveryCodeRegex = regexp.MustCompile(`^[0-9a-f]{10}$`)
+
+// totpCodeStep returns the time step of the code, if it is valid at the time given. As with totp.Validate, the codes of
+// the previous and of the next steps are accepted too, for the clocks which are not in sync.
+func totpCodeStep(code string, secret string, now time.Time) (int64, bool) {
+	for skew := -1; skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCode(secret, t)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// generateTotpRecoveryCodes returns new recovery codes to show to the user, and their hashes to store
+func generateTotpRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, totpRecoveryCodes)
+	hashes := make([]string, totpRecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+
+		hash, err := utils.Argon2id.Hash(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = hash
+	}
+	return codes, hashes, nil
+}
+
+func oauthCallback(ctx echo.Context) error {
+	// a login started before the provider was disabled cannot be completed
+	if isOAuthProviderDisabled(ctx, ctx.Param("provider")) {
+		return errorRes(403, tr(ctx, "error.oauth-provider-disabled"), nil)
+	}
+
+	var user goth.User
+	var err error
+	if ctx.Param("provider") == SAMLProvider {
+		user, err = samlCompleteUserAuth(ctx)
+	} else {
+		user, err = gothic.CompleteUserAuth(ctx.Response(), ctx.Request())
+	}
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.complete-oauth-login", err.Error()), err)
+	}
+
+	if user.Provider == MicrosoftProvider {
+		// the nickname given is the display name, which may contain spaces
+		if principalName, ok := user.RawData["userPrincipalName"].(string); ok {
+			user.NickName, _, _ = strings.Cut(principalName, "@")
+		}
+	}
+	if isOIDCProvider(user.Provider) {
+		user.UserID = oidcUserId(user.Provider, user.UserID)
+	}
+
+	_, allowLink := oauthAllowedActions(user.Provider)
+	importGists := user.Provider == GitHubProvider && popGithubImport(ctx)
+
+	currUser := getUserLogged(ctx)
 	if currUser != nil {
-		// Map each provider to a function that checks the relevant ID in currUser
-		providerIDCheckMap := map[string]func() bool{
-			GitHubProvider: func() bool { return currUser.GithubID != "" },
-			GitLabProvider: func() bool { return currUser.GitlabID != "" },
-			GiteaProvider:  func() bool { return currUser.GiteaID != "" },
-			OpenIDConnect:  func() bool { return currUser.OIDCID != "" },
-		}
-
-		// Check if the provider is valid and if the user has a linked ID
-		// Means that the user wants to unlink the account
-		if checkFunc, exists := providerIDCheckMap[provider]; exists && checkFunc() {
-			if err := currUser.DeleteProviderID(provider); err != nil {
-				return errorRes(500, "Cannot unlink account from "+title.String(provider), err)
+		if reauthProvider := popAccountDeleteReauth(ctx); reauthProvider == user.Provider {
+			return accountDeleteReauthCallback(ctx, currUser, user.Provider, user.UserID)
+		}
+
+		if importGists {
+			return githubImportCallback(ctx, currUser, user.AccessToken, user.UserID)
+		}
+
+		if !allowLink {
+			addFlash(ctx, tr(ctx, "flash.auth.oauth-link-disabled", title.String(user.Provider)), "error")
+			return redirect(ctx, "/settings")
+		}
+
+		// if user is logged in, link account to user and update its avatar URL
+		if err = linkProvider(ctx, currUser, user); err != nil {
+			return errorRes(500, "Cannot update user "+title.String(user.Provider)+" id", err)
+		}
+
+		if isOIDCProvider(user.Provider) {
+			sess := getSession(ctx)
+			sess.Values[oidcIdTokenKey] = user.IDToken
+			sess.Values[oidcProviderKey] = user.Provider
+			saveSession(sess, ctx)
+		}
+
+		addFlash(ctx, tr(ctx, "flash.auth.account-linked-oauth", title.String(user.Provider)), "success")
+		return redirect(ctx, "/settings")
+	}
+
+	userDB, err := db.GetUserByProvider(user.UserID, user.Provider)
+
+	// if user is not in database, link it to the account using its email, or create it
+	if errors.Is(err, gorm.ErrRecordNotFound) && allowLink {
+		emailUser, emailErr := getEmailAccount(user)
+		if emailErr != nil {
+			return errorRes(500, "Cannot get user", emailErr)
+		}
+
+		if emailUser != nil {
+			// the address could have been added to the provider by someone else than the owner of the account
+			if emailUser.Password != "" {
+				return startOAuthEmailLink(ctx, emailUser, user)
+			}
+
+			if err = linkProvider(ctx, emailUser, user); err != nil {
+				return errorRes(500, "Cannot update user "+title.String(user.Provider)+" id", err)
+			}
+			userDB, err = emailUser, nil
+		}
+	}
+
+	if err != nil {
+		if getData(ctx, "DisableSignup") == true {
+			return errorRes(403, tr(ctx, "error.signup-disabled"), nil)
+		}
+
+		if isReadOnly(ctx) {
+			return readOnlyError(ctx)
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get user", err)
+		}
+
+		if allowSignup, _ := oauthAllowedActions(user.Provider); !allowSignup {
+			addFlash(ctx, tr(ctx, "flash.auth.oauth-signup-disabled", title.String(user.Provider)), "error")
+			return redirect(ctx, "/login")
+		}
+
+		if !isSignupEmailAllowed(user.Email) {
+			addFlash(ctx, tr(ctx, "flash.auth.signup-domain-not-allowed", strings.Join(signupDomains(), ", ")), "error")
+			return redirect(ctx, "/login")
+		}
+
+		if utils.IsReservedUsername(user.NickName) {
+			addFlash(ctx, tr(ctx, "flash.auth.username-reserved"), "error")
+			return redirect(ctx, "/login")
+		}
+
+		address := strings.ToLower(strings.TrimSpace(user.Email))
+		if config.C.UniqueEmails && address != "" {
+			// an address not verified by the provider could belong to the owner of another account
+			if !isProviderEmailVerified(user) {
+				address = ""
+			} else if emailTaken, err := db.EmailUsedByOtherUser(address, 0); err != nil {
+				return errorRes(500, "Cannot check email", err)
+			} else if emailTaken {
+				addFlash(ctx, tr(ctx, "flash.auth.oauth-email-exists", title.String(user.Provider)), "error")
+				return redirect(ctx, "/login")
+			}
+		}
+
+		userDB = &db.User{
+			Username:      user.NickName,
+			Email:         address,
+			EmailVerified: true,
+			MD5Hash:       fmt.Sprintf("%x", md5.Sum([]byte(address))),
+		}
+
+		// set provider id and avatar URL
+		updateUserProviderInfo(userDB, user.Provider, user)
+
+		if userDB.PendingApproval, err = signupNeedsApproval(); err != nil {
+			return errorRes(500, "Cannot count users", err)
+		}
+
+		if err = userDB.Create(); err != nil {
+			if db.IsEmailConstraintViolation(err) {
+				addFlash(ctx, tr(ctx, "flash.auth.oauth-email-exists", title.String(user.Provider)), "error")
+				return redirect(ctx, "/login")
+			}
+			if db.IsUniqueConstraintViolation(err) {
+				addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
+				return redirect(ctx, "/login")
+			}
+
+			return errorRes(500, "Cannot create user", err)
+		}
+
+		if userDB.ID == 1 {
+			if err = userDB.SetAdmin(); err != nil {
+				return errorRes(500, "Cannot set user admin", err)
+			}
+		}
+
+		audit(ctx, db.AuditRegister, userDB, user.Provider)
+
+		var keysUrl string
+		switch {
+		case config.C.PrivacyNoOutbound:
+		case user.Provider == GitHubProvider:
+			keysUrl = "https://github.com/" + user.NickName + ".keys"
+		case user.Provider == GitLabProvider:
+			keysUrl = urlJoin(config.C.GitlabUrl, user.NickName+".keys")
+		case user.Provider == GiteaProvider:
+			keysUrl = urlJoin(config.C.GiteaUrl, user.NickName+".keys")
+		case user.Provider == BitbucketProvider:
+			// the keys are only listed by the API, to the user itself
+			importBitbucketKeys(ctx, userDB, user)
+		case isOIDCProvider(user.Provider) && config.C.OIDCKeysUrl != "":
+			keysUrl = strings.ReplaceAll(config.C.OIDCKeysUrl, "{username}", url.PathEscape(user.NickName))
+		}
+
+		if keysUrl != "" {
+			importProviderKeys(ctx, userDB, user.Provider, keysUrl)
+		}
+
+		if userDB.PendingApproval {
+			addFlash(ctx, tr(ctx, "flash.auth.account-created-pending-approval"), "success")
+			return redirect(ctx, "/login")
+		}
+	}
+
+	if !canLogIn(ctx, userDB) {
+		return redirect(ctx, "/login")
+	}
+
+	if isOIDCProvider(user.Provider) {
+		if err = syncOIDCAdmin(userDB, user); err != nil {
+			return errorRes(500, "Cannot update user admin role", err)
+		}
+	}
+
+	// the second factor of the user is asked whatever the provider, as for the other login methods
+	sess := getSession(ctx)
+	if ok, err := hasTwoFactor(userDB); err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	} else if ok {
+		setTotpLoginUser(sess, userDB)
+		if isOIDCProvider(user.Provider) {
+			sess.Values[totpOidcIdTokenKey] = user.IDToken
+			sess.Values[totpOidcProviderKey] = user.Provider
+		}
+		saveSession(sess, ctx)
+		return redirect(ctx, "/login/totp")
+	}
+
+	recordLoginDevice(ctx, userDB)
+	audit(ctx, db.AuditLogin, userDB, user.Provider)
+
+	if err := setSessionUser(ctx, sess, userDB.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
+	if isOIDCProvider(user.Provider) {
+		// kept for RP-initiated logout; the user session store is encrypted with session-encrypt.key
+		sess.Values[oidcIdTokenKey] = user.IDToken
+		sess.Values[oidcProviderKey] = user.Provider
+	}
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return redirect(ctx, "/")
+}
+
+// linkProvider links the account of the provider to the user, and updates its avatar URL
+func linkProvider(ctx echo.Context, userDB *db.User, user goth.User) error {
+	updateUserProviderInfo(userDB, user.Provider, user)
+	if err := userDB.Update(); err != nil {
+		return err
+	}
+
+	// an admin impersonating the user is the actor, as for the other changes they make
+	actor := userDB
+	if getImpersonator(ctx) != nil {
+		actor = nil
+	}
+	audit(ctx, db.AuditOAuthLink, actor, user.Provider)
+	return nil
+}
+
+// getEmailAccount returns the account to link to the provider user because it uses the same email, or nil if there is
+// none or if the accounts are not linked by email. Both Opengist and the provider must have verified the address.
+func getEmailAccount(user goth.User) (*db.User, error) {
+	if !config.C.LinkAccountsByEmail || strings.TrimSpace(user.Email) == "" || !isProviderEmailVerified(user) {
+		return nil, nil
+	}
+
+	userDB, err := db.GetUserByEmail(user.Email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// an account already linked to another user of the provider is left as it is
+	if !userDB.EmailVerified || isProviderLinked(userDB, user.Provider) ||
+		isOIDCProvider(user.Provider) && userDB.OIDCID != "" {
+		return nil, nil
+	}
+	return userDB, nil
+}
+
+// isProviderEmailVerified reports whether the provider checked that the email it gave belongs to the user. GitHub and
+// GitLab only give verified addresses, the OpenID Connect and OAuth2 providers tell it in the email_verified claim, and
+// the others cannot be trusted.
+func isProviderEmailVerified(user goth.User) bool {
+	provider := user.Provider
+	if isOIDCProvider(provider) {
+		provider = OpenIDConnect
+	}
+
+	switch provider {
+	case GitHubProvider, GitLabProvider:
+		return true
+	case BitbucketProvider:
+		// only the primary email is given, once confirmed
+		return true
+	case OpenIDConnect, OAuth2Provider:
+		switch verified := user.RawData["email_verified"].(type) {
+		case bool:
+			return verified
+		case string:
+			return verified == "true"
+		}
+	}
+	return false
+}
+
+const oauthEmailLinkTtl = 10 * time.Minute
+
+// startOAuthEmailLink keeps the provider user in the session until the password of the account using its email is
+// confirmed by processOAuthEmailLink
+func startOAuthEmailLink(ctx echo.Context, userDB *db.User, user goth.User) error {
+	sess := getSession(ctx)
+	sess.Values["oauthLinkUser"] = userDB.ID
+	sess.Values["oauthLinkProvider"] = user.Provider
+	sess.Values["oauthLinkId"] = user.UserID
+	sess.Values["oauthLinkAvatar"] = user.AvatarURL
+	sess.Values["oauthLinkIdToken"] = user.IDToken
+	sess.Values["oauthLinkUntil"] = time.Now().Add(oauthEmailLinkTtl).Unix()
+	saveSession(sess, ctx)
+
+	return redirect(ctx, "/login/oauth-link")
+}
+
+func clearOAuthEmailLink(ctx echo.Context) {
+	sess := getSession(ctx)
+	for _, key := range []string{"oauthLinkUser", "oauthLinkProvider", "oauthLinkId", "oauthLinkAvatar", "oauthLinkIdToken", "oauthLinkUntil"} {
+		delete(sess.Values, key)
+	}
+	saveSession(sess, ctx)
+}
+
+// getOAuthEmailLink returns the account waiting to be linked and the provider user, or nil if there is none or if it
+// took too long
+func getOAuthEmailLink(ctx echo.Context) (*db.User, goth.User, error) {
+	sess := getSession(ctx)
+	userId, ok := sess.Values["oauthLinkUser"].(uint)
+	if !ok {
+		return nil, goth.User{}, nil
+	}
+	if until, ok := sess.Values["oauthLinkUntil"].(int64); !ok || time.Now().Unix() > until {
+		clearOAuthEmailLink(ctx)
+		return nil, goth.User{}, nil
+	}
+
+	user := goth.User{}
+	user.Provider, _ = sess.Values["oauthLinkProvider"].(string)
+	user.UserID, _ = sess.Values["oauthLinkId"].(string)
+	user.AvatarURL, _ = sess.Values["oauthLinkAvatar"].(string)
+	user.IDToken, _ = sess.Values["oauthLinkIdToken"].(string)
+
+	userDB, err := db.GetUserById(userId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			clearOAuthEmailLink(ctx)
+			return nil, user, nil
+		}
+		return nil, user, err
+	}
+	return userDB, user, nil
+}
+
+func oauthEmailLink(ctx echo.Context) error {
+	userDB, user, err := getOAuthEmailLink(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if userDB == nil {
+		return redirect(ctx, "/login")
+	}
+
+	setData(ctx, "title", trH(ctx, "auth.oauth-link"))
+	setData(ctx, "htmlTitle", trH(ctx, "auth.oauth-link"))
+	setData(ctx, "linkUsername", userDB.Username)
+	setData(ctx, "linkProvider", oauthProviderName(user.Provider))
+	return html(ctx, "auth_oauth_link.html")
+}
+
+func processOAuthEmailLink(ctx echo.Context) error {
+	userDB, user, err := getOAuthEmailLink(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if userDB == nil {
+		return redirect(ctx, "/login")
+	}
+
+	if ctx.FormValue("cancel") != "" {
+		clearOAuthEmailLink(ctx)
+		return redirect(ctx, "/login")
+	}
+
+	attemptKeys := loginAttemptKeys(ctx, userDB.Username)
+	if config.C.MaxLoginAttempts > 0 {
+		locked, until, err := db.IsLoginLocked(attemptKeys...)
+		if err != nil {
+			return errorRes(500, "Cannot check for login lockout", err)
+		}
+		if locked {
+			clearOAuthEmailLink(ctx)
+			addFlash(ctx, tr(ctx, "flash.auth.login-locked", int(math.Ceil(time.Until(time.Unix(until, 0)).Minutes()))), "error")
+			return redirect(ctx, "/login")
+		}
+	}
+
+	if ok, err := utils.Argon2id.Verify(ctx.FormValue("password"), userDB.Password); !ok {
+		if err != nil {
+			return errorRes(500, "Cannot check for password", err)
+		}
+		authWarn(ctx, db.AuditLoginFailed, userDB.Username).Str("method", user.Provider).Msg("Invalid password to link an OAuth account")
+		audit(ctx, db.AuditLoginFailed, userDB, user.Provider)
+		recordLoginFailure(attemptKeys)
+		addFlash(ctx, tr(ctx, "flash.auth.invalid-credentials"), "error")
+		return redirect(ctx, "/login/oauth-link")
+	}
+
+	clearOAuthEmailLink(ctx)
+
+	if !canLogIn(ctx, userDB) {
+		return redirect(ctx, "/login")
+	}
+
+	// another account may have been linked to the provider user in the meantime
+	if _, err = db.GetUserByProvider(user.UserID, user.Provider); !errors.Is(err, gorm.ErrRecordNotFound) {
+		if err != nil {
+			return errorRes(500, "Cannot get user", err)
+		}
+		return redirect(ctx, "/login")
+	}
+
+	if err = linkProvider(ctx, userDB, user); err != nil {
+		return errorRes(500, "Cannot update user "+title.String(user.Provider)+" id", err)
+	}
+	addFlash(ctx, tr(ctx, "flash.auth.account-linked-oauth", title.String(user.Provider)), "success")
+
+	if ok, err := hasTwoFactor(userDB); err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	} else if ok {
+		return startTotpLogin(ctx, userDB)
+	}
+
+	if err = db.ResetLoginAttempts(attemptKeys...); err != nil {
+		log.Error().Err(err).Msg("Cannot reset failed logins")
+	}
+
+	recordLoginDevice(ctx, userDB)
+	audit(ctx, db.AuditLogin, userDB, user.Provider)
+
+	sess := getSession(ctx)
+	if err := setSessionUser(ctx, sess, userDB.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
+	if isOIDCProvider(user.Provider) {
+		sess.Values[oidcIdTokenKey] = user.IDToken
+		sess.Values[oidcProviderKey] = user.Provider
+	}
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return redirect(ctx, "/")
+}
+
+func oauth(ctx echo.Context) error {
+	provider := ctx.Param("provider")
+	if isOAuthProviderDisabled(ctx, provider) {
+		return errorRes(403, tr(ctx, "error.oauth-provider-disabled"), nil)
+	}
+
+	opengistUrl := getData(ctx, "baseHttpUrl").(string)
+	importGists := provider == GitHubProvider && ctx.QueryParam("import") == "gists"
+
+	switch provider {
+	case GitHubProvider:
+		var scopes []string
+		if importGists {
+			// needed to list the secret gists
+			scopes = []string{"gist"}
+		}
+
+		githubProvider := github.New(
+			config.C.GithubClientKey,
+			config.C.GithubSecret,
+			urlJoin(opengistUrl, "/oauth/github/callback"),
+			scopes...,
+		)
+		githubProvider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(githubProvider)
+
+	case GitLabProvider:
+		gitlabProvider := gitlab.NewCustomisedURL(
+			config.C.GitlabClientKey,
+			config.C.GitlabSecret,
+			urlJoin(opengistUrl, "/oauth/gitlab/callback"),
+			urlJoin(config.C.GitlabUrl, "/oauth/authorize"),
+			urlJoin(config.C.GitlabUrl, "/oauth/token"),
+			urlJoin(config.C.GitlabUrl, "/api/v4/user"),
+		)
+		gitlabProvider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(gitlabProvider)
+
+	case GiteaProvider:
+		giteaProvider := gitea.NewCustomisedURL(
+			config.C.GiteaClientKey,
+			config.C.GiteaSecret,
+			urlJoin(opengistUrl, "/oauth/gitea/callback"),
+			urlJoin(config.C.GiteaUrl, "/login/oauth/authorize"),
+			urlJoin(config.C.GiteaUrl, "/login/oauth/access_token"),
+			urlJoin(config.C.GiteaUrl, "/api/v1/user"),
+		)
+		giteaProvider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(giteaProvider)
+	case BitbucketProvider:
+		bitbucketProvider := bitbucket.New(
+			config.C.BitbucketClientKey,
+			config.C.BitbucketSecret,
+			urlJoin(opengistUrl, "/oauth/bitbucket/callback"),
+		)
+		bitbucketProvider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(bitbucketProvider)
+	case MicrosoftProvider:
+		microsoftProvider := azureadv2.New(
+			config.C.MicrosoftClientKey,
+			config.C.MicrosoftSecret,
+			urlJoin(opengistUrl, "/oauth/microsoft/callback"),
+			azureadv2.ProviderOptions{Tenant: azureadv2.TenantType(config.C.MicrosoftTenant)},
+		)
+		microsoftProvider.SetName(MicrosoftProvider)
+		microsoftProvider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(microsoftProvider)
+	case OpenIDConnect:
+		oidcProvider, err := newOIDCProvider(OpenIDConnect, opengistUrl)
+		if err != nil {
+			return errorRes(500, "Cannot create OIDC provider", err)
+		}
+
+		goth.UseProviders(oidcProvider)
+	case OAuth2Provider:
+		oauth2Provider := auth.NewOAuth2Provider(
+			OAuth2Provider,
+			config.C.OAuth2ClientKey,
+			config.C.OAuth2Secret,
+			urlJoin(opengistUrl, "/oauth/oauth2/callback"),
+			config.C.OAuth2AuthorizeUrl,
+			config.C.OAuth2TokenUrl,
+			config.C.OAuth2UserinfoUrl,
+			splitScopes(config.C.OAuth2Scopes),
+		)
+		oauth2Provider.IDField = config.C.OAuth2IdField
+		oauth2Provider.UsernameField = config.C.OAuth2UsernameField
+		oauth2Provider.EmailField = config.C.OAuth2EmailField
+		oauth2Provider.AvatarField = config.C.OAuth2AvatarField
+		oauth2Provider.HTTPClient = utils.HttpClient
+
+		goth.UseProviders(oauth2Provider)
+	default:
+		if _, ok := namedOIDCProvider(provider); ok {
+			oidcProvider, err := newOIDCProvider(provider, opengistUrl)
+			if err != nil {
+				return errorRes(500, "Cannot create OIDC provider", err)
 			}
 
-			addFlash(ctx, tr(ctx, "flash.auth.account-unlinked-oauth", title.String(provider)), "success")
+			goth.UseProviders(oidcProvider)
+		}
+	}
+
+	if importGists {
+		if !startGithubImport(ctx) {
+			addFlash(ctx, tr(ctx, "flash.user.github-import-not-linked"), "error")
+			return redirect(ctx, "/settings")
+		}
+	} else if ctx.QueryParam("reauth") == "delete-account" {
+		if !startAccountDeleteReauth(ctx, provider) {
+			addFlash(ctx, tr(ctx, "flash.user.delete-account-wrong-account"), "error")
+			return redirect(ctx, "/settings/account/delete")
+		}
+	} else if currUser := getUserLogged(ctx); currUser != nil {
+		// a sign-in or link button never unlinks an account, that is done by oauthUnlink
+		if isProviderLinked(currUser, provider) {
+			addFlash(ctx, tr(ctx, "flash.auth.account-already-linked-oauth", oauthProviderName(provider)), "success")
+			return redirect(ctx, "/settings")
+		}
+
+		if _, allowLink := oauthAllowedActions(provider); !allowLink {
+			addFlash(ctx, tr(ctx, "flash.auth.oauth-link-disabled", oauthProviderName(provider)), "error")
+			return redirect(ctx, "/settings")
+		}
+
+		// the OpenID Connect providers share the field of the linked account
+		if isOIDCProvider(provider) && currUser.OIDCID != "" {
+			addFlash(ctx, tr(ctx, "flash.auth.oidc-already-linked", oauthProviderName(linkedOIDCProvider(currUser))), "error")
 			return redirect(ctx, "/settings")
 		}
 	}
 
+	if provider == SAMLProvider {
+		if !isOAuthProviderConfigured(SAMLProvider) {
+			return errorRes(400, tr(ctx, "error.oauth-unsupported"), nil)
+		}
+		return samlBeginAuth(ctx)
+	}
+
 	ctxValue := context.WithValue(ctx.Request().Context(), gothic.ProviderParamKey, provider)
 	ctx.SetRequest(ctx.Request().WithContext(ctxValue))
-	if provider != GitHubProvider && provider != GitLabProvider && provider != GiteaProvider && provider != OpenIDConnect {
+	if provider != GitHubProvider && provider != GitLabProvider && provider != GiteaProvider && provider != BitbucketProvider && provider != MicrosoftProvider && !isOIDCProvider(provider) && provider != OAuth2Provider {
 		return errorRes(400, tr(ctx, "error.oauth-unsupported"), nil)
 	}
 
@@ -376,10 +1727,453 @@ func oauth(ctx echo.Context) error {
 	return nil
 }
 
+// isOAuthProviderConfigured reports whether the keys of the provider are set in the configuration
+func isOAuthProviderConfigured(provider string) bool {
+	switch provider {
+	case GitHubProvider:
+		return config.C.GithubClientKey != "" && config.C.GithubSecret != ""
+	case GitLabProvider:
+		return config.C.GitlabClientKey != "" && config.C.GitlabSecret != ""
+	case GiteaProvider:
+		return config.C.GiteaClientKey != "" && config.C.GiteaSecret != ""
+	case BitbucketProvider:
+		return config.C.BitbucketClientKey != "" && config.C.BitbucketSecret != ""
+	case MicrosoftProvider:
+		return config.C.MicrosoftClientKey != "" && config.C.MicrosoftSecret != ""
+	case OpenIDConnect:
+		return config.C.OIDCClientKey != "" && config.C.OIDCSecret != "" && config.C.OIDCDiscoveryUrl != ""
+	case OAuth2Provider:
+		return config.C.OAuth2ClientKey != "" && config.C.OAuth2Secret != "" && config.C.OAuth2AuthorizeUrl != "" &&
+			config.C.OAuth2TokenUrl != "" && config.C.OAuth2UserinfoUrl != ""
+	case SAMLProvider:
+		return config.C.SAMLIdPMetadataUrl != ""
+	}
+	_, ok := namedOIDCProvider(provider)
+	return ok
+}
+
+// isOAuthProviderDisabled reports whether an admin disabled the login with the provider
+func isOAuthProviderDisabled(ctx echo.Context, provider string) bool {
+	return getData(ctx, settingDataKey(db.SettingDisableOAuth(provider))) == true
+}
+
+// isOAuthProviderEnabled reports whether the login with the provider is offered: it must be configured, and not
+// disabled by an admin
+func isOAuthProviderEnabled(ctx echo.Context, provider string) bool {
+	return isOAuthProviderConfigured(provider) && !isOAuthProviderDisabled(ctx, provider)
+}
+
+func oauthProviderName(provider string) string {
+	switch provider {
+	case GitHubProvider:
+		return "GitHub"
+	case GitLabProvider:
+		return config.C.GitlabName
+	case GiteaProvider:
+		return config.C.GiteaName
+	case BitbucketProvider:
+		return "Bitbucket"
+	case MicrosoftProvider:
+		return "Microsoft"
+	case OpenIDConnect:
+		return "OpenID Connect"
+	case OAuth2Provider:
+		return config.C.OAuth2Name
+	case SAMLProvider:
+		return config.C.SAMLName
+	}
+	if p, ok := namedOIDCProvider(provider); ok {
+		return p.Name
+	}
+	return title.String(provider)
+}
+
+// oauthButton is a button of the login page starting the login with an OAuth provider. Without a label, it reads
+// "Continue with <name> account".
+type oauthButton struct {
+	Provider string
+	Name     string
+	Label    string
+	Icon     string
+}
+
+// oauthButtonConfig returns the label and the icon set in the configuration for the login button of the provider
+func oauthButtonConfig(provider string) (string, string) {
+	switch provider {
+	case GitHubProvider:
+		return config.C.GithubButtonLabel, config.C.GithubButtonIcon
+	case GitLabProvider:
+		return config.C.GitlabButtonLabel, config.C.GitlabButtonIcon
+	case GiteaProvider:
+		return config.C.GiteaButtonLabel, config.C.GiteaButtonIcon
+	case BitbucketProvider:
+		return config.C.BitbucketButtonLabel, config.C.BitbucketButtonIcon
+	case MicrosoftProvider:
+		return config.C.MicrosoftButtonLabel, config.C.MicrosoftButtonIcon
+	case OpenIDConnect:
+		return config.C.OIDCButtonLabel, config.C.OIDCButtonIcon
+	case OAuth2Provider:
+		return config.C.OAuth2ButtonLabel, config.C.OAuth2ButtonIcon
+	case SAMLProvider:
+		return config.C.SAMLButtonLabel, config.C.SAMLButtonIcon
+	}
+	if p, ok := namedOIDCProvider(provider); ok {
+		return p.ButtonLabel, p.ButtonIcon
+	}
+	return "", ""
+}
+
+// oauthButtons returns the buttons of the login page, for the providers users can log in with
+func oauthButtons(ctx echo.Context) []oauthButton {
+	var buttons []oauthButton
+	for _, provider := range allOAuthProviders() {
+		if !isOAuthProviderEnabled(ctx, provider) {
+			continue
+		}
+
+		button := oauthButton{Provider: provider, Name: oauthProviderName(provider)}
+		if provider == OpenIDConnect {
+			button.Name = "OpenID"
+		}
+		button.Label, button.Icon = oauthButtonConfig(provider)
+		// like the custom logo, an icon which is not a URL is a file of the custom directory
+		if button.Icon != "" && !strings.Contains(button.Icon, "://") {
+			button.Icon = customAsset(button.Icon)
+		}
+		buttons = append(buttons, button)
+	}
+	return buttons
+}
+
+// configuredOAuthProviders returns the providers set in the configuration, with the setting disabling each of them
+func configuredOAuthProviders(ctx echo.Context) []oauthProviderSetting {
+	providers := make([]oauthProviderSetting, 0, len(oauthProviders))
+	for _, provider := range allOAuthProviders() {
+		if !isOAuthProviderConfigured(provider) {
+			continue
+		}
+		key := db.SettingDisableOAuth(provider)
+		providers = append(providers, oauthProviderSetting{
+			Name:       oauthProviderName(provider),
+			SettingKey: key,
+			Disabled:   isOAuthProviderDisabled(ctx, provider),
+		})
+	}
+	return providers
+}
+
+func oauthUnlink(ctx echo.Context) error {
+	provider := ctx.Param("provider")
+	currUser := getUserLogged(ctx)
+
+	if !isProviderLinked(currUser, provider) {
+		return redirect(ctx, "/settings")
+	}
+
+	if err := currUser.DeleteProviderID(provider); err != nil {
+		return errorRes(500, "Cannot unlink account from "+title.String(provider), err)
+	}
+
+	audit(ctx, db.AuditOAuthUnlink, currUser, provider)
+
+	addFlash(ctx, tr(ctx, "flash.auth.account-unlinked-oauth", oauthProviderName(provider)), "success")
+	return redirect(ctx, "/settings")
+}
+
+// oauthAllowedActions returns whether new accounts can be created with the provider, and whether existing accounts
+// can be linked to it
+func oauthAllowedActions(provider string) (signup bool, link bool) {
+	if isOIDCProvider(provider) {
+		provider = OpenIDConnect
+	}
+
+	switch provider {
+	case GitHubProvider:
+		return config.C.GithubAllowSignup, config.C.GithubAllowLink
+	case GitLabProvider:
+		return config.C.GitlabAllowSignup, config.C.GitlabAllowLink
+	case GiteaProvider:
+		return config.C.GiteaAllowSignup, config.C.GiteaAllowLink
+	case BitbucketProvider:
+		return config.C.BitbucketAllowSignup, config.C.BitbucketAllowLink
+	case MicrosoftProvider:
+		return config.C.MicrosoftAllowSignup, config.C.MicrosoftAllowLink
+	case OpenIDConnect:
+		return config.C.OIDCAllowSignup, config.C.OIDCAllowLink
+	case OAuth2Provider:
+		return config.C.OAuth2AllowSignup, config.C.OAuth2AllowLink
+	case SAMLProvider:
+		return config.C.SAMLAllowSignup, config.C.SAMLAllowLink
+	default:
+		return false, false
+	}
+}
+
+// isProviderLinked reports whether the user has an account of the provider linked
+func isProviderLinked(user *db.User, provider string) bool {
+	switch provider {
+	case GitHubProvider:
+		return user.GithubID != ""
+	case GitLabProvider:
+		return user.GitlabID != ""
+	case GiteaProvider:
+		return user.GiteaID != ""
+	case BitbucketProvider:
+		return user.BitbucketID != ""
+	case MicrosoftProvider:
+		return user.MicrosoftID != ""
+	case OAuth2Provider:
+		return user.OAuth2ID != ""
+	case SAMLProvider:
+		return user.SAMLID != ""
+	default:
+		return isOIDCProvider(provider) && linkedOIDCProvider(user) == provider
+	}
+}
+
 func logout(ctx echo.Context) error {
+	endSessionUrl := oidcEndSessionUrl(ctx)
+
 	deleteSession(ctx)
 	deleteCsrfCookie(ctx)
-	return redirect(ctx, "/all")
+
+	if endSessionUrl != "" {
+		return ctx.Redirect(302, endSessionUrl)
+	}
+	if isAbsoluteUrl(config.C.PostLogoutRedirect) {
+		return ctx.Redirect(302, config.C.PostLogoutRedirect)
+	}
+	return redirect(ctx, config.C.PostLogoutRedirect)
+}
+
+// importProviderKeys adds to the user the SSH keys listed one per line at keysUrl, like the .keys endpoints of the
+// forges. Failures are reported to the user but do not prevent the signup.
+func importProviderKeys(ctx echo.Context, userDB *db.User, provider string, keysUrl string) {
+	resp, err := utils.GetWithRetries(keysUrl)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+	}
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.auth.user-sshkeys-not-retrievable"), "error")
+		log.Error().Err(err).Msg("Could not get user keys from " + provider)
+		return
+	}
+
+	createProviderKeys(ctx, userDB, provider, strings.Split(string(body), "\n"))
+}
+
+// importBitbucketKeys imports the SSH keys of a Bitbucket account, which its API only lists to the user itself
+func importBitbucketKeys(ctx echo.Context, userDB *db.User, user goth.User) {
+	keys, err := fetchBitbucketKeys(user)
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.auth.user-sshkeys-not-retrievable"), "error")
+		log.Error().Err(err).Msg("Could not get user keys from " + user.Provider)
+		return
+	}
+
+	createProviderKeys(ctx, userDB, user.Provider, keys)
+}
+
+func fetchBitbucketKeys(user goth.User) ([]string, error) {
+	req, err := http.NewRequest("GET", urlJoin(bitbucketApiUrl, "/users/", user.UserID, "/ssh-keys")+"?pagelen=100", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+user.AccessToken)
+
+	resp, err := utils.DoWithRetries(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		Values []struct {
+			Key string `json:"key"`
+		} `json:"values"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(result.Values))
+	for _, value := range result.Values {
+		keys = append(keys, value.Key)
+	}
+	return keys, nil
+}
+
+func createProviderKeys(ctx echo.Context, userDB *db.User, provider string, keys []string) {
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		sshKey := db.SSHKey{
+			Title:   "Added from " + provider,
+			Content: key,
+			User:    *userDB,
+		}
+
+		if err := sshKey.Create(); err != nil {
+			addFlash(ctx, tr(ctx, "flash.auth.user-sshkeys-not-created"), "error")
+			log.Error().Err(err).Msg("Could not create ssh key")
+		}
+	}
+}
+
+// postLogoutRedirectUrl returns the absolute URL where users are sent after logging out
+func postLogoutRedirectUrl(baseUrl string) string {
+	if isAbsoluteUrl(config.C.PostLogoutRedirect) {
+		return config.C.PostLogoutRedirect
+	}
+	return strings.TrimSuffix(baseUrl, "/") + config.C.PostLogoutRedirect
+}
+
+func isAbsoluteUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	return err == nil && u.IsAbs()
+}
+
+// syncOIDCAdmin grants or revokes the admin role of the user according to its membership of the admin group
+// given by the OIDC provider. Nothing is changed if no admin group is configured or if the claim is missing, and
+// the first user, made admin when the instance was set up, is never demoted.
+func syncOIDCAdmin(userDB *db.User, user goth.User) error {
+	if config.C.OIDCAdminGroup == "" {
+		return nil
+	}
+
+	claim, ok := user.RawData[config.C.OIDCGroupsClaim]
+	if !ok {
+		log.Debug().Msgf("OIDC claim %q missing for user %s, admin role left unchanged", config.C.OIDCGroupsClaim, userDB.Username)
+		return nil
+	}
+
+	var isMember bool
+	switch groups := claim.(type) {
+	case string:
+		isMember = groups == config.C.OIDCAdminGroup
+	case []interface{}:
+		for _, group := range groups {
+			if g, ok := group.(string); ok && g == config.C.OIDCAdminGroup {
+				isMember = true
+				break
+			}
+		}
+	default:
+		log.Warn().Msgf("OIDC claim %q of user %s is not a list of groups, admin role left unchanged", config.C.OIDCGroupsClaim, userDB.Username)
+		return nil
+	}
+
+	switch {
+	case isMember && !userDB.IsAdmin:
+		return userDB.SetAdmin()
+	case !isMember && userDB.IsAdmin && userDB.ID != 1:
+		return userDB.RevokeAdmin()
+	}
+	return nil
+}
+
+// oidcEndSessionUrl returns the RP-initiated logout URL of the OIDC provider if the current session
+// holds an id_token and the provider advertises an end_session_endpoint, an empty string otherwise
+func oidcEndSessionUrl(ctx echo.Context) string {
+	idToken, ok := getSession(ctx).Values[oidcIdTokenKey].(string)
+	if !ok || idToken == "" {
+		return ""
+	}
+
+	baseUrl := getData(ctx, "baseHttpUrl").(string)
+
+	// the sessions opened before several providers could be configured did not record it
+	provider, _ := getSession(ctx).Values[oidcProviderKey].(string)
+	if !isOIDCProvider(provider) {
+		provider = OpenIDConnect
+	}
+
+	var oidcProvider *openidConnect.Provider
+	if p, err := goth.GetProvider(provider); err == nil {
+		oidcProvider = p.(*openidConnect.Provider)
+	} else {
+		if oidcProvider, err = newOIDCProvider(provider, baseUrl); err != nil {
+			log.Error().Err(err).Msg("Cannot create OIDC provider")
+			return ""
+		}
+		goth.UseProviders(oidcProvider)
+	}
+
+	if oidcProvider.OpenIDConfig == nil || oidcProvider.OpenIDConfig.EndSessionEndpoint == "" {
+		return ""
+	}
+
+	endSessionUrl, err := url.Parse(oidcProvider.OpenIDConfig.EndSessionEndpoint)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot parse OIDC end session endpoint")
+		return ""
+	}
+
+	query := endSessionUrl.Query()
+	query.Set("id_token_hint", idToken)
+	query.Set("client_id", oidcProviderConfig(provider).ClientKey)
+	query.Set("post_logout_redirect_uri", postLogoutRedirectUrl(baseUrl))
+	endSessionUrl.RawQuery = query.Encode()
+
+	return endSessionUrl.String()
+}
+
+// recordLoginDevice saves the device (IP address and user agent) used to log in, and emails the user
+// if they opted in to be notified of logins from a device never seen before
+func recordLoginDevice(ctx echo.Context, user *db.User) {
+	nbDevices, err := db.CountUserDevices(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot count user devices")
+		return
+	}
+
+	ip := ctx.RealIP()
+	userAgent := ctx.Request().UserAgent()
+	isNew, err := db.RecordUserDevice(user.ID, ip, userAgent)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot record user device")
+		return
+	}
+
+	// the very first device of a user is not worth a notification
+	if !isNew || nbDevices == 0 || !user.NotifyNewLogin || user.Email == "" || !email.Enabled() {
+		return
+	}
+
+	location := tr(ctx, "email.new-login.location-unknown")
+	if country := ctx.Request().Header.Get("CF-IPCountry"); country != "" {
+		location = country
+	}
+
+	subject := tr(ctx, "email.new-login.subject")
+	body := tr(ctx, "email.new-login.body",
+		user.Username,
+		time.Now().Format(time.RFC1123),
+		ip,
+		location,
+		userAgent,
+		urlJoin(getData(ctx, "baseHttpUrl").(string), "/settings"),
+	)
+
+	go func(to string) {
+		if err := email.Send(to, subject, body); err != nil {
+			log.Error().Err(err).Msg("Cannot send new login notification email")
+		}
+	}(user.Email)
 }
 
 func urlJoin(base string, elem ...string) string {
@@ -400,20 +2194,55 @@ func updateUserProviderInfo(userDB *db.User, provider string, user goth.User) {
 		userDB.GitlabID = user.UserID
 	case GiteaProvider:
 		userDB.GiteaID = user.UserID
-	case OpenIDConnect:
-		userDB.OIDCID = user.UserID
+	case BitbucketProvider:
+		userDB.BitbucketID = user.UserID
+	case MicrosoftProvider:
+		userDB.MicrosoftID = user.UserID
+	case OAuth2Provider:
+		userDB.OAuth2ID = user.UserID
 		userDB.AvatarURL = user.AvatarURL
+	case SAMLProvider:
+		userDB.SAMLID = user.UserID
+	default:
+		if isOIDCProvider(provider) {
+			userDB.OIDCID = user.UserID
+			userDB.AvatarURL = user.AvatarURL
+		}
+	}
+
+	if config.C.DisableExternalAvatars {
+		userDB.AvatarURL = ""
+	}
+}
+
+func splitScopes(scopes string) []string {
+	var result []string
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			result = append(result, scope)
+		}
 	}
+	return result
 }
 
+// getAvatarUrlFromProvider returns the avatar of the user of an OAuth provider, fetched from its API for Gitea and
+// Bitbucket. No avatar is looked up when the external avatars are disabled.
 func getAvatarUrlFromProvider(provider string, identifier string) string {
+	if config.C.DisableExternalAvatars {
+		return ""
+	}
+
 	switch provider {
 	case GitHubProvider:
 		return "https://avatars.githubusercontent.com/u/" + identifier + "?v=4"
 	case GitLabProvider:
 		return urlJoin(config.C.GitlabUrl, "/uploads/-/system/user/avatar/", identifier, "/avatar.png") + "?width=400"
 	case GiteaProvider:
-		resp, err := http.Get(urlJoin(config.C.GiteaUrl, "/api/v1/users/", identifier))
+		if config.C.PrivacyNoOutbound {
+			return ""
+		}
+
+		resp, err := utils.GetWithRetries(urlJoin(config.C.GiteaUrl, "/api/v1/users/", identifier))
 		if err != nil {
 			log.Error().Err(err).Msg("Cannot get user from Gitea")
 			return ""
@@ -439,6 +2268,33 @@ func getAvatarUrlFromProvider(provider string, identifier string) string {
 			return ""
 		}
 		return field.(string)
+	case BitbucketProvider:
+		if config.C.PrivacyNoOutbound {
+			return ""
+		}
+
+		resp, err := utils.GetWithRetries(urlJoin(bitbucketApiUrl, "/users/", identifier))
+		if err != nil {
+			log.Error().Err(err).Msg("Cannot get user from Bitbucket")
+			return ""
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			Links struct {
+				Avatar struct {
+					Href string `json:"href"`
+				} `json:"avatar"`
+			} `json:"links"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			log.Error().Err(err).Msg("Cannot unmarshal Bitbucket response body")
+			return ""
+		}
+		return result.Links.Avatar.Href
+	case MicrosoftProvider:
+		// the photo of a Microsoft account can only be fetched with an access token, Gravatar is used instead
+		return ""
 	}
 	return ""
 }
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/storage"
+	"github.com/thomiceli/opengist/internal/utils"
+	"gorm.io/gorm"
+)
+
+const maxAvatarSize = 1 << 20
+
+// avatarContentTypes are the formats accepted for an uploaded avatar, as detected from its content
+var avatarContentTypes = []string{"image/png", "image/jpeg", "image/webp"}
+
+func avatarKey(userId uint) string {
+	return "avatars/" + strconv.FormatUint(uint64(userId), 10)
+}
+
+// avatarUrl returns the uploaded avatar of the user if any, then the one of its OAuth provider, then the one of the
+// avatar source of the instance. Gravatar and Libravatar are not used if noGravatar is set. When the external avatars
+// are disabled, the ones of the OAuth providers are ignored and the identicons replace Gravatar and Libravatar.
+func avatarUrl(user *db.User, noGravatar bool) string {
+	if user.CustomAvatar {
+		return config.C.ExternalUrl + "/avatars/" + strconv.FormatUint(uint64(user.ID), 10)
+	}
+
+	if user.AvatarURL != "" && !config.C.DisableExternalAvatars {
+		return user.AvatarURL
+	}
+
+	if user.MD5Hash == "" {
+		return defaultAvatar()
+	}
+
+	source := config.C.AvatarSource
+	if config.C.DisableExternalAvatars && (source == "gravatar" || source == "libravatar") {
+		source = "identicon"
+	}
+
+	switch source {
+	case "gravatar":
+		if !noGravatar {
+			return "https://www.gravatar.com/avatar/" + user.MD5Hash + "?d=identicon&s=200"
+		}
+	case "libravatar":
+		if !noGravatar {
+			return "https://seccdn.libravatar.org/avatar/" + user.MD5Hash + "?d=identicon&s=200"
+		}
+	case "identicon":
+		return config.C.ExternalUrl + "/avatars/identicon/" + user.MD5Hash
+	}
+
+	return defaultAvatar()
+}
+
+// identiconAvatar serves the identicon of an MD5 hash, generated on the instance so that no external service is called
+func identiconAvatar(ctx echo.Context) error {
+	content, err := utils.Identicon(ctx.Param("hash"))
+	if err != nil {
+		return notFound("Avatar not found")
+	}
+
+	// the image only depends on the hash
+	ctx.Response().Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	return ctx.Blob(200, "image/png", content)
+}
+
+func userAvatar(ctx echo.Context) error {
+	userId, _ := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	user, err := db.GetUserById(uint(userId))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notFound("User not found")
+		}
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	noGravatar := getData(ctx, "DisableGravatar") == true
+	if !user.CustomAvatar {
+		return ctx.Redirect(http.StatusFound, avatarUrl(user, noGravatar))
+	}
+
+	reader, err := storage.S.Get(avatarKey(user.ID))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			user.CustomAvatar = false
+			return ctx.Redirect(http.StatusFound, avatarUrl(user, noGravatar))
+		}
+		return errorRes(500, "Cannot get avatar", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(io.LimitReader(reader, maxAvatarSize))
+	if err != nil {
+		return errorRes(500, "Cannot read avatar", err)
+	}
+
+	// revalidated on each display, so that a new avatar shows up at once
+	sum := sha256.Sum256(content)
+	ctx.Response().Header().Set("Cache-Control", "no-cache")
+	ctx.Response().Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(ctx.Response(), ctx.Request(), "", time.Time{}, bytes.NewReader(content))
+	return nil
+}
+
+func avatarProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	file, err := ctx.FormFile("avatar")
+	if err != nil {
+		addFlash(ctx, tr(ctx, "flash.user.avatar-invalid"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if file.Size > maxAvatarSize {
+		addFlash(ctx, tr(ctx, "flash.user.avatar-too-large", maxAvatarSize>>10), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return errorRes(500, "Cannot open avatar", err)
+	}
+	defer src.Close()
+
+	content, err := io.ReadAll(io.LimitReader(src, maxAvatarSize+1))
+	if err != nil {
+		return errorRes(500, "Cannot read avatar", err)
+	}
+	if len(content) > maxAvatarSize {
+		addFlash(ctx, tr(ctx, "flash.user.avatar-too-large", maxAvatarSize>>10), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	// the type sent by the browser is not trusted
+	contentType := http.DetectContentType(content)
+	if !slices.Contains(avatarContentTypes, contentType) {
+		addFlash(ctx, tr(ctx, "flash.user.avatar-invalid"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if err = storage.S.Put(avatarKey(user.ID), bytes.NewReader(content), int64(len(content)), contentType); err != nil {
+		return errorRes(500, "Cannot save avatar", err)
+	}
+
+	user.CustomAvatar = true
+	if err = user.Update(); err != nil {
+		return errorRes(500, "Cannot update user", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.avatar-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func avatarDeleteProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	user.CustomAvatar = false
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update user", err)
+	}
+
+	deleteAvatar(user)
+
+	addFlash(ctx, tr(ctx, "flash.user.avatar-deleted"), "success")
+	return redirect(ctx, "/settings")
+}
+
+// deleteAvatar removes the uploaded avatar of the user from the storage, if any
+func deleteAvatar(user *db.User) {
+	if err := storage.S.Delete(avatarKey(user.ID)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Msgf("Cannot delete the avatar of user %d", user.ID)
+	}
+}
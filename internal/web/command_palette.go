@@ -0,0 +1,54 @@
+package web
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// paletteGistsPerPage is the number of gists returned at once to the command palette
+const paletteGistsPerPage = 100
+
+type paletteGist struct {
+	ID         string `json:"id"`
+	Owner      string `json:"owner"`
+	Title      string `json:"title"`
+	Visibility string `json:"visibility"`
+	URL        string `json:"url"`
+}
+
+// paletteGists lists the gists the user can open from the command palette, which are matched in the browser
+func paletteGists(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	page := getPage(ctx)
+	if page < 1 {
+		page = 1
+	}
+
+	// one more gist is fetched to know whether there is a next page
+	gists, err := db.GetGistsAccessibleByUser(user.ID, (page-1)*paletteGistsPerPage, paletteGistsPerPage+1)
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	hasMore := len(gists) > paletteGistsPerPage
+	if hasMore {
+		gists = gists[:paletteGistsPerPage]
+	}
+
+	items := make([]paletteGist, 0, len(gists))
+	for _, gist := range gists {
+		items = append(items, paletteGist{
+			ID:         gist.Identifier(),
+			Owner:      gist.User.Username,
+			Title:      gist.Title,
+			Visibility: gist.VisibilityStr(),
+			URL:        "/" + gist.User.Username + "/" + gist.Identifier(),
+		})
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"gists":   items,
+		"page":    page,
+		"hasMore": hasMore,
+	})
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+// compareCommitsMax is the number of recent revisions offered on the gist page to be compared
+const compareCommitsMax = 30
+
+// diffSide is a side of a row of a side-by-side diff, Type is the prefix of the unified diff line ('-', '+' or ' '),
+// or 0 if the side is empty
+type diffSide struct {
+	Num  int
+	Line string
+	Type byte
+}
+
+type diffSplitRow struct {
+	Hunk        bool
+	Left, Right diffSide
+}
+
+func compare(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	from, to, found := strings.Cut(ctx.Param("revisions"), "..")
+	// a single range only, git would read more than two revisions
+	if !found || from == "" || to == "" || strings.Contains(to, "..") {
+		return notFound("Revision not found")
+	}
+
+	fromHash, _, err := gist.Commit(from)
+	var toHash string
+	if err == nil {
+		toHash, _, err = gist.Commit(to)
+	}
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching commit", err)
+	}
+
+	files, err := gist.Diff(fromHash, toHash)
+	if err != nil {
+		return errorRes(500, "Error fetching diff", err)
+	}
+
+	setData(ctx, "page", "revisions")
+	setData(ctx, "revision", "HEAD")
+	setData(ctx, "from", fromHash)
+	setData(ctx, "to", toHash)
+	setData(ctx, "files", files)
+	setData(ctx, "split", ctx.QueryParam("view") == "split")
+	setData(ctx, "htmlTitle", trH(ctx, "gist.compare.title", gist.Title))
+
+	return html(ctx, "compare.html")
+}
+
+// compareRevisions sends the revisions picked in the form of the gist page to their comparison
+func compareRevisions(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	from, to := ctx.QueryParam("from"), ctx.QueryParam("to")
+	if from == "" || to == "" {
+		return notFound("Revision not found")
+	}
+
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier()+"/compare/"+url.PathEscape(from)+".."+url.PathEscape(to))
+}
+
+// splitDiff pairs the removed and added lines of a unified diff, to show them side by side
+func splitDiff(content string) []diffSplitRow {
+	var rows []diffSplitRow
+	var removed, added []diffSide
+	left, right := 0, 0
+
+	flush := func() {
+		for i := 0; i < len(removed) || i < len(added); i++ {
+			var row diffSplitRow
+			if i < len(removed) {
+				row.Left = removed[i]
+			}
+			if i < len(added) {
+				row.Right = added[i]
+			}
+			rows = append(rows, row)
+		}
+		removed, added = removed[:0], added[:0]
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" || line[0] == '\\' {
+			continue
+		}
+
+		switch line[0] {
+		case '@':
+			flush()
+			// @@ -left,count +right,count @@
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				left = hunkStart(fields[1])
+				right = hunkStart(fields[2])
+			}
+			rows = append(rows, diffSplitRow{Hunk: true, Left: diffSide{Line: line}})
+		case '-':
+			removed = append(removed, diffSide{Num: left, Line: line[1:], Type: '-'})
+			left++
+		case '+':
+			added = append(added, diffSide{Num: right, Line: line[1:], Type: '+'})
+			right++
+		default:
+			flush()
+			rows = append(rows, diffSplitRow{
+				Left:  diffSide{Num: left, Line: line[1:], Type: ' '},
+				Right: diffSide{Num: right, Line: line[1:], Type: ' '},
+			})
+			left++
+			right++
+		}
+	}
+	flush()
+
+	return rows
+}
+
+func hunkStart(field string) int {
+	start, _, _ := strings.Cut(field[1:], ",")
+	n, _ := strconv.Atoi(start)
+	return n
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+// exportMetadataFilename is the name of the file describing each gist in the folder of its files
+const exportMetadataFilename = ".opengist.json"
+
+type gistExportMetadata struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
+	URL         string    `json:"url,omitempty"`
+	Files       []string  `json:"files"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// exportGists streams a zip archive of all the gists of the logged user, each one in a folder holding its files at
+// HEAD and its metadata. The archive is written as it is built, so that large accounts are not held in memory.
+func exportGists(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	gists, err := db.GetAllGistsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get gists", err)
+	}
+
+	ctx.Response().Header().Set("Content-Type", "application/zip")
+	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+user.Username+"-gists.zip")
+	ctx.Response().WriteHeader(200)
+
+	// the status is already sent, errors can only interrupt the archive
+	zipWriter := zip.NewWriter(ctx.Response())
+	for _, gist := range gists {
+		if err = exportGist(zipWriter, gist); err != nil {
+			log.Error().Err(err).Msgf("Cannot export gist %s of user %s", gist.Uuid, user.Username)
+			return nil
+		}
+		ctx.Response().Flush()
+	}
+
+	if err = zipWriter.Close(); err != nil {
+		log.Error().Err(err).Msgf("Cannot close the gists export of user %s", user.Username)
+	}
+	return nil
+}
+
+func exportGist(zipWriter *zip.Writer, gist *db.Gist) error {
+	folder := gist.Identifier() + "/"
+
+	// a gist without commits is exported with its metadata only
+	files, err := gist.Files("HEAD", false)
+	if _, ok := err.(*git.RevisionNotFoundError); !ok && err != nil {
+		return err
+	}
+
+	metadata := gistExportMetadata{
+		Title:       gist.Title,
+		Description: gist.Description,
+		Visibility:  gist.Private.String(),
+		URL:         gist.URL,
+		Files:       make([]string, 0, len(files)),
+		CreatedAt:   time.Unix(gist.CreatedAt, 0).UTC(),
+		UpdatedAt:   time.Unix(gist.UpdatedAt, 0).UTC(),
+	}
+
+	for _, file := range files {
+		metadata.Files = append(metadata.Files, file.Filename)
+
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     folder + file.Filename,
+			Method:   zip.Deflate,
+			Modified: metadata.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write([]byte(file.Content)); err != nil {
+			return err
+		}
+	}
+
+	f, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     folder + exportMetadataFilename,
+		Method:   zip.Deflate,
+		Modified: metadata.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(metadata)
+}
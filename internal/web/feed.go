@@ -0,0 +1,207 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"gorm.io/gorm"
+)
+
+// number of gists listed in the feeds of a user
+const feedSize = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	Uri  string `xml:"uri"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	Id         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Guid        string   `xml:"guid"`
+	Description string   `xml:"description,omitempty"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+// userGistsOrFeed serves the feeds of a user at /:user.atom and /:user.rss, which share their route with the gists of
+// the user as the usernames cannot contain a dot
+func userGistsOrFeed(ctx echo.Context) error {
+	for _, format := range []string{"atom", "rss"} {
+		if username, ok := strings.CutSuffix(ctx.Param("user"), "."+format); ok {
+			return userFeed(ctx, username, format)
+		}
+	}
+	return allGists(ctx)
+}
+
+// userFeed renders the last public gists of a user as an Atom or an RSS feed. The unlisted and private gists never
+// appear in it, whoever asks for it.
+func userFeed(ctx echo.Context, username string, format string) error {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Error fetching user", err)
+		}
+		renamed, err := db.GetUserByOldUsername(username)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return notFound("User not found")
+			}
+			return errorRes(500, "Cannot get user", err)
+		}
+		return ctx.Redirect(301, urlJoin(getData(ctx, "baseHttpUrl").(string), renamed.Username+"."+format))
+	}
+
+	gists, err := db.GetRecentPublicGistsFromUser(user.ID, feedSize)
+	if err != nil {
+		return errorRes(500, "Error fetching gists", err)
+	}
+
+	var lastModified time.Time
+	for _, gist := range gists {
+		if updated := time.Unix(gist.UpdatedAt, 0); updated.After(lastModified) {
+			lastModified = updated
+		}
+	}
+
+	var feed any
+	var contentType string
+	if format == "atom" {
+		feed = newAtomFeed(ctx, user, gists, lastModified)
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		feed = newRssFeed(ctx, user, gists, lastModified)
+		contentType = "application/rss+xml; charset=utf-8"
+	}
+
+	content, err := xml.Marshal(feed)
+	if err != nil {
+		return errorRes(500, "Cannot render the feed", err)
+	}
+	content = append([]byte(xml.Header), content...)
+
+	sum := sha256.Sum256(content)
+	if checkNotModified(ctx, false, `"`+hex.EncodeToString(sum[:16])+`"`, lastModified) {
+		return ctx.NoContent(304)
+	}
+	return ctx.Blob(200, contentType, content)
+}
+
+func newAtomFeed(ctx echo.Context, user *db.User, gists []*db.Gist, updated time.Time) *atomFeed {
+	baseUrl := getData(ctx, "baseHttpUrl").(string)
+	userUrl := urlJoin(baseUrl, user.Username)
+	if updated.IsZero() {
+		updated = time.Unix(user.CreatedAt, 0)
+	}
+
+	feed := &atomFeed{
+		Title: tr(ctx, "gist.feed.title", user.Username),
+		Id:    userUrl,
+		Links: []atomLink{
+			{Href: userUrl + ".atom", Rel: "self", Type: "application/atom+xml"},
+			{Href: userUrl, Rel: "alternate", Type: "text/html"},
+		},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: user.Username, Uri: userUrl},
+		Entries: make([]atomEntry, 0, len(gists)),
+	}
+
+	for _, gist := range gists {
+		gistUrl := urlJoin(userUrl, gist.Identifier())
+		entry := atomEntry{
+			Title:     gist.Title,
+			Id:        gistUrl,
+			Link:      atomLink{Href: gistUrl},
+			Published: time.Unix(gist.CreatedAt, 0).UTC().Format(time.RFC3339),
+			Updated:   time.Unix(gist.UpdatedAt, 0).UTC().Format(time.RFC3339),
+			Summary:   gist.Description,
+		}
+		for _, tag := range gist.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag.Name})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func newRssFeed(ctx echo.Context, user *db.User, gists []*db.Gist, updated time.Time) *rssFeed {
+	baseUrl := getData(ctx, "baseHttpUrl").(string)
+	userUrl := urlJoin(baseUrl, user.Username)
+
+	channel := rssChannel{
+		Title:       tr(ctx, "gist.feed.title", user.Username),
+		Link:        userUrl,
+		Description: tr(ctx, "gist.feed.description", user.Username),
+		Items:       make([]rssItem, 0, len(gists)),
+	}
+	if !updated.IsZero() {
+		channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, gist := range gists {
+		gistUrl := urlJoin(userUrl, gist.Identifier())
+		item := rssItem{
+			Title:       gist.Title,
+			Link:        gistUrl,
+			Guid:        gistUrl,
+			Description: gist.Description,
+			PubDate:     time.Unix(gist.CreatedAt, 0).UTC().Format(time.RFC1123Z),
+		}
+		for _, tag := range gist.Tags {
+			item.Categories = append(item.Categories, tag.Name)
+		}
+		channel.Items = append(channel.Items, item)
+	}
+	return &rssFeed{Version: "2.0", Channel: channel}
+}
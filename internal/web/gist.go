@@ -4,23 +4,33 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"math"
+	"mime"
+	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/auth"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/i18n"
 	"github.com/thomiceli/opengist/internal/index"
 	"github.com/thomiceli/opengist/internal/render"
 	"github.com/thomiceli/opengist/internal/utils"
 
+	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/thomiceli/opengist/internal/config"
@@ -49,42 +59,62 @@ func gistInit(next echo.HandlerFunc) echo.HandlerFunc {
 
 		gist, err := db.GetGist(userName, gistName)
 		if err != nil {
+			if renamed, err := redirectRenamedUser(ctx, userName); renamed || err != nil {
+				return err
+			}
 			return notFound("Gist not found")
 		}
 
-		if gist.Private == db.PrivateVisibility {
-			if currUser == nil || currUser.ID != gist.UserID {
-				return notFound("Gist not found")
-			}
+		if gist.Private == db.PrivateVisibility && !gist.CanWrite(currUser) {
+			return notFound("Gist not found")
 		}
 
-		setData(ctx, "gist", gist)
-
-		if config.C.SshGit {
-			var sshDomain string
+		if gist.IsExpired() {
+			return notFound("Gist not found")
+		}
 
-			if config.C.SshExternalDomain != "" {
-				sshDomain = config.C.SshExternalDomain
-			} else {
-				sshDomain = strings.Split(ctx.Request().Host, ":")[0]
-			}
+		setData(ctx, "gist", gist)
+		setData(ctx, "canWrite", gist.CanWrite(currUser))
+		setData(ctx, "canManage", gist.CanManage(currUser))
 
-			if config.C.SshPort == "22" {
-				setData(ctx, "sshCloneUrl", sshDomain+":"+userName+"/"+gistName+".git")
-			} else {
-				setData(ctx, "sshCloneUrl", "ssh://"+sshDomain+":"+config.C.SshPort+"/"+userName+"/"+gistName+".git")
-			}
+		if gist.IsProtected() && !gist.CanWrite(currUser) && !isGistUnlocked(ctx, gist) &&
+			ctx.Path() != "/:user/:gistname/unlock" {
+			setData(ctx, "NoIndex", true)
+			setData(ctx, "next", ctx.Request().URL.Path)
+			setData(ctx, "htmlTitle", gist.Title)
+			return htmlWithCode(ctx, 403, "gist_password.html")
 		}
 
-		baseHttpUrl := getData(ctx, "baseHttpUrl").(string)
+		httpCloneUrl, sshCloneUrl := git.CloneUrls(getData(ctx, "baseHttpUrl").(string), userName, gistName)
+		// SSH needs a key of an account, so it is not shown to anonymous users
+		if currUser == nil {
+			sshCloneUrl = ""
+		}
+		if httpCloneUrl != "" {
+			setData(ctx, "httpCloneUrl", httpCloneUrl)
+		}
+		if sshCloneUrl != "" {
+			setData(ctx, "sshCloneUrl", sshCloneUrl)
+		}
+		cloneProtocol := ""
+		if currUser != nil {
+			cloneProtocol = currUser.CloneProtocol
+		}
+		setData(ctx, "cloneProtocol", cloneProtocol)
 
-		if config.C.HttpGit {
-			setData(ctx, "httpCloneUrl", baseHttpUrl+"/"+userName+"/"+gistName+".git")
+		// private and protected gists are only cloned over SSH with the key of someone who can write to them
+		anonymousClone := gist.Private != db.PrivateVisibility && !gist.IsProtected()
+		if !anonymousClone && !gist.CanWrite(currUser) {
+			sshCloneUrl = ""
 		}
+		setEditorUrls(ctx, httpCloneUrl, sshCloneUrl, anonymousClone)
 
+		baseHttpUrl := getData(ctx, "baseHttpUrl").(string)
 		setData(ctx, "httpCopyUrl", baseHttpUrl+"/"+userName+"/"+gistName)
 		setData(ctx, "currentUrl", template.URL(ctx.Request().URL.Path))
-		setData(ctx, "embedScript", fmt.Sprintf(`<script src="%s"></script>`, baseHttpUrl+"/"+userName+"/"+gistName+".js"))
+		if gist.IsEmbeddable() {
+			setData(ctx, "embedScript", fmt.Sprintf(`<script src="%s"></script>`, baseHttpUrl+"/"+userName+"/"+gistName+".js"))
+		}
 
 		nbCommits, err := gist.NbCommits()
 		if err != nil {
@@ -108,6 +138,23 @@ func gistInit(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// setEditorUrls sets the links opening the clone URL of a gist in an editor, for the clone URLs the viewer can use.
+// Gitpod clones from its own servers, so it is only offered for gists cloned without credentials over HTTP.
+func setEditorUrls(ctx echo.Context, httpCloneUrl, sshCloneUrl string, anonymousClone bool) {
+	cloneUrl := httpCloneUrl
+	if cloneUrl == "" {
+		cloneUrl = sshCloneUrl
+	}
+	if cloneUrl == "" {
+		return
+	}
+
+	setData(ctx, "vscodeUrl", template.URL("vscode://vscode.git/clone?url="+url.QueryEscape(cloneUrl)))
+	if httpCloneUrl != "" && anonymousClone {
+		setData(ctx, "gitpodUrl", template.URL("https://gitpod.io/#"+httpCloneUrl))
+	}
+}
+
 // gistSoftInit try to load a gist (same as gistInit) but does not return a 404 if the gist is not found
 // useful for git clients using HTTP to obfuscate the existence of a private gist
 func gistSoftInit(next echo.HandlerFunc) echo.HandlerFunc {
@@ -117,13 +164,116 @@ func gistSoftInit(next echo.HandlerFunc) echo.HandlerFunc {
 
 		gistName = strings.TrimSuffix(gistName, ".git")
 
-		gist, _ := db.GetGist(userName, gistName)
+		gist, err := db.GetGist(userName, gistName)
+		if err != nil {
+			if renamed, err := redirectRenamedUser(ctx, userName); renamed || err != nil {
+				return err
+			}
+		} else if gist.IsExpired() {
+			// an expired gist is not found anymore, even before it is deleted
+			gist = new(db.Gist)
+		}
 		setData(ctx, "gist", gist)
 
 		return next(ctx)
 	}
 }
 
+// redirectRenamedUser redirects to the same URL with the current username of the user formerly named username, and
+// returns false if there is no such user
+func redirectRenamedUser(ctx echo.Context, username string) (bool, error) {
+	user, err := db.GetUserByOldUsername(username)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, errorRes(500, "Cannot get user", err)
+	}
+
+	location := ctx.Request().URL
+	parts := strings.SplitN(strings.TrimPrefix(location.Path, "/"), "/", 2)
+	parts[0] = user.Username
+	target := "/" + strings.Join(parts, "/")
+	if location.RawQuery != "" {
+		target += "?" + location.RawQuery
+	}
+
+	return true, ctx.Redirect(301, config.C.ExternalUrl+target)
+}
+
+// gistUnlockedValue identifies the password of a protected gist in the session of the users who entered it, so that
+// changing the password asks them for the new one
+func gistUnlockedValue(gist *db.Gist) string {
+	sum := sha256.Sum256([]byte(gist.PasswordHash))
+	return hex.EncodeToString(sum[:16])
+}
+
+func isGistUnlocked(ctx echo.Context, gist *db.Gist) bool {
+	value, _ := getSession(ctx).Values["unlockedGist-"+gist.Uuid].(string)
+	return value == gistUnlockedValue(gist)
+}
+
+// gistAttemptKey returns the key counting the failed passwords of the protected gist from the IP address of the request
+func gistAttemptKey(ctx echo.Context, gist *db.Gist) string {
+	return "gist:" + gist.Uuid + ":ip:" + ctx.RealIP()
+}
+
+func recordGistPasswordFailure(key string) {
+	if config.C.MaxLoginAttempts <= 0 {
+		return
+	}
+
+	if err := db.RecordLoginFailure(key, config.C.MaxLoginAttempts, loginAttemptsWindow, loginLockout); err != nil {
+		log.Error().Err(err).Msg("Cannot record failed gist password")
+	}
+}
+
+func gistUnlock(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	// only paths of the gist are accepted as targets, to avoid open redirects
+	target := "/" + gist.User.Username + "/" + gist.Identifier()
+	if next := ctx.FormValue("next"); strings.HasPrefix(next, target+"/") {
+		target = next
+	}
+
+	if !gist.IsProtected() {
+		return redirect(ctx, target)
+	}
+
+	attemptKey := gistAttemptKey(ctx, gist)
+	if config.C.MaxLoginAttempts > 0 {
+		locked, until, err := db.IsLoginLocked(attemptKey)
+		if err != nil {
+			return errorRes(500, "Cannot check for login lockout", err)
+		}
+		if locked {
+			addFlash(ctx, tr(ctx, "flash.auth.login-locked", int(math.Ceil(time.Until(time.Unix(until, 0)).Minutes()))), "error")
+			return redirect(ctx, target)
+		}
+	}
+
+	if ok, err := utils.Argon2id.Verify(ctx.FormValue("password"), gist.PasswordHash); !ok {
+		if err != nil {
+			return errorRes(500, "Cannot check for password", err)
+		}
+		authWarn(ctx, "gist-password-failed", "").Str("gist", gist.Uuid).Msg("Invalid gist password attempt")
+		recordGistPasswordFailure(attemptKey)
+		addFlash(ctx, tr(ctx, "flash.gist.password-invalid"), "error")
+		return redirect(ctx, target)
+	}
+
+	if err := db.ResetLoginAttempts(attemptKey); err != nil {
+		log.Error().Err(err).Msg("Cannot reset failed gist passwords")
+	}
+
+	sess := getSession(ctx)
+	sess.Values["unlockedGist-"+gist.Uuid] = gistUnlockedValue(gist)
+	saveSession(sess, ctx)
+
+	return redirect(ctx, target)
+}
+
 // gistNewPushInit has the same behavior as gistSoftInit but create a new gist empty instead
 func gistNewPushSoftInit(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -140,24 +290,57 @@ func allGists(ctx echo.Context) error {
 	userLogged := getUserLogged(ctx)
 	pageInt := getPage(ctx)
 
+	// the clones and the last views of the gists are only shown to their owner, on the list of their gists
+	ownGists := userLogged != nil && ctx.Path() == "/:user" && strings.EqualFold(userLogged.Username, fromUserStr)
+	setData(ctx, "ownGists", ownGists)
+
 	sort := "created"
 	sortText := trH(ctx, "gist.list.sort-by-created")
 	order := "desc"
 	orderText := trH(ctx, "gist.list.order-by-desc")
 
-	if ctx.QueryParam("sort") == "updated" {
+	switch ctx.QueryParam("sort") {
+	case "updated":
 		sort = "updated"
 		sortText = trH(ctx, "gist.list.sort-by-updated")
+	case "views":
+		sort = "views"
+		sortText = trH(ctx, "gist.list.sort-by-views")
+		orderText = trH(ctx, "gist.list.order-by-most")
+	case "likes":
+		sort = "likes"
+		sortText = trH(ctx, "gist.list.sort-by-likes")
+		orderText = trH(ctx, "gist.list.order-by-most")
+	case "clones":
+		if ownGists {
+			sort = "clones"
+			sortText = trH(ctx, "gist.list.sort-by-clones")
+			orderText = trH(ctx, "gist.list.order-by-most")
+		}
+	case "last-viewed":
+		if ownGists {
+			sort = "last_viewed"
+			sortText = trH(ctx, "gist.list.sort-by-last-viewed")
+		}
 	}
 
 	if ctx.QueryParam("order") == "asc" {
 		order = "asc"
 		orderText = trH(ctx, "gist.list.order-by-asc")
+		if sort == "views" || sort == "likes" || sort == "clones" {
+			orderText = trH(ctx, "gist.list.order-by-least")
+		}
 	}
 
 	setData(ctx, "sort", sortText)
 	setData(ctx, "order", orderText)
 
+	// the public list and the gists of a user can be filtered by tag
+	var tag string
+	if tags := db.ParseTags(ctx.QueryParam("tag")); len(tags) > 0 {
+		tag = tags[0]
+	}
+
 	var gists []*db.Gist
 	var currentUserId uint
 	if userLogged != nil {
@@ -178,8 +361,9 @@ func allGists(ctx echo.Context) error {
 		} else if strings.HasSuffix(urlctx, "all") {
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all"))
 			setData(ctx, "mode", "all")
+			setTagFilterData(ctx, tag)
 			urlPage = "all"
-			gists, err = db.GetAllGistsForCurrentUser(currentUserId, pageInt-1, sort, order)
+			gists, err = db.GetAllGistsForCurrentUser(currentUserId, tag, pageInt-1, sort, order)
 		}
 	} else {
 		liked := false
@@ -200,6 +384,9 @@ func allGists(ctx echo.Context) error {
 		fromUser, err = db.GetUserByUsername(fromUserStr)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if renamed, err := redirectRenamedUser(ctx, fromUserStr); renamed || err != nil {
+					return err
+				}
 				return notFound("User not found")
 			}
 			return errorRes(500, "Error fetching user", err)
@@ -238,7 +425,18 @@ func allGists(ctx echo.Context) error {
 			urlPage = fromUserStr
 			setData(ctx, "htmlTitle", trH(ctx, "gist.list.all-from", fromUserStr))
 			setData(ctx, "mode", "fromUser")
-			gists, err = db.GetAllGistsFromUser(fromUser.ID, currentUserId, pageInt-1, sort, order)
+			setData(ctx, "feedUrl", urlJoin(getData(ctx, "baseHttpUrl").(string), fromUser.Username+".atom"))
+			setTagFilterData(ctx, tag)
+
+			// the gists which are not public only count for the users who can see them
+			publicOnly := userLogged == nil || (userLogged.ID != fromUser.ID &&
+				!(fromUser.IsOrganization && db.IsOrganizationMember(fromUser.ID, userLogged.ID)))
+			if stats, err := languageStats.get(fromUser.ID, publicOnly); err != nil {
+				log.Error().Err(err).Msg("Cannot compute the language stats of " + fromUser.Username)
+			} else {
+				setData(ctx, "languageStats", stats)
+			}
+			gists, err = db.GetAllGistsFromUser(fromUser.ID, currentUserId, tag, pageInt-1, sort, order)
 		}
 	}
 
@@ -255,14 +453,44 @@ func allGists(ctx echo.Context) error {
 		return errorRes(500, "Error fetching gists", err)
 	}
 
-	if err = paginate(ctx, renderedGists, pageInt, 10, "gists", fromUserStr, 2, "&sort="+sort+"&order="+order); err != nil {
+	paginationParams := "&sort=" + sort + "&order=" + order
+	if tag != "" {
+		paginationParams += "&tag=" + url.QueryEscape(tag)
+	}
+	if err = paginate(ctx, renderedGists, pageInt, 10, "gists", fromUserStr, 2, paginationParams); err != nil {
 		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
 	}
 
 	setData(ctx, "urlPage", urlPage)
+	setListingData(ctx)
 	return html(ctx, "all.html")
 }
 
+// setTagFilterData keeps the tag the gists are filtered by in the sorting links of the listing
+func setTagFilterData(ctx echo.Context, tag string) {
+	if tag == "" {
+		return
+	}
+	setData(ctx, "tag", tag)
+	setData(ctx, "searchQueryUrl", template.URL("&tag="+url.QueryEscape(tag)))
+}
+
+// tagsAutocomplete returns the names of the existing tags starting with the query, for the tags input of the gist form
+func tagsAutocomplete(ctx echo.Context) error {
+	var currentUserId uint
+	if userLogged := getUserLogged(ctx); userLogged != nil {
+		currentUserId = userLogged.ID
+	}
+
+	prefix := strings.ToLower(strings.TrimSpace(ctx.QueryParam("q")))
+	tags, err := db.GetTagsStartingWith(prefix, currentUserId, 10)
+	if err != nil {
+		return errorRes(500, "Error fetching tags", err)
+	}
+
+	return ctx.JSON(200, tags)
+}
+
 func search(ctx echo.Context) error {
 	var err error
 
@@ -277,13 +505,22 @@ func search(ctx echo.Context) error {
 		currentUserId = 0
 	}
 
+	var visibility *db.Visibility
+	if meta["visibility"] != "" {
+		v, err := db.ParseVisibility(meta["visibility"])
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.bad-request"), err)
+		}
+		visibility = &v
+	}
+
 	var visibleGistsIds []uint
-	visibleGistsIds, err = db.GetAllGistsVisibleByUser(currentUserId)
+	visibleGistsIds, err = db.GetAllGistsVisibleByUser(currentUserId, visibility)
 	if err != nil {
 		return errorRes(500, "Error fetching gists", err)
 	}
 
-	gistsIds, nbHits, langs, err := index.SearchGists(content, index.SearchGistMetadata{
+	gistsIds, nbHits, langs, highlights, err := index.SearchGists(content, index.SearchGistMetadata{
 		Username:  meta["user"],
 		Title:     meta["title"],
 		Filename:  meta["filename"],
@@ -308,6 +545,12 @@ func search(ctx echo.Context) error {
 		renderedGists = append(renderedGists, &rendered)
 	}
 
+	// the snippets are escaped by the index, except for the tags marking the matches
+	snippets := make(map[uint]template.HTML, len(highlights))
+	for gistId, highlight := range highlights {
+		snippets[gistId] = template.HTML(highlight)
+	}
+
 	if pageInt > 1 && len(renderedGists) != 0 {
 		setData(ctx, "prevPage", pageInt-1)
 	}
@@ -321,11 +564,42 @@ func search(ctx echo.Context) error {
 	setData(ctx, "htmlTitle", trH(ctx, "gist.list.search-results"))
 	setData(ctx, "nbHits", nbHits)
 	setData(ctx, "gists", renderedGists)
+	setData(ctx, "snippets", snippets)
 	setData(ctx, "langs", langs)
 	setData(ctx, "searchQuery", ctx.QueryParam("q"))
+	setListingData(ctx)
 	return html(ctx, "search.html")
 }
 
+// setListingData sets the layout and the metadata columns of the gist listings, from the preferences of the
+// logged user or else from the instance defaults
+func setListingData(ctx echo.Context) {
+	density, columns := listingPreferences(getUserLogged(ctx))
+	setData(ctx, "listingCompact", density == "compact")
+	setData(ctx, "listingColumns", columns)
+}
+
+// listingPreferences returns the density of the listings and the set of columns shown
+func listingPreferences(user *db.User) (string, map[string]bool) {
+	density, columns := config.C.ListingDensity, config.C.ListingColumns
+	if user != nil {
+		if user.ListingDensity != "" {
+			density = user.ListingDensity
+		}
+		if user.ListingColumns != "" {
+			columns = user.ListingColumns
+		}
+	}
+
+	// the values are checked when saved, an unknown column is only left out
+	parsed, _ := utils.ParseListingColumns(columns)
+	shown := make(map[string]bool, len(parsed))
+	for _, column := range parsed {
+		shown[column] = true
+	}
+	return density, shown
+}
+
 func gistIndex(ctx echo.Context) error {
 	if getData(ctx, "gistpage") == "js" {
 		return gistJs(ctx)
@@ -340,6 +614,34 @@ func gistIndex(ctx echo.Context) error {
 		revision = "HEAD"
 	}
 
+	if ctx.QueryParam("preview") == "visitor" {
+		if err := previewAsVisitor(ctx, gist); err != nil {
+			return err
+		}
+		if getData(ctx, "previewAsVisitor") == true && gist.IsProtected() {
+			setData(ctx, "next", ctx.Request().URL.Path)
+			setData(ctx, "htmlTitle", gist.Title)
+			return htmlWithCode(ctx, 403, "gist_password.html")
+		}
+	}
+
+	countGistView(ctx, gist)
+
+	collaborators, err := db.GetGistCollaborators(gist.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get collaborators", err)
+	}
+	setData(ctx, "collaborators", collaborators)
+
+	// gists without commits are not cached
+	hash, _, err := gist.Commit(revision)
+	if err == nil && len(getFlashSession(ctx).Values) == 0 {
+		if notModified(ctx, gist, gistPageEtag(ctx, gist, hash), time.Time{}) {
+			return ctx.NoContent(304)
+		}
+		ctx.Response().Header().Set("Vary", "Cookie")
+	}
+
 	files, err := gist.Files(revision, true)
 	if _, ok := err.(*git.RevisionNotFoundError); ok {
 		return notFound("Revision not found")
@@ -349,14 +651,72 @@ func gistIndex(ctx echo.Context) error {
 
 	renderedFiles := render.HighlightFiles(files)
 
+	if nbCommits, _ := getData(ctx, "nbCommits").(string); nbCommits != "" && nbCommits != "0" && nbCommits != "1" {
+		commits, err := gist.Commits(compareCommitsMax)
+		if err != nil {
+			return errorRes(500, "Error fetching commits", err)
+		}
+		setData(ctx, "compareCommits", commits)
+	}
+
 	setData(ctx, "page", "code")
 	setData(ctx, "commit", revision)
+	// the permalinks to lines point to the commit, for them to survive the edits of the gist
+	setData(ctx, "commitHash", hash)
 	setData(ctx, "files", renderedFiles)
 	setData(ctx, "revision", revision)
 	setData(ctx, "htmlTitle", gist.Title)
 	return html(ctx, "gist.html")
 }
 
+// previewAsVisitor makes the gist page render as for an unauthenticated visitor, if the owner of the gist asks for
+// it. The error a visitor would get is returned instead if the gist is not visible to them.
+func previewAsVisitor(ctx echo.Context, gist *db.Gist) error {
+	if !gist.CanWrite(getUserLogged(ctx)) {
+		return nil
+	}
+
+	if gist.Private == db.PrivateVisibility {
+		return notFound(tr(ctx, "gist.preview.private"))
+	}
+
+	allow, err := auth.ShouldAllowUnauthenticatedGistAccess(ContextAuthInfo{ctx}, true)
+	if err != nil {
+		return errorRes(500, "Cannot check if unauthenticated access is allowed", err)
+	}
+	if !allow {
+		return errorRes(401, tr(ctx, "gist.preview.login-required"), nil)
+	}
+
+	setData(ctx, "userLogged", nil)
+	setData(ctx, "hasLiked", nil)
+	setData(ctx, "previewAsVisitor", true)
+	setData(ctx, "NoIndex", true)
+	return nil
+}
+
+// gistPageEtag is a weak ETag of the gist page, which besides the commit shown depends on the gist metadata and on
+// the user viewing it
+func gistPageEtag(ctx echo.Context, gist *db.Gist, hash string) string {
+	var userId uint
+	if user := getUserLogged(ctx); user != nil {
+		userId = user.ID
+	}
+
+	var collaborators []string
+	if list, ok := getData(ctx, "collaborators").([]*db.GistCollaborator); ok {
+		for _, collaborator := range list {
+			collaborators = append(collaborators, collaborator.User.Username)
+		}
+	}
+
+	// the views, the pin, the tags and the visibility are changed without updating the gist
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d|%d|%d|%s|%d|%v|%s|%s", hash, gist.UpdatedAt, gist.NbLikes,
+		gist.NbForks, gist.Views, gist.PinnedAt, gist.Private, gist.TagsList(), userId, getData(ctx, "hasLiked"),
+		getData(ctx, "localeName"), strings.Join(collaborators, ","))))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
 func gistJson(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	files, err := gist.Files("HEAD", true)
@@ -394,25 +754,59 @@ func gistJson(ctx echo.Context) error {
 		"visibility":  gist.VisibilityStr(),
 		"files":       renderedFiles,
 		"embed": map[string]string{
-			"html":    htmlbuf.String(),
-			"css":     cssUrl,
-			"js":      jsUrl,
-			"js_dark": jsUrl + "?dark",
+			"html":     htmlbuf.String(),
+			"css":      cssUrl,
+			"js":       jsUrl,
+			"js_dark":  jsUrl + "?dark",
+			"js_light": jsUrl + "?light",
 		},
 	})
 }
 
+// embedAutoTheme is the class of an embedded gist following the color scheme of the embedding page, replaced by the
+// embed script once the scheme is known
+const embedAutoTheme = "opengist-theme-auto"
+
 func gistJs(ctx echo.Context) error {
+	// explicit parameters override the theme of the instance
+	theme := config.C.EmbedTheme
 	if _, exists := ctx.QueryParams()["dark"]; exists {
+		theme = "dark"
+	} else if _, exists := ctx.QueryParams()["light"]; exists {
+		theme = "light"
+	}
+
+	switch theme {
+	case "dark":
 		setData(ctx, "dark", "dark")
+	case "auto":
+		setData(ctx, "dark", embedAutoTheme)
 	}
 
 	gist := getData(ctx, "gist").(*db.Gist)
+	if !gist.IsEmbeddable() {
+		return notFound("Gist not found")
+	}
+
 	files, err := gist.Files("HEAD", true)
 	if err != nil {
 		return errorRes(500, "Error fetching files", err)
 	}
 
+	// a single file of the gist can be embedded
+	if filename := ctx.QueryParam("file"); filename != "" {
+		var file *git.File
+		for _, f := range files {
+			if f.Filename == filename {
+				file = f
+			}
+		}
+		if file == nil {
+			return notFound("File not found")
+		}
+		files = []*git.File{file}
+	}
+
 	renderedFiles := render.HighlightFiles(files)
 	setData(ctx, "files", renderedFiles)
 
@@ -431,6 +825,14 @@ func gistJs(ctx echo.Context) error {
 	js := `document.write('<link rel="stylesheet" href="%s">')
 document.write('%s')
 `
+	if theme == "auto" {
+		js = `(function() {
+var dark = window.matchMedia && window.matchMedia('(prefers-color-scheme: dark)').matches;
+document.write('<link rel="stylesheet" href="%s">')
+document.write('%s'.replace('` + embedAutoTheme + `', dark ? 'dark' : ''))
+})()
+`
+	}
 	content := strings.Replace(htmlbuf.String(), `\n`, `\\n`, -1)
 	content = strings.Replace(content, "\n", `\n`, -1)
 	js = fmt.Sprintf(js, cssUrl, content)
@@ -476,10 +878,66 @@ func revisions(ctx echo.Context) error {
 }
 
 func create(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	dto := new(db.GistDTO)
+	files := []db.FileDTO{{}}
+
+	templates, err := db.GetTemplatesForUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Error fetching templates", err)
+	}
+
+	// the new gist is pre-populated with the description and the files of the template picked
+	if templateId := ctx.QueryParam("template"); templateId != "" {
+		template, err := db.GetGistByID(templateId)
+		if err != nil || !template.CanUseAsTemplate(user) {
+			return notFound("Template not found")
+		}
+
+		templateFiles, err := template.Files("HEAD", false)
+		if _, ok := err.(*git.RevisionNotFoundError); !ok && err != nil {
+			return errorRes(500, "Error fetching files from repository", err)
+		}
+		if len(templateFiles) > 0 {
+			files = make([]db.FileDTO, 0, len(templateFiles))
+			for _, file := range templateFiles {
+				files = append(files, db.FileDTO{Filename: file.Filename, Content: file.Content})
+			}
+		}
+		dto.Description = template.Description
+		setData(ctx, "templateId", template.ID)
+	}
+
 	setData(ctx, "htmlTitle", trH(ctx, "gist.new.create-a-new-gist"))
+	setExpiryData(ctx, user.DefaultExpiry)
+	setData(ctx, "visibility", defaultVisibility(user))
+	setData(ctx, "templates", templates)
+	setData(ctx, "dto", dto)
+	setData(ctx, "files", files)
 	return html(ctx, "create.html")
 }
 
+// defaultVisibility returns the visibility given to the gists created by the user without choosing one
+func defaultVisibility(user *db.User) db.Visibility {
+	value := config.C.DefaultGistVisibility
+	if user != nil && user.DefaultVisibility != "" {
+		value = user.DefaultVisibility
+	}
+
+	// the values are checked when saved
+	visibility, err := db.ParseVisibility(value)
+	if err != nil {
+		return db.PublicVisibility
+	}
+	return visibility
+}
+
+// setExpiryData sets the expiry options of the forms, the selected one being shortened to the instance maximum
+func setExpiryData(ctx echo.Context, selected string) {
+	setData(ctx, "expiryOptions", utils.AllowedExpiries(config.C.GistMaxExpiry))
+	setData(ctx, "expiry", utils.ClampExpiry(selected, config.C.GistMaxExpiry))
+}
+
 func processCreate(ctx echo.Context) error {
 	isCreate := false
 	if ctx.Request().URL.Path == "/" {
@@ -505,51 +963,125 @@ func processCreate(ctx echo.Context) error {
 		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
 	}
 
+	if isCreate && ctx.FormValue("private") == "" {
+		dto.Private = defaultVisibility(getUserLogged(ctx))
+	}
+
 	dto.Files = make([]db.FileDTO, 0)
+	takenNames := make(map[string]bool)
+	for _, name := range ctx.Request().PostForm["name"] {
+		takenNames[strings.Trim(name, " ")] = true
+	}
+
+	// the names of the files when the edit form was opened, to tell the renamed files from the new ones
+	originalNames := ctx.Request().PostForm["original-name"]
+	if isCreate || len(originalNames) != len(ctx.Request().PostForm["content"]) {
+		originalNames = nil
+	}
+
 	fileCounter := 0
 	for i := 0; i < len(ctx.Request().PostForm["content"]); i++ {
 		name := ctx.Request().PostForm["name"][i]
 		content := ctx.Request().PostForm["content"][i]
 
-		if name == "" {
-			fileCounter += 1
-			name = "gistfile" + strconv.Itoa(fileCounter) + ".txt"
-		}
-
 		escapedValue, err := url.QueryUnescape(content)
 		if err != nil {
 			return errorRes(400, tr(ctx, "error.invalid-character-unescaped"), err)
 		}
 
-		dto.Files = append(dto.Files, db.FileDTO{
+		if name == "" {
+			fileCounter += 1
+			name = utils.DefaultFilename(config.C.GistDefaultFilename, fileCounter, escapedValue, takenNames)
+			takenNames[name] = true
+		}
+
+		file := db.FileDTO{
 			Filename: strings.Trim(name, " "),
 			Content:  escapedValue,
-		})
+		}
+		if originalNames != nil {
+			file.OriginalFilename = originalNames[i]
+		}
+		dto.Files = append(dto.Files, file)
 	}
 
-	err = ctx.Validate(dto)
-	if err != nil {
-		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+	renderForm := func() error {
 		if isCreate {
-			return html(ctx, "create.html")
-		} else {
-			files, err := gist.Files("HEAD", false)
+			templates, err := db.GetTemplatesForUser(getUserLogged(ctx).ID)
 			if err != nil {
-				return errorRes(500, "Error fetching files", err)
+				return errorRes(500, "Error fetching templates", err)
+			}
+
+			files := dto.Files
+			if len(files) == 0 {
+				files = []db.FileDTO{{}}
 			}
+			setExpiryData(ctx, ctx.FormValue("expiry"))
+			setData(ctx, "visibility", dto.Private)
+			setData(ctx, "templates", templates)
+			setData(ctx, "dto", dto)
 			setData(ctx, "files", files)
-			return html(ctx, "edit.html")
+			return html(ctx, "create.html")
+		}
+
+		files, err := gist.Files("HEAD", false)
+		if err != nil {
+			return errorRes(500, "Error fetching files", err)
 		}
+		setData(ctx, "files", files)
+		return html(ctx, "edit.html")
+	}
+
+	err = ctx.Validate(dto)
+	if err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return renderForm()
 	}
 
+	// the password of a protected gist is kept when the field is left empty
+	if dto.Protected && dto.Password == "" && (isCreate || !gist.IsProtected()) {
+		addFlash(ctx, tr(ctx, "flash.gist.password-required"), "error")
+		return renderForm()
+	}
+
+	tags := db.ParseTags(dto.Tags)
+	if message := tagsError(ctx, tags); message != "" {
+		addFlash(ctx, message, "error")
+		return renderForm()
+	}
+
+	filenames := make(map[string]bool, len(dto.Files))
+	for _, file := range dto.Files {
+		if filenames[file.Filename] {
+			addFlash(ctx, tr(ctx, "flash.gist.duplicate-filename", file.Filename), "error")
+			return renderForm()
+		}
+		filenames[file.Filename] = true
+	}
+
+	user := getUserLogged(ctx)
+	// the collaborators only edit the content of the gist, its URL and its password are kept
+	canManage := isCreate || gist.CanManage(user)
+
 	if isCreate {
 		gist = dto.ToGist()
 	} else {
+		url := gist.URL
 		gist = dto.ToExistingGist(gist)
+		if !canManage {
+			gist.URL = url
+		}
 	}
 
-	user := getUserLogged(ctx)
-	gist.NbFiles = len(dto.Files)
+	switch {
+	case !canManage:
+	case !dto.Protected:
+		gist.PasswordHash = ""
+	case dto.Password != "":
+		if gist.PasswordHash, err = utils.Argon2id.Hash(dto.Password); err != nil {
+			return errorRes(500, "Cannot hash password", err)
+		}
+	}
 
 	if isCreate {
 		uuidGist, err := uuid.NewRandom()
@@ -560,6 +1092,7 @@ func processCreate(ctx echo.Context) error {
 
 		gist.UserID = user.ID
 		gist.User = *user
+		gist.ExpiresAt = utils.ExpiresAt(utils.ClampExpiry(ctx.FormValue("expiry"), config.C.GistMaxExpiry))
 	}
 
 	if gist.Title == "" {
@@ -570,38 +1103,80 @@ func processCreate(ctx echo.Context) error {
 		}
 	}
 
-	if len(dto.Files) > 0 {
-		split := strings.Split(dto.Files[0].Content, "\n")
+	if err = saveGist(gist, dto.Files, tags, isCreate); err != nil {
+		return errorRes(500, "Error saving the gist", err)
+	}
+	triggerSaveWebhooks(ctx, gist, isCreate)
+
+	return redirect(ctx, "/"+user.Username+"/"+gist.Identifier())
+}
+
+// tagsError returns the message of the first limit the tags of a gist exceed, or an empty string if there is none
+func tagsError(ctx echo.Context, tags []string) string {
+	if len(tags) > db.MaxGistTags {
+		return tr(ctx, "flash.gist.too-many-tags", db.MaxGistTags)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > db.MaxTagLength {
+			return tr(ctx, "flash.gist.tag-too-long", db.MaxTagLength)
+		}
+	}
+	return ""
+}
+
+// saveGist commits the files of a gist which is created or edited, then saves it with its tags and indexes it
+func saveGist(gist *db.Gist, files []db.FileDTO, tags []string, isCreate bool) error {
+	gist.NbFiles = len(files)
+	gist.Size = 0
+	gist.FileOrder = make([]string, 0, len(files))
+	for _, file := range files {
+		gist.Size += uint64(len(file.Content))
+		gist.FileOrder = append(gist.FileOrder, file.Filename)
+	}
+
+	if len(files) > 0 {
+		split := strings.Split(files[0].Content, "\n")
 		if len(split) > 10 {
 			gist.Preview = strings.Join(split[:10], "\n")
 		} else {
-			gist.Preview = dto.Files[0].Content
+			gist.Preview = files[0].Content
 		}
 
-		gist.PreviewFilename = dto.Files[0].Filename
+		gist.PreviewFilename = files[0].Filename
 	}
 
-	if err = gist.InitRepository(); err != nil {
-		return errorRes(500, "Error creating the repository", err)
+	if err := gist.InitRepository(); err != nil {
+		return fmt.Errorf("cannot create the repository: %w", err)
 	}
 
-	if err = gist.AddAndCommitFiles(&dto.Files); err != nil {
-		return errorRes(500, "Error adding and committing files", err)
+	if err := gist.AddAndCommitFiles(&files); err != nil {
+		return fmt.Errorf("cannot add and commit files: %w", err)
 	}
 
 	if isCreate {
-		if err = gist.Create(); err != nil {
-			return errorRes(500, "Error creating the gist", err)
+		if err := gist.Create(); err != nil {
+			return fmt.Errorf("cannot create the gist: %w", err)
 		}
 	} else {
-		if err = gist.Update(); err != nil {
-			return errorRes(500, "Error updating the gist", err)
+		if err := gist.Update(); err != nil {
+			return fmt.Errorf("cannot update the gist: %w", err)
 		}
 	}
 
+	if err := gist.SetTags(tags); err != nil {
+		return fmt.Errorf("cannot save the tags of the gist: %w", err)
+	}
+
 	gist.AddInIndex()
+	return nil
+}
 
-	return redirect(ctx, "/"+user.Username+"/"+gist.Identifier())
+func triggerSaveWebhooks(ctx echo.Context, gist *db.Gist, isCreate bool) {
+	if isCreate {
+		triggerWebhooks(ctx, db.WebhookEventGistCreated, gist)
+	} else {
+		triggerWebhooks(ctx, db.WebhookEventGistUpdated, gist)
+	}
 }
 
 func editVisibility(ctx echo.Context) error {
@@ -616,23 +1191,82 @@ func editVisibility(ctx echo.Context) error {
 	if err := gist.UpdateNoTimestamps(); err != nil {
 		return errorRes(500, "Error updating this gist", err)
 	}
+	triggerWebhooks(ctx, db.WebhookEventGistUpdated, gist)
 
 	addFlash(ctx, tr(ctx, "flash.gist.visibility-changed"), "success")
 	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
 }
 
+func bulkEditVisibility(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	visibility, err := db.ParseVisibility(ctx.FormValue("private"))
+	if err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
+	var gistIds []uint
+	seen := make(map[uint]bool)
+	for _, id := range ctx.Request().PostForm["gist"] {
+		gistId, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.invalid-number"), err)
+		}
+		if !seen[uint(gistId)] {
+			seen[uint(gistId)] = true
+			gistIds = append(gistIds, uint(gistId))
+		}
+	}
+
+	if len(gistIds) == 0 {
+		addFlash(ctx, tr(ctx, "flash.gist.none-selected"), "error")
+		return redirect(ctx, "/"+user.Username)
+	}
+
+	changed, err := db.SetGistsVisibility(user.ID, gistIds, visibility)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(403, tr(ctx, "error.not-your-gists"), nil)
+		}
+		return errorRes(500, "Error updating the visibility of the gists", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.visibility-changed-count", changed, len(gistIds)), "success")
+	return redirect(ctx, "/"+user.Username)
+}
+
 func deleteGist(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 
-	if err := gist.Delete(); err != nil {
+	if err := trashGist(ctx, gist); err != nil {
 		return errorRes(500, "Error deleting this gist", err)
 	}
-	gist.RemoveFromIndex()
 
-	addFlash(ctx, tr(ctx, "flash.gist.deleted"), "success")
+	if config.C.TrashRetentionDays > 0 {
+		addFlash(ctx, tr(ctx, "flash.gist.trashed", config.C.TrashRetentionDays), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.gist.deleted"), "success")
+	}
 	return redirect(ctx, "/")
 }
 
+// trashGist moves the gist deleted by its owner to the trash, or deletes it right away if the trash is disabled
+func trashGist(ctx echo.Context, gist *db.Gist) error {
+	var err error
+	if config.C.TrashRetentionDays > 0 {
+		err = gist.Trash()
+	} else {
+		err = gist.Delete()
+	}
+	if err != nil {
+		return err
+	}
+
+	gist.RemoveFromIndex()
+	triggerWebhooks(ctx, db.WebhookEventGistDeleted, gist)
+	return nil
+}
+
 func like(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	currentUser := getUserLogged(ctx)
@@ -659,6 +1293,50 @@ func like(ctx echo.Context) error {
 	return redirect(ctx, redirectTo)
 }
 
+func pinGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	gistUrl := "/" + gist.User.Username + "/" + gist.Identifier()
+
+	if gist.PinnedAt > 0 {
+		if err := gist.SetPinned(false); err != nil {
+			return errorRes(500, "Error unpinning this gist", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.gist.unpinned"), "success")
+		return redirect(ctx, gistUrl)
+	}
+
+	count, err := db.CountPinnedGistsOfUser(gist.UserID)
+	if err != nil {
+		return errorRes(500, "Error counting pinned gists", err)
+	}
+	if count >= db.MaxPinnedGists {
+		addFlash(ctx, tr(ctx, "flash.gist.too-many-pinned", db.MaxPinnedGists), "error")
+		return redirect(ctx, gistUrl)
+	}
+
+	if err = gist.SetPinned(true); err != nil {
+		return errorRes(500, "Error pinning this gist", err)
+	}
+	addFlash(ctx, tr(ctx, "flash.gist.pinned"), "success")
+	return redirect(ctx, gistUrl)
+}
+
+// templateGist marks the gist as a template new gists can be created from, or unmarks it
+func templateGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	if err := gist.SetTemplate(!gist.IsTemplate); err != nil {
+		return errorRes(500, "Error saving this gist as a template", err)
+	}
+
+	if gist.IsTemplate {
+		addFlash(ctx, tr(ctx, "flash.gist.template-saved"), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.gist.template-removed"), "success")
+	}
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
 func fork(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	currentUser := getUserLogged(ctx)
@@ -690,8 +1368,13 @@ func fork(ctx echo.Context) error {
 		Description:     gist.Description,
 		Private:         gist.Private,
 		UserID:          currentUser.ID,
+		User:            *currentUser,
 		ForkedID:        gist.ID,
 		NbFiles:         gist.NbFiles,
+		Size:            gist.Size,
+		FileOrder:       gist.FileOrder,
+		// a fork must not expose the content of a gist protected by a password
+		PasswordHash: gist.PasswordHash,
 	}
 
 	if err = newGist.CreateForked(); err != nil {
@@ -705,23 +1388,111 @@ func fork(ctx echo.Context) error {
 		return errorRes(500, "Error incrementing the fork count", err)
 	}
 
+	newGist.AddInIndex()
+
 	addFlash(ctx, tr(ctx, "flash.gist.forked"), "success")
 
 	return redirect(ctx, "/"+currentUser.Username+"/"+newGist.Identifier())
 }
 
+// rawContentTypes are the types of the files served raw as themselves, the other ones are served as plain text or
+// bytes so that a gist cannot run scripts on the origin of the instance
+var rawContentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".ico":  "image/x-icon",
+}
+
+func rawContentType(filename string, head []byte) string {
+	if contentType, ok := rawContentTypes[strings.ToLower(filepath.Ext(filename))]; ok {
+		return contentType
+	}
+	if strings.HasPrefix(http.DetectContentType(head), "text/") {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// rawFile streams the content of a file at a revision, which can be a commit hash for the link to stay the same
+// across edits
 func rawFile(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
-	file, err := gist.File(ctx.Param("revision"), ctx.Param("file"), false)
+
+	// the content of a file only depends on the commit, as the filename is part of the URL
+	hash, date, err := gist.Commit(ctx.Param("revision"))
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching the revision", err)
+	}
+	if notModified(ctx, gist, `"`+hash+`"`, date) {
+		return ctx.NoContent(304)
+	}
+
+	reader, size, err := gist.FileReader(hash, ctx.Param("file"))
 	if err != nil {
 		return errorRes(500, "Error getting file content", err)
 	}
-
-	if file == nil {
+	if reader == nil {
 		return notFound("File not found")
 	}
+	defer reader.Close()
+
+	content := bufio.NewReader(reader)
+	head, _ := content.Peek(512)
+
+	header := ctx.Response().Header()
+	header.Set("Content-Type", rawContentType(ctx.Param("file"), head))
+	header.Set("Content-Length", strconv.FormatUint(size, 10))
+	header.Set("X-Content-Type-Options", "nosniff")
+	ctx.Response().WriteHeader(200)
+
+	if _, err = io.Copy(ctx.Response(), content); err != nil {
+		log.Error().Err(err).Msgf("Cannot stream file %s of gist %s", ctx.Param("file"), gist.Uuid)
+	}
+	return nil
+}
+
+// gistFiles returns the full content of the text files of a gist at a revision, for the whole gist to be copied at
+// once from its page
+func gistFiles(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	hash, date, err := gist.Commit(ctx.Param("revision"))
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching the revision", err)
+	}
+	if notModified(ctx, gist, `"`+hash+`"`, date) {
+		return ctx.NoContent(304)
+	}
 
-	return plainText(ctx, 200, file.Content)
+	files, err := gist.Files(hash, false)
+	if err != nil {
+		return errorRes(500, "Error fetching files", err)
+	}
+
+	type fileContent struct {
+		Filename string `json:"filename"`
+		Content  string `json:"content"`
+	}
+	contents := make([]fileContent, 0, len(files))
+	for _, file := range files {
+		// binary files cannot be pasted anywhere
+		if !utf8.ValidString(file.Content) || strings.ContainsRune(file.Content, 0) {
+			continue
+		}
+		contents = append(contents, fileContent{Filename: file.Filename, Content: file.Content})
+	}
+
+	return ctx.JSON(200, map[string]interface{}{
+		"revision": hash,
+		"files":    contents,
+	})
 }
 
 func downloadFile(ctx echo.Context) error {
@@ -754,6 +1525,15 @@ func edit(ctx echo.Context) error {
 		return errorRes(500, "Error fetching files from repository", err)
 	}
 
+	// the owner of the gist can transfer it to the organizations they own
+	if user := getUserLogged(ctx); user.ID == gist.UserID {
+		organizations, err := db.GetOrganizationsOwnedByUser(user.ID)
+		if err != nil {
+			return errorRes(500, "Cannot get organizations", err)
+		}
+		setData(ctx, "ownedOrganizations", organizations)
+	}
+
 	setData(ctx, "files", files)
 	setData(ctx, "htmlTitle", trH(ctx, "gist.edit.edit-gist", gist.Title))
 
@@ -764,6 +1544,16 @@ func downloadZip(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 	revision := ctx.Param("revision")
 
+	hash, date, err := gist.Commit(revision)
+	if _, ok := err.(*git.RevisionNotFoundError); ok {
+		return notFound("Revision not found")
+	} else if err != nil {
+		return errorRes(500, "Error fetching the revision", err)
+	}
+	if notModified(ctx, gist, `"`+hash+`"`, date) {
+		return ctx.NoContent(304)
+	}
+
 	files, err := gist.Files(revision, false)
 	if err != nil {
 		return errorRes(500, "Error fetching files from repository", err)
@@ -772,39 +1562,51 @@ func downloadZip(ctx echo.Context) error {
 		return notFound("No files found in this revision")
 	}
 
-	zipFile := new(bytes.Buffer)
-
-	zipWriter := zip.NewWriter(zipFile)
+	ctx.Response().Header().Set("Content-Type", "application/zip")
+	ctx.Response().Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": gistArchiveName(gist) + ".zip",
+	}))
+	ctx.Response().WriteHeader(200)
 
+	// the archive is streamed as it is built, errors past this point can only interrupt it
+	zipWriter := zip.NewWriter(ctx.Response())
 	for _, file := range files {
-		fh := &zip.FileHeader{
-			Name:   file.Filename,
-			Method: zip.Deflate,
-		}
-		f, err := zipWriter.CreateHeader(fh)
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     file.Filename,
+			Method:   zip.Deflate,
+			Modified: date,
+		})
 		if err != nil {
-			return errorRes(500, "Error adding a file the to the zip archive", err)
+			log.Error().Err(err).Msgf("Cannot add file %s to the archive of gist %s", file.Filename, gist.Uuid)
+			return nil
 		}
-		_, err = f.Write([]byte(file.Content))
-		if err != nil {
-			return errorRes(500, "Error adding file content the to the zip archive", err)
+		if _, err = f.Write([]byte(file.Content)); err != nil {
+			log.Error().Err(err).Msgf("Cannot write file %s to the archive of gist %s", file.Filename, gist.Uuid)
+			return nil
 		}
 	}
-	err = zipWriter.Close()
-	if err != nil {
-		return errorRes(500, "Error closing the zip archive", err)
-	}
 
-	ctx.Response().Header().Set("Content-Type", "application/zip")
-	ctx.Response().Header().Set("Content-Disposition", "attachment; filename="+gist.Identifier()+".zip")
-	ctx.Response().Header().Set("Content-Length", strconv.Itoa(len(zipFile.Bytes())))
-	_, err = ctx.Response().Write(zipFile.Bytes())
-	if err != nil {
-		return errorRes(500, "Error writing the zip archive", err)
+	if err = zipWriter.Close(); err != nil {
+		log.Error().Err(err).Msgf("Cannot close the archive of gist %s", gist.Uuid)
 	}
 	return nil
 }
 
+var archiveNameRegex = regexp.MustCompile(`[^\p{L}\p{N}_.-]+`)
+
+// gistArchiveName names the archive of a gist after its title, or its identifier when the title has no usable character
+func gistArchiveName(gist *db.Gist) string {
+	name := strings.Trim(archiveNameRegex.ReplaceAllString(gist.Title, "-"), "-.")
+	// untitled gists get their UUID as title, their identifier may be a custom URL
+	if name == "" || gist.Title == "gist:"+gist.Uuid {
+		return gist.Identifier()
+	}
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+	return name
+}
+
 func likes(ctx echo.Context) error {
 	gist := getData(ctx, "gist").(*db.Gist)
 
@@ -880,13 +1682,102 @@ func checkbox(ctx echo.Context) error {
 	if err = gist.UpdatePreviewAndCount(true); err != nil {
 		return errorRes(500, "Error updating the gist", err)
 	}
+	triggerWebhooks(ctx, db.WebhookEventGistUpdated, gist)
 
 	return plainText(ctx, 200, "ok")
 }
 
+// maximum size of a file fetched from a URL to create a gist
+const maxFetchedFileSize = 1 << 20
+
+// fetchUrl returns the content of a remote text file, to prefill the editor with it
+func fetchUrl(ctx echo.Context) error {
+	if !config.C.GistCreateFromUrl {
+		return ctx.JSON(404, map[string]string{"error": tr(ctx, "error.page-not-found")})
+	}
+
+	fileUrl, err := url.Parse(ctx.QueryParam("url"))
+	if err != nil || (fileUrl.Scheme != "http" && fileUrl.Scheme != "https") || fileUrl.Host == "" {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-invalid")})
+	}
+
+	resp, err := utils.PublicHttpClient.Get(fileUrl.String())
+	if err != nil {
+		log.Info().Err(err).Str("url", fileUrl.String()).Msg("Cannot fetch remote file")
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-failed")})
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-failed")})
+	}
+
+	if !isTextContentType(resp.Header.Get("Content-Type")) {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-binary")})
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchedFileSize+1))
+	if err != nil {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-failed")})
+	}
+	if len(content) > maxFetchedFileSize {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-too-large", humanize.IBytes(maxFetchedFileSize))})
+	}
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) != -1 {
+		return ctx.JSON(400, map[string]string{"error": tr(ctx, "error.fetch-url-binary")})
+	}
+
+	filename := path.Base(resp.Request.URL.Path)
+	if filename == "/" || filename == "." {
+		filename = ""
+	}
+
+	return ctx.JSON(200, map[string]string{
+		"filename": filename,
+		"content":  string(content),
+	})
+}
+
+// isTextContentType reports whether a Content-Type header describes a text file. A missing header is accepted,
+// the content being checked afterward.
+func isTextContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/x-sh", "application/x-shellscript", "application/x-yaml", "application/yaml",
+		"application/toml", "application/sql", "application/x-httpd-php":
+		return true
+	case "application/octet-stream":
+		// sent by many servers for unknown extensions, the content decides
+		return true
+	}
+	return false
+}
+
 func preview(ctx echo.Context) error {
 	content := ctx.FormValue("content")
 
+	// the description of a gist is rendered with a restricted Markdown
+	if ctx.FormValue("description") == "true" {
+		previewStr, err := render.MarkdownDescription(content)
+		if err != nil {
+			return errorRes(500, "Error rendering markdown", err)
+		}
+		return plainText(ctx, 200, previewStr)
+	}
+
 	previewStr, err := render.MarkdownString(content)
 	if err != nil {
 		return errorRes(500, "Error rendering markdown", err)
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"gorm.io/gorm"
+)
+
+// gistCollaboratorAdd allows a user to edit the gist and to push to its repository
+func gistCollaboratorAdd(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	back := "/" + gist.User.Username + "/" + gist.Identifier()
+
+	collaborator, err := db.GetUserByUsername(strings.TrimSpace(ctx.FormValue("username")))
+	if err != nil || collaborator.IsOrganization {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get user", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.gist.collaborator-unknown-user"), "error")
+		return redirect(ctx, back)
+	}
+
+	// the users managing the gist already write it
+	if gist.CanManage(collaborator) {
+		addFlash(ctx, tr(ctx, "flash.gist.collaborator-owner"), "error")
+		return redirect(ctx, back)
+	}
+
+	if err = db.AddGistCollaborator(gist.ID, collaborator.ID); err != nil {
+		return errorRes(500, "Cannot add collaborator", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.collaborator-added", collaborator.Username), "success")
+	return redirect(ctx, back)
+}
+
+func gistCollaboratorRemove(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	back := "/" + gist.User.Username + "/" + gist.Identifier()
+
+	collaborator, err := db.GetUserByUsername(ctx.Param("collaborator"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return redirect(ctx, back)
+		}
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	if err = db.RemoveGistCollaborator(gist.ID, collaborator.ID); err != nil {
+		return errorRes(500, "Cannot remove collaborator", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.collaborator-removed", collaborator.Username), "success")
+	return redirect(ctx, back)
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// gistViewWindow is the time during which the views of a gist by the same visitor are counted once
+const gistViewWindow = 30 * time.Minute
+
+// gistViews remembers when the visitors last viewed the gists, by gist and by user or IP address
+var gistViews = &viewRecorder{seen: make(map[string]time.Time)}
+
+type viewRecorder struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// record reports whether a view of key counts, that is if it was not already seen within the window
+func (r *viewRecorder) record(key string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if last, ok := r.seen[key]; ok && now.Sub(last) < gistViewWindow {
+		return false
+	}
+
+	// the expired views are dropped from time to time, to keep the map from growing forever
+	if len(r.seen) >= 10000 {
+		for k, last := range r.seen {
+			if now.Sub(last) >= gistViewWindow {
+				delete(r.seen, k)
+			}
+		}
+	}
+
+	r.seen[key] = now
+	return true
+}
+
+// countGistView adds a view to the gist in the background, unless the visitor is its owner or viewed it recently
+func countGistView(ctx echo.Context, gist *db.Gist) {
+	visitor := "ip:" + ctx.RealIP()
+	if user := getUserLogged(ctx); user != nil {
+		if user.ID == gist.UserID {
+			return
+		}
+		visitor = "user:" + strconv.FormatUint(uint64(user.ID), 10)
+	}
+
+	if !gistViews.record(gist.Uuid+":"+visitor, time.Now()) {
+		return
+	}
+
+	go func() {
+		if err := db.IncrementGistViews(gist.ID); err != nil {
+			log.Error().Err(err).Msgf("Cannot count a view of gist %s", gist.Uuid)
+		}
+	}()
+}
+
+// countGistClone adds a clone to the gist in the background, so that the Git client is not kept waiting
+func countGistClone(gist *db.Gist) {
+	// the repository of a gist being created
+	if gist.ID == 0 {
+		return
+	}
+
+	go func() {
+		if err := db.IncrementGistClones(gist.ID); err != nil {
+			log.Error().Err(err).Msgf("Cannot count a clone of gist %s", gist.Uuid)
+		}
+	}()
+}
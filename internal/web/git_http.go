@@ -20,9 +20,9 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/auth"
+	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
-	"github.com/thomiceli/opengist/internal/memdb"
 	"gorm.io/gorm"
 )
 
@@ -42,13 +42,21 @@ var routes = []struct {
 	{"(.*?)/objects/[0-9a-f]{2}/[0-9a-f]{38}$", "GET", looseObject},
 	{"(.*?)/objects/pack/pack-[0-9a-f]{40}\\.pack$", "GET", packFile},
 	{"(.*?)/objects/pack/pack-[0-9a-f]{40}\\.idx$", "GET", idxFile},
+	{"(.*?)/info/lfs/objects/batch$", "POST", lfsBatch},
+	{"(.*?)/info/lfs/objects/[0-9a-f]{64}$", "GET", lfsDownload},
+	{"(.*?)/info/lfs/objects/[0-9a-f]{64}$", "PUT", lfsUpload},
 }
 
 func gitHttp(ctx echo.Context) error {
 	for _, route := range routes {
 		matched, _ := regexp.MatchString(route.gitUrl, ctx.Request().URL.Path)
 		if ctx.Request().Method == route.method && matched {
-			if !strings.HasPrefix(ctx.Request().Header.Get("User-Agent"), "git/") {
+			// the objects of Git LFS are transferred by the git-lfs client
+			isLfs := strings.Contains(route.gitUrl, "/info/lfs/")
+			if isLfs && (!config.C.LfsEnabled || !strings.HasPrefix(ctx.Request().Header.Get("User-Agent"), "git-lfs/")) {
+				continue
+			}
+			if !isLfs && !strings.HasPrefix(ctx.Request().Header.Get("User-Agent"), "git/") {
 				continue
 			}
 
@@ -60,9 +68,24 @@ func gitHttp(ctx echo.Context) error {
 			isPull := ctx.QueryParam("service") == "git-upload-pack" ||
 				strings.HasSuffix(ctx.Request().URL.Path, "git-upload-pack") ||
 				ctx.Request().Method == "GET" && !isInfoRefs
+			if strings.HasSuffix(route.gitUrl, "/info/lfs/objects/batch$") {
+				batch, err := readLfsBatch(ctx)
+				if err != nil {
+					return lfsError(ctx, 422, "Cannot read the batch request")
+				}
+				isPull = batch.Operation == "download"
+			}
+
+			if !isPull && isReadOnly(ctx) {
+				if isLfs {
+					return lfsError(ctx, 503, tr(ctx, "error.read-only"))
+				}
+				return plainText(ctx, 503, tr(ctx, "error.read-only"))
+			}
 
 			repositoryPath := git.RepositoryPath(gist.User.Username, gist.Uuid)
-			if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
+			// the repository of a push to /init is only known once the user is authenticated
+			if _, err := os.Stat(repositoryPath); os.IsNotExist(err) && !isInit && !isInitReceive {
 				if err != nil {
 					log.Info().Err(err).Msg("Repository directory does not exist")
 					return errorRes(404, "Repository directory does not exist", err)
@@ -79,9 +102,10 @@ func gitHttp(ctx echo.Context) error {
 			// Shows basic auth if :
 			// - user wants to push the gist
 			// - user wants to clone/pull a private gist
+			// - user wants to clone/pull a gist protected by a password
 			// - gist is not found (obfuscation)
 			// - admin setting to require login is set to true
-			if isPull && gist.Private != db.PrivateVisibility && gist.ID != 0 && allow {
+			if isPull && gist.Private != db.PrivateVisibility && !gist.IsProtected() && gist.ID != 0 && allow {
 				return route.handler(ctx)
 			}
 
@@ -105,18 +129,74 @@ func gitHttp(ctx echo.Context) error {
 					return plainText(ctx, 404, "Check your credentials or make sure you have access to the Gist")
 				}
 
+				// a protected gist is pulled with its password, whatever the username, or with the credentials of
+				// its owner. Its password is locked out after too many failures, as with the form to unlock it.
+				var gistKey string
+				if gist.IsProtected() && isPull && gist.Private != db.PrivateVisibility {
+					gistKey = gistAttemptKey(ctx, gist)
+					locked, err := loginLocked(gistKey)
+					if err != nil {
+						return errorRes(500, "Cannot check for login lockout", err)
+					}
+					if ok, _ := utils.Argon2id.Verify(authPassword, gist.PasswordHash); ok && !locked {
+						if err = db.ResetLoginAttempts(gistKey); err != nil {
+							log.Error().Err(err).Msg("Cannot reset failed gist passwords")
+						}
+						return route.handler(ctx)
+					}
+				}
+
 				var userToCheckPermissions *db.User
-				if gist.Private != db.PrivateVisibility && isPull {
+				if gist.Private != db.PrivateVisibility && !gist.IsProtected() && isPull {
+					userToCheckPermissions, _ = db.GetUserByUsername(authUsername)
+				} else if gist.User.IsOrganization {
+					// the gists of an organization are accessed with the credentials of one of its members
 					userToCheckPermissions, _ = db.GetUserByUsername(authUsername)
+					if !gist.CanWrite(userToCheckPermissions) {
+						authWarn(ctx, db.AuditLoginFailed, authUsername).Str("method", "git-http").Msg("Invalid HTTP authentication attempt")
+						return plainText(ctx, 404, "Check your credentials or make sure you have access to the Gist")
+					}
 				} else {
 					userToCheckPermissions = &gist.User
+					// the collaborators of the gist use their own credentials
+					if collaborator, err := db.GetUserByUsername(authUsername); err == nil &&
+						collaborator.ID != gist.UserID && gist.CanWrite(collaborator) {
+						userToCheckPermissions = collaborator
+					}
 				}
 
-				if ok, err := utils.Argon2id.Verify(authPassword, userToCheckPermissions.Password); !ok {
+				// the password is only checked against the account named, so that the failures are counted for it
+				if userToCheckPermissions.ID != 0 && !strings.EqualFold(userToCheckPermissions.Username, authUsername) {
+					authWarn(ctx, db.AuditLoginFailed, authUsername).Str("method", "git-http").Msg("Invalid HTTP authentication attempt")
+					if gistKey != "" {
+						recordGistPasswordFailure(gistKey)
+					}
+					return plainText(ctx, 404, "Check your credentials or make sure you have access to the Gist")
+				}
+
+				// the passwords of the accounts share the lockout of the login form. A success does not reset it, the
+				// second factor is not checked here.
+				attemptKeys := loginAttemptKeys(ctx, authUsername)
+				locked, err := loginLocked(attemptKeys...)
+				if err != nil {
+					return errorRes(500, "Cannot check for login lockout", err)
+				}
+				if locked {
+					authWarn(ctx, "login-locked", authUsername).Str("method", "git-http").Msg("Locked out HTTP authentication attempt")
+					return plainText(ctx, 429, "Too many failed authentication attempts, try again later")
+				}
+
+				if ok, err := utils.Argon2id.Verify(authPassword, userToCheckPermissions.Password); !ok || !userToCheckPermissions.CanLogIn() {
 					if err != nil {
 						return errorRes(500, "Cannot verify password", err)
 					}
-					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+					authWarn(ctx, db.AuditLoginFailed, authUsername).Str("method", "git-http").Msg("Invalid HTTP authentication attempt")
+					if !ok {
+						recordLoginFailure(attemptKeys)
+						if gistKey != "" {
+							recordGistPasswordFailure(gistKey)
+						}
+					}
 					return plainText(ctx, 404, "Check your credentials or make sure you have access to the Gist")
 				}
 			} else {
@@ -125,15 +205,28 @@ func gitHttp(ctx echo.Context) error {
 					if !errors.Is(err, gorm.ErrRecordNotFound) {
 						return errorRes(500, "Cannot get user", err)
 					}
-					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+					authWarn(ctx, db.AuditLoginFailed, authUsername).Str("method", "git-http").Msg("Invalid HTTP authentication attempt")
 					return errorRes(401, "Invalid credentials", nil)
 				}
 
-				if ok, err := utils.Argon2id.Verify(authPassword, user.Password); !ok {
+				attemptKeys := loginAttemptKeys(ctx, user.Username)
+				locked, err := loginLocked(attemptKeys...)
+				if err != nil {
+					return errorRes(500, "Cannot check for login lockout", err)
+				}
+				if locked {
+					authWarn(ctx, "login-locked", authUsername).Str("method", "git-http").Msg("Locked out HTTP authentication attempt")
+					return plainText(ctx, 429, "Too many failed authentication attempts, try again later")
+				}
+
+				if ok, err := utils.Argon2id.Verify(authPassword, user.Password); !ok || !user.EmailVerified || !user.CanLogIn() {
 					if err != nil {
 						return errorRes(500, "Cannot check for password", err)
 					}
-					log.Warn().Msg("Invalid HTTP authentication attempt from " + ctx.RealIP())
+					authWarn(ctx, db.AuditLoginFailed, authUsername).Str("method", "git-http").Msg("Invalid HTTP authentication attempt")
+					if !ok {
+						recordLoginFailure(attemptKeys)
+					}
 					return errorRes(401, "Invalid credentials", nil)
 				}
 
@@ -156,18 +249,20 @@ func gitHttp(ctx echo.Context) error {
 						return errorRes(500, "Cannot init repository in database", err)
 					}
 
-					if err := memdb.InsertGistInit(user.ID, gist); err != nil {
+					if err := db.AddInitGistToQueue(gist.ID, user.ID); err != nil {
 						return errorRes(500, "Cannot save the URL for the new Gist", err)
 					}
 
 					setData(ctx, "gist", gist)
 				} else {
-					gistFromMemdb, err := memdb.GetGistInitAndDelete(user.ID)
+					gist, err := db.GetInitGistAndDelete(user.ID)
 					if err != nil {
-						return errorRes(500, "Cannot get the gist link from the in memory database", err)
+						return errorRes(500, "Cannot get the gist link from the database", err)
+					}
+					if gist == nil {
+						return notFound("Gist not found")
 					}
 
-					gist := gistFromMemdb.Gist
 					setData(ctx, "gist", gist)
 					setData(ctx, "repositoryPath", git.RepositoryPath(gist.User.Username, gist.Uuid))
 				}
@@ -219,6 +314,10 @@ func pack(ctx echo.Context, serviceType string) error {
 	cmd.Env = append(cmd.Env, "OPENGIST_REPOSITORY_URL_INTERNAL="+git.RepositoryUrl(ctx, gist.User.Username, gist.Identifier()))
 	cmd.Env = append(cmd.Env, "OPENGIST_REPOSITORY_ID="+strconv.Itoa(int(gist.ID)))
 
+	if serviceType == "receive-pack" {
+		defer git.LockForWrite()()
+	}
+
 	if err = cmd.Run(); err != nil {
 		return errorRes(500, "Cannot run git "+serviceType+" ; "+stderr.String(), err)
 	}
@@ -255,6 +354,11 @@ func infoRefs(ctx echo.Context) error {
 	_, _ = ctx.Response().Write([]byte("0000"))
 	_, _ = ctx.Response().Write(refs)
 
+	// the refs are advertised once per clone or fetch, while the packs may be asked for several times
+	if service == "upload-pack" {
+		countGistClone(gist)
+	}
+
 	return nil
 }
 
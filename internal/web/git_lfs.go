@@ -0,0 +1,151 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/git"
+)
+
+// content type of the requests and responses of the Git LFS batch API
+const lfsContentType = "application/vnd.git-lfs+json"
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string              `json:"transfer"`
+	Objects  []lfsObjectResponse `json:"objects"`
+}
+
+type lfsObjectResponse struct {
+	lfsObject
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// readLfsBatch reads the batch request of the git-lfs client, whose operation tells whether the gist is pulled or
+// pushed
+func readLfsBatch(ctx echo.Context) (*lfsBatchRequest, error) {
+	defer ctx.Request().Body.Close()
+
+	batch := new(lfsBatchRequest)
+	if err := json.NewDecoder(ctx.Request().Body).Decode(batch); err != nil {
+		return nil, err
+	}
+	setData(ctx, "lfsBatch", batch)
+	return batch, nil
+}
+
+// lfsBatch tells the git-lfs client where to download the objects of the gist from, or where to upload the ones
+// the gist does not have yet. The objects are transferred with the basic transfer adapter.
+func lfsBatch(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	batch := getData(ctx, "lfsBatch").(*lfsBatchRequest)
+
+	if batch.Operation != "download" && batch.Operation != "upload" {
+		return lfsError(ctx, 422, "Unknown operation "+batch.Operation)
+	}
+
+	// the client sends the credentials it used for the batch again along with the transfers
+	var header map[string]string
+	if authHeader := ctx.Request().Header.Get("Authorization"); authHeader != "" {
+		header = map[string]string{"Authorization": authHeader}
+	}
+	objectsUrl := git.RepositoryUrl(ctx, gist.User.Username, gist.Identifier()) + "/info/lfs/objects/"
+
+	objects := make([]lfsObjectResponse, 0, len(batch.Objects))
+	for _, object := range batch.Objects {
+		res := lfsObjectResponse{lfsObject: object}
+		action := lfsAction{Href: objectsUrl + object.Oid, Header: header}
+
+		switch {
+		case !git.IsLfsOid(object.Oid) || object.Size < 0:
+			res.Error = &lfsObjectError{Code: 422, Message: "Invalid object"}
+		case git.LfsObjectExists(gist.Uuid, object.Oid):
+			// an object the gist already has is not uploaded again
+			if batch.Operation == "download" {
+				res.Actions = map[string]lfsAction{"download": action}
+			}
+		case batch.Operation == "download":
+			res.Error = &lfsObjectError{Code: 404, Message: "Object does not exist"}
+		default:
+			res.Actions = map[string]lfsAction{"upload": action}
+		}
+
+		res.Authenticated = res.Actions != nil && header != nil
+		objects = append(objects, res)
+	}
+
+	ctx.Response().Header().Set("Content-Type", lfsContentType)
+	return ctx.JSON(200, lfsBatchResponse{Transfer: "basic", Objects: objects})
+}
+
+func lfsDownload(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+
+	object, err := git.OpenLfsObject(gist.Uuid, path.Base(ctx.Request().URL.Path))
+	if os.IsNotExist(err) {
+		return lfsError(ctx, 404, "Object does not exist")
+	} else if err != nil {
+		return errorRes(500, "Cannot open the object", err)
+	}
+	defer object.Close()
+
+	fi, err := object.Stat()
+	if err != nil {
+		return errorRes(500, "Cannot open the object", err)
+	}
+
+	cacheHeadersForever(ctx)
+	ctx.Response().Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	return ctx.Stream(200, "application/octet-stream", object)
+}
+
+func lfsUpload(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	defer ctx.Request().Body.Close()
+
+	if ctx.Request().ContentLength < 0 {
+		return lfsError(ctx, 411, "The size of the object is required")
+	}
+
+	pointer := &git.LfsPointer{Oid: path.Base(ctx.Request().URL.Path), Size: ctx.Request().ContentLength}
+	if err := git.WriteLfsObject(gist.Uuid, pointer, ctx.Request().Body); err != nil {
+		if errors.Is(err, git.ErrLfsObjectMismatch) {
+			return lfsError(ctx, 422, "The object does not match its oid and its size")
+		}
+		return errorRes(500, "Cannot store the object", err)
+	}
+
+	return ctx.NoContent(200)
+}
+
+func lfsError(ctx echo.Context, code int, message string) error {
+	ctx.Response().Header().Set("Content-Type", lfsContentType)
+	return ctx.JSON(code, map[string]string{"message": message})
+}
@@ -0,0 +1,250 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+const (
+	githubApiUrl           = "https://api.github.com"
+	githubImportSessionKey = "githubImport"
+	// the files of a gist are served truncated by the API past 1 MiB, their raw content has no such limit
+	maxImportedFileSize = 10 << 20
+)
+
+var githubNextPageRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// errGithubRateLimited is returned when GitHub refuses more API calls until the time given
+type errGithubRateLimited struct {
+	reset time.Time
+}
+
+func (e *errGithubRateLimited) Error() string {
+	return "GitHub API rate limit exceeded until " + e.reset.Format(time.RFC3339)
+}
+
+type githubGist struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Public      bool      `json:"public"`
+	CreatedAt   time.Time `json:"created_at"`
+	Files       map[string]struct {
+		Filename string `json:"filename"`
+		RawURL   string `json:"raw_url"`
+	} `json:"files"`
+}
+
+// githubGistsImportResult counts the gists handled by an import, which stops at the first error
+type githubGistsImportResult struct {
+	imported int
+	skipped  int
+}
+
+// importGithubGists creates for the user a copy of each of the GitHub gists the access token can list, public and
+// secret ones. Gists imported before are skipped, so that an import interrupted by the rate limit can be resumed.
+func importGithubGists(user *db.User, accessToken string) (githubGistsImportResult, error) {
+	var result githubGistsImportResult
+
+	pageUrl := githubApiUrl + "/gists?per_page=100"
+	for pageUrl != "" {
+		var gists []githubGist
+		next, err := githubApiGet(pageUrl, accessToken, &gists)
+		if err != nil {
+			return result, err
+		}
+
+		for _, ghGist := range gists {
+			imported, err := importGithubGist(user, &ghGist)
+			if err != nil {
+				return result, fmt.Errorf("cannot import GitHub gist %s: %w", ghGist.ID, err)
+			}
+			if imported {
+				result.imported++
+			} else {
+				result.skipped++
+			}
+		}
+
+		pageUrl = next
+	}
+
+	return result, nil
+}
+
+// githubApiGet decodes the JSON response of a GitHub API endpoint into v, and returns the URL of the next page of
+// results if there is one
+func githubApiGet(apiUrl string, accessToken string, v interface{}) (string, error) {
+	req, err := http.NewRequest("GET", apiUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := utils.HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) &&
+		resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		return "", &errGithubRateLimited{reset: time.Unix(reset, 0)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub API responded with %s", resp.Status)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+
+	var next string
+	if match := githubNextPageRegex.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+		next = match[1]
+	}
+	return next, nil
+}
+
+func fetchGithubGistFile(rawUrl string) (string, error) {
+	resp, err := utils.HttpClient.Get(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s for %s", resp.Status, rawUrl)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxImportedFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(content) > maxImportedFileSize {
+		return "", fmt.Errorf("file %s is larger than %d bytes", rawUrl, maxImportedFileSize)
+	}
+	return string(content), nil
+}
+
+// importGithubGist creates the gist for the user, unless it was already imported
+func importGithubGist(user *db.User, ghGist *githubGist) (bool, error) {
+	sourceId := "github:" + ghGist.ID
+	exists, err := db.GistSourceExistsForUser(sourceId, user.ID)
+	if err != nil || exists || len(ghGist.Files) == 0 {
+		return false, err
+	}
+
+	files := make([]db.FileDTO, 0, len(ghGist.Files))
+	for _, file := range ghGist.Files {
+		content, err := fetchGithubGistFile(file.RawURL)
+		if err != nil {
+			return false, err
+		}
+		files = append(files, db.FileDTO{Filename: file.Filename, Content: content})
+	}
+	// GitHub shows the files of a gist by filename
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+
+	uuidGist, err := uuid.NewRandom()
+	if err != nil {
+		return false, err
+	}
+
+	gist := &db.Gist{
+		Uuid:        strings.Replace(uuidGist.String(), "-", "", -1),
+		Title:       files[0].Filename,
+		Description: ghGist.Description,
+		Private:     db.PublicVisibility,
+		UserID:      user.ID,
+		User:        *user,
+		CreatedAt:   ghGist.CreatedAt.Unix(),
+		SourceID:    sourceId,
+	}
+	// secret gists are reachable by anyone knowing their URL, like unlisted ones
+	if !ghGist.Public {
+		gist.Private = db.UnlistedVisibility
+	}
+	for _, file := range files {
+		gist.FileOrder = append(gist.FileOrder, file.Filename)
+	}
+
+	if err = gist.InitRepository(); err != nil {
+		return false, err
+	}
+	if err = gist.AddAndCommitFiles(&files); err != nil {
+		return false, err
+	}
+	if err = gist.Create(); err != nil {
+		return false, err
+	}
+	if err = gist.UpdatePreviewAndCount(false); err != nil {
+		return false, err
+	}
+
+	gist.AddInIndex()
+	return true, nil
+}
+
+// startGithubImport marks the session of the logged user so that the gists are imported when GitHub redirects back to
+// the OAuth callback. Only the GitHub account linked to the user can be imported.
+func startGithubImport(ctx echo.Context) bool {
+	currUser := getUserLogged(ctx)
+	if currUser == nil || currUser.GithubID == "" {
+		return false
+	}
+
+	sess := getSession(ctx)
+	sess.Values[githubImportSessionKey] = true
+	saveSession(sess, ctx)
+	return true
+}
+
+func popGithubImport(ctx echo.Context) bool {
+	sess := getSession(ctx)
+	importGists, _ := sess.Values[githubImportSessionKey].(bool)
+	if importGists {
+		delete(sess.Values, githubImportSessionKey)
+		saveSession(sess, ctx)
+	}
+	return importGists
+}
+
+// githubImportCallback imports the gists of the logged user once they authorized Opengist to read them on GitHub
+func githubImportCallback(ctx echo.Context, currUser *db.User, accessToken string, githubId string) error {
+	if githubId != currUser.GithubID {
+		addFlash(ctx, tr(ctx, "flash.user.github-import-wrong-account"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	result, err := importGithubGists(currUser, accessToken)
+	var rateLimited *errGithubRateLimited
+	switch {
+	case errors.As(err, &rateLimited):
+		addFlash(ctx, tr(ctx, "flash.user.github-import-rate-limited", result.imported, rateLimited.reset.Format("15:04 MST")), "error")
+	case err != nil:
+		log.Error().Err(err).Msgf("Cannot import the GitHub gists of user %s", currUser.Username)
+		addFlash(ctx, tr(ctx, "flash.user.github-import-failed", result.imported), "error")
+	default:
+		addFlash(ctx, tr(ctx, "flash.user.github-imported", result.imported, result.skipped), "success")
+	}
+
+	return redirect(ctx, "/settings")
+}
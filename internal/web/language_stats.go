@@ -0,0 +1,53 @@
+package web
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// languageStats keeps the language stats of the users, computed again when their gists change
+var languageStats = &languageStatsCache{entries: make(map[string]*languageStatsEntry)}
+
+type languageStatsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*languageStatsEntry
+}
+
+type languageStatsEntry struct {
+	version string
+	stats   []*db.LanguageStat
+}
+
+// get returns the language stats of the user, from the cache if none of the gists counted changed since they were
+// computed. The stats of the public gists only and the ones of all the gists are kept apart.
+func (c *languageStatsCache) get(userId uint, publicOnly bool) ([]*db.LanguageStat, error) {
+	version, err := db.GetLanguageStatsVersion(userId, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strconv.FormatUint(uint64(userId), 10) + ":" + strconv.FormatBool(publicOnly)
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok && entry.version == version {
+		return entry.stats, nil
+	}
+
+	stats, err := db.GetLanguageStatsOfUser(userId, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// the cache is emptied when it holds too many users, to keep the map from growing forever
+	if len(c.entries) >= 10000 {
+		c.entries = make(map[string]*languageStatsEntry)
+	}
+	c.entries[key] = &languageStatsEntry{version: version, stats: stats}
+	return stats, nil
+}
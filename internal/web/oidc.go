@@ -0,0 +1,159 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/markbates/goth/providers/openidConnect"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+// oidcProviderPrefix starts the name of the OpenID Connect providers set in oidc.providers, e.g. oidc-staff
+const oidcProviderPrefix = "oidc-"
+
+// session key holding the OpenID Connect provider which gave the id_token
+const oidcProviderKey = "oidcProvider"
+
+// namedOIDCProvider returns the OpenID Connect provider set in oidc.providers under the name, if any
+func namedOIDCProvider(provider string) (config.OIDCProvider, bool) {
+	id, ok := strings.CutPrefix(provider, oidcProviderPrefix)
+	if !ok {
+		return config.OIDCProvider{}, false
+	}
+	for _, p := range config.C.OIDCProviders {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return config.OIDCProvider{}, false
+}
+
+// oidcProviderConfig returns the configuration of an OpenID Connect provider, the one of the oidc.* keys included
+func oidcProviderConfig(provider string) config.OIDCProvider {
+	if p, ok := namedOIDCProvider(provider); ok {
+		return p
+	}
+	return config.OIDCProvider{
+		Name:         "OpenID Connect",
+		ClientKey:    config.C.OIDCClientKey,
+		Secret:       config.C.OIDCSecret,
+		DiscoveryUrl: config.C.OIDCDiscoveryUrl,
+	}
+}
+
+// isOIDCProvider reports whether the provider is the OpenID Connect provider of the oidc.* keys or one of
+// oidc.providers
+func isOIDCProvider(provider string) bool {
+	if provider == OpenIDConnect {
+		return true
+	}
+	_, ok := namedOIDCProvider(provider)
+	return ok
+}
+
+// oidcProviderNames returns the names of the providers set in oidc.providers
+func oidcProviderNames() []string {
+	names := make([]string, 0, len(config.C.OIDCProviders))
+	for _, p := range config.C.OIDCProviders {
+		names = append(names, oidcProviderPrefix+p.ID)
+	}
+	return names
+}
+
+// allOAuthProviders returns the OAuth providers users can log in with, the ones of oidc.providers included, in the
+// order they are shown
+func allOAuthProviders() []string {
+	providers := make([]string, 0, len(oauthProviders)+len(config.C.OIDCProviders))
+	for _, provider := range oauthProviders {
+		providers = append(providers, provider)
+		if provider == OpenIDConnect {
+			providers = append(providers, oidcProviderNames()...)
+		}
+	}
+	return providers
+}
+
+// oidcUserId returns the id stored for a user of an OpenID Connect provider. The subjects given by the providers of
+// oidc.providers are prefixed by the name of the provider, so that the accounts of two providers never collide.
+func oidcUserId(provider string, subject string) string {
+	if provider == OpenIDConnect {
+		return subject
+	}
+	return provider + ":" + subject
+}
+
+// linkedOIDCProvider returns the OpenID Connect provider the user has an account of linked, empty if none. The
+// providers share the field of the account, so only one of them can be linked at once.
+func linkedOIDCProvider(user *db.User) string {
+	if user.OIDCID == "" {
+		return ""
+	}
+	if provider, _, found := strings.Cut(user.OIDCID, ":"); found && strings.HasPrefix(provider, oidcProviderPrefix) {
+		return provider
+	}
+	return OpenIDConnect
+}
+
+// enabledOIDCProviders returns the providers of oidc.providers users can log in with
+func enabledOIDCProviders(ctx echo.Context) []namedProvider {
+	var providers []namedProvider
+	for _, provider := range oidcProviderNames() {
+		if !isOAuthProviderDisabled(ctx, provider) {
+			providers = append(providers, namedProvider{Provider: provider, Name: oauthProviderName(provider)})
+		}
+	}
+	return providers
+}
+
+func newOIDCProvider(provider string, opengistUrl string) (*openidConnect.Provider, error) {
+	p := oidcProviderConfig(provider)
+	discovery, err := fetchOIDCDiscovery(p.DiscoveryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProvider, err := openidConnect.NewCustomisedURL(
+		p.ClientKey,
+		p.Secret,
+		urlJoin(opengistUrl, "/oauth/"+provider+"/callback"),
+		discovery.AuthEndpoint,
+		discovery.TokenEndpoint,
+		discovery.Issuer,
+		discovery.UserInfoEndpoint,
+		discovery.EndSessionEndpoint,
+		"openid",
+		"email",
+		"profile",
+	)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider.HTTPClient = utils.HttpClient
+	oidcProvider.SetName(provider)
+	return oidcProvider, nil
+}
+
+// fetchOIDCDiscovery gets the endpoints of an OpenID Connect provider from its discovery document, with the client
+// trusting the certificates of http.ca-certs
+func fetchOIDCDiscovery(discoveryUrl string) (*openidConnect.OpenIDConfig, error) {
+	resp, err := utils.HttpClient.Get(discoveryUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("cannot get the OIDC discovery document: %s", resp.Status)
+	}
+
+	discovery := &openidConnect.OpenIDConfig{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(discovery); err != nil {
+		return nil, err
+	}
+	return discovery, nil
+}
@@ -0,0 +1,234 @@
+package web
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/utils"
+	"gorm.io/gorm"
+)
+
+func userOrganizations(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	memberships, err := db.GetOrganizationsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get organizations", err)
+	}
+
+	setData(ctx, "memberships", memberships)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.organizations"))
+	return html(ctx, "settings_organizations.html")
+}
+
+func organizationCreate(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	dto := new(db.OrganizationDTO)
+	if err := ctx.Bind(dto); err != nil {
+		return errorRes(400, tr(ctx, "error.cannot-bind-data"), err)
+	}
+
+	if err := ctx.Validate(dto); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/settings/organizations")
+	}
+
+	// the organizations and the users share their names, as both own gists under them
+	if exists, err := db.UserExists(dto.Name); err != nil || exists {
+		addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
+		return redirect(ctx, "/settings/organizations")
+	}
+
+	organization, err := db.CreateOrganization(dto.Name, user)
+	if err != nil {
+		return errorRes(500, "Cannot create organization", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.organization.created", organization.Username), "success")
+	return redirect(ctx, "/settings/organizations/"+organization.Username)
+}
+
+// getOrganization returns the organization of the route and the role of the logged user in it, the organization is
+// not found for the users who are not its members
+func getOrganization(ctx echo.Context) (*db.User, string, error) {
+	organization, err := db.GetOrganizationByName(ctx.Param("org"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", notFound("Organization not found")
+		}
+		return nil, "", errorRes(500, "Cannot get organization", err)
+	}
+
+	role, err := db.GetOrganizationRole(organization.ID, getUserLogged(ctx).ID)
+	if err != nil {
+		return nil, "", errorRes(500, "Cannot get organization role", err)
+	}
+	if role == "" {
+		return nil, "", notFound("Organization not found")
+	}
+	return organization, role, nil
+}
+
+func userOrganization(ctx echo.Context) error {
+	organization, role, err := getOrganization(ctx)
+	if err != nil {
+		return err
+	}
+
+	members, err := db.GetOrganizationMembers(organization.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get organization members", err)
+	}
+
+	setData(ctx, "organization", organization)
+	setData(ctx, "organizationRole", role)
+	setData(ctx, "members", members)
+	setData(ctx, "organizationRoles", db.OrganizationRoles)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.organization", organization.Username))
+	return html(ctx, "settings_organization.html")
+}
+
+// organizationMemberSet adds a member to the organization, or changes the role of a member
+func organizationMemberSet(ctx echo.Context) error {
+	organization, role, err := getOrganization(ctx)
+	if err != nil {
+		return err
+	}
+	if role != db.OrganizationRoleOwner {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+	back := "/settings/organizations/" + organization.Username
+
+	newRole := ctx.FormValue("role")
+	if !db.IsOrganizationRole(newRole) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+
+	member, err := db.GetUserByUsername(strings.TrimSpace(ctx.FormValue("username")))
+	if err != nil || member.IsOrganization {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get user", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.organization.unknown-user"), "error")
+		return redirect(ctx, back)
+	}
+
+	if newRole != db.OrganizationRoleOwner {
+		if ok, err := keepsAnOwner(organization, member); err != nil || !ok {
+			if err != nil {
+				return errorRes(500, "Cannot count organization owners", err)
+			}
+			addFlash(ctx, tr(ctx, "flash.organization.last-owner"), "error")
+			return redirect(ctx, back)
+		}
+	}
+
+	if err = db.SetOrganizationMember(organization.ID, member.ID, newRole); err != nil {
+		return errorRes(500, "Cannot save organization member", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.organization.member-saved", member.Username), "success")
+	return redirect(ctx, back)
+}
+
+// organizationMemberRemove removes a member from the organization, the owners remove anyone and the members leave it
+func organizationMemberRemove(ctx echo.Context) error {
+	organization, role, err := getOrganization(ctx)
+	if err != nil {
+		return err
+	}
+	back := "/settings/organizations/" + organization.Username
+
+	member, err := db.GetUserByUsername(ctx.Param("user"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return redirect(ctx, back)
+		}
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	isSelf := member.ID == getUserLogged(ctx).ID
+	if role != db.OrganizationRoleOwner && !isSelf {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	if ok, err := keepsAnOwner(organization, member); err != nil || !ok {
+		if err != nil {
+			return errorRes(500, "Cannot count organization owners", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.organization.last-owner"), "error")
+		return redirect(ctx, back)
+	}
+
+	if err = db.RemoveOrganizationMember(organization.ID, member.ID); err != nil {
+		return errorRes(500, "Cannot remove organization member", err)
+	}
+
+	if isSelf {
+		addFlash(ctx, tr(ctx, "flash.organization.left", organization.Username), "success")
+		return redirect(ctx, "/settings/organizations")
+	}
+	addFlash(ctx, tr(ctx, "flash.organization.member-removed", member.Username), "success")
+	return redirect(ctx, back)
+}
+
+// keepsAnOwner reports whether the organization still has an owner once the member is no longer one of them
+func keepsAnOwner(organization *db.User, member *db.User) (bool, error) {
+	role, err := db.GetOrganizationRole(organization.ID, member.ID)
+	if err != nil || role != db.OrganizationRoleOwner {
+		return err == nil, err
+	}
+
+	count, err := db.CountOrganizationOwners(organization.ID)
+	return count > 1, err
+}
+
+// transferGist gives a gist of the logged user to one of the organizations they own
+func transferGist(ctx echo.Context) error {
+	gist := getData(ctx, "gist").(*db.Gist)
+	user := getUserLogged(ctx)
+	back := "/" + gist.User.Username + "/" + gist.Identifier() + "/edit"
+
+	if gist.UserID != user.ID {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	organization, err := db.GetOrganizationByName(strings.TrimSpace(ctx.FormValue("organization")))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get organization", err)
+		}
+		return redirect(ctx, back)
+	}
+
+	role, err := db.GetOrganizationRole(organization.ID, user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get organization role", err)
+	}
+	if role != db.OrganizationRoleOwner {
+		return errorRes(403, tr(ctx, "error.forbidden"), nil)
+	}
+
+	if gist.URL != "" {
+		exists, err := db.GistURLExistsForUser(gist.URL, organization.ID)
+		if err != nil {
+			return errorRes(500, "Cannot check the gist URL", err)
+		}
+		if exists {
+			addFlash(ctx, tr(ctx, "flash.gist.transfer-url-exists"), "error")
+			return redirect(ctx, back)
+		}
+	}
+
+	if err = gist.TransferTo(organization); err != nil {
+		return errorRes(500, "Cannot transfer this gist", err)
+	}
+	gist.AddInIndex()
+
+	addFlash(ctx, tr(ctx, "flash.gist.transferred", organization.Username), "success")
+	return redirect(ctx, "/"+organization.Username+"/"+gist.Identifier())
+}
@@ -0,0 +1,306 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/webauthn"
+	"gorm.io/gorm"
+)
+
+const (
+	passkeyChallengeTtl = 5 * time.Minute
+	passkeyNameMaxLen   = 64
+)
+
+func relyingParty(ctx echo.Context) (*webauthn.RelyingParty, error) {
+	return webauthn.NewRelyingParty("Opengist", getData(ctx, "baseHttpUrl").(string))
+}
+
+// newPasskeyChallenge returns the options of a WebAuthn ceremony built around a new challenge, kept in the session
+// until the response of the browser is received
+func newPasskeyChallenge(ctx echo.Context, options func(rp *webauthn.RelyingParty, challenge string) map[string]interface{}) error {
+	rp, err := relyingParty(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get WebAuthn relying party", err)
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return errorRes(500, "Cannot create WebAuthn challenge", err)
+	}
+
+	sess := getSession(ctx)
+	sess.Values["webauthnChallenge"] = challenge
+	sess.Values["webauthnUntil"] = time.Now().Add(passkeyChallengeTtl).Unix()
+	saveSession(sess, ctx)
+
+	return ctx.JSON(200, options(rp, challenge))
+}
+
+// popPasskeyChallenge returns the challenge kept in the session, or an empty string if there is none or if it
+// expired. A challenge can only be answered once.
+func popPasskeyChallenge(ctx echo.Context) string {
+	sess := getSession(ctx)
+	challenge, _ := sess.Values["webauthnChallenge"].(string)
+	until, _ := sess.Values["webauthnUntil"].(int64)
+
+	delete(sess.Values, "webauthnChallenge")
+	delete(sess.Values, "webauthnUntil")
+	saveSession(sess, ctx)
+
+	if time.Now().Unix() > until {
+		return ""
+	}
+	return challenge
+}
+
+func decodeFormBase64(ctx echo.Context, field string) []byte {
+	value, _ := base64.RawURLEncoding.DecodeString(ctx.FormValue(field))
+	return value
+}
+
+func userPasskeys(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	passkeys, err := db.GetWebAuthnCredentialsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	setData(ctx, "passkeys", passkeys)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.passkeys"))
+	return html(ctx, "settings_passkeys.html")
+}
+
+func passkeyCreationOptions(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	passkeys, err := db.GetWebAuthnCredentialsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+
+	excluded := make([][]byte, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		excluded = append(excluded, passkey.RawCredentialID())
+	}
+
+	return newPasskeyChallenge(ctx, func(rp *webauthn.RelyingParty, challenge string) map[string]interface{} {
+		return rp.CreationOptions(challenge, user.ID, user.Username, excluded)
+	})
+}
+
+func passkeyRegisterProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	rp, err := relyingParty(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get WebAuthn relying party", err)
+	}
+
+	credential, err := rp.VerifyRegistration(
+		popPasskeyChallenge(ctx),
+		decodeFormBase64(ctx, "clientDataJSON"),
+		decodeFormBase64(ctx, "attestationObject"),
+	)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Invalid passkey registration for user %s", user.Username)
+		addFlash(ctx, tr(ctx, "flash.user.passkey-invalid"), "error")
+		return redirect(ctx, "/settings/passkeys")
+	}
+
+	name := strings.TrimSpace(ctx.FormValue("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if runes := []rune(name); len(runes) > passkeyNameMaxLen {
+		name = string(runes[:passkeyNameMaxLen])
+	}
+
+	if err = db.CreateWebAuthnCredential(user.ID, name, credential.ID, credential.PublicKey, credential.SignCount); err != nil {
+		if db.IsUniqueConstraintViolation(err) {
+			addFlash(ctx, tr(ctx, "flash.user.passkey-invalid"), "error")
+			return redirect(ctx, "/settings/passkeys")
+		}
+		return errorRes(500, "Cannot save passkey", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.passkey-added"), "success")
+	return redirect(ctx, "/settings/passkeys")
+}
+
+func passkeyDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	passkeyId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings/passkeys")
+	}
+
+	if ok, err := keepsTwoFactor(user, false); err != nil || !ok {
+		if err != nil {
+			return errorRes(500, "Cannot get passkeys", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.two-factor-required"), "error")
+		return redirect(ctx, "/settings/passkeys")
+	}
+
+	if err = db.DeleteWebAuthnCredentialOfUser(uint(passkeyId), user.ID); err != nil {
+		return errorRes(500, "Cannot delete passkey", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.passkey-deleted"), "success")
+	return redirect(ctx, "/settings/passkeys")
+}
+
+func passkeyRequestOptions(ctx echo.Context) error {
+	if getData(ctx, "DisableLoginForm") == true {
+		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
+	}
+
+	return newPasskeyChallenge(ctx, func(rp *webauthn.RelyingParty, challenge string) map[string]interface{} {
+		return rp.RequestOptions(challenge)
+	})
+}
+
+// verifyPasskeyAssertion checks the response of the browser to the challenge kept in the session, and returns the
+// passkey it was signed with, or nil if the response is not valid. The failures are logged for the user given, if any.
+func verifyPasskeyAssertion(ctx echo.Context, user *db.User) (*db.WebAuthnCredential, error) {
+	challenge := popPasskeyChallenge(ctx)
+
+	username := ""
+	if user != nil {
+		username = user.Username
+	} else {
+		user = &db.User{}
+	}
+
+	passkey, err := db.GetWebAuthnCredentialByCredentialID(decodeFormBase64(ctx, "credentialId"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errorRes(500, "Cannot get passkey", err)
+		}
+		authWarn(ctx, db.AuditLoginFailed, username).Str("method", "passkey").Msg("Unknown passkey used to log in")
+		return nil, nil
+	}
+
+	rp, err := relyingParty(ctx)
+	if err != nil {
+		return nil, errorRes(500, "Cannot get WebAuthn relying party", err)
+	}
+
+	signCount, err := rp.VerifyAssertion(
+		challenge,
+		&webauthn.Credential{ID: passkey.RawCredentialID(), PublicKey: passkey.PublicKey, SignCount: passkey.SignCount},
+		decodeFormBase64(ctx, "clientDataJSON"),
+		decodeFormBase64(ctx, "authenticatorData"),
+		decodeFormBase64(ctx, "signature"),
+	)
+	if err != nil {
+		authWarn(ctx, db.AuditLoginFailed, username).Str("method", "passkey").Err(err).Msg("Invalid passkey authentication attempt")
+		audit(ctx, db.AuditLoginFailed, user, "passkey")
+		return nil, nil
+	}
+
+	if err = passkey.Used(signCount); err != nil {
+		return nil, errorRes(500, "Cannot update passkey", err)
+	}
+	return passkey, nil
+}
+
+// processLoginPasskey logs in the user owning the passkey, without a password nor a two-factor code since the
+// authenticator already verified the user
+func processLoginPasskey(ctx echo.Context) error {
+	if getData(ctx, "DisableLoginForm") == true {
+		return errorRes(403, tr(ctx, "error.login-disabled-form"), nil)
+	}
+
+	passkey, err := verifyPasskeyAssertion(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if passkey == nil {
+		addFlash(ctx, tr(ctx, "flash.auth.passkey-failed"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	user, err := db.GetUserById(passkey.UserID)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+
+	if !canLogIn(ctx, user) {
+		return redirect(ctx, "/login")
+	}
+
+	if !user.EmailVerified {
+		addFlash(ctx, tr(ctx, "flash.auth.account-not-verified"), "error")
+		return redirect(ctx, "/login")
+	}
+
+	recordLoginDevice(ctx, user)
+	audit(ctx, db.AuditLogin, user, "passkey")
+
+	sess := getSession(ctx)
+	if err := setSessionUser(ctx, sess, user.ID); err != nil {
+		return errorRes(500, "Cannot create session", err)
+	}
+	sess.Options.MaxAge = 60 * 60 * 24 * 365 // 1 year
+	saveSession(sess, ctx)
+	deleteCsrfCookie(ctx)
+
+	return redirect(ctx, "/")
+}
+
+// passkeySecondFactorOptions returns the options to sign in with a passkey as the second factor of a login, whatever
+// the login method
+func passkeySecondFactorOptions(ctx echo.Context) error {
+	user, err := getTotpLoginUser(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if user == nil {
+		return errorRes(403, "No login waiting for a second factor", nil)
+	}
+
+	return newPasskeyChallenge(ctx, func(rp *webauthn.RelyingParty, challenge string) map[string]interface{} {
+		return rp.RequestOptions(challenge)
+	})
+}
+
+// processLoginSecondFactorPasskey completes the login waiting for a second factor with one of the passkeys of the user
+func processLoginSecondFactorPasskey(ctx echo.Context) error {
+	user, err := getTotpLoginUser(ctx)
+	if err != nil {
+		return errorRes(500, "Cannot get user", err)
+	}
+	if user == nil {
+		return redirect(ctx, "/login")
+	}
+
+	if !canLogIn(ctx, user) {
+		clearTotpLogin(ctx)
+		return redirect(ctx, "/login")
+	}
+
+	passkey, err := verifyPasskeyAssertion(ctx, user)
+	if err != nil {
+		return err
+	}
+	if passkey == nil || passkey.UserID != user.ID {
+		if passkey != nil {
+			authWarn(ctx, db.AuditLoginFailed, user.Username).Str("method", "passkey").Msg("Passkey of another user used as a second factor")
+			audit(ctx, db.AuditLoginFailed, user, "passkey")
+		}
+		addFlash(ctx, tr(ctx, "flash.auth.passkey-failed"), "error")
+		return redirect(ctx, "/login/totp")
+	}
+
+	return completeSecondFactorLogin(ctx, user, "passkey")
+}
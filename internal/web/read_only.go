@@ -0,0 +1,58 @@
+package web
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// readOnlyRoutes keep working in read-only mode, as they only log the users in, or let an admin back up the instance or
+// turn the mode off
+var readOnlyRoutes = []string{
+	"/login",
+	"/login/email",
+	"/login/email/:token",
+	"/login/totp",
+	"/login/totp/passkey",
+	"/login/passkey",
+	"/login/oauth-link",
+	"/impersonate/stop",
+	"/settings/two-factor/skip",
+	"/:user/:gistname/unlock",
+	"/admin-panel/backup",
+	"/admin-panel/set-config",
+}
+
+// isReadOnly reports whether the instance is in read-only mode, from the configuration or toggled by an admin
+func isReadOnly(ctx echo.Context) bool {
+	return config.C.ReadOnlyMode || getData(ctx, settingDataKey(db.SettingReadOnlyMode)) == true
+}
+
+// readOnlyError is the maintenance error sent for the changes refused in read-only mode
+func readOnlyError(ctx echo.Context) error {
+	return errorRes(503, tr(ctx, "error.read-only"), nil)
+}
+
+// readOnly refuses the requests changing anything while the instance is in read-only mode. The users can still log in
+// and view the gists, and the admins can keep using the admin panel if the configuration allows it.
+func readOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		method := ctx.Request().Method
+		if method == "GET" || method == "HEAD" || method == "OPTIONS" || !isReadOnly(ctx) {
+			return next(ctx)
+		}
+
+		if slices.Contains(readOnlyRoutes, ctx.Path()) {
+			return next(ctx)
+		}
+		// the admin panel checks by itself that the user is an admin
+		if config.C.ReadOnlyAllowAdminWrites && strings.HasPrefix(ctx.Path(), "/admin-panel/") {
+			return next(ctx)
+		}
+
+		return readOnlyError(ctx)
+	}
+}
@@ -0,0 +1,350 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gorilla/securecookie"
+	"github.com/labstack/echo/v4"
+	"github.com/markbates/goth"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+// samlRequestCookie holds the ID of the authentication request sent to the identity provider, to check that the
+// assertion received answers it
+const samlRequestCookie = "saml-request"
+
+// samlRequestTtl is how long the user has to log in to the identity provider
+const samlRequestTtl = 10 * time.Minute
+
+// samlUserCookie holds the user of an assertion, from the ACS endpoint to the callback which logs them in
+const samlUserCookie = "saml-user"
+
+// samlUserTtl is how long the user of an assertion can be used to log in, once redirected from the ACS endpoint to the
+// callback
+const samlUserTtl = 2 * time.Minute
+
+// samlCodec encrypts the user of an assertion in its cookie, it is set by NewServer from the session keys
+var samlCodec *securecookie.SecureCookie
+
+// samlUsedNonces remembers the users of assertions already used to log in until they expire, so that each one is only
+// used once
+var samlUsedNonces = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+func newSAMLCodec(hashKey, blockKey []byte) *securecookie.SecureCookie {
+	return securecookie.New(hashKey, blockKey).
+		MaxAge(int(samlUserTtl.Seconds())).
+		SetSerializer(securecookie.JSONEncoder{})
+}
+
+var samlIdPMetadata struct {
+	sync.Mutex
+	url      string
+	metadata *saml.EntityDescriptor
+}
+
+// samlUser is the user of an assertion, passed from the ACS endpoint to the callback
+type samlUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Nonce    string `json:"nonce"`
+}
+
+// newSAMLServiceProvider returns Opengist as a service provider of the identity provider of the configuration
+func newSAMLServiceProvider(opengistUrl string) (*saml.ServiceProvider, error) {
+	idpMetadata, err := getSAMLIdPMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	metadataUrl, err := url.Parse(urlJoin(opengistUrl, "/oauth/saml/metadata"))
+	if err != nil {
+		return nil, err
+	}
+	acsUrl, err := url.Parse(urlJoin(opengistUrl, "/oauth/saml/acs"))
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          config.C.SAMLEntityID,
+		MetadataURL:       *metadataUrl,
+		AcsURL:            *acsUrl,
+		IDPMetadata:       idpMetadata,
+		HTTPClient:        utils.HttpClient,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		AllowIDPInitiated: config.C.SAMLAllowIdPInitiated,
+	}
+
+	if config.C.SAMLCertificate != "" {
+		keyPair, err := tls.LoadX509KeyPair(config.C.SAMLCertificate, config.C.SAMLKey)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("the SAML key must be an RSA key")
+		}
+		certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+
+		sp.Key = key
+		sp.Certificate = certificate
+		sp.SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	}
+
+	return sp, nil
+}
+
+// getSAMLIdPMetadata fetches the metadata of the identity provider, once for the URL of the configuration
+func getSAMLIdPMetadata() (*saml.EntityDescriptor, error) {
+	samlIdPMetadata.Lock()
+	defer samlIdPMetadata.Unlock()
+
+	if samlIdPMetadata.metadata != nil && samlIdPMetadata.url == config.C.SAMLIdPMetadataUrl {
+		return samlIdPMetadata.metadata, nil
+	}
+
+	resp, err := utils.HttpClient.Get(config.C.SAMLIdPMetadataUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := new(saml.EntityDescriptor)
+	if err = xml.Unmarshal(body, metadata); err != nil {
+		// the metadata may list several entities, the first one is used
+		entities := new(saml.EntitiesDescriptor)
+		if xml.Unmarshal(body, entities) != nil || len(entities.EntityDescriptors) == 0 {
+			return nil, err
+		}
+		metadata = &entities.EntityDescriptors[0]
+	}
+
+	samlIdPMetadata.url = config.C.SAMLIdPMetadataUrl
+	samlIdPMetadata.metadata = metadata
+	return metadata, nil
+}
+
+// samlBeginAuth redirects to the identity provider with an authentication request, the SP-initiated flow
+func samlBeginAuth(ctx echo.Context) error {
+	sp, err := newSAMLServiceProvider(getData(ctx, "baseHttpUrl").(string))
+	if err != nil {
+		return errorRes(500, "Cannot create SAML service provider", err)
+	}
+
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return errorRes(500, "Cannot create SAML request", err)
+	}
+	redirectUrl, err := req.Redirect("", sp)
+	if err != nil {
+		return errorRes(500, "Cannot create SAML request", err)
+	}
+
+	setSAMLRequestCookie(ctx, req.ID, int(samlRequestTtl.Seconds()))
+	return ctx.Redirect(302, redirectUrl.String())
+}
+
+// samlAcs receives the assertions posted by the identity provider. The session cookie is not sent with this
+// cross-site request, so the user is passed encrypted in a short-lived cookie to the callback, which completes the
+// login like the other providers.
+func samlAcs(ctx echo.Context) error {
+	if isOAuthProviderDisabled(ctx, SAMLProvider) || !isOAuthProviderConfigured(SAMLProvider) {
+		return errorRes(403, tr(ctx, "error.oauth-provider-disabled"), nil)
+	}
+
+	sp, err := newSAMLServiceProvider(getData(ctx, "baseHttpUrl").(string))
+	if err != nil {
+		return errorRes(500, "Cannot create SAML service provider", err)
+	}
+
+	var requestIds []string
+	if cookie, err := ctx.Cookie(samlRequestCookie); err == nil && cookie.Value != "" {
+		requestIds = append(requestIds, cookie.Value)
+	}
+	setSAMLRequestCookie(ctx, "", -1)
+
+	assertion, err := sp.ParseResponse(ctx.Request(), requestIds)
+	if err != nil {
+		var invalidErr *saml.InvalidResponseError
+		if errors.As(err, &invalidErr) {
+			err = invalidErr.PrivateErr
+		}
+		return errorRes(400, tr(ctx, "error.complete-oauth-login", "invalid SAML response"), err)
+	}
+
+	user := samlUserFromAssertion(assertion)
+	if user.ID == "" {
+		return errorRes(400, tr(ctx, "error.complete-oauth-login", "missing SAML NameID"), nil)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return errorRes(500, "Cannot encode SAML user", err)
+	}
+	user.Nonce = hex.EncodeToString(nonce)
+
+	token, err := samlCodec.Encode(SAMLProvider, user)
+	if err != nil {
+		return errorRes(500, "Cannot encode SAML user", err)
+	}
+	setSAMLUserCookie(ctx, token, int(samlUserTtl.Seconds()))
+	return redirect(ctx, "/oauth/saml/callback")
+}
+
+// samlCompleteUserAuth returns the user of the assertion passed by samlAcs, whose cookie is removed
+func samlCompleteUserAuth(ctx echo.Context) (goth.User, error) {
+	var token string
+	if cookie, err := ctx.Cookie(samlUserCookie); err == nil {
+		token = cookie.Value
+	}
+	setSAMLUserCookie(ctx, "", -1)
+
+	var user samlUser
+	if err := samlCodec.Decode(SAMLProvider, token, &user); err != nil || !useSAMLNonce(user.Nonce) {
+		return goth.User{}, errors.New("invalid or expired SAML login")
+	}
+
+	return goth.User{
+		Provider: SAMLProvider,
+		UserID:   user.ID,
+		NickName: user.Username,
+		Email:    user.Email,
+	}, nil
+}
+
+func samlMetadata(ctx echo.Context) error {
+	if !isOAuthProviderEnabled(ctx, SAMLProvider) {
+		return notFound("SAML is not configured")
+	}
+
+	sp, err := newSAMLServiceProvider(getData(ctx, "baseHttpUrl").(string))
+	if err != nil {
+		return errorRes(500, "Cannot create SAML service provider", err)
+	}
+
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		return errorRes(500, "Cannot encode SAML metadata", err)
+	}
+	return ctx.Blob(200, "application/samlmetadata+xml", metadata)
+}
+
+// samlUserFromAssertion maps the NameID and the attributes of the assertion to a user
+func samlUserFromAssertion(assertion *saml.Assertion) samlUser {
+	var user samlUser
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		user.ID = strings.TrimSpace(assertion.Subject.NameID.Value)
+	}
+
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if len(attribute.Values) == 0 {
+				continue
+			}
+			value := strings.TrimSpace(attribute.Values[0].Value)
+			switch {
+			case isSAMLAttribute(attribute, config.C.SAMLUsernameAttribute):
+				user.Username = value
+			case isSAMLAttribute(attribute, config.C.SAMLEmailAttribute):
+				user.Email = value
+			}
+		}
+	}
+
+	if user.Username == "" {
+		user.Username, _, _ = strings.Cut(user.ID, "@")
+	}
+	if user.Email == "" && strings.Contains(user.ID, "@") {
+		user.Email = user.ID
+	}
+	return user
+}
+
+func isSAMLAttribute(attribute saml.Attribute, name string) bool {
+	return name != "" && (attribute.Name == name || attribute.FriendlyName == name)
+}
+
+// setSAMLRequestCookie keeps the ID of the authentication request until the identity provider posts its answer. The
+// post is a cross-site request, the cookie is only sent with it if it is secure.
+func setSAMLRequestCookie(ctx echo.Context, requestId string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     samlRequestCookie,
+		Value:    requestId,
+		Path:     "/oauth/saml",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if secureCookies(ctx) {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	ctx.SetCookie(cookie)
+}
+
+// setSAMLUserCookie keeps the user of an assertion until the callback. The redirection to the callback is a top-level
+// navigation, so the cookie is sent with it even though the assertion was posted from another site.
+func setSAMLUserCookie(ctx echo.Context, token string, maxAge int) {
+	ctx.SetCookie(&http.Cookie{
+		Name:     samlUserCookie,
+		Value:    token,
+		Path:     "/oauth/saml/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(ctx),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// useSAMLNonce reports whether the nonce of the user of an assertion was not used yet, and marks it used
+func useSAMLNonce(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+
+	samlUsedNonces.Lock()
+	defer samlUsedNonces.Unlock()
+
+	now := time.Now()
+	for n, until := range samlUsedNonces.until {
+		if now.After(until) {
+			delete(samlUsedNonces.until, n)
+		}
+	}
+
+	if _, used := samlUsedNonces.until[nonce]; used {
+		return false
+	}
+	samlUsedNonces.until[nonce] = now.Add(samlUserTtl)
+	return true
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/thomiceli/opengist/internal/utils"
 	"github.com/thomiceli/opengist/templates"
 
+	"github.com/dustin/go-humanize"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -32,8 +33,11 @@ import (
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/render"
 	"github.com/thomiceli/opengist/public"
 	"golang.org/x/text/language"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
 )
 
 var (
@@ -59,8 +63,15 @@ var (
 		"lines": func(i string) []string {
 			return strings.Split(i, "\n")
 		},
-		"isMarkdown": func(i string) bool {
-			return strings.ToLower(filepath.Ext(i)) == ".md"
+		"isMarkdown": render.IsMarkdown,
+		"splitDiff":  splitDiff,
+		"markdownDescription": func(description string) template.HTML {
+			rendered, err := render.MarkdownDescription(description)
+			if err != nil {
+				log.Warn().Err(err).Msg("Cannot render the description of a gist")
+				return template.HTML(htmlpkg.EscapeString(description))
+			}
+			return template.HTML(rendered)
 		},
 		"isCsv": func(i string) bool {
 			return strings.ToLower(filepath.Ext(i)) == ".csv"
@@ -84,19 +95,9 @@ var (
 		"slug": func(s string) string {
 			return strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
 		},
-		"avatarUrl": func(user *db.User, noGravatar bool) string {
-			if user.AvatarURL != "" {
-				return user.AvatarURL
-			}
-
-			if user.MD5Hash != "" && !noGravatar {
-				return "https://www.gravatar.com/avatar/" + user.MD5Hash + "?d=identicon&s=200"
-			}
-
-			return defaultAvatar()
-		},
-		"asset":  asset,
-		"custom": customAsset,
+		"avatarUrl": avatarUrl,
+		"asset":     asset,
+		"custom":    customAsset,
 		"dev": func() bool {
 			return dev
 		},
@@ -115,7 +116,8 @@ var (
 			}
 			return s
 		},
-		"unescape": htmlpkg.UnescapeString,
+		"humanSize": humanize.IBytes,
+		"unescape":  htmlpkg.UnescapeString,
 		"join": func(s ...string) string {
 			return strings.Join(s, "")
 		},
@@ -164,16 +166,18 @@ type Server struct {
 func NewServer(isDev bool, sessionsPath string) *Server {
 	dev = isDev
 	flashStore = sessions.NewCookieStore([]byte("opengist"))
-	userStore = sessions.NewFilesystemStore(sessionsPath,
-		utils.ReadKey(path.Join(sessionsPath, "session-auth.key")),
-		utils.ReadKey(path.Join(sessionsPath, "session-encrypt.key")),
-	)
+	authKey := utils.ReadKey(path.Join(sessionsPath, "session-auth.key"))
+	encryptKey := utils.ReadKey(path.Join(sessionsPath, "session-encrypt.key"))
+	userStore = sessions.NewFilesystemStore(sessionsPath, authKey, encryptKey)
 	userStore.MaxLength(10 * 1024)
 	gothic.Store = userStore
+	apiLimits = newApiLimiter()
+	samlCodec = newSAMLCodec(authKey, encryptKey)
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
+	e.IPExtractor = ipExtractor()
 
 	if err := i18n.Locales.LoadAll(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to load locales")
@@ -185,16 +189,21 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 		Getter: middleware.MethodFromForm("_method"),
 	}))
 	e.Pre(middleware.RemoveTrailingSlash())
-	e.Pre(middleware.CORS())
+	e.Pre(webCors())
+	e.Pre(apiCors())
+	e.Pre(middleware.RequestID())
 	e.Pre(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogURI: true, LogStatus: true, LogMethod: true,
+		LogURI: true, LogStatus: true, LogMethod: true, LogRequestID: true,
 		LogValuesFunc: func(ctx echo.Context, v middleware.RequestLoggerValues) error {
 			log.Info().Str("URI", v.URI).Int("status", v.Status).Str("method", v.Method).
-				Str("ip", ctx.RealIP()).
+				Str("ip", ctx.RealIP()).Str("request_id", v.RequestID).
 				Msg("HTTP")
 			return nil
 		},
 	}))
+	if config.C.ForceCanonicalHost {
+		e.Pre(canonicalHost(config.C.ExternalUrl))
+	}
 	e.Use(middleware.Recover())
 	e.Use(middleware.Secure())
 
@@ -214,24 +223,13 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 		templates: t,
 	}
 
-	e.HTTPErrorHandler = func(er error, ctx echo.Context) {
-		if err, ok := er.(*echo.HTTPError); ok {
-			if err.Code >= 500 {
-				log.Error().Int("code", err.Code).Err(err.Internal).Msg("HTTP: " + err.Message.(string))
-			}
-
-			setData(ctx, "error", err)
-			if errHtml := htmlWithCode(ctx, err.Code, "error.html"); errHtml != nil {
-				log.Fatal().Err(errHtml).Send()
-			}
-		} else {
-			log.Fatal().Err(er).Send()
-		}
-	}
+	e.HTTPErrorHandler = httpErrorHandler
 
 	e.Use(sessionInit)
 
 	e.Validator = utils.NewValidator()
+	utils.PasswordPolicy = passwordPolicy
+	utils.ReservedUsernames = reservedUsernames
 
 	if !dev {
 		parseManifestEntries()
@@ -241,44 +239,134 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 	g1 := e.Group("")
 	{
 		if !dev {
-			g1.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+			csrfConfig := middleware.CSRFConfig{
 				TokenLookup:    "form:_csrf",
 				CookiePath:     "/",
 				CookieHTTPOnly: true,
 				CookieSameSite: http.SameSiteStrictMode,
-			}))
+			}
+			csrf := middleware.CSRFWithConfig(csrfConfig)
+			csrfConfig.CookieSecure = true
+			csrfSecure := middleware.CSRFWithConfig(csrfConfig)
+
+			// the CSRF middleware only takes a fixed Secure flag for its cookie, so pick one per request
+			g1.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				handler, secureHandler := csrf(next), csrfSecure(next)
+				return func(ctx echo.Context) error {
+					if secureCookies(ctx) {
+						return secureHandler(ctx)
+					}
+					return handler(ctx)
+				}
+			})
 			g1.Use(csrfInit)
 		}
 
+		g1.Use(auditImpersonation)
+		g1.Use(requireTwoFactor)
+		g1.Use(readOnly)
+
 		g1.GET("/", create, logged)
 		g1.POST("/", processCreate, logged)
 		g1.GET("/preview", preview, logged)
+		g1.GET("/fetch-url", fetchUrl, logged)
+		g1.GET("/palette/gists", paletteGists, logged)
+		g1.POST("/gists/visibility", bulkEditVisibility, logged)
 
 		g1.GET("/healthcheck", healthcheck)
+		g1.POST("/impersonate/stop", stopImpersonating, logged)
 
 		g1.GET("/register", register)
-		g1.POST("/register", processRegister)
+		g1.POST("/register", processRegister, ipRateLimiter(config.C.RegisterRateLimit, registerRateLimited))
+		g1.GET("/verify-email/:token", verifyEmail)
 		g1.GET("/login", login)
 		g1.POST("/login", processLogin)
+		g1.GET("/login/email", loginEmail)
+		g1.POST("/login/email", processLoginEmail, emailRateLimiter())
+		g1.GET("/login/email/:token", loginEmailToken)
+		g1.POST("/login/email/:token", processLoginEmailToken)
+		g1.GET("/login/totp", loginTotp)
+		g1.POST("/login/totp", processLoginTotp)
+		g1.GET("/login/totp/passkey/options", passkeySecondFactorOptions)
+		g1.POST("/login/totp/passkey", processLoginSecondFactorPasskey)
+		g1.GET("/login/oauth-link", oauthEmailLink)
+		g1.POST("/login/oauth-link", processOAuthEmailLink)
+		g1.GET("/login/passkey/options", passkeyRequestOptions)
+		g1.POST("/login/passkey", processLoginPasskey)
+		g1.GET("/forgot-password", forgotPassword)
+		g1.POST("/forgot-password", processForgotPassword, emailRateLimiter())
+		g1.GET("/reset-password/:token", resetPassword)
+		g1.POST("/reset-password/:token", processResetPassword)
 		g1.GET("/logout", logout)
-		g1.GET("/oauth/:provider", oauth)
-		g1.GET("/oauth/:provider/callback", oauthCallback)
+		g1.GET("/oauth/:provider", oauth, notImpersonating)
+		g1.GET("/oauth/:provider/callback", oauthCallback, notImpersonating)
+		g1.POST("/oauth/:provider/unlink", oauthUnlink, logged, notImpersonating)
+		g1.GET("/oauth/saml/metadata", samlMetadata)
 
 		g1.GET("/settings", userSettings, logged)
-		g1.POST("/settings/email", emailProcess, logged)
-		g1.DELETE("/settings/account", accountDeleteProcess, logged)
-		g1.POST("/settings/ssh-keys", sshKeysProcess, logged)
-		g1.DELETE("/settings/ssh-keys/:id", sshKeysDelete, logged)
-		g1.PUT("/settings/password", passwordProcess, logged)
-		g1.PUT("/settings/username", usernameProcess, logged)
+		g1.POST("/settings/email", emailProcess, logged, notImpersonating)
+		g1.GET("/settings/email/verify/:token", emailVerifyProcess, logged)
+		g1.GET("/settings/totp", totpSetup, logged, notImpersonating)
+		g1.POST("/settings/totp", totpEnableProcess, logged, notImpersonating)
+		g1.DELETE("/settings/totp", totpDisableProcess, logged, notImpersonating)
+		g1.GET("/settings/two-factor", twoFactorSetup, logged)
+		g1.POST("/settings/two-factor/skip", twoFactorSkip, logged)
+		g1.GET("/settings/sessions", userSessions, logged)
+		g1.DELETE("/settings/sessions", sessionsRevokeOthers, logged, notImpersonating)
+		g1.DELETE("/settings/sessions/:id", sessionRevoke, logged, notImpersonating)
+		g1.GET("/settings/trash", userTrash, logged)
+		g1.GET("/settings/search", userSearch, logged)
+		g1.POST("/settings/trash/:id/restore", trashRestore, logged)
+		g1.DELETE("/settings/trash/:id", trashDelete, logged)
+		g1.GET("/settings/api-tokens", userApiTokens, logged)
+		g1.POST("/settings/api-tokens", apiTokenCreate, logged, notImpersonating)
+		g1.DELETE("/settings/api-tokens/:id", apiTokenDelete, logged, notImpersonating)
+		g1.GET("/settings/webhooks", userWebhooks, logged)
+		g1.POST("/settings/webhooks", webhookCreate, logged, notImpersonating)
+		g1.DELETE("/settings/webhooks/:id", webhookDelete, logged, notImpersonating)
+		g1.POST("/settings/webhooks/:id/test", webhookTest, logged, notImpersonating)
+		g1.GET("/settings/organizations", userOrganizations, logged)
+		g1.POST("/settings/organizations", organizationCreate, logged)
+		g1.GET("/settings/organizations/:org", userOrganization, logged)
+		g1.POST("/settings/organizations/:org/members", organizationMemberSet, logged)
+		g1.DELETE("/settings/organizations/:org/members/:user", organizationMemberRemove, logged)
+		g1.GET("/settings/passkeys", userPasskeys, logged)
+		g1.GET("/settings/passkeys/options", passkeyCreationOptions, logged, notImpersonating)
+		g1.POST("/settings/passkeys", passkeyRegisterProcess, logged, notImpersonating)
+		g1.DELETE("/settings/passkeys/:id", passkeyDelete, logged, notImpersonating)
+		g1.PUT("/settings/login-notifications", loginNotificationsProcess, logged)
+		g1.PUT("/settings/default-expiry", defaultExpiryProcess, logged)
+		g1.PUT("/settings/default-visibility", defaultVisibilityProcess, logged)
+		g1.PUT("/settings/clone-protocol", cloneProtocolProcess, logged)
+		g1.PUT("/settings/listing", listingProcess, logged)
+		g1.PUT("/settings/theme", themeProcess, logged)
+		g1.GET("/settings/export", exportGists, logged)
+		g1.GET("/settings/account/delete", accountDelete, logged, notImpersonating)
+		g1.DELETE("/settings/account", accountDeleteProcess, logged, notImpersonating)
+		g1.POST("/settings/ssh-keys", sshKeysProcess, logged, notImpersonating)
+		g1.DELETE("/settings/ssh-keys/:id", sshKeysDelete, logged, notImpersonating)
+		g1.PUT("/settings/password", passwordProcess, logged, notImpersonating)
+		g1.PUT("/settings/username", usernameProcess, logged, notImpersonating)
+		g1.POST("/settings/avatar", avatarProcess, logged)
+		g1.DELETE("/settings/avatar", avatarDeleteProcess, logged)
 		g2 := g1.Group("/admin-panel")
 		{
 			g2.Use(adminPermission)
 			g2.GET("", adminIndex)
 			g2.GET("/users", adminUsers)
+			g2.POST("/users/bulk", adminUsersBulk)
 			g2.POST("/users/:user/delete", adminUserDelete)
+			g2.POST("/users/:user/api-rate-limit", adminUserApiRateLimit)
+			g2.POST("/users/:user/disable", adminUserDisable)
+			g2.POST("/users/:user/impersonate", adminUserImpersonate)
+			g2.GET("/signups", adminSignups)
+			g2.POST("/signups/:user/approve", adminSignupApprove)
+			g2.POST("/signups/:user/reject", adminSignupReject)
 			g2.GET("/gists", adminGists)
 			g2.POST("/gists/:gist/delete", adminGistDelete)
+			g2.POST("/gists/:gist/hide", adminGistHide)
+			g2.POST("/gists/:gist/transfer", adminGistTransfer)
+			g2.POST("/gists/:gist/share-template", adminGistShareTemplate)
 			g2.GET("/invitations", adminInvitations)
 			g2.POST("/invitations", adminInvitationsCreate)
 			g2.POST("/invitations/:id/delete", adminInvitationsDelete)
@@ -288,15 +376,27 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 			g2.POST("/sync-previews", adminSyncGistPreviews)
 			g2.POST("/reset-hooks", adminResetHooks)
 			g2.POST("/index-gists", adminIndexGists)
+			g2.POST("/delete-expired-gists", adminDeleteExpiredGists)
+			g2.POST("/delete-unverified-users", adminDeleteUnverifiedUsers)
+			g2.POST("/backup", adminBackup)
 			g2.GET("/configuration", adminConfig)
 			g2.PUT("/set-config", adminSetConfig)
+			g2.GET("/audit-log", adminAuditLog)
+			g2.GET("/audit-log/export", adminAuditLogExport)
 		}
 
 		if config.C.HttpGit {
 			e.Any("/init/*", gitHttp, gistNewPushSoftInit)
 		}
 
+		// posted by the identity provider, without the CSRF token of the web forms
+		e.POST("/oauth/saml/acs", samlAcs)
+
 		g1.GET("/all", allGists, checkRequireLogin)
+		g1.GET("/tags", tagsAutocomplete, checkRequireLogin)
+		g1.GET("/highlight.css", highlightThemeCss)
+		g1.GET("/avatars/:id", userAvatar, checkRequireLogin)
+		g1.GET("/avatars/identicon/:hash", identiconAvatar, checkRequireLogin)
 
 		if index.Enabled() {
 			g1.GET("/search", search, checkRequireLogin)
@@ -304,7 +404,7 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 			g1.GET("/search", allGists, checkRequireLogin)
 		}
 
-		g1.GET("/:user", allGists, checkRequireLogin)
+		g1.GET("/:user", userGistsOrFeed, checkRequireLogin)
 		g1.GET("/:user/liked", allGists, checkRequireLogin)
 		g1.GET("/:user/forked", allGists, checkRequireLogin)
 
@@ -314,14 +414,23 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 			g3.GET("", gistIndex)
 			g3.GET("/rev/:revision", gistIndex)
 			g3.GET("/revisions", revisions)
+			g3.GET("/compare", compareRevisions)
+			g3.GET("/compare/:revisions", compare)
+			g3.POST("/unlock", gistUnlock)
 			g3.GET("/archive/:revision", downloadZip)
-			g3.POST("/visibility", editVisibility, logged, writePermission)
-			g3.POST("/delete", deleteGist, logged, writePermission)
+			g3.POST("/visibility", editVisibility, logged, managePermission)
+			g3.POST("/delete", deleteGist, logged, managePermission)
 			g3.GET("/raw/:revision/:file", rawFile)
+			g3.GET("/files/:revision", gistFiles)
 			g3.GET("/download/:revision/:file", downloadFile)
 			g3.GET("/edit", edit, logged, writePermission)
 			g3.POST("/edit", processCreate, logged, writePermission)
 			g3.POST("/like", like, logged)
+			g3.POST("/pin", pinGist, logged, managePermission)
+			g3.POST("/template", templateGist, logged, managePermission)
+			g3.POST("/transfer", transferGist, logged, managePermission)
+			g3.POST("/collaborators", gistCollaboratorAdd, logged, managePermission)
+			g3.DELETE("/collaborators/:collaborator", gistCollaboratorRemove, logged, managePermission)
 			g3.GET("/likes", likes, checkRequireLogin)
 			g3.POST("/fork", fork, logged)
 			g3.GET("/forks", forks, checkRequireLogin)
@@ -329,6 +438,17 @@ func NewServer(isDev bool, sessionsPath string) *Server {
 		}
 	}
 
+	// API routes, authenticated with the tokens of the users instead of the cookie session
+	api := e.Group(apiPrefix, ipRateLimiter(config.C.ApiIpRateLimit, apiIpRateLimited), apiAuth, apiRateLimit, readOnly)
+	{
+		read, write := apiScope(db.ApiTokenScopeRead), apiScope(db.ApiTokenScopeWrite)
+		api.GET("/users/:user/gists", apiListGists, read)
+		api.POST("/gists", apiCreateGist, write)
+		api.GET("/gists/:user/:gistname", apiGetGist, read, apiGistInit)
+		api.PATCH("/gists/:user/:gistname", apiUpdateGist, write, apiGistInit, apiWritePermission)
+		api.DELETE("/gists/:user/:gistname", apiDeleteGist, write, apiGistInit, apiManagePermission)
+	}
+
 	customFs := os.DirFS(filepath.Join(config.GetHomeDir(), "custom"))
 	e.GET("/assets/*", func(ctx echo.Context) error {
 		if _, err := public.Files.Open(path.Join("assets", ctx.Param("*"))); !dev && err == nil {
@@ -375,6 +495,63 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.echo.ServeHTTP(w, r)
 }
 
+// emailRateLimiter limits per IP address the requests sending an email to an account, on top of the limits per account
+func emailRateLimiter() echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Every(3 * time.Minute),
+			Burst:     5,
+			ExpiresIn: 15 * time.Minute,
+		}),
+	})
+}
+
+// ipRateLimiter limits per IP address the requests to perHour per hour, or does not limit them if perHour is 0.
+// The requests over the limit are answered by deny.
+func ipRateLimiter(perHour int, deny echo.HandlerFunc) echo.MiddlewareFunc {
+	if perHour <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(perHour) / time.Hour.Seconds()),
+			Burst:     perHour,
+			ExpiresIn: time.Hour,
+		}),
+		DenyHandler: func(ctx echo.Context, identifier string, err error) error {
+			log.Warn().Msg("Rate limit exceeded for " + ctx.Request().URL.Path + " from " + identifier)
+			return deny(ctx)
+		},
+	})
+}
+
+// canonicalHost redirects the requests made to another host than the one of the external url, so that the links, the
+// cookies and the OAuth callbacks all use the same one whatever the Host header sent
+func canonicalHost(externalUrl string) echo.MiddlewareFunc {
+	// the external url was checked when loading the config
+	canonical, _ := url.Parse(externalUrl)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			// the healthcheck is queried by the container runtimes and the load balancers on their own address
+			if strings.EqualFold(req.Host, canonical.Host) || req.URL.Path == "/healthcheck" {
+				return next(ctx)
+			}
+
+			code := http.StatusMovedPermanently
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				// keeps the method and the body of the request
+				code = http.StatusPermanentRedirect
+			}
+			return ctx.Redirect(code, externalUrl+req.URL.RequestURI())
+		}
+	}
+}
+
 func dataInit(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ctxValue := context.WithValue(ctx.Request().Context(), dataKey, echo.Map{})
@@ -387,13 +564,19 @@ func dataInit(next echo.HandlerFunc) echo.HandlerFunc {
 
 		setData(ctx, "c", config.C)
 
-		setData(ctx, "githubOauth", config.C.GithubClientKey != "" && config.C.GithubSecret != "")
-		setData(ctx, "gitlabOauth", config.C.GitlabClientKey != "" && config.C.GitlabSecret != "")
-		setData(ctx, "giteaOauth", config.C.GiteaClientKey != "" && config.C.GiteaSecret != "")
-		setData(ctx, "oidcOauth", config.C.OIDCClientKey != "" && config.C.OIDCSecret != "" && config.C.OIDCDiscoveryUrl != "")
+		setData(ctx, "githubOauth", isOAuthProviderEnabled(ctx, GitHubProvider))
+		setData(ctx, "gitlabOauth", isOAuthProviderEnabled(ctx, GitLabProvider))
+		setData(ctx, "giteaOauth", isOAuthProviderEnabled(ctx, GiteaProvider))
+		setData(ctx, "bitbucketOauth", isOAuthProviderEnabled(ctx, BitbucketProvider))
+		setData(ctx, "microsoftOauth", isOAuthProviderEnabled(ctx, MicrosoftProvider))
+		setData(ctx, "oidcOauth", isOAuthProviderEnabled(ctx, OpenIDConnect))
+		setData(ctx, "oidcProviders", enabledOIDCProviders(ctx))
+		setData(ctx, "oauth2Oauth", isOAuthProviderEnabled(ctx, OAuth2Provider))
+		setData(ctx, "samlOauth", isOAuthProviderEnabled(ctx, SAMLProvider))
+		setData(ctx, "oauthButtons", oauthButtons(ctx))
 
 		httpProtocol := "http"
-		if ctx.Request().TLS != nil || ctx.Request().Header.Get("X-Forwarded-Proto") == "https" {
+		if isHttpsRequest(ctx) {
 			httpProtocol = "https"
 		}
 		setData(ctx, "httpProtocol", strings.ToUpper(httpProtocol))
@@ -468,9 +651,44 @@ func sessionInit(next echo.HandlerFunc) echo.HandlerFunc {
 				setData(ctx, "userLogged", nil)
 				return redirect(ctx, "/all")
 			}
-			if user != nil {
-				setData(ctx, "userLogged", user)
+
+			if token, ok := sess.Values["sessionToken"].(string); ok {
+				session, err := db.GetSessionByToken(token)
+				if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					return errorRes(500, "Cannot get session", err)
+				}
+				if err != nil || session.UserID != user.ID || !user.CanLogIn() {
+					// the session was revoked, or the user disabled
+					sess.Values["user"] = nil
+					delete(sess.Values, "sessionToken")
+					saveSession(sess, ctx)
+					setData(ctx, "userLogged", nil)
+					return next(ctx)
+				}
+				if err = session.Touch(ctx.RealIP(), ctx.Request().UserAgent()); err != nil {
+					log.Error().Err(err).Msg("Cannot update session")
+				}
+			} else {
+				// logged in before the sessions were recorded in the database
+				if err = setSessionUser(ctx, sess, user.ID); err != nil {
+					return errorRes(500, "Cannot create session", err)
+				}
+				saveSession(sess, ctx)
+			}
+
+			if impersonatedId, ok := sess.Values["impersonatedUser"].(uint); ok {
+				impersonated, err := db.GetUserById(impersonatedId)
+				if err != nil || !canImpersonate(user, impersonated) {
+					// the user was deleted, or the admin is no longer allowed to impersonate them
+					delete(sess.Values, "impersonatedUser")
+					saveSession(sess, ctx)
+				} else {
+					setData(ctx, "impersonator", user)
+					user = impersonated
+				}
 			}
+
+			setData(ctx, "userLogged", user)
 			return next(ctx)
 		}
 
@@ -497,6 +715,16 @@ func writePermission(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func managePermission(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		gist := getData(ctx, "gist").(*db.Gist)
+		if !gist.CanManage(getUserLogged(ctx)) {
+			return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+		}
+		return next(ctx)
+	}
+}
+
 func adminPermission(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		user := getUserLogged(ctx)
@@ -517,6 +745,34 @@ func logged(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// ipExtractor reads the address of the clients from the connection, or from the X-Forwarded-For header set by the
+// trusted reverse proxies. The headers sent by anyone else are ignored, they would get around the rate limits.
+func ipExtractor() echo.IPExtractor {
+	proxies := config.TrustedProxies()
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	// echo trusts the private networks by default
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// notImpersonating keeps the admins impersonating a user away from their credentials, sessions, linked accounts,
+// username, webhooks and the deletion of their account
+func notImpersonating(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if getImpersonator(ctx) != nil {
+			addFlash(ctx, tr(ctx, "flash.user.impersonation-forbidden"), "error")
+			return redirect(ctx, "/settings")
+		}
+		return next(ctx)
+	}
+}
+
 func makeCheckRequireLogin(isSingleGistAccess bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
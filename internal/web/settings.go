@@ -1,21 +1,32 @@
 package web
 
 import (
+	"bytes"
 	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/thomiceli/opengist/internal/config"
-	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/email"
 	"github.com/thomiceli/opengist/internal/i18n"
+	"github.com/thomiceli/opengist/internal/index"
+	"github.com/thomiceli/opengist/internal/render"
 	"github.com/thomiceli/opengist/internal/utils"
-	"os"
-	"path/filepath"
+	"html/template"
+	"image/png"
+	"math"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/db"
 	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
 )
 
 func userSettings(ctx echo.Context) error {
@@ -26,44 +37,389 @@ func userSettings(ctx echo.Context) error {
 		return errorRes(500, "Cannot get SSH keys", err)
 	}
 
+	pendingEmail, err := db.GetPendingEmailVerification(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get pending email verification", err)
+	}
+
 	setData(ctx, "email", user.Email)
+	setData(ctx, "pendingEmail", pendingEmail)
 	setData(ctx, "sshKeys", keys)
 	setData(ctx, "hasPassword", user.Password != "")
+	setData(ctx, "emailEnabled", email.Enabled())
+	setData(ctx, "linkedOIDCProvider", linkedOIDCProvider(user))
+	setExpiryData(ctx, user.DefaultExpiry)
+	setData(ctx, "visibilities", utils.Visibilities)
+	setData(ctx, "instanceVisibility", config.C.DefaultGistVisibility)
+	setListingSettingsData(ctx, user)
+	setData(ctx, "themes", utils.Themes)
+	setData(ctx, "cloneProtocols", utils.CloneProtocols)
+	setData(ctx, "highlightThemes", render.HighlightThemes())
 	setData(ctx, "htmlTitle", trH(ctx, "settings"))
 	return html(ctx, "settings.html")
 }
 
 func emailProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
-	email := ctx.FormValue("email")
+	newEmail := strings.ToLower(strings.TrimSpace(ctx.FormValue("email")))
 	var hash string
 
-	if email == "" {
+	if newEmail != "" && newEmail != user.Email {
+		used, err := db.EmailUsedByOtherUser(newEmail, user.ID)
+		if err != nil {
+			return errorRes(500, "Cannot check email", err)
+		}
+		if used {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return redirect(ctx, "/settings")
+		}
+
+		// the current email is kept until the new one is confirmed
+		if config.C.SmtpVerifyEmailChange && email.Enabled() {
+			return sendEmailVerification(ctx, user, newEmail)
+		}
+	}
+
+	if newEmail == "" {
 		// generate random md5 string
 		hash = fmt.Sprintf("%x", md5.Sum([]byte(time.Now().String())))
 	} else {
-		hash = fmt.Sprintf("%x", md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email)))))
+		hash = fmt.Sprintf("%x", md5.Sum([]byte(newEmail)))
 	}
 
-	user.Email = strings.ToLower(email)
+	user.Email = newEmail
 	user.MD5Hash = hash
 
 	if err := user.Update(); err != nil {
+		if db.IsEmailConstraintViolation(err) {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return redirect(ctx, "/settings")
+		}
 		return errorRes(500, "Cannot update email", err)
 	}
 
+	// setting an email cancels the change waiting for a confirmation
+	if err := db.DeleteEmailVerifications(user.ID); err != nil {
+		return errorRes(500, "Cannot delete email verifications", err)
+	}
+
 	addFlash(ctx, tr(ctx, "flash.user.email-updated"), "success")
 	return redirect(ctx, "/settings")
 }
 
-func accountDeleteProcess(ctx echo.Context) error {
+func sendEmailVerification(ctx echo.Context, user *db.User, newEmail string) error {
+	verification, err := db.CreateEmailVerification(user.ID, newEmail, emailVerificationTtl)
+	if err != nil {
+		return errorRes(500, "Cannot create email verification", err)
+	}
+
+	subject := tr(ctx, "email.verify-email.subject")
+	body := tr(ctx, "email.verify-email.body",
+		user.Username,
+		urlJoin(getData(ctx, "baseHttpUrl").(string), "/settings/email/verify", verification.Token),
+	)
+
+	go func(to string) {
+		if err := email.Send(to, subject, body); err != nil {
+			log.Error().Err(err).Msg("Cannot send email verification")
+		}
+	}(newEmail)
+
+	addFlash(ctx, tr(ctx, "flash.user.email-verification-sent", newEmail), "success")
+	return redirect(ctx, "/settings")
+}
+
+func emailVerifyProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	verification, err := db.GetEmailVerificationByToken(ctx.Param("token"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return errorRes(500, "Cannot get email verification", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	// the link must be opened by the account which asked for the change
+	if verification.UserID != user.ID {
+		addFlash(ctx, tr(ctx, "flash.user.email-verification-invalid"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if err = verification.Confirm(); err != nil {
+		if errors.Is(err, db.ErrEmailAlreadyUsed) {
+			addFlash(ctx, tr(ctx, "flash.user.email-already-used"), "error")
+			return redirect(ctx, "/settings")
+		}
+		return errorRes(500, "Cannot update email", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.email-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+// totpSetup shows a new secret to add to an authenticator app. It is kept in the session, and saved to the account
+// once a code generated from it is sent to totpEnableProcess.
+func totpSetup(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if user.TOTPEnabled {
+		return redirect(ctx, "/settings")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Opengist",
+		AccountName: user.Username,
+	})
+	if err != nil {
+		return errorRes(500, "Cannot generate two-factor secret", err)
+	}
+
+	qrCode, err := key.Image(200, 200)
+	if err != nil {
+		return errorRes(500, "Cannot generate QR code", err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, qrCode); err != nil {
+		return errorRes(500, "Cannot encode QR code", err)
+	}
+
+	sess := getSession(ctx)
+	sess.Values["totpSecret"] = key.Secret()
+	saveSession(sess, ctx)
+
+	setData(ctx, "totpSecret", key.Secret())
+	setData(ctx, "totpQrCode", template.URL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(buf.Bytes())))
+	setData(ctx, "htmlTitle", trH(ctx, "settings.totp"))
+	return html(ctx, "settings_totp.html")
+}
+
+func totpEnableProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if user.TOTPEnabled {
+		return redirect(ctx, "/settings")
+	}
+
+	sess := getSession(ctx)
+	secret, ok := sess.Values["totpSecret"].(string)
+	if !ok {
+		return redirect(ctx, "/settings/totp")
+	}
+
+	step, ok := totpCodeStep(strings.TrimSpace(ctx.FormValue("code")), secret, time.Now())
+	if !ok {
+		addFlash(ctx, tr(ctx, "flash.user.totp-invalid-code"), "error")
+		return redirect(ctx, "/settings/totp")
+	}
+
+	codes, hashes, err := generateTotpRecoveryCodes()
+	if err != nil {
+		return errorRes(500, "Cannot generate recovery codes", err)
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPSecret = secret
+	user.TOTPRecoveryCodes = hashes
+	user.TOTPLastStep = step
+	if err = user.Update(); err != nil {
+		return errorRes(500, "Cannot enable two-factor authentication", err)
+	}
+
+	delete(sess.Values, "totpSecret")
+	saveSession(sess, ctx)
+
+	// the recovery codes are shown only once, only their hashes are kept
+	setData(ctx, "totpRecoveryCodes", codes)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.totp"))
+	return html(ctx, "settings_totp.html")
+}
+
+func totpDisableProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if !user.TOTPEnabled {
+		return redirect(ctx, "/settings")
+	}
+
+	ok, err := checkTotpCode(user, ctx.FormValue("code"))
+	if err != nil {
+		return errorRes(500, "Cannot check two-factor code", err)
+	}
+	if !ok {
+		authWarn(ctx, "totp-disable-failed", user.Username).Msg("Invalid two-factor code to disable it")
+		addFlash(ctx, tr(ctx, "flash.user.totp-invalid-code"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	if ok, err = keepsTwoFactor(user, true); err != nil || !ok {
+		if err != nil {
+			return errorRes(500, "Cannot get passkeys", err)
+		}
+		addFlash(ctx, tr(ctx, "flash.user.two-factor-required"), "error")
+		return redirect(ctx, "/settings")
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPRecoveryCodes = nil
+	user.TOTPLastStep = 0
+	if err = user.Update(); err != nil {
+		return errorRes(500, "Cannot disable two-factor authentication", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.totp-disabled"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func loginNotificationsProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
+	user.NotifyNewLogin = ctx.FormValue("notify") == "1"
 
-	if err := user.Delete(); err != nil {
-		return errorRes(500, "Cannot delete this user", err)
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update login notifications", err)
 	}
 
-	return redirect(ctx, "/all")
+	addFlash(ctx, tr(ctx, "flash.user.login-notifications-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func defaultExpiryProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	expiry := ctx.FormValue("expiry")
+	if !utils.IsValidExpiry(expiry) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+	user.DefaultExpiry = utils.ClampExpiry(expiry, config.C.GistMaxExpiry)
+
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update default gist expiration", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.default-expiry-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func defaultVisibilityProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	visibility := ctx.FormValue("visibility")
+	if visibility != "" && !slices.Contains(utils.Visibilities, visibility) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+	user.DefaultVisibility = visibility
+
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update default gist visibility", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.default-visibility-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func cloneProtocolProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	protocol := ctx.FormValue("protocol")
+	if protocol != "" && !slices.Contains(utils.CloneProtocols, protocol) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+	user.CloneProtocol = protocol
+
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update clone URL preference", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.clone-protocol-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func setListingSettingsData(ctx echo.Context, user *db.User) {
+	_, columns := listingPreferences(user)
+	setData(ctx, "listingDensities", utils.ListingDensities)
+	setData(ctx, "listingAllColumns", utils.ListingColumns)
+	setData(ctx, "listingColumns", columns)
+}
+
+func listingProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	if ctx.FormValue("reset") == "1" {
+		user.ListingDensity = ""
+		user.ListingColumns = ""
+	} else {
+		density := ctx.FormValue("density")
+		if density != "" && !slices.Contains(utils.ListingDensities, density) {
+			return errorRes(400, tr(ctx, "error.bad-request"), nil)
+		}
+
+		if err := ctx.Request().ParseForm(); err != nil {
+			return errorRes(400, tr(ctx, "error.bad-request"), err)
+		}
+		columns, err := utils.ParseListingColumns(strings.Join(ctx.Request().PostForm["column"], ","))
+		if err != nil {
+			return errorRes(400, tr(ctx, "error.bad-request"), err)
+		}
+
+		user.ListingDensity = density
+		user.ListingColumns = strings.Join(columns, ",")
+		if user.ListingColumns == "" {
+			user.ListingColumns = "none"
+		}
+	}
+
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update listing preferences", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.listing-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+func themeProcess(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	theme := ctx.FormValue("theme")
+	if theme == "auto" {
+		theme = ""
+	}
+	if theme != "" && !slices.Contains(utils.Themes, theme) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+
+	highlight := ctx.FormValue("highlight")
+	if highlight != "" && !render.IsHighlightTheme(highlight) {
+		return errorRes(400, tr(ctx, "error.bad-request"), nil)
+	}
+
+	user.PreferredTheme = theme
+	user.HighlightTheme = highlight
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update theme", err)
+	}
+
+	// the theme menu of the header saves the choice in the background
+	if ctx.FormValue("menu") != "" {
+		return ctx.NoContent(204)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.theme-updated"), "success")
+	return redirect(ctx, "/settings")
+}
+
+// highlightThemeCss serves the stylesheet of a highlight theme, which only changes with the version of Opengist
+func highlightThemeCss(ctx echo.Context) error {
+	name := ctx.QueryParam("theme")
+	if !render.IsHighlightTheme(name) {
+		return notFound("Theme not found")
+	}
+
+	css, err := render.HighlightThemeCSS(name)
+	if err != nil {
+		return errorRes(500, "Cannot render theme", err)
+	}
+
+	ctx.Response().Header().Set("Cache-Control", "public, max-age=86400")
+	return ctx.Blob(200, "text/css; charset=utf-8", []byte(css))
 }
 
 func sshKeysProcess(ctx echo.Context) error {
@@ -126,6 +482,149 @@ func sshKeysDelete(ctx echo.Context) error {
 	return redirect(ctx, "/settings")
 }
 
+func userSessions(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	sessions, err := db.GetSessionsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get sessions", err)
+	}
+
+	var currentSessionId uint
+	token, _ := getSession(ctx).Values["sessionToken"].(string)
+	for _, session := range sessions {
+		if session.Token == token {
+			currentSessionId = session.ID
+		}
+	}
+
+	setData(ctx, "sessions", sessions)
+	setData(ctx, "currentSessionId", currentSessionId)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.sessions"))
+	return html(ctx, "settings_sessions.html")
+}
+
+func sessionRevoke(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	sessionId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings/sessions")
+	}
+
+	if err = db.DeleteSessionOfUser(uint(sessionId), user.ID); err != nil {
+		return errorRes(500, "Cannot revoke session", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.session-revoked"), "success")
+	return redirect(ctx, "/settings/sessions")
+}
+
+func sessionsRevokeOthers(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	token, _ := getSession(ctx).Values["sessionToken"].(string)
+
+	if err := db.DeleteSessionsOfUser(user.ID, token); err != nil {
+		return errorRes(500, "Cannot revoke sessions", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.sessions-revoked"), "success")
+	return redirect(ctx, "/settings/sessions")
+}
+
+func userTrash(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	gists, err := db.GetTrashedGistsOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get trashed gists", err)
+	}
+
+	setData(ctx, "gists", gists)
+	setData(ctx, "retentionDays", config.C.TrashRetentionDays)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.trash"))
+	return html(ctx, "settings_trash.html")
+}
+
+// maxOwnSearchLength is the maximum length of the text searched in the gists of the user
+const maxOwnSearchLength = 256
+
+// userSearch searches the gists of the user, including the unlisted and private ones
+func userSearch(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	pageInt := getPage(ctx)
+
+	query := strings.TrimSpace(ctx.QueryParam("q"))
+	if runes := []rune(query); len(runes) > maxOwnSearchLength {
+		query = string(runes[:maxOwnSearchLength])
+	}
+
+	setData(ctx, "query", query)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.search"))
+	if query == "" {
+		return html(ctx, "settings_search.html")
+	}
+
+	if pageInt < 1 {
+		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
+	}
+
+	results, err := db.SearchGistsOfUser(user.ID, query, (pageInt-1)*10, 11)
+	if err != nil {
+		return errorRes(500, "Cannot search gists", err)
+	}
+
+	if err = paginate(ctx, results, pageInt, 10, "results", "settings/search", 1, "&q="+url.QueryEscape(query)); err != nil {
+		return errorRes(404, tr(ctx, "error.page-not-found"), nil)
+	}
+
+	return html(ctx, "settings_search.html")
+}
+
+func trashedGist(ctx echo.Context) (*db.Gist, error) {
+	gistId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return nil, notFound("Gist not found")
+	}
+
+	gist, err := db.GetTrashedGistOfUser(getUserLogged(ctx).ID, uint(gistId))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, notFound("Gist not found")
+		}
+		return nil, errorRes(500, "Cannot get trashed gist", err)
+	}
+	return gist, nil
+}
+
+func trashRestore(ctx echo.Context) error {
+	gist, err := trashedGist(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = gist.Restore(); err != nil {
+		return errorRes(500, "Cannot restore gist", err)
+	}
+	gist.AddInIndex()
+
+	addFlash(ctx, tr(ctx, "flash.gist.restored"), "success")
+	return redirect(ctx, "/"+gist.User.Username+"/"+gist.Identifier())
+}
+
+func trashDelete(ctx echo.Context) error {
+	gist, err := trashedGist(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = gist.Delete(); err != nil {
+		return errorRes(500, "Cannot delete gist", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.gist.deleted"), "success")
+	return redirect(ctx, "/settings/trash")
+}
+
 func passwordProcess(ctx echo.Context) error {
 	user := getUserLogged(ctx)
 
@@ -137,7 +636,12 @@ func passwordProcess(ctx echo.Context) error {
 
 	if err := ctx.Validate(dto); err != nil {
 		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
-		return html(ctx, "settings.html")
+		return redirect(ctx, "/settings")
+	}
+
+	if err := ctx.Validate(&db.PasswordDTO{Password: dto.Password}); err != nil {
+		addFlash(ctx, utils.ValidationMessages(&err, getData(ctx, "locale").(*i18n.Locale)), "error")
+		return redirect(ctx, "/settings")
 	}
 
 	password, err := utils.Argon2id.Hash(dto.Password)
@@ -150,6 +654,8 @@ func passwordProcess(ctx echo.Context) error {
 		return errorRes(500, "Cannot update password", err)
 	}
 
+	audit(ctx, db.AuditPasswordChange, nil, "")
+
 	addFlash(ctx, tr(ctx, "flash.user.password-updated"), "success")
 	return redirect(ctx, "/settings")
 }
@@ -168,25 +674,32 @@ func usernameProcess(ctx echo.Context) error {
 		return redirect(ctx, "/settings")
 	}
 
+	if config.C.UsernameChangeCooldown > 0 && user.UsernameChangedAt != 0 {
+		allowedAt := time.Unix(user.UsernameChangedAt, 0).AddDate(0, 0, config.C.UsernameChangeCooldown)
+		if time.Now().Before(allowedAt) {
+			addFlash(ctx, tr(ctx, "flash.user.username-change-cooldown", int(math.Ceil(time.Until(allowedAt).Hours()/24))), "error")
+			return redirect(ctx, "/settings")
+		}
+	}
+
 	if exists, err := db.UserExists(dto.Username); err != nil || exists {
 		addFlash(ctx, tr(ctx, "flash.auth.username-exists"), "error")
 		return redirect(ctx, "/settings")
 	}
 
-	sourceDir := filepath.Join(config.GetHomeDir(), git.ReposDirectory, strings.ToLower(user.Username))
-	destinationDir := filepath.Join(config.GetHomeDir(), git.ReposDirectory, strings.ToLower(dto.Username))
+	if err := user.Rename(dto.Username); err != nil {
+		return errorRes(500, "Cannot update username", err)
+	}
 
-	if _, err := os.Stat(sourceDir); !os.IsNotExist(err) {
-		err := os.Rename(sourceDir, destinationDir)
+	// the gists are searched by username
+	if index.Enabled() {
+		gists, err := db.GetAllGistsOfUser(user.ID)
 		if err != nil {
-			return errorRes(500, "Cannot rename user directory", err)
+			return errorRes(500, "Cannot get gists", err)
+		}
+		for _, gist := range gists {
+			gist.AddInIndex()
 		}
-	}
-
-	user.Username = dto.Username
-
-	if err := user.Update(); err != nil {
-		return errorRes(500, "Cannot update username", err)
 	}
 
 	addFlash(ctx, tr(ctx, "flash.user.username-updated"), "success")
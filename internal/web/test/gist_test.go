@@ -1,11 +1,30 @@
 package test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/thomiceli/opengist/internal/actions"
+	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
+	"github.com/thomiceli/opengist/internal/index"
+	"github.com/thomiceli/opengist/internal/webhook"
 )
 
 func TestGists(t *testing.T) {
@@ -149,6 +168,63 @@ func TestVisibility(t *testing.T) {
 	require.Equal(t, db.UnlistedVisibility, gist1db.Private)
 }
 
+func TestBulkVisibility(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title: "gist",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: db.PublicVisibility,
+		},
+		Name:    []string{""},
+		Content: []string{"yeah"},
+	}
+	for i := 0; i < 2; i++ {
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	s.sessionCookie = ""
+
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	type bulkVisibility struct {
+		Private string   `form:"private"`
+		Gist    []string `form:"gist"`
+	}
+
+	// gist 1 belongs to another user, nothing must change
+	err = s.request("POST", "/gists/visibility", bulkVisibility{Private: "2", Gist: []string{"1", "3"}}, 403)
+	require.NoError(t, err)
+	gist3db, err := db.GetGistByID("3")
+	require.NoError(t, err)
+	require.Equal(t, db.PublicVisibility, gist3db.Private)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+
+	err = s.request("POST", "/gists/visibility", bulkVisibility{Private: "2", Gist: []string{"1", "2", "2"}}, 302)
+	require.NoError(t, err)
+	for _, id := range []string{"1", "2"} {
+		gistdb, err := db.GetGistByID(id)
+		require.NoError(t, err)
+		require.Equal(t, db.PrivateVisibility, gistdb.Private)
+	}
+
+	err = s.request("POST", "/gists/visibility", bulkVisibility{Private: "unknown", Gist: []string{"1"}}, 400)
+	require.NoError(t, err)
+}
+
 func TestLikeFork(t *testing.T) {
 	setup(t)
 	s, err := newTestServer()
@@ -208,6 +284,61 @@ func TestLikeFork(t *testing.T) {
 	require.Equal(t, gist1db.Description, gist2db.Description)
 	require.Equal(t, gist1db.Private, gist2db.Private)
 	require.Equal(t, user2.Username, gist2db.User.Username)
+	require.Equal(t, gist1db.ID, gist2db.ForkedID)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, 1, gist1db.NbForks)
+}
+
+func TestLikedGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	for i, visibility := range []db.Visibility{db.PublicVisibility, db.UnlistedVisibility} {
+		gist := db.GistDTO{
+			Title:         "gist" + strconv.Itoa(i+1),
+			VisibilityDTO: db.VisibilityDTO{Private: visibility},
+			Name:          []string{""},
+			Content:       []string{"yeah"},
+		}
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	s.sessionCookie = ""
+	register(t, s, db.UserDTO{Username: "kaguya", Password: "kaguya"})
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	for _, gist := range []*db.Gist{gist1db, gist2db} {
+		err = s.request("POST", "/thomas/"+gist.Uuid+"/like", nil, 302)
+		require.NoError(t, err)
+	}
+
+	// the unlisted gist liked is only listed to the user who liked it
+	gists, err := db.GetAllGistsLikedByUser(2, 2, 0, "created", "desc")
+	require.NoError(t, err)
+	require.Len(t, gists, 2)
+	gists, err = db.GetAllGistsLikedByUser(2, 0, 0, "created", "desc")
+	require.NoError(t, err)
+	require.Len(t, gists, 1)
+	require.Equal(t, gist1db.ID, gists[0].ID)
+
+	// the gists can be sorted by their number of likes, the second toggle unlikes the first gist
+	err = s.request("POST", "/thomas/"+gist1db.Uuid+"/like", nil, 302)
+	require.NoError(t, err)
+	gists, err = db.GetAllGistsForCurrentUser(1, "", 0, "likes", "desc")
+	require.NoError(t, err)
+	require.Equal(t, gist2db.ID, gists[0].ID)
+	gists, err = db.GetAllGistsForCurrentUser(1, "", 0, "likes", "asc")
+	require.NoError(t, err)
+	require.Equal(t, gist1db.ID, gists[0].ID)
 }
 
 func TestCustomUrl(t *testing.T) {
@@ -269,3 +400,3257 @@ func TestCustomUrl(t *testing.T) {
 	require.Equal(t, gist2db.Uuid, gist2db.Identifier())
 	require.NotEqual(t, gist2db.URL, gist2db.Identifier())
 }
+
+func TestGistExpiry(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type defaultExpiry struct {
+		Expiry string `form:"expiry"`
+	}
+
+	err = s.request("PUT", "/settings/default-expiry", defaultExpiry{Expiry: "1w"}, 302)
+	require.NoError(t, err)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "1w", user1db.DefaultExpiry)
+
+	err = s.request("PUT", "/settings/default-expiry", defaultExpiry{Expiry: "2w"}, 400)
+	require.NoError(t, err)
+
+	type gistWithExpiry struct {
+		db.GistDTO
+		Expiry string `form:"expiry"`
+	}
+
+	gist := gistWithExpiry{
+		GistDTO: db.GistDTO{
+			Title:   "gist",
+			Name:    []string{"gist.txt"},
+			Content: []string{"yeah"},
+		},
+		Expiry: "1h",
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), gist1db.ExpiresAt, 5)
+
+	err = s.request("GET", "/"+user1.Username+"/"+gist1db.Identifier(), nil, 200)
+	require.NoError(t, err)
+	infoRefs := func() int {
+		req := httptest.NewRequest("GET", "http://localhost:6157/"+user1.Username+"/"+gist1db.Uuid+".git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("User-Agent", "git/2.43.0")
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, 200, infoRefs())
+
+	gist1db.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, gist1db.Update())
+
+	err = s.request("GET", "/"+user1.Username+"/"+gist1db.Identifier(), nil, 404)
+	require.NoError(t, err)
+	// nor can it be cloned over HTTP
+	require.Equal(t, 401, infoRefs())
+	gists, err := db.GetAllGistsFromUser(user1db.ID, user1db.ID, "", 0, "created", "desc")
+	require.NoError(t, err)
+	require.Empty(t, gists)
+
+	// a gist without expiry is shortened to the instance maximum
+	config.C.GistMaxExpiry = "1d"
+	defer func() { config.C.GistMaxExpiry = "" }()
+
+	gist.Expiry = ""
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(24*time.Hour).Unix(), gist2db.ExpiresAt, 5)
+}
+
+func TestPasswordProtectedGist(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:     "gist",
+		Name:      []string{"gist.txt"},
+		Content:   []string{"secret"},
+		Protected: true,
+	}
+	err = s.request("POST", "/", gist, 200)
+	require.NoError(t, err)
+	_, err = db.GetGistByID("1")
+	require.Error(t, err)
+
+	gist.Password = "hunter2"
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.True(t, gist1db.IsProtected())
+	require.NotContains(t, gist1db.PasswordHash, "hunter2")
+
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	// the owner is never asked for the password
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+
+	// an empty password keeps the current one
+	gist.Password = ""
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.True(t, gist1db.IsProtected())
+
+	ownerCookie := s.sessionCookie
+	s.sessionCookie = ""
+
+	err = s.request("GET", gistPath, nil, 403)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath+"/raw/HEAD/gist.txt", nil, 403)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath+"/archive/HEAD", nil, 403)
+	require.NoError(t, err)
+
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("POST", gistPath+"/unlock", struct {
+		Password string `form:"password"`
+	}{"wrong"}, 302)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath, nil, 403)
+	require.NoError(t, err)
+
+	err = s.request("POST", gistPath+"/unlock", struct {
+		Password string `form:"password"`
+	}{"hunter2"}, 302)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath+"/raw/HEAD/gist.txt", nil, 200)
+	require.NoError(t, err)
+
+	// forks keep the protection
+	err = s.request("POST", gistPath+"/fork", nil, 302)
+	require.NoError(t, err)
+	fork, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	require.Equal(t, gist1db.PasswordHash, fork.PasswordHash)
+
+	// clones are allowed with the password of the gist
+	require.Error(t, clientGitClone("kaguya:wrong", user1.Username, gist1db.Uuid))
+	require.NoError(t, clientGitClone("kaguya:hunter2", user1.Username, gist1db.Uuid))
+
+	// the password of the gist is locked out after too many failures, as with the form to unlock it
+	pull := func(username, password string) int {
+		req := httptest.NewRequest("GET", "http://localhost:6157/"+user1.Username+"/"+gist1db.Uuid+".git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("User-Agent", "git/2.43.0")
+		req.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, 200, pull("kaguya", "hunter2"))
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 404, pull("kaguya", "wrong"))
+	}
+	require.Equal(t, 404, pull("kaguya", "hunter2"))
+
+	// the password of the owner shares the lockout of the login form
+	require.Equal(t, 200, pull(user1.Username, user1.Password))
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 404, pull(user1.Username, "wrong"))
+	}
+	require.Equal(t, 429, pull(user1.Username, user1.Password))
+	require.Error(t, s.request("POST", "/login", user1, 302))
+
+	require.NoError(t, db.ResetLoginAttempts("user:thomas", "ip:192.0.2.1", "gist:"+gist1db.Uuid+":ip:192.0.2.1"))
+	require.Equal(t, 200, pull("kaguya", "hunter2"))
+
+	// removing the protection opens the gist again
+	s.sessionCookie = ownerCookie
+	gist.Protected = false
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.False(t, gist1db.IsProtected())
+
+	s.sessionCookie = ""
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+}
+
+func TestExportGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "first",
+		Name:    []string{"a.txt", "b.md"},
+		Content: []string{"aaa", "# bbb"},
+	}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "second",
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+		Name:          []string{"c.txt"},
+		Content:       []string{"ccc"},
+	}, 302)
+	require.NoError(t, err)
+	user1Cookie := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "other",
+		Name:    []string{"d.txt"},
+		Content: []string{"ddd"},
+	}, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+
+	resp := s.rawRequest("GET", "/settings/export", user1Cookie)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+
+	contents := make(map[string]string)
+	for _, file := range archive.File {
+		f, err := file.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		contents[file.Name] = string(content)
+	}
+
+	require.Len(t, contents, 5)
+	require.Equal(t, "aaa", contents[gist1db.Uuid+"/a.txt"])
+	require.Equal(t, "# bbb", contents[gist1db.Uuid+"/b.md"])
+	require.Equal(t, "ccc", contents[gist2db.Uuid+"/c.txt"])
+
+	var metadata struct {
+		Title      string   `json:"title"`
+		Visibility string   `json:"visibility"`
+		Files      []string `json:"files"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(contents[gist2db.Uuid+"/.opengist.json"]), &metadata))
+	require.Equal(t, "second", metadata.Title)
+	require.Equal(t, "private", metadata.Visibility)
+	require.Equal(t, []string{"c.txt"}, metadata.Files)
+
+	// anonymous users are sent to the login page
+	resp = s.rawRequest("GET", "/settings/export")
+	require.Equal(t, 302, resp.StatusCode)
+}
+
+func TestDownloadZip(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "My scripts: étape 1",
+		Name:    []string{"b.sh", "a.sh"},
+		Content: []string{"echo b", "echo a"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist = db.GistDTO{Name: []string{""}, Content: []string{"private"}}
+	gist.Title = ""
+	gist.Private = db.PrivateVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	download := func(id string) *http.Response {
+		gistdb, err := db.GetGistByID(id)
+		require.NoError(t, err)
+		return s.rawRequest("GET", "/"+user1.Username+"/"+gistdb.Identifier()+"/archive/HEAD",
+			&http.Cookie{Name: "session", Value: s.sessionCookie})
+	}
+
+	resp := download("1")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	require.Equal(t, "attachment; filename*=utf-8''My-scripts-%C3%A9tape-1.zip", resp.Header.Get("Content-Disposition"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	require.Len(t, archive.File, 2)
+	require.Equal(t, "b.sh", archive.File[0].Name)
+	f, err := archive.File[0].Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "echo b", string(content))
+
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	resp = download("2")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "attachment; filename="+gist2db.Uuid+".zip", resp.Header.Get("Content-Disposition"))
+
+	// the archive of a private gist is as hidden as its page
+	s.sessionCookie = ""
+	resp = download("2")
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestRawFileRevision(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"first"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	gist.Name = []string{"gist.txt", "page.html"}
+	gist.Content = []string{"second", "<script>alert(1)</script>"}
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+
+	commits, err := gist1db.Log(0)
+	require.NoError(t, err)
+	require.Len(t, commits, 2)
+	firstHash := commits[1].Hash
+
+	get := func(uri string) (*http.Response, string) {
+		resp := s.rawRequest("GET", gistPath+uri)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/raw/" + firstHash + "/gist.txt")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "first", body)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "5", resp.Header.Get("Content-Length"))
+
+	resp, body = get("/raw/HEAD/gist.txt")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "second", body)
+
+	// files are never served as pages of the instance
+	resp, _ = get("/raw/HEAD/page.html")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+
+	resp, _ = get("/raw/" + firstHash + "/page.html")
+	require.Equal(t, 404, resp.StatusCode)
+	resp, _ = get("/raw/0123456789abcdef0123456789abcdef01234567/gist.txt")
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestGistFiles(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user1Cookie := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	for _, gist := range []db.GistDTO{
+		{Title: "public", Name: []string{"a.txt", "b.go"}, Content: []string{"first", "package main"}},
+		{Title: "private", VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility}, Name: []string{"c.txt"}, Content: []string{"secret"}},
+		{Title: "protected", Protected: true, Password: "secret", Name: []string{"d.txt"}, Content: []string{"secret"}},
+	} {
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	gistPath := func(id string) string {
+		gist, err := db.GetGistByID(id)
+		require.NoError(t, err)
+		return "/" + user1.Username + "/" + gist.Identifier()
+	}
+
+	resp := s.rawRequest("GET", gistPath("1"))
+	require.Equal(t, 200, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `id="gist-copy-all"`)
+	require.Contains(t, string(body), gistPath("1")+"/files/HEAD")
+	require.Contains(t, string(body), gistPath("1")+"/raw/HEAD/b.go")
+
+	var files struct {
+		Revision string `json:"revision"`
+		Files    []struct {
+			Filename string `json:"filename"`
+			Content  string `json:"content"`
+		} `json:"files"`
+	}
+	resp = s.rawRequest("GET", gistPath("1")+"/files/HEAD")
+	require.Equal(t, 200, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+	require.Len(t, files.Revision, 40)
+	require.Len(t, files.Files, 2)
+	require.Equal(t, "a.txt", files.Files[0].Filename)
+	require.Equal(t, "first", files.Files[0].Content)
+	require.Equal(t, "package main", files.Files[1].Content)
+
+	resp = s.rawRequest("GET", gistPath("1")+"/files/0123456789abcdef0123456789abcdef01234567")
+	require.Equal(t, 404, resp.StatusCode)
+
+	// the content of secret gists is only given to the ones who can see them
+	resp = s.rawRequest("GET", gistPath("2")+"/files/HEAD")
+	require.Equal(t, 404, resp.StatusCode)
+	resp = s.rawRequest("GET", gistPath("3")+"/files/HEAD")
+	require.Equal(t, 403, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(body), `"content"`)
+
+	resp = s.rawRequest("GET", gistPath("2")+"/files/HEAD", user1Cookie)
+	require.Equal(t, 200, resp.StatusCode)
+	resp = s.rawRequest("GET", gistPath("3")+"/files/HEAD", user1Cookie)
+	require.Equal(t, 200, resp.StatusCode)
+}
+
+func TestLinesPermalink(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"a.txt", "b.txt"},
+		Content: []string{"first\nsecond", "third"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	gist.Content = []string{"first\nsecond\nedited", "third"}
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+
+	commits, err := gist1db.Log(0)
+	require.NoError(t, err)
+	require.Len(t, commits, 2)
+
+	page := func(uri string) string {
+		resp := s.rawRequest("GET", gistPath+uri)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// the permalinks point to the commit shown, whatever the revision asked
+	body := page("")
+	require.Equal(t, 2, strings.Count(body, `data-url="`+gistPath+"/rev/"+commits[0].Hash+`"`))
+	require.Contains(t, body, `id="file-a-txt-3"`)
+	require.Contains(t, body, `id="file-b-txt-1"`)
+
+	body = page("/rev/" + commits[1].Hash[:7])
+	require.Contains(t, body, `data-url="`+gistPath+"/rev/"+commits[1].Hash+`"`)
+	require.NotContains(t, body, `id="file-a-txt-3"`)
+}
+
+func TestSearch(t *testing.T) {
+	setup(t)
+	config.C.IndexEnabled = true
+	defer func() { config.C.IndexEnabled = false }()
+	require.NoError(t, index.Open(filepath.Join(t.TempDir(), "opengist.index")))
+	defer index.Close()
+
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for _, gist := range []db.GistDTO{
+		{Title: "public", Name: []string{"main.go"}, Content: []string{"package main\n\n// the <needle> is here"}},
+		{Title: "private", VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility}, Name: []string{"a.txt"}, Content: []string{"needle"}},
+		{Title: "protected", Protected: true, Password: "secret", Name: []string{"b.txt"}, Content: []string{"needle"}},
+		{Title: "described", Description: "the **haystack** around", Name: []string{"c.txt"}, Content: []string{"straw"}},
+	} {
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+	user1Cookie := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	search := func(query string, cookies ...*http.Cookie) string {
+		resp := s.rawRequest("GET", "/search?q="+url.QueryEscape(query), cookies...)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// gists are indexed in the background
+	require.Eventually(t, func() bool {
+		return strings.Contains(search("needle", user1Cookie), "3 gists found")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	body := search("needle")
+	require.Contains(t, body, "1 gists found")
+	require.Contains(t, body, ">public</a>")
+	require.Contains(t, body, "the &lt;<mark>needle</mark>&gt; is here")
+
+	body = search("needle visibility:private", user1Cookie)
+	require.Contains(t, body, "1 gists found")
+	require.Contains(t, body, ">private</a>")
+
+	body = search("needle visibility:private")
+	require.Contains(t, body, "0 gists found")
+
+	// the descriptions are indexed as written
+	body = search("haystack")
+	require.Contains(t, body, "1 gists found")
+	require.Contains(t, body, ">described</a>")
+}
+
+func TestGistViews(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for _, title := range []string{"viewed", "not viewed"} {
+		err = s.request("POST", "/", db.GistDTO{Title: title, Name: []string{"a.txt"}, Content: []string{"a"}}, 302)
+		require.NoError(t, err)
+	}
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	views := func() int64 {
+		gist, err := db.GetGistByID("1")
+		require.NoError(t, err)
+		return gist.Views
+	}
+
+	// the owner does not count
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+
+	// a visitor is counted once within the window
+	s.sessionCookie = ""
+	for i := 0; i < 3; i++ {
+		err = s.request("GET", gistPath, nil, 200)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return views() == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return views() == 2 }, 5*time.Second, 20*time.Millisecond)
+
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	gists, err := db.GetAllGistsFromUser(user1db.ID, 0, "", 0, "views", "desc")
+	require.NoError(t, err)
+	require.Len(t, gists, 2)
+	require.Equal(t, "viewed", gists[0].Title)
+
+	err = s.request("GET", "/"+user1.Username+"?sort=views&order=asc", nil, 200)
+	require.NoError(t, err)
+}
+
+func TestGistCloneStats(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for _, title := range []string{"cloned", "not cloned"} {
+		err = s.request("POST", "/", db.GistDTO{Title: title, Name: []string{"a.txt"}, Content: []string{"a"}}, 302)
+		require.NoError(t, err)
+	}
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Zero(t, gist1db.LastViewedAt)
+
+	stats := func() *db.Gist {
+		gist, err := db.GetGistByID("1")
+		require.NoError(t, err)
+		return gist
+	}
+
+	require.NoError(t, clientGitClone("thomas:thomas", user1.Username, gist1db.Uuid))
+	require.Eventually(t, func() bool { return stats().Clones == 1 }, 5*time.Second, 20*time.Millisecond)
+	require.NotZero(t, stats().LastClonedAt)
+	require.Equal(t, gist1db.UpdatedAt, stats().UpdatedAt)
+
+	// a view by someone else than the owner sets the last view
+	ownerCookie := s.sessionCookie
+	s.sessionCookie = ""
+	err = s.request("GET", "/"+user1.Username+"/"+gist1db.Identifier(), nil, 200)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return stats().LastViewedAt != 0 }, 5*time.Second, 20*time.Millisecond)
+
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	gists, err := db.GetAllGistsFromUser(user1db.ID, user1db.ID, "", 0, "clones", "desc")
+	require.NoError(t, err)
+	require.Len(t, gists, 2)
+	require.Equal(t, "cloned", gists[0].Title)
+	gists, err = db.GetAllGistsFromUser(user1db.ID, user1db.ID, "", 0, "last_viewed", "asc")
+	require.NoError(t, err)
+	require.Equal(t, "not cloned", gists[0].Title)
+
+	list := func(uri string) string {
+		var cookies []*http.Cookie
+		if s.sessionCookie != "" {
+			cookies = append(cookies, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		}
+		resp := s.rawRequest("GET", uri, cookies...)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// the stats are only shown to the owner
+	body := list("/" + user1.Username + "?sort=clones&order=desc")
+	require.NotContains(t, body, "gist-clones")
+	require.NotContains(t, body, "sort=last-viewed")
+	require.Contains(t, body, "Recently created")
+
+	s.sessionCookie = ownerCookie
+	body = list("/" + user1.Username + "?sort=clones&order=desc")
+	require.Contains(t, body, "Most cloned")
+	require.Contains(t, body, "1 clones")
+	require.Contains(t, body, "gist-last-viewed")
+	require.Contains(t, body, "Never viewed by others")
+	require.Contains(t, body, "sort=last-viewed")
+	require.Less(t, strings.Index(body, ">cloned</a>"), strings.Index(body, ">not cloned</a>"))
+
+	body = list("/" + user1.Username + "?sort=last-viewed&order=asc")
+	require.Contains(t, body, "Least recently viewed")
+	require.Less(t, strings.Index(body, ">not cloned</a>"), strings.Index(body, ">cloned</a>"))
+}
+
+func TestGistTags(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "go-gist",
+		Name:    []string{"main.go"},
+		Content: []string{"package main"},
+		Tags:    " Golang, CLI tools,golang,, ",
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, "cli-tools, golang", gist1db.TagsList())
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	gist.Title = "secret-gist"
+	gist.Tags = "golang, secret"
+	gist.Private = db.PrivateVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist.Title = "too many tags"
+	gist.Tags = "a,b,c,d,e,f,g,h,i,j,k"
+	err = s.request("POST", "/", gist, 200)
+	require.NoError(t, err)
+
+	gist = db.GistDTO{Title: "plain-gist", Name: []string{"a.txt"}, Content: []string{"a"}}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	list := func(uri string) string {
+		resp := s.rawRequest("GET", uri, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	body := list("/all?tag=GoLang")
+	require.Contains(t, body, "go-gist")
+	require.Contains(t, body, "secret-gist")
+	require.NotContains(t, body, "plain-gist")
+
+	body = list("/" + user1.Username + "?tag=cli-tools")
+	require.Contains(t, body, "go-gist")
+	require.NotContains(t, body, "secret-gist")
+
+	body = list(gistPath)
+	require.Contains(t, body, "/all?tag=golang")
+
+	// the tags of the private gist are only suggested to its owner
+	var tags []string
+	require.NoError(t, json.Unmarshal([]byte(list("/tags?q=s")), &tags))
+	require.Equal(t, []string{"secret"}, tags)
+
+	gist = db.GistDTO{Title: "go-gist", Name: []string{"main.go"}, Content: []string{"package main"}, Tags: "go"}
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, "go", gist1db.TagsList())
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	require.NoError(t, json.Unmarshal([]byte(list("/tags?q=")), &tags))
+	require.Equal(t, []string{"go"}, tags)
+
+	body = list("/all?tag=golang")
+	require.NotContains(t, body, "secret-gist")
+}
+
+func TestVisibilityBadges(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for _, visibility := range []db.Visibility{db.PublicVisibility, db.UnlistedVisibility, db.PrivateVisibility} {
+		gist := db.GistDTO{
+			Title:         "gist-" + visibility.String(),
+			Name:          []string{"gist.txt"},
+			Content:       []string{"yeah"},
+			VisibilityDTO: db.VisibilityDTO{Private: visibility},
+		}
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	body := func(uri string) string {
+		resp := s.rawRequest("GET", uri, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// the owner sees the level of the gists which are not public
+	page := body("/" + user1.Username)
+	require.Contains(t, page, "gist-public")
+	require.Contains(t, page, "gist-unlisted")
+	require.Contains(t, page, "gist-private")
+	require.Equal(t, 2, strings.Count(page, "gist-visibility-badge"))
+
+	// the other users only see the public one
+	s.sessionCookie = ""
+	page = body("/" + user1.Username)
+	require.Contains(t, page, "gist-public")
+	require.NotContains(t, page, "gist-unlisted")
+	require.NotContains(t, page, "gist-private")
+	require.Equal(t, 0, strings.Count(page, "gist-visibility-badge"))
+}
+
+func TestPinGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+
+	gist := db.GistDTO{Name: []string{"a.txt"}, Content: []string{"a"}}
+	for i := 1; i <= db.MaxPinnedGists+1; i++ {
+		gist.Title = "gist" + strconv.Itoa(i)
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+	gist.Title = "private"
+	gist.Private = db.PrivateVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gistPath := func(id int) string {
+		gistdb, err := db.GetGistByID(strconv.Itoa(id))
+		require.NoError(t, err)
+		return "/" + user1.Username + "/" + gistdb.Identifier()
+	}
+	titles := func(currentUserId uint) []string {
+		gists, err := db.GetAllGistsFromUser(user1db.ID, currentUserId, "", 0, "created", "desc")
+		require.NoError(t, err)
+		titles := make([]string, 0, len(gists))
+		for _, gist := range gists {
+			titles = append(titles, gist.Title)
+		}
+		return titles
+	}
+
+	// the pinned gists come first
+	for _, id := range []int{8, 2} {
+		err = s.request("POST", gistPath(id)+"/pin", nil, 302)
+		require.NoError(t, err)
+	}
+	require.ElementsMatch(t, []string{"private", "gist2"}, titles(user1db.ID)[:2])
+	require.Equal(t, "gist2", titles(0)[0])
+
+	err = s.request("POST", gistPath(8)+"/pin", nil, 302)
+	require.NoError(t, err)
+	require.Equal(t, "gist2", titles(user1db.ID)[0])
+	require.NotEqual(t, "private", titles(user1db.ID)[1])
+
+	for _, id := range []int{1, 3, 4, 5, 6, 7} {
+		err = s.request("POST", gistPath(id)+"/pin", nil, 302)
+		require.NoError(t, err)
+	}
+	count, err := db.CountPinnedGistsOfUser(user1db.ID)
+	require.NoError(t, err)
+	require.EqualValues(t, db.MaxPinnedGists, count)
+	gist7db, err := db.GetGistByID("7")
+	require.NoError(t, err)
+	require.Zero(t, gist7db.PinnedAt)
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("POST", gistPath(7)+"/pin", nil, 302)
+	require.NoError(t, err)
+	gist7db, err = db.GetGistByID("7")
+	require.NoError(t, err)
+	require.Zero(t, gist7db.PinnedAt)
+}
+
+func TestGistTemplates(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	admin := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, admin)
+
+	gist := db.GistDTO{
+		Title:         "bug-report",
+		Description:   "a bug report",
+		Name:          []string{"report.md", "steps.txt"},
+		Content:       []string{"# Bug", "1. open"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + admin.Username + "/" + gist1db.Identifier()
+
+	createPage := func(query string, code int) string {
+		resp := s.rawRequest("GET", "/"+query, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, code, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// a gist must be saved as a template to be used
+	err = s.request("GET", "/?template=1", nil, 404)
+	require.NoError(t, err)
+	require.NotContains(t, createPage("", 200), "bug-report")
+
+	err = s.request("POST", gistPath+"/template", nil, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.True(t, gist1db.IsTemplate)
+
+	require.Contains(t, createPage("", 200), "bug-report")
+	body := createPage("?template=1", 200)
+	require.Contains(t, body, `value="a bug report"`)
+	require.Contains(t, body, `value="report.md"`)
+	require.Contains(t, body, `value="steps.txt"`)
+	require.Contains(t, body, `value="1. open"`)
+
+	// the template is private to its owner until an admin shares it
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("GET", "/?template=1", nil, 404)
+	require.NoError(t, err)
+	require.NotContains(t, createPage("", 200), "bug-report")
+	err = s.request("POST", gistPath+"/template", nil, 404)
+	require.NoError(t, err)
+	err = s.request("POST", "/admin-panel/gists/1/share-template", nil, 404)
+	require.NoError(t, err)
+
+	login(t, s, admin)
+	err = s.request("POST", "/admin-panel/gists/1/share-template", nil, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.True(t, gist1db.TemplateShared)
+
+	login(t, s, user2)
+	require.Contains(t, createPage("", 200), "bug-report (thomas)")
+	require.Contains(t, createPage("?template=1", 200), `value="report.md"`)
+
+	// the gist is no longer offered once its owner removes the template
+	login(t, s, admin)
+	err = s.request("POST", gistPath+"/template", nil, 302)
+	require.NoError(t, err)
+
+	login(t, s, user2)
+	err = s.request("GET", "/?template=1", nil, 404)
+	require.NoError(t, err)
+	require.NotContains(t, createPage("", 200), "bug-report")
+}
+
+func TestOrganizations(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	owner := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, owner)
+	s.sessionCookie = ""
+	member := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, member)
+	memberdb, err := db.GetUserByUsername(member.Username)
+	require.NoError(t, err)
+
+	login(t, s, owner)
+	ownerdb, err := db.GetUserByUsername(owner.Username)
+	require.NoError(t, err)
+
+	err = s.request("POST", "/settings/organizations", db.OrganizationDTO{Name: "acme"}, 302)
+	require.NoError(t, err)
+	org, err := db.GetOrganizationByName("acme")
+	require.NoError(t, err)
+	role, err := db.GetOrganizationRole(org.ID, ownerdb.ID)
+	require.NoError(t, err)
+	require.Equal(t, db.OrganizationRoleOwner, role)
+
+	// the organizations and the users share their names
+	err = s.request("POST", "/settings/organizations", db.OrganizationDTO{Name: "kaguya"}, 302)
+	require.NoError(t, err)
+	_, err = db.GetOrganizationByName("kaguya")
+	require.Error(t, err)
+
+	gist := db.GistDTO{
+		Title:         "runbook",
+		Name:          []string{"runbook.md"},
+		Content:       []string{"# Runbook"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+
+	err = s.request("GET", "/"+owner.Username+"/"+gist1db.Identifier()+"/edit", nil, 200)
+	require.NoError(t, err)
+
+	type transferForm struct {
+		Organization string `form:"organization"`
+	}
+	err = s.request("POST", "/"+owner.Username+"/"+gist1db.Identifier()+"/transfer", transferForm{"acme"}, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, org.ID, gist1db.UserID)
+	gistPath := "/acme/" + gist1db.Identifier()
+
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+
+	// the private gists of the organization are hidden from the users who are not its members
+	login(t, s, member)
+	err = s.request("GET", gistPath, nil, 404)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings/organizations/acme", nil, 404)
+	require.NoError(t, err)
+	require.Error(t, clientGitClone("kaguya:kaguya", "acme", gist1db.Identifier()))
+
+	type memberForm struct {
+		Username string `form:"username"`
+		Role     string `form:"role"`
+	}
+	login(t, s, owner)
+	err = s.request("POST", "/settings/organizations/acme/members", memberForm{member.Username, db.OrganizationRoleMember}, 302)
+	require.NoError(t, err)
+	require.True(t, db.IsOrganizationMember(org.ID, memberdb.ID))
+	err = s.request("GET", "/settings/organizations/acme", nil, 200)
+	require.NoError(t, err)
+
+	// all the members write the gists of the organization, and see them listed
+	login(t, s, member)
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath+"/edit", nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", "/acme", nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings/organizations", nil, 200)
+	require.NoError(t, err)
+	count, err := db.CountAllGistsFromUser(org.ID, memberdb.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+	require.NoError(t, clientGitClone("kaguya:kaguya", "acme", gist1db.Identifier()))
+
+	// only the owners manage the members
+	err = s.request("POST", "/settings/organizations/acme/members", memberForm{member.Username, db.OrganizationRoleOwner}, 403)
+	require.NoError(t, err)
+
+	// the last owner cannot leave the organization
+	login(t, s, owner)
+	err = s.request("DELETE", "/settings/organizations/acme/members/"+owner.Username, nil, 302)
+	require.NoError(t, err)
+	require.True(t, db.IsOrganizationMember(org.ID, ownerdb.ID))
+
+	login(t, s, member)
+	err = s.request("DELETE", "/settings/organizations/acme/members/"+member.Username, nil, 302)
+	require.NoError(t, err)
+	require.False(t, db.IsOrganizationMember(org.ID, memberdb.ID))
+	err = s.request("GET", gistPath, nil, 404)
+	require.NoError(t, err)
+}
+
+func TestGistCollaborators(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	owner := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, owner)
+	s.sessionCookie = ""
+	collaborator := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, collaborator)
+	collaboratordb, err := db.GetUserByUsername(collaborator.Username)
+	require.NoError(t, err)
+
+	login(t, s, owner)
+	gist := db.GistDTO{
+		Title:         "notes",
+		Name:          []string{"notes.md"},
+		Content:       []string{"# Notes"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + owner.Username + "/" + gist1db.Identifier()
+
+	login(t, s, collaborator)
+	err = s.request("GET", gistPath, nil, 404)
+	require.NoError(t, err)
+	require.Error(t, clientGitClone("kaguya:kaguya", owner.Username, gist1db.Identifier()))
+
+	type collaboratorForm struct {
+		Username string `form:"username"`
+	}
+	err = s.request("POST", gistPath+"/collaborators", collaboratorForm{owner.Username}, 404)
+	require.NoError(t, err)
+
+	login(t, s, owner)
+	err = s.request("POST", gistPath+"/collaborators", collaboratorForm{collaborator.Username}, 302)
+	require.NoError(t, err)
+	require.True(t, db.IsGistCollaborator(gist1db.ID, collaboratordb.ID))
+
+	// the collaborators edit the files of the gist and push to it with their own credentials
+	login(t, s, collaborator)
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+	err = s.request("GET", gistPath+"/edit", nil, 200)
+	require.NoError(t, err)
+	require.NoError(t, clientGitClone("kaguya:kaguya", owner.Username, gist1db.Identifier()))
+	require.NoError(t, clientGitPush(gist1db.Identifier()))
+
+	// but they do not manage it
+	err = s.request("POST", gistPath+"/visibility", db.VisibilityDTO{Private: db.PublicVisibility}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", gistPath+"/delete", nil, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, db.PrivateVisibility, gist1db.Private)
+	err = s.request("DELETE", gistPath+"/collaborators/"+collaborator.Username, nil, 302)
+	require.NoError(t, err)
+	require.True(t, db.IsGistCollaborator(gist1db.ID, collaboratordb.ID))
+
+	login(t, s, owner)
+	err = s.request("DELETE", gistPath+"/collaborators/"+collaborator.Username, nil, 302)
+	require.NoError(t, err)
+	require.False(t, db.IsGistCollaborator(gist1db.ID, collaboratordb.ID))
+
+	login(t, s, collaborator)
+	err = s.request("GET", gistPath, nil, 404)
+	require.NoError(t, err)
+}
+
+func TestListingPreferences(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type listing struct {
+		Density string   `form:"density"`
+		Column  []string `form:"column"`
+		Reset   string   `form:"reset"`
+	}
+
+	err = s.request("PUT", "/settings/listing", listing{Density: "tiny"}, 400)
+	require.NoError(t, err)
+	err = s.request("PUT", "/settings/listing", listing{Density: "compact", Column: []string{"views"}}, 400)
+	require.NoError(t, err)
+
+	err = s.request("PUT", "/settings/listing", listing{Density: "compact", Column: []string{"language", "likes", "language"}}, 302)
+	require.NoError(t, err)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "compact", user1db.ListingDensity)
+	require.Equal(t, "language,likes", user1db.ListingColumns)
+
+	err = s.request("PUT", "/settings/listing", listing{}, 302)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "none", user1db.ListingColumns)
+
+	err = s.request("PUT", "/settings/listing", listing{Reset: "1"}, 302)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "", user1db.ListingDensity)
+	require.Equal(t, "", user1db.ListingColumns)
+
+	err = s.request("GET", "/all", nil, 200)
+	require.NoError(t, err)
+}
+
+func TestThemePreferences(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type theme struct {
+		Theme     string `form:"theme"`
+		Highlight string `form:"highlight"`
+		Menu      string `form:"menu"`
+	}
+
+	err = s.request("PUT", "/settings/theme", theme{Theme: "sepia"}, 400)
+	require.NoError(t, err)
+	err = s.request("PUT", "/settings/theme", theme{Theme: "dark", Highlight: "unknown"}, 400)
+	require.NoError(t, err)
+
+	err = s.request("PUT", "/settings/theme", theme{Theme: "dark", Highlight: "monokai"}, 302)
+	require.NoError(t, err)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "dark", user1db.PreferredTheme)
+	require.Equal(t, "monokai", user1db.HighlightTheme)
+
+	get := func(uri string) (int, string) {
+		resp := s.rawRequest("GET", uri, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/all")
+	require.Equal(t, 200, code)
+	require.Contains(t, body, `class="h-full highlight-theme"`)
+	require.Contains(t, body, "/highlight.css?theme=monokai")
+	require.Contains(t, body, `window.opengist_theme = "dark"`)
+
+	code, body = get("/highlight.css?theme=monokai")
+	require.Equal(t, 200, code)
+	require.Contains(t, body, "html.highlight-theme .chroma:not(.markdown) {")
+	require.Contains(t, body, "html.highlight-theme .chroma .k {")
+	code, _ = get("/highlight.css?theme=unknown")
+	require.Equal(t, 404, code)
+
+	// the theme menu keeps the highlight theme
+	err = s.request("PUT", "/settings/theme", theme{Theme: "auto", Highlight: "monokai", Menu: "1"}, 204)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Equal(t, "", user1db.PreferredTheme)
+	require.Equal(t, "monokai", user1db.HighlightTheme)
+
+	s.sessionCookie = ""
+	code, body = get("/all")
+	require.Equal(t, 200, code)
+	require.NotContains(t, body, "highlight.css")
+}
+
+func TestConditionalRequests(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist.Private = db.PrivateVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	get := func(uri string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:6157"+uri, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: s.sessionCookie})
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w
+	}
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	hash, _, err := gist1db.Commit("HEAD")
+	require.NoError(t, err)
+	gist1Url := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	for _, uri := range []string{gist1Url + "/raw/HEAD/gist.txt", gist1Url + "/archive/HEAD"} {
+		w := get(uri, "", "")
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, `"`+hash+`"`, w.Header().Get("ETag"))
+		// the pages seen by a logged-in user are not shared
+		require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+		lastModified := w.Header().Get("Last-Modified")
+		require.NotEmpty(t, lastModified)
+
+		w = get(uri, "If-None-Match", `"`+hash+`"`)
+		require.Equal(t, 304, w.Code)
+		require.Empty(t, w.Body.String())
+
+		w = get(uri, "If-None-Match", `"other"`)
+		require.Equal(t, 200, w.Code)
+
+		w = get(uri, "If-Modified-Since", lastModified)
+		require.Equal(t, 304, w.Code)
+	}
+
+	w := get(gist1Url, "", "")
+	require.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	w = get(gist1Url, "If-None-Match", etag)
+	require.Equal(t, 304, w.Code)
+
+	// the page changes once the gist is liked, pinned or its visibility changed
+	err = s.request("POST", gist1Url+"/like", nil, 302)
+	require.NoError(t, err)
+	w = get(gist1Url, "If-None-Match", etag)
+	require.Equal(t, 200, w.Code)
+	etag = w.Header().Get("ETag")
+
+	err = s.request("POST", gist1Url+"/pin", nil, 302)
+	require.NoError(t, err)
+	w = get(gist1Url, "If-None-Match", etag)
+	require.Equal(t, 200, w.Code)
+	etag = w.Header().Get("ETag")
+
+	err = s.request("POST", gist1Url+"/visibility", db.VisibilityDTO{Private: db.UnlistedVisibility}, 302)
+	require.NoError(t, err)
+	w = get(gist1Url, "If-None-Match", etag)
+	require.Equal(t, 200, w.Code)
+
+	// the anonymous visitors can share theirs
+	ownerCookie := s.sessionCookie
+	s.sessionCookie = ""
+	w = get(gist1Url+"/raw/HEAD/gist.txt", "", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "public, no-cache", w.Header().Get("Cache-Control"))
+	s.sessionCookie = ownerCookie
+
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	w = get("/"+user1.Username+"/"+gist2db.Identifier()+"/raw/HEAD/gist.txt", "", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+}
+
+func TestDefaultFilename(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist1 := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: 0,
+		},
+		Name:    []string{"", "gistfile1.txt", ""},
+		Content: []string{"yeah", "yeah\ncool", "// filename: main.go\npackage main"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+
+	gist1files, err := git.GetFilesOfRepository(gist1db.User.Username, gist1db.Uuid, "HEAD")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"gistfile1.txt", "gistfile2.txt", "main.go"}, gist1files)
+}
+
+func TestFileOrder(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist1 := db.GistDTO{
+		Title: "gist1",
+		VisibilityDTO: db.VisibilityDTO{
+			Private: 0,
+		},
+		Name:    []string{"c.txt", "a.txt", "b.txt"},
+		Content: []string{"c", "a", "b"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"c.txt", "a.txt", "b.txt"}, gist1db.FileOrder)
+	require.Equal(t, "c.txt", gist1db.PreviewFilename)
+
+	files, err := gist1db.Files("HEAD", false)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	require.Equal(t, "c.txt", files[0].Filename)
+	require.Equal(t, "a.txt", files[1].Filename)
+	require.Equal(t, "b.txt", files[2].Filename)
+
+	// a file missing from the saved order comes last
+	gist1db.FileOrder = []string{"b.txt"}
+	files, err = gist1db.Files("HEAD", false)
+	require.NoError(t, err)
+	require.Equal(t, "b.txt", files[0].Filename)
+	require.Equal(t, "a.txt", files[1].Filename)
+	require.Equal(t, "c.txt", files[2].Filename)
+}
+
+func TestFetchUrl(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("echo hello"))
+	}))
+	defer remote.Close()
+
+	config.C.GistCreateFromUrl = true
+	defer func() { config.C.GistCreateFromUrl = false }()
+
+	err = s.request("GET", "/fetch-url?url="+url.QueryEscape(remote.URL+"/hello.sh"), nil, 302)
+	require.NoError(t, err)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	err = s.request("GET", "/fetch-url?url="+url.QueryEscape("ftp://example.com/hello.sh"), nil, 400)
+	require.NoError(t, err)
+
+	// loopback addresses cannot be reached with a user given URL
+	err = s.request("GET", "/fetch-url?url="+url.QueryEscape(remote.URL+"/hello.sh"), nil, 400)
+	require.NoError(t, err)
+
+	config.C.GistCreateFromUrl = false
+	err = s.request("GET", "/fetch-url?url="+url.QueryEscape(remote.URL+"/hello.sh"), nil, 404)
+	require.NoError(t, err)
+}
+
+func TestErrorPages(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	get := func(uri string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:6157"+uri, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: s.sessionCookie})
+		req.Header.Set("Accept", accept)
+
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/thomas/unknown", "text/html,application/xhtml+xml,*/*;q=0.8")
+	require.Equal(t, 404, w.Code)
+	requestId := w.Header().Get("X-Request-Id")
+	require.NotEmpty(t, requestId)
+	require.Contains(t, w.Body.String(), "Request ID: "+requestId)
+	require.Contains(t, w.Body.String(), "Not found")
+
+	w = get("/thomas/unknown", "application/json")
+	require.Equal(t, 404, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), "application/json")
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, float64(404), body["code"])
+	require.Equal(t, w.Header().Get("X-Request-Id"), body["request_id"])
+	require.NotEmpty(t, body["error"])
+}
+
+func TestPreviewAsVisitor(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist.Private = db.PrivateVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:6157"+uri, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: s.sessionCookie})
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w
+	}
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gist1Url := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	w := get(gist1Url)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), gist1Url+"/edit")
+
+	// owner controls are hidden
+	w = get(gist1Url + "?preview=visitor")
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "Exit preview")
+	require.NotContains(t, w.Body.String(), gist1Url+"/edit")
+
+	// visitors cannot see a private gist
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	w = get("/" + user1.Username + "/" + gist2db.Identifier() + "?preview=visitor")
+	require.Equal(t, 404, w.Code)
+
+	// only the owner can use the preview
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	w = get(gist1Url + "?preview=visitor")
+	require.Equal(t, 200, w.Code)
+	require.NotContains(t, w.Body.String(), "Exit preview")
+}
+
+func TestEmbedTheme(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	jsUrl := "/" + user1.Username + "/" + gist1db.Identifier() + ".js"
+
+	get := func(uri string) string {
+		req := httptest.NewRequest("GET", "http://localhost:6157"+uri, nil)
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		return w.Body.String()
+	}
+
+	// the embedding page picks the theme by default
+	js := get(jsUrl)
+	require.Contains(t, js, "prefers-color-scheme: dark")
+
+	js = get(jsUrl + "?dark")
+	require.NotContains(t, js, "prefers-color-scheme")
+	require.Contains(t, js, `class="html dark"`)
+
+	js = get(jsUrl + "?light")
+	require.NotContains(t, js, "prefers-color-scheme")
+	require.NotContains(t, js, `class="html dark"`)
+
+	config.C.EmbedTheme = "dark"
+	defer func() { config.C.EmbedTheme = "auto" }()
+	js = get(jsUrl)
+	require.NotContains(t, js, "prefers-color-scheme")
+	require.Contains(t, js, `class="html dark"`)
+}
+
+func TestEmbedGist(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "embedded-gist",
+		Name:    []string{"first.txt", "second.txt"},
+		Content: []string{"first content", "second content"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	get := func(uri string, expectedCode int) string {
+		resp := s.rawRequest("GET", uri)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, expectedCode, resp.StatusCode)
+		return string(body)
+	}
+
+	js := get(gistPath+".js", 200)
+	require.Contains(t, js, "first content")
+	require.Contains(t, js, "second content")
+	require.Contains(t, js, `>embedded-gist</a>`)
+	require.Contains(t, js, `href="http://localhost:6157`+gistPath+`"`)
+
+	js = get(gistPath+".js?file=second.txt", 200)
+	require.NotContains(t, js, "first content")
+	require.Contains(t, js, "second content")
+
+	get(gistPath+".js?file=third.txt", 404)
+
+	// only public gists can be embedded
+	err = s.request("POST", gistPath+"/visibility", db.VisibilityDTO{Private: db.UnlistedVisibility}, 302)
+	require.NoError(t, err)
+	get(gistPath+".js", 404)
+
+	page := get(gistPath, 200)
+	require.NotContains(t, page, "gist-menu-share")
+}
+
+func TestAdminGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	admin := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, admin)
+
+	gist := db.GistDTO{
+		Title:   "public-gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist.Title = "unlisted-gist"
+	gist.Name = []string{"gist.go"}
+	gist.Content = []string{"package main\n\nfunc main() {}\n"}
+	gist.Private = db.UnlistedVisibility
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("GET", "/admin-panel/gists", nil, 404)
+	require.NoError(t, err)
+
+	login(t, s, admin)
+
+	list := func(query string) string {
+		resp := s.rawRequest("GET", "/admin-panel/gists"+query, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	body := list("")
+	require.Contains(t, body, "public-gist")
+	require.Contains(t, body, "unlisted-gist")
+
+	body = list("?visibility=unlisted")
+	require.NotContains(t, body, "public-gist")
+	require.Contains(t, body, "unlisted-gist")
+
+	body = list("?language=go")
+	require.NotContains(t, body, "public-gist")
+	require.Contains(t, body, "unlisted-gist")
+
+	body = list("?owner=kaguya")
+	require.NotContains(t, body, "public-gist")
+	require.NotContains(t, body, "unlisted-gist")
+
+	body = list("?min-size=10B")
+	require.NotContains(t, body, "public-gist")
+	require.Contains(t, body, "unlisted-gist")
+
+	err = s.request("GET", "/admin-panel/gists?min-size=abc", nil, 400)
+	require.NoError(t, err)
+
+	err = s.request("POST", "/admin-panel/gists/1/hide", nil, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, db.PrivateVisibility, gist1db.Private)
+
+	transfer := struct {
+		Username string `form:"username"`
+	}{}
+
+	transfer.Username = "unknown"
+	err = s.request("POST", "/admin-panel/gists/1/transfer", transfer, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, admin.Username, gist1db.User.Username)
+
+	// the gist keeps its owner if its repository cannot be moved
+	blocking := git.RepositoryPath(user2.Username, gist1db.Uuid)
+	require.NoError(t, os.MkdirAll(blocking, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(blocking, "file"), []byte("file"), 0644))
+	transfer.Username = user2.Username
+	err = s.request("POST", "/admin-panel/gists/1/transfer", transfer, 500)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, admin.Username, gist1db.User.Username)
+	require.DirExists(t, git.RepositoryPath(admin.Username, gist1db.Uuid))
+	require.NoError(t, os.RemoveAll(blocking))
+
+	err = s.request("POST", "/admin-panel/gists/1/transfer", transfer, 302)
+	require.NoError(t, err)
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, user2.Username, gist1db.User.Username)
+	require.DirExists(t, git.RepositoryPath(user2.Username, gist1db.Uuid))
+	require.NoDirExists(t, git.RepositoryPath(admin.Username, gist1db.Uuid))
+
+	body = list("?owner=kaguya")
+	require.Contains(t, body, "public-gist")
+}
+
+func TestApi(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type tokenForm struct {
+		Name   string `form:"name"`
+		Scopes string `form:"scopes"`
+	}
+	err = s.request("POST", "/settings/api-tokens", tokenForm{Name: "script", Scopes: "write"}, 302)
+	require.NoError(t, err)
+	err = s.request("GET", "/settings/api-tokens", nil, 200)
+	require.NoError(t, err)
+
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	tokens, err := db.GetApiTokensOfUser(user1db.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, "script", tokens[0].Name)
+	require.Equal(t, []string{"write"}, tokens[0].ScopesList())
+
+	_, readWrite, err := db.CreateApiToken(user1db.ID, "all", []string{db.ApiTokenScopeRead, db.ApiTokenScopeWrite})
+	require.NoError(t, err)
+	_, readOnly, err := db.CreateApiToken(user1db.ID, "read", []string{db.ApiTokenScopeRead})
+	require.NoError(t, err)
+
+	api := func(method, uri, token string, body interface{}, expectedCode int) map[string]interface{} {
+		var reader io.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, "http://localhost:6157/api/v1"+uri, reader)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		require.Equal(t, expectedCode, w.Code, w.Body.String())
+
+		res := make(map[string]interface{})
+		if strings.HasPrefix(w.Body.String(), "{") {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		}
+		return res
+	}
+
+	newGist := map[string]interface{}{
+		"title":      "api gist",
+		"visibility": "private",
+		"tags":       []string{"Go"},
+		"files":      []map[string]string{{"filename": "main.go", "content": "package main"}},
+	}
+
+	api("POST", "/gists", "", newGist, 401)
+	api("POST", "/gists", "og_abc_def", newGist, 401)
+	api("POST", "/gists", readOnly, newGist, 403)
+
+	// the secret of the token is checked, not only its lookup, against a SHA-256 hash
+	require.Regexp(t, `^[0-9a-f]{64}$`, tokens[0].Hash)
+	api("POST", "/gists", readWrite+"0", newGist, 401)
+
+	res := api("POST", "/gists", readWrite, newGist, 201)
+	require.Equal(t, "api gist", res["title"])
+	require.Equal(t, "private", res["visibility"])
+	require.Equal(t, []interface{}{"go"}, res["tags"])
+	gistUri := "/gists/thomas/" + res["id"].(string)
+
+	res = api("GET", gistUri, readOnly, nil, 200)
+	require.Equal(t, "package main", res["files"].([]interface{})[0].(map[string]interface{})["content"])
+
+	// the cookie session of the user is not enough to use the API
+	resp := s.rawRequest("GET", "/api/v1"+gistUri)
+	require.Equal(t, 401, resp.StatusCode)
+	require.Equal(t, "application/json", strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+
+	res = api("PATCH", gistUri, readWrite, map[string]interface{}{"description": "updated"}, 200)
+	require.Equal(t, "updated", res["description"])
+	require.Equal(t, "api gist", res["title"])
+	require.Len(t, res["files"], 1)
+
+	api("PATCH", gistUri, readWrite, map[string]interface{}{"files": []interface{}{}}, 400)
+
+	// another user cannot see the private gist nor edit it once public
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	user2db, err := db.GetUserByUsername(user2.Username)
+	require.NoError(t, err)
+	_, other, err := db.CreateApiToken(user2db.ID, "all", db.ApiTokenScopes)
+	require.NoError(t, err)
+
+	api("GET", gistUri, other, nil, 404)
+	list := api("GET", "/users/thomas/gists", other, nil, 200)
+	require.Empty(t, list)
+
+	api("PATCH", gistUri, readWrite, map[string]interface{}{"visibility": "public"}, 200)
+	api("GET", gistUri, other, nil, 200)
+	api("PATCH", gistUri, other, map[string]interface{}{"title": "stolen"}, 403)
+	api("DELETE", gistUri, other, nil, 403)
+
+	req := httptest.NewRequest("GET", "http://localhost:6157/api/v1/users/thomas/gists", nil)
+	req.Header.Set("Authorization", "Bearer "+other)
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var gists []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &gists))
+	require.Len(t, gists, 1)
+	require.Equal(t, "api gist", gists[0]["title"])
+
+	api("DELETE", gistUri, readWrite, nil, 204)
+	api("GET", gistUri, readWrite, nil, 404)
+
+	// the tokens can only be deleted by their owner
+	err = s.request("DELETE", "/settings/api-tokens/"+strconv.Itoa(int(tokens[0].ID)), nil, 302)
+	require.NoError(t, err)
+	tokens, err = db.GetApiTokensOfUser(user1db.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 3)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	err = s.request("DELETE", "/settings/api-tokens/"+strconv.Itoa(int(tokens[0].ID)), nil, 302)
+	require.NoError(t, err)
+	tokens, err = db.GetApiTokensOfUser(user1db.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+}
+
+func TestApiRateLimit(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.ApiRateLimit = 3
+	config.C.ApiTokenRateLimit = 2
+	defer func() { config.C.ApiRateLimit, config.C.ApiTokenRateLimit = 1000, 0 }()
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+
+	token1, value1, err := db.CreateApiToken(user1db.ID, "first", []string{db.ApiTokenScopeRead})
+	require.NoError(t, err)
+	_, value2, err := db.CreateApiToken(user1db.ID, "second", []string{db.ApiTokenScopeRead})
+	require.NoError(t, err)
+
+	api := func(token string, expectedCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:6157/api/v1/users/thomas/gists", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		require.Equal(t, expectedCode, w.Code, w.Body.String())
+		return w
+	}
+
+	w := api(value1, 200)
+	require.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	w = api(value1, 200)
+	require.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	// the limit of the token is reached before the one of the user
+	w = api(value1, 429)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+	api(value2, 200)
+
+	// then the one of the user, for all the tokens
+	w = api(value2, 429)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.True(t, retryAfter > 0 && retryAfter <= 3600)
+
+	token1, err = db.GetApiTokenByValue(value1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), token1.Requests)
+
+	resp := s.rawRequest("GET", "/settings/api-tokens", &http.Cookie{Name: "session", Value: s.sessionCookie})
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "made 3 of the 3 requests")
+	require.Contains(t, string(body), "3 requests in total, 2 in the last hour")
+
+	// the admins can lift the limit of a user, or set it back to the default
+	type limitForm struct {
+		Limit string `form:"limit"`
+	}
+	limitUri := "/admin-panel/users/" + strconv.Itoa(int(user1db.ID)) + "/api-rate-limit"
+
+	err = s.request("POST", limitUri, limitForm{Limit: "-1"}, 302)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.Nil(t, user1db.ApiRateLimit)
+
+	err = s.request("POST", limitUri, limitForm{Limit: "0"}, 302)
+	require.NoError(t, err)
+	user1db, err = db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	require.NotNil(t, user1db.ApiRateLimit)
+	require.Equal(t, 0, *user1db.ApiRateLimit)
+
+	w = api(value2, 200)
+	require.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	err = s.request("POST", limitUri, limitForm{Limit: ""}, 302)
+	require.NoError(t, err)
+	api(value2, 429)
+
+	// only the admins can change the limits
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("POST", limitUri, limitForm{Limit: "0"}, 404)
+	require.NoError(t, err)
+}
+
+func TestApiIpRateLimit(t *testing.T) {
+	setup(t)
+	config.C.ApiIpRateLimit = 3
+	defer func() { config.C.ApiIpRateLimit = 3000 }()
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	api := func(token string, ip string) int {
+		req := httptest.NewRequest("GET", "http://localhost:6157/api/v1/users/thomas/gists", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the guessed tokens are limited before being checked
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 401, api("og_0123456789abcdef_"+strconv.Itoa(i), "10.0.0.1"))
+	}
+	require.Equal(t, 429, api("og_0123456789abcdef_3", "10.0.0.1"))
+	require.Equal(t, 401, api("og_0123456789abcdef_3", "10.0.0.2"))
+}
+
+func TestApiCors(t *testing.T) {
+	setup(t)
+	config.C.CorsAllowedOrigins = "https://tools.example.com/, https://other.example.com"
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	_, token, err := db.CreateApiToken(user1db.ID, "tools", []string{db.ApiTokenScopeRead})
+	require.NoError(t, err)
+
+	request := func(method, uri, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:6157"+uri, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w
+	}
+
+	// the preflight requests are answered without a token
+	w := request(http.MethodOptions, "/api/v1/gists", "https://tools.example.com")
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "https://tools.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	require.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
+	require.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	w = request(http.MethodOptions, "/api/v1/gists", "https://evil.example.com")
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = request(http.MethodGet, "/api/v1/users/thomas/gists", "https://other.example.com")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "https://other.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "X-RateLimit-Remaining")
+
+	w = request(http.MethodGet, "/api/v1/users/thomas/gists", "https://evil.example.com")
+	require.Equal(t, 200, w.Code)
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// the web routes keep their policy, without credentials
+	w = request(http.MethodGet, "/all", "https://evil.example.com")
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestApiCorsAnyOrigin(t *testing.T) {
+	setup(t)
+	config.C.CorsAllowedOrigins = "*"
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	req := httptest.NewRequest(http.MethodOptions, "http://localhost:6157/api/v1/gists", nil)
+	req.Header.Set("Origin", "https://tools.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, req)
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestDefaultVisibility(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.DefaultGistVisibility = "unlisted"
+	defer func() { config.C.DefaultGistVisibility = "public" }()
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	// a gist submitted without choosing a visibility
+	type gistForm struct {
+		Title   string   `form:"title"`
+		Name    []string `form:"name"`
+		Content []string `form:"content"`
+	}
+	createGist := func(title string) *db.Gist {
+		err := s.request("POST", "/", gistForm{Title: title, Name: []string{"a.txt"}, Content: []string{"yeah"}}, 302)
+		require.NoError(t, err)
+		gists, err := db.GetAllGistsForAdmin(db.AdminGistFilter{Sort: "id", Order: "desc"}, 0)
+		require.NoError(t, err)
+		require.Equal(t, title, gists[0].Title)
+		return gists[0]
+	}
+
+	createPage := func() string {
+		resp := s.rawRequest("GET", "/", &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	require.Contains(t, createPage(), `name="private" value="1"`)
+	require.Equal(t, db.UnlistedVisibility, createGist("gist1").Private)
+
+	// the visibility chosen is kept
+	err = s.request("POST", "/", db.GistDTO{Title: "gist2", Name: []string{"a.txt"}, Content: []string{"yeah"}}, 302)
+	require.NoError(t, err)
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	require.Equal(t, db.PublicVisibility, gist2db.Private)
+
+	type visibilityForm struct {
+		Visibility string `form:"visibility"`
+	}
+	err = s.request("PUT", "/settings/default-visibility", visibilityForm{"private"}, 302)
+	require.NoError(t, err)
+	require.Contains(t, createPage(), `name="private" value="2"`)
+	require.Equal(t, db.PrivateVisibility, createGist("gist3").Private)
+
+	err = s.request("PUT", "/settings/default-visibility", visibilityForm{"secret"}, 400)
+	require.NoError(t, err)
+
+	user1db, err := db.GetUserByUsername(user1.Username)
+	require.NoError(t, err)
+	_, token, err := db.CreateApiToken(user1db.ID, "script", []string{db.ApiTokenScopeWrite})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "http://localhost:6157/api/v1/gists", strings.NewReader(`{"files":[{"filename":"a.txt","content":"yeah"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"visibility":"private"`)
+
+	// back to the instance default
+	err = s.request("PUT", "/settings/default-visibility", visibilityForm{""}, 302)
+	require.NoError(t, err)
+	require.Equal(t, db.UnlistedVisibility, createGist("gist5").Private)
+}
+
+func TestMarkdownFile(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	content := "# Title\n\n<script>alert(1)</script>\n\n[link](javascript:alert(1))\n\n```go\nfunc main() {}\n```\n"
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "gist1",
+		Name:    []string{"README.markdown", "notes.txt"},
+		Content: []string{content, "# not markdown"},
+	}, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+
+	resp := s.rawRequest("GET", "/thomas/"+gist1db.Identifier())
+	require.Equal(t, 200, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	page := string(body)
+
+	// rendered, with the code fence highlighted, and the source view kept aside
+	require.Contains(t, page, `<h1>Title</h1>`)
+	require.Contains(t, page, `<span class="kd">func</span>`)
+	require.Contains(t, page, `markdown-source hidden`)
+	require.Contains(t, page, `id="file-readme-markdown-1"`)
+	require.Equal(t, 1, strings.Count(page, `markdown-toggle`))
+
+	// the raw HTML and the dangerous links are not rendered
+	require.NotContains(t, page, "<script>alert(1)</script>")
+	require.NotContains(t, page, `href="javascript:`)
+}
+
+func TestCompareRevisions(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt", "old.txt"},
+		Content: []string{"first\nline", "removed"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	gist.Name = []string{"gist.txt", "new.txt"}
+	gist.Content = []string{"second\nline", "added"}
+	err = s.request("POST", gistPath+"/edit", gist, 302)
+	require.NoError(t, err)
+
+	commits, err := gist1db.Log(0)
+	require.NoError(t, err)
+	require.Len(t, commits, 2)
+	first, second := commits[1].Hash, commits[0].Hash
+
+	get := func(uri string) (*http.Response, string) {
+		resp := s.rawRequest("GET", gistPath+uri)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// the revisions are offered on the gist page
+	resp, body := get("")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, body, `<option value="`+first+`" selected>`)
+
+	files, err := gist1db.Diff(first, second)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	resp, body = get("/compare/" + first + ".." + second)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, body, "new.txt")
+	require.Contains(t, body, "old.txt")
+	require.Contains(t, body, "first")
+	require.Contains(t, body, "second")
+
+	resp, body = get("/compare/" + first[:7] + ".." + second + "?view=split")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, body, `<td class="overflow-hidden red-diff">first</td>`)
+	require.Contains(t, body, `<td class="overflow-hidden green-diff">second</td>`)
+
+	resp, body = get("/compare/" + second + ".." + second)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, body, "No changes between these revisions")
+
+	resp, _ = get("/compare?from=" + first + "&to=HEAD")
+	require.Equal(t, 302, resp.StatusCode)
+	require.Equal(t, gistPath+"/compare/"+first+"..HEAD", resp.Header.Get("Location"))
+
+	for _, revisions := range []string{second, first + "..", first + "..HEAD..HEAD", "--output=x..HEAD", first + "..0123456789abcdef"} {
+		resp, _ = get("/compare/" + revisions)
+		require.Equal(t, 404, resp.StatusCode, revisions)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		URL:     "my-gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"hello"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+
+	err = s.request("POST", gistPath+"/fork", nil, 302)
+	require.NoError(t, err)
+
+	fork, err := db.GetGistByID("2")
+	require.NoError(t, err)
+	forkPath := "/" + user2.Username + "/" + fork.Identifier()
+
+	err = s.request("POST", forkPath+"/delete", nil, 302)
+	require.NoError(t, err)
+
+	err = s.request("GET", forkPath, nil, 404)
+	require.NoError(t, err)
+
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, 0, gist1db.NbForks)
+
+	// the repository is kept, and the trash of another user cannot be touched
+	_, err = git.GetFilesOfRepository(user2.Username, fork.Uuid, "HEAD")
+	require.NoError(t, err)
+
+	login(t, s, user1)
+
+	err = s.request("POST", "/settings/trash/2/restore", nil, 404)
+	require.NoError(t, err)
+
+	err = s.request("POST", gistPath+"/delete", nil, 302)
+	require.NoError(t, err)
+
+	err = s.request("GET", gistPath, nil, 404)
+	require.NoError(t, err)
+
+	resp := s.rawRequest("GET", "/settings/trash", &http.Cookie{Name: "session", Value: s.sessionCookie})
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, string(body), user1.Username+"/my-gist")
+
+	err = s.request("POST", "/settings/trash/1/restore", nil, 302)
+	require.NoError(t, err)
+
+	err = s.request("GET", gistPath, nil, 200)
+	require.NoError(t, err)
+
+	login(t, s, user2)
+
+	err = s.request("POST", "/settings/trash/2/restore", nil, 302)
+	require.NoError(t, err)
+
+	gist1db, err = db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, 1, gist1db.NbForks)
+
+	err = s.request("POST", forkPath+"/delete", nil, 302)
+	require.NoError(t, err)
+
+	err = s.request("DELETE", "/settings/trash/2", nil, 302)
+	require.NoError(t, err)
+
+	_, err = db.GetTrashedGistOfUser(2, 2)
+	require.Error(t, err)
+	_, err = git.GetFilesOfRepository(user2.Username, fork.Uuid, "HEAD")
+	require.Error(t, err)
+
+	// without a trash, the gists are deleted right away
+	config.C.TrashRetentionDays = 0
+	defer func() { config.C.TrashRetentionDays = 30 }()
+
+	login(t, s, user1)
+
+	err = s.request("POST", gistPath+"/delete", nil, 302)
+	require.NoError(t, err)
+
+	trashed, err := db.GetTrashedGistsOfUser(1)
+	require.NoError(t, err)
+	require.Empty(t, trashed)
+	_, err = git.GetFilesOfRepository(user1.Username, gist1db.Uuid, "HEAD")
+	require.Error(t, err)
+}
+
+func TestWebhooks(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	retryDelays := webhook.RetryDelays
+	webhook.RetryDelays = []time.Duration{10 * time.Millisecond}
+	defer func() { webhook.RetryDelays = retryDelays }()
+
+	type received struct {
+		event     string
+		signature string
+		body      []byte
+	}
+	requests := make(chan received, 10)
+	failures := 0
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.Header.Get("X-Opengist-Event"), r.Header.Get(webhook.SignatureHeader), body}
+		if r.URL.Path == "/flaky" && failures == 0 {
+			failures++
+			w.WriteHeader(503)
+		}
+	}))
+	defer remote.Close()
+
+	next := func() received {
+		select {
+		case r := <-requests:
+			return r
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "webhook not called")
+		}
+		return received{}
+	}
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type webhookForm struct {
+		URL    string `form:"url"`
+		Secret string `form:"secret"`
+		Events string `form:"events"`
+	}
+	err = s.request("POST", "/settings/webhooks", webhookForm{URL: "ftp://example.com", Secret: "s", Events: "gist.created"}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/settings/webhooks", webhookForm{URL: remote.URL, Secret: "s", Events: "unknown"}, 302)
+	require.NoError(t, err)
+	webhooks, err := db.GetWebhooksOfUser(1)
+	require.NoError(t, err)
+	require.Empty(t, webhooks)
+
+	err = s.request("POST", "/settings/webhooks", webhookForm{URL: remote.URL, Secret: "secret", Events: "gist.created"}, 302)
+	require.NoError(t, err)
+	webhooks, err = db.GetWebhooksOfUser(1)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+	require.Equal(t, []string{db.WebhookEventGistCreated}, webhooks[0].EventsList())
+
+	// the webhooks cannot reach the local network by default
+	webhookUri := "/settings/webhooks/" + strconv.Itoa(int(webhooks[0].ID))
+	err = s.request("POST", webhookUri+"/test", nil, 302)
+	require.NoError(t, err)
+	deliveries, err := webhooks[0].GetDeliveries()
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.False(t, deliveries[0].Succeeded())
+	require.Equal(t, 0, deliveries[0].StatusCode)
+
+	config.C.WebhooksAllowPrivateNetwork = true
+	defer func() { config.C.WebhooksAllowPrivateNetwork = false }()
+
+	err = s.request("POST", webhookUri+"/test", nil, 302)
+	require.NoError(t, err)
+	ping := next()
+	require.Equal(t, db.WebhookEventPing, ping.event)
+	require.Equal(t, webhook.Sign("secret", ping.body), ping.signature)
+
+	gist := db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"hello"},
+	}
+	err = s.request("POST", "/", gist, 302)
+	require.NoError(t, err)
+
+	created := next()
+	require.Equal(t, db.WebhookEventGistCreated, created.event)
+	require.Equal(t, webhook.Sign("secret", created.body), created.signature)
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(created.body, &payload))
+	require.Equal(t, "gist.created", payload["event"])
+	require.Equal(t, "gist", payload["gist"].(map[string]interface{})["title"])
+
+	// the events the webhook is not subscribed to are not sent
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	err = s.request("POST", "/"+user1.Username+"/"+gist1db.Identifier()+"/edit", gist, 302)
+	require.NoError(t, err)
+
+	// the failed deliveries are retried
+	flaky, err := db.CreateWebhook(1, remote.URL+"/flaky", "other", []string{db.WebhookEventGistDeleted})
+	require.NoError(t, err)
+
+	err = s.request("POST", "/"+user1.Username+"/"+gist1db.Identifier()+"/delete", nil, 302)
+	require.NoError(t, err)
+	require.Equal(t, db.WebhookEventGistDeleted, next().event)
+	retried := next()
+	require.Equal(t, db.WebhookEventGistDeleted, retried.event)
+	require.Equal(t, webhook.Sign("other", retried.body), retried.signature)
+
+	require.Eventually(t, func() bool {
+		deliveries, err = flaky.GetDeliveries()
+		return err == nil && len(deliveries) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, deliveries[0].Attempt)
+	require.True(t, deliveries[0].Succeeded())
+	require.Equal(t, 503, deliveries[1].StatusCode)
+	require.Equal(t, deliveries[0].UUID, deliveries[1].UUID)
+
+	resp := s.rawRequest("GET", "/settings/webhooks", &http.Cookie{Name: "session", Value: s.sessionCookie})
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, string(body), remote.URL+"/flaky")
+
+	// the webhooks can only be deleted by their owner
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("DELETE", webhookUri, nil, 302)
+	require.NoError(t, err)
+	err = s.request("POST", webhookUri+"/test", nil, 404)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	err = s.request("DELETE", webhookUri, nil, 302)
+	require.NoError(t, err)
+	webhooks, err = db.GetWebhooksOfUser(1)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+}
+
+func TestLanguageStats(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "go",
+		Name:          []string{"main.go", "notes.txt"},
+		Content:       []string{"package main\n\nfunc main() {}\n", "notes"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+	}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "python",
+		Name:          []string{"script.py"},
+		Content:       []string{"print('hello')\n"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}, 302)
+	require.NoError(t, err)
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+
+	profile := func(cookies ...*http.Cookie) string {
+		resp := s.rawRequest("GET", "/thomas", cookies...)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	owner := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	body := profile(owner)
+	require.Contains(t, body, `data-language="Go"`)
+	require.Contains(t, body, `data-language="Text"`)
+	require.Contains(t, body, `data-language="Python"`)
+
+	// the private gist does not count for the other users
+	body = profile()
+	require.Contains(t, body, `data-language="Go"`)
+	require.NotContains(t, body, `data-language="Python"`)
+
+	// the stats are computed again once the gist is public
+	err = s.request("POST", "/thomas/"+gist2db.Uuid+"/visibility", db.VisibilityDTO{Private: db.PublicVisibility}, 302)
+	require.NoError(t, err)
+	body = profile()
+	require.Contains(t, body, `data-language="Python"`)
+
+	err = s.request("POST", "/thomas/"+gist2db.Uuid+"/delete", nil, 302)
+	require.NoError(t, err)
+	body = profile()
+	require.NotContains(t, body, `data-language="Python"`)
+}
+
+func TestCommandPaletteGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	for _, visibility := range []db.Visibility{db.PublicVisibility, db.PrivateVisibility} {
+		err = s.request("POST", "/", db.GistDTO{
+			Title:         "gist-" + visibility.String(),
+			Name:          []string{"file.txt"},
+			Content:       []string{"hello"},
+			VisibilityDTO: db.VisibilityDTO{Private: visibility},
+		}, 302)
+		require.NoError(t, err)
+	}
+
+	s.sessionCookie = ""
+	user2 := db.UserDTO{Username: "kaguya", Password: "kaguya"}
+	register(t, s, user2)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "kaguya-gist",
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}, 302)
+	require.NoError(t, err)
+	gist3db, err := db.GetGistByID("3")
+	require.NoError(t, err)
+
+	type paletteResponse struct {
+		Gists []struct {
+			ID         string `json:"id"`
+			Owner      string `json:"owner"`
+			Title      string `json:"title"`
+			Visibility string `json:"visibility"`
+			URL        string `json:"url"`
+		} `json:"gists"`
+		Page    int  `json:"page"`
+		HasMore bool `json:"hasMore"`
+	}
+	getGists := func(uri string) paletteResponse {
+		resp := s.rawRequest("GET", uri, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, 200, resp.StatusCode)
+		var palette paletteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&palette))
+		return palette
+	}
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	palette := getGists("/palette/gists")
+	require.Len(t, palette.Gists, 2)
+	require.False(t, palette.HasMore)
+	for _, gist := range palette.Gists {
+		require.Equal(t, "thomas", gist.Owner)
+		require.Equal(t, "/thomas/"+gist.ID, gist.URL)
+	}
+
+	palette = getGists("/palette/gists?page=2")
+	require.Empty(t, palette.Gists)
+	require.Equal(t, 2, palette.Page)
+
+	// the gists the user collaborates on are listed too
+	s.sessionCookie = ""
+	login(t, s, user2)
+	err = s.request("POST", "/kaguya/"+gist3db.Uuid+"/collaborators", struct {
+		Username string `form:"username"`
+	}{"thomas"}, 302)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	palette = getGists("/palette/gists")
+	require.Len(t, palette.Gists, 3)
+	require.Equal(t, "kaguya-gist", palette.Gists[0].Title)
+	require.Equal(t, "private", palette.Gists[0].Visibility)
+
+	s.sessionCookie = ""
+	err = s.request("GET", "/palette/gists", nil, 302)
+	require.NoError(t, err)
+}
+
+func TestSearchOwnGists(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	gists := []db.GistDTO{
+		{Title: "private-gist", Name: []string{"notes.txt", "secret.txt"}, Content: []string{"nothing", "line\nthe hidden Needle"}, VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility}},
+		{Title: "needle-in-title", Name: []string{"file.txt"}, Content: []string{"hello"}, VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility}},
+		{Title: "unrelated-gist", Name: []string{"file.txt"}, Content: []string{"hello"}, VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility}},
+	}
+	for _, gist := range gists {
+		err = s.request("POST", "/", gist, 302)
+		require.NoError(t, err)
+	}
+
+	s.sessionCookie = ""
+	register(t, s, db.UserDTO{Username: "kaguya", Password: "kaguya"})
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "kaguya-gist",
+		Name:          []string{"file.txt"},
+		Content:       []string{"needle"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+	}, 302)
+	require.NoError(t, err)
+
+	s.sessionCookie = ""
+	login(t, s, user1)
+	search := func(uri string, code int) string {
+		resp := s.rawRequest("GET", uri, &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, code, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	body := search("/settings/search?q=NEEDLE", 200)
+	require.Contains(t, body, "private-gist")
+	require.Contains(t, body, "secret.txt:2")
+	require.Contains(t, body, "the hidden Needle")
+	require.Contains(t, body, "needle-in-title")
+	require.NotContains(t, body, "unrelated-gist")
+	require.NotContains(t, body, "kaguya-gist")
+
+	search("/settings/search?q=needle&page=2", 404)
+
+	s.sessionCookie = ""
+	err = s.request("GET", "/settings/search?q=needle", nil, 302)
+	require.NoError(t, err)
+}
+
+func TestOpenInEditor(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "public",
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PublicVisibility},
+	}, 302)
+	require.NoError(t, err)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:         "private",
+		Name:          []string{"file.txt"},
+		Content:       []string{"hello"},
+		VisibilityDTO: db.VisibilityDTO{Private: db.PrivateVisibility},
+	}, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gist2db, err := db.GetGistByID("2")
+	require.NoError(t, err)
+
+	page := func(path string, cookies ...*http.Cookie) string {
+		resp := s.rawRequest("GET", path, cookies...)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	owner := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	cloneUrl := "http://localhost:6157/thomas/" + gist1db.Uuid + ".git"
+	body := page("/thomas/" + gist1db.Uuid)
+	require.Contains(t, body, `href="vscode://vscode.git/clone?url=`+url.QueryEscape(cloneUrl)+`"`)
+	require.Contains(t, body, `href="https://gitpod.io/#`+cloneUrl+`"`)
+
+	// a private gist needs credentials that Gitpod does not have
+	body = page("/thomas/"+gist2db.Uuid, owner)
+	require.Contains(t, body, `id="gist-open-vscode"`)
+	require.NotContains(t, body, `id="gist-open-gitpod"`)
+
+	// without any clone URL, nothing can be opened
+	config.C.HttpGit = false
+	config.C.SshGit = false
+	body = page("/thomas/" + gist1db.Uuid)
+	require.NotContains(t, body, `id="gist-open-vscode"`)
+	require.NotContains(t, body, `id="gist-open-gitpod"`)
+}
+
+func TestGistRenameFiles(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	type gistEdit struct {
+		db.GistDTO
+		OriginalName []string `form:"original-name"`
+	}
+
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"a.txt", "b.txt"},
+		Content: []string{"one\ntwo\nthree\n", "b\n"},
+	}, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+	repositoryPath := git.RepositoryPath(user1.Username, gist1db.Uuid)
+
+	gitLog := func(args ...string) []string {
+		out, err := exec.Command("git", append([]string{"-C", repositoryPath, "log", "--format=%H"}, args...)...).Output()
+		require.NoError(t, err)
+		return strings.Fields(string(out))
+	}
+	files := func() map[string]string {
+		files, err := gist1db.Files("HEAD", false)
+		require.NoError(t, err)
+		contents := make(map[string]string)
+		for _, file := range files {
+			contents[file.Filename] = file.Content
+		}
+		return contents
+	}
+
+	// the history of a renamed file is followed even if its whole content changed
+	err = s.request("POST", gistPath+"/edit", gistEdit{
+		GistDTO: db.GistDTO{
+			Title:   "gist",
+			Name:    []string{"c.txt", "b.txt"},
+			Content: []string{"something else entirely\n", "b\n"},
+		},
+		OriginalName: []string{"a.txt", "b.txt"},
+	}, 302)
+	require.NoError(t, err)
+	require.Len(t, gitLog(), 3)
+	require.Len(t, gitLog("--follow", "--", "c.txt"), 3)
+	require.Equal(t, map[string]string{"c.txt": "something else entirely\n", "b.txt": "b\n"}, files())
+
+	// files can swap their names, in a single commit when nothing else changed
+	err = s.request("POST", gistPath+"/edit", gistEdit{
+		GistDTO: db.GistDTO{
+			Title:   "gist",
+			Name:    []string{"b.txt", "c.txt"},
+			Content: []string{"something else entirely\n", "b\n"},
+		},
+		OriginalName: []string{"c.txt", "b.txt"},
+	}, 302)
+	require.NoError(t, err)
+	require.Len(t, gitLog(), 4)
+	require.Equal(t, map[string]string{"b.txt": "something else entirely\n", "c.txt": "b\n"}, files())
+
+	// a file cannot be renamed like another one
+	err = s.request("POST", gistPath+"/edit", gistEdit{
+		GistDTO: db.GistDTO{
+			Title:   "gist",
+			Name:    []string{"c.txt", "c.txt"},
+			Content: []string{"something else entirely\n", "b\n"},
+		},
+		OriginalName: []string{"b.txt", "c.txt"},
+	}, 200)
+	require.NoError(t, err)
+	require.Len(t, gitLog(), 4)
+
+	// new files are not renamed ones
+	err = s.request("POST", gistPath+"/edit", gistEdit{
+		GistDTO: db.GistDTO{
+			Title:   "gist",
+			Name:    []string{"b.txt", "c.txt", "d.txt"},
+			Content: []string{"something else entirely\n", "b\n", "d\n"},
+		},
+		OriginalName: []string{"b.txt", "c.txt", ""},
+	}, 302)
+	require.NoError(t, err)
+	require.Len(t, gitLog(), 5)
+	require.Len(t, files(), 3)
+}
+
+func TestGistCloneUrls(t *testing.T) {
+	setup(t)
+	config.C.SshExternalDomain = "ssh.example.com"
+	config.C.SshExternalPort = "22"
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"gist.txt"},
+		Content: []string{"yeah"},
+	}, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+
+	page := func(cookies ...*http.Cookie) string {
+		resp := s.rawRequest("GET", gistPath, cookies...)
+		defer resp.Body.Close()
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	sessionCookie := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	body := page(sessionCookie)
+	require.Contains(t, body, `data-link="http://localhost:6157/thomas/`+gist1db.Identifier()+`.git"`)
+	require.Contains(t, body, `data-link="ssh.example.com:thomas/`+gist1db.Identifier()+`.git"`)
+	require.NotContains(t, body, "data-default")
+
+	// anonymous users cannot clone over SSH
+	body = page()
+	require.Contains(t, body, `id="gist-menu-http"`)
+	require.NotContains(t, body, `id="gist-menu-ssh"`)
+
+	err = s.request("PUT", "/settings/clone-protocol", struct {
+		Protocol string `form:"protocol"`
+	}{"ftp"}, 400)
+	require.NoError(t, err)
+	err = s.request("PUT", "/settings/clone-protocol", struct {
+		Protocol string `form:"protocol"`
+	}{"ssh"}, 302)
+	require.NoError(t, err)
+
+	body = page(sessionCookie)
+	require.Contains(t, body, `.git" data-default><p>Clone via SSH`)
+}
+
+func TestGistLfs(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.LfsEnabled = true
+	config.C.LfsThreshold = 1024
+	defer func() { config.C.LfsEnabled = false }()
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	large := strings.Repeat("0123456789abcdef\n", 100)
+	err = s.request("POST", "/", db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"large.txt", "small.txt"},
+		Content: []string{large, "small\n"},
+	}, 302)
+	require.NoError(t, err)
+
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	gistPath := "/" + user1.Username + "/" + gist1db.Identifier()
+	repositoryPath := git.RepositoryPath(user1.Username, gist1db.Uuid)
+
+	show := func(filename string) string {
+		out, err := exec.Command("git", "-C", repositoryPath, "show", "HEAD:"+filename).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// the large file is committed as a pointer to its object
+	pointer, ok := git.ParseLfsPointer(show("large.txt"))
+	require.True(t, ok)
+	require.Equal(t, int64(len(large)), pointer.Size)
+	require.True(t, git.LfsObjectExists(gist1db.Uuid, pointer.Oid))
+	require.Equal(t, "small\n", show("small.txt"))
+	require.Equal(t, "/large.txt filter=lfs diff=lfs merge=lfs -text\n", show(".gitattributes"))
+
+	// the gist and its raw files have the content of the object
+	file, err := gist1db.File("HEAD", "large.txt", false)
+	require.NoError(t, err)
+	require.Equal(t, large, file.Content)
+	require.Equal(t, uint64(len(large)), file.Size)
+
+	res := s.rawRequest("GET", gistPath+"/raw/HEAD/large.txt")
+	require.Equal(t, 200, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, large, string(body))
+
+	lfsRequest := func(method string, uri string, body string, username string, password string) *http.Response {
+		req := httptest.NewRequest(method, "http://localhost:6157"+uri, strings.NewReader(body))
+		req.Header.Set("User-Agent", "git-lfs/3.4.1")
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w.Result()
+	}
+	batch := func(operation string, oid string, size int, username string, password string) (int, map[string]any) {
+		res := lfsRequest("POST", gistPath+".git/info/lfs/objects/batch",
+			`{"operation":"`+operation+`","transfers":["basic"],"objects":[{"oid":"`+oid+`","size":`+strconv.Itoa(size)+`}]}`,
+			username, password)
+		if res.StatusCode != 200 {
+			return res.StatusCode, nil
+		}
+		var batch struct {
+			Objects []map[string]any `json:"objects"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&batch))
+		require.Len(t, batch.Objects, 1)
+		return res.StatusCode, batch.Objects[0]
+	}
+	href := func(object map[string]any, action string) string {
+		href := object["actions"].(map[string]any)[action].(map[string]any)["href"].(string)
+		return strings.TrimPrefix(href, "http://localhost:6157")
+	}
+
+	// the git-lfs client downloads the objects of a public gist without credentials
+	code, object := batch("download", pointer.Oid, len(large), "", "")
+	require.Equal(t, 200, code)
+	require.Equal(t, gistPath+"/info/lfs/objects/"+pointer.Oid, href(object, "download"))
+
+	res = lfsRequest("GET", href(object, "download"), "", "", "")
+	require.Equal(t, 200, res.StatusCode)
+	body, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, large, string(body))
+
+	missing := strings.Repeat("0", 64)
+	_, object = batch("download", missing, 1, "", "")
+	require.Equal(t, float64(404), object["error"].(map[string]any)["code"])
+
+	// uploading requires the credentials of the owner
+	uploaded := "uploaded with git-lfs\n"
+	uploadedPointer, err := git.StoreLfsObject("other", uploaded)
+	require.NoError(t, err)
+
+	code, _ = batch("upload", uploadedPointer.Oid, len(uploaded), "", "")
+	require.Equal(t, 401, code)
+	code, _ = batch("upload", uploadedPointer.Oid, len(uploaded), "thomas", "wrong")
+	require.Equal(t, 404, code)
+
+	code, object = batch("upload", uploadedPointer.Oid, len(uploaded), "thomas", "thomas")
+	require.Equal(t, 200, code)
+	uploadPath := href(object, "upload")
+
+	res = lfsRequest("PUT", uploadPath, "not the content\n", "thomas", "thomas")
+	require.Equal(t, 422, res.StatusCode)
+	require.False(t, git.LfsObjectExists(gist1db.Uuid, uploadedPointer.Oid))
+
+	res = lfsRequest("PUT", uploadPath, uploaded, "thomas", "thomas")
+	require.Equal(t, 200, res.StatusCode)
+	require.True(t, git.LfsObjectExists(gist1db.Uuid, uploadedPointer.Oid))
+
+	// an object the gist has is not uploaded again
+	_, object = batch("upload", pointer.Oid, len(large), "thomas", "thomas")
+	require.Nil(t, object["actions"])
+
+	// a file shrunk below the threshold is committed as it is, and is no longer marked in .gitattributes
+	err = s.request("POST", gistPath+"/edit", db.GistDTO{
+		Title:   "gist",
+		Name:    []string{"large.txt", "small.txt"},
+		Content: []string{"not large anymore\n", "small\n"},
+	}, 302)
+	require.NoError(t, err)
+	require.Equal(t, "not large anymore\n", show("large.txt"))
+	files, err := gist1db.FileNames("HEAD")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"large.txt", "small.txt"}, files)
+
+	// the objects are deleted along with the gist
+	config.C.TrashRetentionDays = 0
+	defer func() { config.C.TrashRetentionDays = 30 }()
+	err = s.request("POST", gistPath+"/delete", nil, 302)
+	require.NoError(t, err)
+	require.False(t, git.LfsObjectExists(gist1db.Uuid, pointer.Oid))
+}
+
+func TestUserFeeds(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+
+	for i, private := range []db.Visibility{db.PublicVisibility, db.UnlistedVisibility, db.PrivateVisibility} {
+		err = s.request("POST", "/", db.GistDTO{
+			Title:       "gist-" + private.String(),
+			Description: "description " + strconv.Itoa(i),
+			Tags:        "go",
+			VisibilityDTO: db.VisibilityDTO{
+				Private: private,
+			},
+			Name:    []string{"file.txt"},
+			Content: []string{"hello"},
+		}, 302)
+		require.NoError(t, err)
+	}
+
+	feed := func(uri string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest("GET", "http://localhost:6157"+uri, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		s.server.ServeHTTP(w, req)
+		return w.Result()
+	}
+	body := func(res *http.Response) string {
+		content, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// only the public gists are listed, whoever asks for the feed
+	s.sessionCookie = ""
+	res := feed("/thomas.atom", nil)
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "application/atom+xml; charset=utf-8", res.Header.Get("Content-Type"))
+	atom := body(res)
+	require.Contains(t, atom, "<title>gist-public</title>")
+	require.Contains(t, atom, "<summary>description 0</summary>")
+	require.Contains(t, atom, `<category term="go"></category>`)
+	require.NotContains(t, atom, "gist-unlisted")
+	require.NotContains(t, atom, "gist-private")
+
+	res = feed("/thomas.rss", nil)
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "application/rss+xml; charset=utf-8", res.Header.Get("Content-Type"))
+	rss := body(res)
+	require.Contains(t, rss, "<title>gist-public</title>")
+	require.NotContains(t, rss, "gist-unlisted")
+	require.NotContains(t, rss, "gist-private")
+
+	// feed readers do not fetch a feed again while it did not change
+	res = feed("/thomas.atom", nil)
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, lastModified)
+	require.Equal(t, "public, no-cache", res.Header.Get("Cache-Control"))
+
+	require.Equal(t, 304, feed("/thomas.atom", map[string]string{"If-None-Match": etag}).StatusCode)
+	require.Equal(t, 304, feed("/thomas.atom", map[string]string{"If-Modified-Since": lastModified}).StatusCode)
+	require.Equal(t, 200, feed("/thomas.rss", map[string]string{"If-None-Match": etag}).StatusCode)
+
+	require.Equal(t, 404, feed("/nobody.atom", nil).StatusCode)
+
+	// the page of the user links to its feed
+	res = feed("/thomas", nil)
+	require.Equal(t, 200, res.StatusCode)
+	require.Contains(t, body(res), `<link rel="alternate" type="application/atom+xml" title="Gists of thomas" href="http://localhost:6157/thomas.atom" />`)
+}
+
+func TestGistDescriptionMarkdown(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	user1 := db.UserDTO{Username: "thomas", Password: "thomas"}
+	register(t, s, user1)
+	user1Cookie := &http.Cookie{Name: "session", Value: s.sessionCookie}
+
+	description := "Some *emphasis*, `code` and a [link](https://example.com) " +
+		"<script>alert(1)</script> [bad](javascript:alert(2)) <img src=x onerror=alert(3)>"
+	err = s.request("POST", "/", db.GistDTO{Title: "described", Description: description, Name: []string{"a.txt"}, Content: []string{"a"}}, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+	require.Equal(t, description, gist1db.Description)
+
+	page := func(uri string) string {
+		resp := s.rawRequest("GET", uri, user1Cookie)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// rendered and sanitized on the gist page
+	body := page("/thomas/" + gist1db.Identifier())
+	require.Contains(t, body, "<em>emphasis</em>")
+	require.Contains(t, body, "<code>code</code>")
+	require.Contains(t, body, `<a href="https://example.com" rel="nofollow noopener noreferrer">link</a>`)
+	require.Contains(t, body, "<a rel=\"nofollow noopener noreferrer\">bad</a>")
+	require.NotContains(t, body, "<script>alert(1)")
+	require.NotContains(t, body, `href="javascript:`)
+	require.NotContains(t, body, "onerror")
+
+	// kept plain in the lists
+	body = page("/thomas")
+	require.Contains(t, body, "Some *emphasis*")
+	require.NotContains(t, body, "<em>emphasis</em>")
+
+	// previewed from the edit form
+	body = page("/preview?" + url.Values{"content": {description}, "description": {"true"}}.Encode())
+	require.True(t, strings.HasPrefix(body, "<p>Some <em>emphasis</em>"))
+	require.NotContains(t, body, "<script>")
+}
+
+func TestBackup(t *testing.T) {
+	setup(t)
+	s, err := newTestServer()
+	require.NoError(t, err, "Failed to create test server")
+	defer teardown(t, s)
+
+	config.C.BackupPath = t.TempDir()
+	config.C.BackupRetention = 2
+	defer func() { config.C.BackupPath, config.C.BackupRetention = "", 7 }()
+
+	register(t, s, db.UserDTO{Username: "thomas", Password: "thomas"})
+	gist1 := db.GistDTO{
+		Title:         "gist1",
+		VisibilityDTO: db.VisibilityDTO{Private: 0},
+		Name:          []string{"gist1.txt"},
+		Content:       []string{"yeah"},
+	}
+	err = s.request("POST", "/", gist1, 302)
+	require.NoError(t, err)
+	gist1db, err := db.GetGistByID("1")
+	require.NoError(t, err)
+
+	adminPanel := func() string {
+		resp := s.rawRequest("GET", "/admin-panel", &http.Cookie{Name: "session", Value: s.sessionCookie})
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	require.Contains(t, adminPanel(), "No backup yet")
+
+	// older archives, of which only the last one is kept with the new one
+	for _, name := range []string{"opengist-backup-20240101-030000.tar.gz", "opengist-backup-20250101-030000.tar.gz"} {
+		require.NoError(t, os.WriteFile(filepath.Join(config.C.BackupPath, name), nil, 0600))
+	}
+
+	actions.Run(actions.Backup)
+
+	entries, err := os.ReadDir(config.C.BackupPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "opengist-backup-20250101-030000.tar.gz", entries[0].Name())
+	archive := entries[1].Name()
+	require.Regexp(t, `^opengist-backup-\d{8}-\d{6}\.tar\.gz$`, archive)
+
+	file, err := os.Open(filepath.Join(config.C.BackupPath, archive))
+	require.NoError(t, err)
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+
+	files := make(map[string]bool)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		files[header.Name] = true
+	}
+	require.True(t, files["opengist.db"])
+	require.True(t, files["repos/thomas/"+gist1db.Uuid+"/HEAD"])
+
+	body := adminPanel()
+	require.Contains(t, body, archive)
+	require.NotContains(t, body, "Last backup failed")
+}
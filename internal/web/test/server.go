@@ -20,7 +20,7 @@ import (
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/git"
-	"github.com/thomiceli/opengist/internal/memdb"
+	"github.com/thomiceli/opengist/internal/storage"
 	"github.com/thomiceli/opengist/internal/web"
 )
 
@@ -93,6 +93,19 @@ func (s *testServer) request(method, uri string, data interface{}, expectedCode
 	return nil
 }
 
+// rawRequest sends a request with the given cookies and returns the raw response,
+// for flows where headers other than the status code must be checked
+func (s *testServer) rawRequest(method, uri string, cookies ...*http.Cookie) *http.Response {
+	req := httptest.NewRequest(method, "http://localhost:6157"+uri, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, req)
+	return w.Result()
+}
+
 func structToURLValues(s interface{}) url.Values {
 	v := url.Values{}
 	if s == nil {
@@ -111,6 +124,8 @@ func structToURLValues(s interface{}) url.Values {
 			if field.Type.Kind() == reflect.Int {
 				fieldValue := rValue.Field(i).Int()
 				v.Add(tag, strconv.FormatInt(fieldValue, 10))
+			} else if field.Type.Kind() == reflect.Bool {
+				v.Add(tag, strconv.FormatBool(rValue.Field(i).Bool()))
 			} else if field.Type.Kind() == reflect.Slice {
 				fieldValue := rValue.Field(i).Interface().([]string)
 				for _, va := range fieldValue {
@@ -158,8 +173,7 @@ func setup(t *testing.T) {
 	err = db.Setup("file::memory:", true)
 	require.NoError(t, err, "Could not initialize database")
 
-	err = memdb.Setup()
-	require.NoError(t, err, "Could not initialize in memory database")
+	storage.Setup()
 
 	// err = index.Open(filepath.Join(homePath, "testsindex", "opengist.index"))
 	// require.NoError(t, err, "Could not open index")
@@ -180,6 +194,9 @@ func teardown(t *testing.T, s *testServer) {
 	err = os.RemoveAll(path.Join(config.GetHomeDir(), "tmp", "sessions"))
 	require.NoError(t, err, "Could not remove repos directory")
 
+	err = os.RemoveAll(path.Join(config.GetHomeDir(), "storage"))
+	require.NoError(t, err, "Could not remove storage directory")
+
 	// err = os.RemoveAll(path.Join(config.C.OpengistHome, "testsindex"))
 	// require.NoError(t, err, "Could not remove repos directory")
 
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+)
+
+// session key marking that the user postponed setting up two-factor authentication until they log in again
+const twoFactorSkippedSessionKey = "twoFactorSkipped"
+
+// twoFactorSetupPaths can be opened by the users who must set up two-factor authentication before anything else
+var twoFactorSetupPaths = []string{"/settings/two-factor", "/settings/totp", "/settings/passkeys", "/logout", "/healthcheck"}
+
+// hasTwoFactor reports whether the user set up a second factor, an authenticator app or a passkey
+func hasTwoFactor(user *db.User) (bool, error) {
+	if user.TOTPEnabled {
+		return true, nil
+	}
+	count, err := db.CountWebAuthnCredentialsOfUser(user.ID)
+	return count > 0, err
+}
+
+// keepsTwoFactor reports whether the user still has a second factor once their authenticator app, or one of their
+// passkeys, is removed. It is always the case when two-factor authentication is not required.
+func keepsTwoFactor(user *db.User, removingTotp bool) (bool, error) {
+	if !config.C.RequireTwoFactor {
+		return true, nil
+	}
+	count, err := db.CountWebAuthnCredentialsOfUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if removingTotp {
+		return count > 0, nil
+	}
+	return user.TOTPEnabled || count > 1, nil
+}
+
+// twoFactorSkipsLeft returns how many more times the user can postpone setting up two-factor authentication
+func twoFactorSkipsLeft(user *db.User) int {
+	return max(config.C.RequireTwoFactorSkips-user.TwoFactorSkips, 0)
+}
+
+func isTwoFactorSetupPath(path string) bool {
+	for _, p := range twoFactorSetupPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requireTwoFactor sends the logged users without a second factor to its setup while two-factor authentication is
+// required, admins included. The admins impersonating a user are let through.
+func requireTwoFactor(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if !config.C.RequireTwoFactor || isTwoFactorSetupPath(ctx.Request().URL.Path) {
+			return next(ctx)
+		}
+
+		user := getUserLogged(ctx)
+		if user == nil || getData(ctx, "impersonator") != nil {
+			return next(ctx)
+		}
+		if skipped, _ := getSession(ctx).Values[twoFactorSkippedSessionKey].(bool); skipped {
+			return next(ctx)
+		}
+
+		ok, err := hasTwoFactor(user)
+		if err != nil {
+			return errorRes(500, "Cannot get passkeys", err)
+		}
+		if ok {
+			return next(ctx)
+		}
+		return redirect(ctx, "/settings/two-factor")
+	}
+}
+
+// twoFactorSetup asks the user to set up two-factor authentication, and lets them postpone it while they have skips
+// left
+func twoFactorSetup(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if !config.C.RequireTwoFactor {
+		return redirect(ctx, "/settings")
+	}
+
+	ok, err := hasTwoFactor(user)
+	if err != nil {
+		return errorRes(500, "Cannot get passkeys", err)
+	}
+	if ok {
+		return redirect(ctx, "/settings")
+	}
+
+	setData(ctx, "skipsLeft", twoFactorSkipsLeft(user))
+	setData(ctx, "htmlTitle", trH(ctx, "settings.two-factor-required"))
+	return html(ctx, "settings_two_factor.html")
+}
+
+// twoFactorSkip lets the user in without a second factor until they log in again, using one of their skips
+func twoFactorSkip(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	if !config.C.RequireTwoFactor {
+		return redirect(ctx, "/")
+	}
+
+	if twoFactorSkipsLeft(user) == 0 {
+		addFlash(ctx, tr(ctx, "flash.user.two-factor-no-skips-left"), "error")
+		return redirect(ctx, "/settings/two-factor")
+	}
+
+	user.TwoFactorSkips++
+	if err := user.Update(); err != nil {
+		return errorRes(500, "Cannot update user", err)
+	}
+
+	sess := getSession(ctx)
+	sess.Values[twoFactorSkippedSessionKey] = true
+	saveSession(sess, ctx)
+	return redirect(ctx, "/")
+}
@@ -3,8 +3,10 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"github.com/thomiceli/opengist/internal/config"
 	"github.com/thomiceli/opengist/internal/db"
 	"github.com/thomiceli/opengist/internal/i18n"
@@ -12,6 +14,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type dataTypeKey string
@@ -51,6 +54,48 @@ func plainText(ctx echo.Context, code int, message string) error {
 	return ctx.String(code, message)
 }
 
+// notModified sets the caching headers of a gist response and reports whether the copy of the client is still
+// fresh, in which case a 304 must be sent instead of the content. A zero lastModified leaves out Last-Modified.
+func notModified(ctx echo.Context, gist *db.Gist, etag string, lastModified time.Time) bool {
+	return checkNotModified(ctx, gist.Private == db.PrivateVisibility || gist.IsProtected(), etag, lastModified)
+}
+
+// checkNotModified is notModified for any response, private telling whether its content must not be kept by shared
+// caches
+func checkNotModified(ctx echo.Context, private bool, etag string, lastModified time.Time) bool {
+	header := ctx.Response().Header()
+	header.Set("ETag", etag)
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// the content of private gists, of an instance requiring a login, or shown to a logged-in user, must not be kept by
+	// shared caches
+	if private || getData(ctx, "RequireLogin") == true || getUserLogged(ctx) != nil {
+		header.Set("Cache-Control", "private, no-cache")
+	} else {
+		header.Set("Cache-Control", "public, no-cache")
+	}
+
+	// If-Modified-Since is only considered when If-None-Match is absent, see RFC 9110
+	if ifNoneMatch := ctx.Request().Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := ctx.Request().Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
 func notFound(message string) error {
 	return errorRes(404, message, nil)
 }
@@ -59,6 +104,78 @@ func errorRes(code int, message string, err error) error {
 	return &echo.HTTPError{Code: code, Message: message, Internal: err}
 }
 
+// errorPages are the status codes having a localized title and description on the error page
+var errorPages = map[int]string{
+	400: "bad-request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not-found",
+	500: "internal",
+	503: "maintenance",
+}
+
+// httpErrorHandler renders the errors returned by the handlers, as a page or as JSON if the client asked for it.
+// Errors not created by errorRes are reported as internal errors.
+func httpErrorHandler(er error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		return
+	}
+
+	var err *echo.HTTPError
+	if !errors.As(er, &err) {
+		err = &echo.HTTPError{Code: 500, Message: http.StatusText(500), Internal: er}
+	}
+
+	requestId := ctx.Response().Header().Get(echo.HeaderXRequestID)
+	message := fmt.Sprint(err.Message)
+
+	if err.Code >= 500 {
+		log.Error().Int("code", err.Code).Str("request_id", requestId).Err(err.Internal).Msg("HTTP: " + message)
+		// the message of an internal error is meant for the logs only
+		message = ""
+	} else if message == http.StatusText(err.Code) {
+		// default message of the errors returned by Echo itself, e.g. for an unknown route
+		message = ""
+	}
+
+	title := http.StatusText(err.Code)
+	description := ""
+	if page, ok := errorPages[err.Code]; ok {
+		title = tr(ctx, "error."+page)
+		description = tr(ctx, "error."+page+"-description")
+	}
+
+	var errRender error
+	if acceptsJson(ctx) || isApiRequest(ctx) {
+		if message == "" {
+			message = title
+		}
+		errRender = ctx.JSON(err.Code, map[string]interface{}{
+			"code":       err.Code,
+			"error":      message,
+			"request_id": requestId,
+		})
+	} else {
+		setData(ctx, "error", err)
+		setData(ctx, "errorTitle", title)
+		setData(ctx, "errorDescription", description)
+		setData(ctx, "errorMessage", message)
+		setData(ctx, "requestId", requestId)
+		setData(ctx, "htmlTitle", title)
+		errRender = htmlWithCode(ctx, err.Code, "error.html")
+	}
+
+	if errRender != nil {
+		log.Error().Err(errRender).Msg("Cannot render the error page")
+	}
+}
+
+// acceptsJson reports whether the client asked for a JSON response rather than a page
+func acceptsJson(ctx echo.Context) bool {
+	accept := ctx.Request().Header.Get(echo.HeaderAccept)
+	return strings.Contains(accept, echo.MIMEApplicationJSON) && !strings.Contains(accept, echo.MIMETextHTML)
+}
+
 func getUserLogged(ctx echo.Context) *db.User {
 	user := getData(ctx, "userLogged")
 	if user != nil {
@@ -67,8 +184,40 @@ func getUserLogged(ctx echo.Context) *db.User {
 	return nil
 }
 
-func setErrorFlashes(ctx echo.Context) {
+// getImpersonator returns the admin impersonating the logged user, or nil
+func getImpersonator(ctx echo.Context) *db.User {
+	user := getData(ctx, "impersonator")
+	if user != nil {
+		return user.(*db.User)
+	}
+	return nil
+}
+
+// isHttpsRequest reports whether the request was made over HTTPS, either directly or through a reverse proxy
+// setting the X-Forwarded-Proto header
+func isHttpsRequest(ctx echo.Context) bool {
+	if ctx.Request().TLS != nil {
+		return true
+	}
+
+	// the header may hold a list of protocols when the request went through several proxies, the first one being the client's
+	proto, _, _ := strings.Cut(ctx.Request().Header.Get(echo.HeaderXForwardedProto), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// secureCookies reports whether the cookies set in the response must be marked Secure
+func secureCookies(ctx echo.Context) bool {
+	return config.C.HttpSecureCookies || isHttpsRequest(ctx)
+}
+
+func getFlashSession(ctx echo.Context) *sessions.Session {
 	sess, _ := flashStore.Get(ctx.Request(), "flash")
+	sess.Options.Secure = secureCookies(ctx)
+	return sess
+}
+
+func setErrorFlashes(ctx echo.Context) {
+	sess := getFlashSession(ctx)
 
 	setData(ctx, "flashErrors", sess.Flashes("error"))
 	setData(ctx, "flashSuccess", sess.Flashes("success"))
@@ -77,13 +226,14 @@ func setErrorFlashes(ctx echo.Context) {
 }
 
 func addFlash(ctx echo.Context, flashMessage string, flashType string) {
-	sess, _ := flashStore.Get(ctx.Request(), "flash")
+	sess := getFlashSession(ctx)
 	sess.AddFlash(flashMessage, flashType)
 	_ = sess.Save(ctx.Request(), ctx.Response())
 }
 
 func getSession(ctx echo.Context) *sessions.Session {
 	sess, _ := userStore.Get(ctx.Request(), "session")
+	sess.Options.Secure = secureCookies(ctx)
 	return sess
 }
 
@@ -93,11 +243,39 @@ func saveSession(sess *sessions.Session, ctx echo.Context) {
 
 func deleteSession(ctx echo.Context) {
 	sess := getSession(ctx)
+	if token, ok := sess.Values["sessionToken"].(string); ok {
+		if err := db.DeleteSessionByToken(token); err != nil {
+			log.Error().Err(err).Msg("Cannot delete session")
+		}
+	}
 	sess.Options.MaxAge = -1
 	sess.Values["user"] = nil
+	delete(sess.Values, "sessionToken")
+	delete(sess.Values, "impersonatedUser")
 	saveSession(sess, ctx)
 }
 
+// setSessionUser logs the user in the cookie session, and records the session in the database so that the user can
+// list and revoke it
+func setSessionUser(ctx echo.Context, sess *sessions.Session, userId uint) error {
+	if token, ok := sess.Values["sessionToken"].(string); ok {
+		if err := db.DeleteSessionByToken(token); err != nil {
+			return err
+		}
+	}
+
+	session, err := db.CreateSession(userId, ctx.RealIP(), ctx.Request().UserAgent())
+	if err != nil {
+		return err
+	}
+
+	sess.Values["user"] = userId
+	sess.Values["sessionToken"] = session.Token
+	delete(sess.Values, "impersonatedUser")
+	delete(sess.Values, twoFactorSkippedSessionKey)
+	return nil
+}
+
 func setCsrfHtmlForm(ctx echo.Context) {
 	if csrfToken, ok := ctx.Get("csrf").(string); ok {
 		setData(ctx, "csrfHtml", template.HTML(`<input type="hidden" name="_csrf" value="`+csrfToken+`">`))
@@ -105,7 +283,7 @@ func setCsrfHtmlForm(ctx echo.Context) {
 }
 
 func deleteCsrfCookie(ctx echo.Context) {
-	ctx.SetCookie(&http.Cookie{Name: "_csrf", Path: "/", MaxAge: -1})
+	ctx.SetCookie(&http.Cookie{Name: "_csrf", Path: "/", MaxAge: -1, Secure: secureCookies(ctx)})
 }
 
 func loadSettings(ctx echo.Context) error {
@@ -115,13 +293,18 @@ func loadSettings(ctx echo.Context) error {
 	}
 
 	for key, value := range settings {
-		s := strings.ReplaceAll(key, "-", " ")
-		s = title.String(s)
-		setData(ctx, strings.ReplaceAll(s, " ", ""), value == "1")
+		setData(ctx, settingDataKey(key), value == "1")
 	}
 	return nil
 }
 
+// settingDataKey returns the name of the template data holding an admin setting, e.g. DisableSignup for disable-signup
+func settingDataKey(key string) string {
+	s := strings.ReplaceAll(key, "-", " ")
+	s = title.String(s)
+	return strings.ReplaceAll(s, " ", "")
+}
+
 func getPage(ctx echo.Context) int {
 	page := ctx.QueryParam("page")
 	if page == "" {
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/webhook"
+)
+
+// webhooksMax is the number of webhooks a user can have
+const webhooksMax = 10
+
+// triggerWebhooks sends the event of the gist to the webhooks of its owner, with the gist as it is returned by the API
+func triggerWebhooks(ctx echo.Context, event string, gist *db.Gist) {
+	webhook.Trigger(gist.UserID, event, map[string]interface{}{
+		"gist": toApiGist(ctx, gist, nil),
+	})
+}
+
+func userWebhooks(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	webhooks, err := db.GetWebhooksOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get webhooks", err)
+	}
+
+	deliveries := make(map[uint][]*db.WebhookDelivery, len(webhooks))
+	for _, w := range webhooks {
+		if deliveries[w.ID], err = w.GetDeliveries(); err != nil {
+			return errorRes(500, "Cannot get webhook deliveries", err)
+		}
+	}
+
+	setData(ctx, "webhooks", webhooks)
+	setData(ctx, "webhookDeliveries", deliveries)
+	setData(ctx, "webhookEvents", db.WebhookEvents)
+	setData(ctx, "htmlTitle", trH(ctx, "settings.webhooks"))
+	return html(ctx, "settings_webhooks.html")
+}
+
+func webhookCreate(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+
+	if err := ctx.Request().ParseForm(); err != nil {
+		return errorRes(400, tr(ctx, "error.bad-request"), err)
+	}
+
+	webhooks, err := db.GetWebhooksOfUser(user.ID)
+	if err != nil {
+		return errorRes(500, "Cannot get webhooks", err)
+	}
+	if len(webhooks) >= webhooksMax {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-too-many", webhooksMax), "error")
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	hookUrl, err := url.Parse(strings.TrimSpace(ctx.FormValue("url")))
+	if err != nil || (hookUrl.Scheme != "http" && hookUrl.Scheme != "https") || hookUrl.Host == "" {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-invalid-url"), "error")
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	secret := ctx.FormValue("secret")
+	if secret == "" {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-no-secret"), "error")
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	events := make([]string, 0, len(db.WebhookEvents))
+	for _, event := range ctx.Request().PostForm["events"] {
+		if db.IsWebhookEvent(event) {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-no-event"), "error")
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	if _, err = db.CreateWebhook(user.ID, hookUrl.String(), secret, events); err != nil {
+		return errorRes(500, "Cannot create webhook", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.webhook-created"), "success")
+	return redirect(ctx, "/settings/webhooks")
+}
+
+func webhookDelete(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	webhookId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	if err = db.DeleteWebhookOfUser(uint(webhookId), user.ID); err != nil {
+		return errorRes(500, "Cannot delete webhook", err)
+	}
+
+	addFlash(ctx, tr(ctx, "flash.user.webhook-deleted"), "success")
+	return redirect(ctx, "/settings/webhooks")
+}
+
+// webhookTest sends a ping to the webhook, and tells whether it was delivered
+func webhookTest(ctx echo.Context) error {
+	user := getUserLogged(ctx)
+	webhookId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return redirect(ctx, "/settings/webhooks")
+	}
+
+	w, err := db.GetWebhookOfUser(uint(webhookId), user.ID)
+	if err != nil {
+		return notFound("Webhook not found")
+	}
+
+	delivery, err := webhook.Ping(w)
+	if err != nil {
+		return errorRes(500, "Cannot send ping", err)
+	}
+
+	if delivery.Succeeded() {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-ping-delivered", delivery.StatusCode), "success")
+	} else {
+		addFlash(ctx, tr(ctx, "flash.user.webhook-ping-failed", delivery.Error), "error")
+	}
+	return redirect(ctx, "/settings/webhooks")
+}
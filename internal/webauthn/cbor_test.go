@@ -0,0 +1,84 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// the examples of RFC 8949, appendix A
+	valid := []struct {
+		data     string
+		expected interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"40", []byte(nil)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c11a514b67b0", int64(1363896240)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, test := range valid {
+		data, err := hex.DecodeString(test.data)
+		require.NoError(t, err)
+		decoded, rest, err := decodeCBOR(data)
+		require.NoError(t, err, test.data)
+		require.Equal(t, test.expected, decoded, test.data)
+		require.Empty(t, rest, test.data)
+	}
+
+	// the bytes following the first item are returned
+	decoded, rest, err := decodeCBOR([]byte{0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), decoded)
+	require.Equal(t, []byte{0x02, 0x03}, rest)
+
+	invalid := map[string]string{
+		"empty":                         "",
+		"truncated argument":            "19 03",
+		"truncated 64-bit argument":     "1b 0000 00e8",
+		"integer over int64":            "1b ffffffffffffffff",
+		"negative integer under int64":  "3b ffffffffffffffff",
+		"truncated byte string":         "44 0102",
+		"oversized byte string":         "5b ffffffffffffffff 01",
+		"truncated text string":         "64 4945",
+		"indefinite byte string":        "5f 4101 ff",
+		"indefinite array":              "9f 01 ff",
+		"truncated array":               "83 01 02",
+		"oversized array":               "9b ffffffffffffffff 01",
+		"truncated map":                 "a2 01 02 03",
+		"map without value":             "a1 01",
+		"map with a byte string key":    "a1 41 01 02",
+		"map with an array key":         "a1 80 02",
+		"oversized map":                 "ba ffffffff 01 02",
+		"tag without item":              "c1",
+		"float":                         "f9 3c00",
+		"simple value with an argument": "f8 ff",
+		"break":                         "ff",
+		"nested too deeply":             "818181818181818181818181818181818181 00",
+	}
+	for name, test := range invalid {
+		data, err := hex.DecodeString(strings.ReplaceAll(test, " ", ""))
+		require.NoError(t, err, name)
+		_, _, err = decodeCBOR(data)
+		require.ErrorIs(t, err, errInvalidCBOR, name)
+	}
+}
@@ -0,0 +1,97 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms offered when creating a credential, by order of preference
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+var ErrUnsupportedKey = errors.New("unsupported public key")
+
+// publicKey is a credential public key, decoded from its COSE form
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parsePublicKey(cose []byte) (*publicKey, error) {
+	decoded, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := decoded.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, ErrUnsupportedKey
+	}
+
+	intField := func(key int64) int64 {
+		value, _ := fields[key].(int64)
+		return value
+	}
+	bytesField := func(key int64) []byte {
+		value, _ := fields[key].([]byte)
+		return value
+	}
+
+	kty, alg := intField(1), intField(3)
+	switch {
+	case kty == 2 && alg == algES256 && intField(-1) == 1:
+		x, y := bytesField(-2), bytesField(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+		// rejects the points which are not on the curve
+		if _, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, ErrUnsupportedKey
+		}
+		return &publicKey{alg: alg, key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+	case kty == 1 && alg == algEdDSA && intField(-1) == 6:
+		x := bytesField(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == algRS256:
+		n, e := bytesField(-1), bytesField(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrUnsupportedKey
+		}
+		return &publicKey{alg: alg, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}}, nil
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+func (k *publicKey) verify(message []byte, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
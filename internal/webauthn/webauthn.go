@@ -0,0 +1,255 @@
+// Package webauthn implements the relying party side of WebAuthn, for logging in with passkeys. Attestations are not
+// verified: credentials are created with the "none" attestation, and authenticators of any vendor are accepted.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+const timeout = 5 * 60 * 1000 // ms
+
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+var (
+	ErrInvalidResponse  = errors.New("invalid authenticator response")
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignCount is returned when the signature counter of an authenticator went backwards, which happens when
+	// the credential was cloned
+	ErrSignCount = errors.New("signature counter did not increase")
+)
+
+var encoding = base64.RawURLEncoding
+
+// RelyingParty is the Opengist instance the credentials are bound to, identified by its domain name
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+// NewRelyingParty returns the relying party served at baseUrl, e.g. https://opengist.example.com
+func NewRelyingParty(name string, baseUrl string) (*RelyingParty, error) {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("no host in URL " + baseUrl)
+	}
+
+	return &RelyingParty{
+		ID:     u.Hostname(),
+		Name:   name,
+		Origin: u.Scheme + "://" + u.Host,
+	}, nil
+}
+
+// NewChallenge returns a random challenge, to be sent in the options and kept until the response is verified
+func NewChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(challenge), nil
+}
+
+// Credential is a key pair created by an authenticator for a user
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE encoded
+	SignCount uint32
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func descriptors(credentialIds [][]byte) []credentialDescriptor {
+	list := make([]credentialDescriptor, 0, len(credentialIds))
+	for _, id := range credentialIds {
+		list = append(list, credentialDescriptor{Type: "public-key", ID: encoding.EncodeToString(id)})
+	}
+	return list
+}
+
+// CreationOptions returns the options of navigator.credentials.create() to register a passkey for a user, binary
+// values being base64url encoded. The credentials the user already has are excluded.
+func (rp *RelyingParty) CreationOptions(challenge string, userId uint, username string, excluded [][]byte) map[string]interface{} {
+	return map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]string{
+			"id":   rp.ID,
+			"name": rp.Name,
+		},
+		"user": map[string]string{
+			"id":          encoding.EncodeToString([]byte(strconv.FormatUint(uint64(userId), 10))),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": algES256},
+			{"type": "public-key", "alg": algEdDSA},
+			{"type": "public-key", "alg": algRS256},
+		},
+		"excludeCredentials": descriptors(excluded),
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation": "none",
+		"timeout":     timeout,
+	}
+}
+
+// RequestOptions returns the options of navigator.credentials.get() to log in with a passkey. No credential is
+// listed, so that the authenticator offers the passkeys it holds for the relying party.
+func (rp *RelyingParty) RequestOptions(challenge string) map[string]interface{} {
+	return map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             rp.ID,
+		"userVerification": "required",
+		"timeout":          timeout,
+	}
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp *RelyingParty) checkClientData(clientDataJSON []byte, ceremony string, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return ErrInvalidResponse
+	}
+
+	if data.Type != ceremony || data.Origin != rp.Origin || challenge == "" ||
+		subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+	rest      []byte
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrInvalidResponse
+	}
+
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data[:32], rpIdHash[:]) {
+		return nil, ErrInvalidResponse
+	}
+
+	parsed := &authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+		rest:      data[37:],
+	}
+	if parsed.flags&flagUserPresent == 0 || parsed.flags&flagUserVerified == 0 {
+		return nil, ErrInvalidResponse
+	}
+	return parsed, nil
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create() to the challenge and returns the created
+// credential
+func (rp *RelyingParty) VerifyRegistration(challenge string, clientDataJSON []byte, attestationObject []byte) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrInvalidResponse
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidResponse
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedCredData == 0 || len(authData.rest) < 18 {
+		return nil, ErrInvalidResponse
+	}
+
+	// attested credential data: AAGUID (16 bytes), credential ID length (2 bytes), credential ID, public key
+	idLength := int(binary.BigEndian.Uint16(authData.rest[16:18]))
+	if len(authData.rest) < 18+idLength || idLength == 0 {
+		return nil, ErrInvalidResponse
+	}
+	credentialId := authData.rest[18 : 18+idLength]
+
+	keyData := authData.rest[18+idLength:]
+	_, after, err := decodeCBOR(keyData)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	cose := keyData[:len(keyData)-len(after)]
+	if _, err = parsePublicKey(cose); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        append([]byte(nil), credentialId...),
+		PublicKey: append([]byte(nil), cose...),
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get() to the challenge against the credential, and
+// returns the new signature counter of the authenticator
+func (rp *RelyingParty) VerifyAssertion(challenge string, credential *Credential, clientDataJSON []byte, rawAuthData []byte, signature []byte) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !key.verify(append(append([]byte(nil), rawAuthData...), clientDataHash[:]...), signature) {
+		return 0, ErrInvalidSignature
+	}
+
+	// authenticators without a counter always send 0
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return authData.signCount, nil
+}
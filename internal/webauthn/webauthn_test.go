@@ -0,0 +1,240 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testChallenge = "Y2hhbGxlbmdlLW9mLXRoZS10ZXN0"
+
+// cborEncode encodes the subset of CBOR used by WebAuthn authenticators. Maps are given as key/value pairs to
+// keep their order.
+func cborEncode(value interface{}) []byte {
+	header := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return header(1, -1-v)
+		}
+		return header(0, v)
+	case []byte:
+		return append(header(2, len(v)), v...)
+	case string:
+		return append(header(3, len(v)), v...)
+	case [][2]interface{}:
+		encoded := header(5, len(v))
+		for _, pair := range v {
+			encoded = append(encoded, cborEncode(pair[0])...)
+			encoded = append(encoded, cborEncode(pair[1])...)
+		}
+		return encoded
+	}
+	panic(fmt.Sprintf("cannot encode %T", value))
+}
+
+func testRelyingParty(t *testing.T) *RelyingParty {
+	rp, err := NewRelyingParty("Opengist", "http://localhost:6157")
+	require.NoError(t, err)
+	return rp
+}
+
+func testClientData(ceremony string, challenge string, origin string) []byte {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return data
+}
+
+func testAuthData(rpId string, flags byte, signCount uint32, rest []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	return append(data, rest...)
+}
+
+func testAttestedCredential(id []byte, cose []byte) []byte {
+	data := make([]byte, 16) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(id)))
+	data = append(data, id...)
+	return append(data, cose...)
+}
+
+func es256Key(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return key, cborEncode([][2]interface{}{{1, 2}, {3, algES256}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	rp := testRelyingParty(t)
+	_, cose := es256Key(t)
+	credentialId := []byte("credential-id")
+	const flags = flagUserPresent | flagUserVerified | flagAttestedCredData
+
+	attestation := func(authData []byte) []byte {
+		return cborEncode([][2]interface{}{{"fmt", "none"}, {"attStmt", [][2]interface{}{}}, {"authData", authData}})
+	}
+	validAuthData := testAuthData("localhost", flags, 0, testAttestedCredential(credentialId, cose))
+	validClientData := testClientData("webauthn.create", testChallenge, "http://localhost:6157")
+
+	credential, err := rp.VerifyRegistration(testChallenge, validClientData, attestation(validAuthData))
+	require.NoError(t, err)
+	require.Equal(t, credentialId, credential.ID)
+	require.Equal(t, cose, credential.PublicKey)
+	require.Equal(t, uint32(0), credential.SignCount)
+
+	tests := []struct {
+		name        string
+		clientData  []byte
+		attestation []byte
+		err         error
+	}{
+		{"wrong ceremony", testClientData("webauthn.get", testChallenge, "http://localhost:6157"), attestation(validAuthData), ErrInvalidResponse},
+		{"wrong challenge", testClientData("webauthn.create", "other", "http://localhost:6157"), attestation(validAuthData), ErrInvalidResponse},
+		{"wrong origin", testClientData("webauthn.create", testChallenge, "https://localhost:6157"), attestation(validAuthData), ErrInvalidResponse},
+		{"malformed client data", []byte("{"), attestation(validAuthData), ErrInvalidResponse},
+		{"wrong rpIdHash", validClientData, attestation(testAuthData("example.com", flags, 0, testAttestedCredential(credentialId, cose))), ErrInvalidResponse},
+		{"user not present", validClientData, attestation(testAuthData("localhost", flags&^flagUserPresent, 0, testAttestedCredential(credentialId, cose))), ErrInvalidResponse},
+		{"user not verified", validClientData, attestation(testAuthData("localhost", flags&^flagUserVerified, 0, testAttestedCredential(credentialId, cose))), ErrInvalidResponse},
+		{"no attested credential", validClientData, attestation(testAuthData("localhost", flags&^flagAttestedCredData, 0, testAttestedCredential(credentialId, cose))), ErrInvalidResponse},
+		{"truncated authenticator data", validClientData, attestation(validAuthData[:36]), ErrInvalidResponse},
+		{"truncated credential id", validClientData, attestation(testAuthData("localhost", flags, 0, testAttestedCredential(credentialId, nil)[:20])), ErrInvalidResponse},
+		{"empty credential id", validClientData, attestation(testAuthData("localhost", flags, 0, testAttestedCredential(nil, cose))), ErrInvalidResponse},
+		{"truncated public key", validClientData, attestation(validAuthData[:len(validAuthData)-1]), ErrInvalidResponse},
+		{"unsupported public key", validClientData, attestation(testAuthData("localhost", flags, 0, testAttestedCredential(credentialId, cborEncode([][2]interface{}{{1, 2}, {3, -35}})))), ErrUnsupportedKey},
+		{"truncated attestation object", validClientData, attestation(validAuthData)[:20], ErrInvalidResponse},
+		{"attestation object not a map", validClientData, cborEncode(validAuthData), ErrInvalidResponse},
+		{"authData not a byte string", validClientData, cborEncode([][2]interface{}{{"fmt", "none"}, {"authData", "text"}}), ErrInvalidResponse},
+	}
+	for _, test := range tests {
+		_, err = rp.VerifyRegistration(testChallenge, test.clientData, test.attestation)
+		require.ErrorIs(t, err, test.err, test.name)
+	}
+
+	// a challenge is required
+	_, err = rp.VerifyRegistration("", testClientData("webauthn.create", "", "http://localhost:6157"), attestation(validAuthData))
+	require.ErrorIs(t, err, ErrInvalidResponse)
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	rp := testRelyingParty(t)
+	key, cose := es256Key(t)
+	credential := &Credential{ID: []byte("credential-id"), PublicKey: cose, SignCount: 4}
+	const flags = flagUserPresent | flagUserVerified
+
+	clientData := testClientData("webauthn.get", testChallenge, "http://localhost:6157")
+	sign := func(authData []byte, clientData []byte) []byte {
+		clientDataHash := sha256.Sum256(clientData)
+		hash := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+		signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		require.NoError(t, err)
+		return signature
+	}
+
+	authData := testAuthData("localhost", flags, 5, nil)
+	signCount, err := rp.VerifyAssertion(testChallenge, credential, clientData, authData, sign(authData, clientData))
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), signCount)
+
+	otherKey, _ := es256Key(t)
+	tests := []struct {
+		name       string
+		credential *Credential
+		clientData []byte
+		authData   []byte
+		signature  func(authData []byte, clientData []byte) []byte
+		err        error
+	}{
+		{"sign counter not increased", credential, clientData, testAuthData("localhost", flags, 4, nil), sign, ErrSignCount},
+		{"sign counter reset", credential, clientData, testAuthData("localhost", flags, 0, nil), sign, ErrSignCount},
+		{"wrong rpIdHash", credential, clientData, testAuthData("example.com", flags, 5, nil), sign, ErrInvalidResponse},
+		{"user not verified", credential, clientData, testAuthData("localhost", flagUserPresent, 5, nil), sign, ErrInvalidResponse},
+		{"user not present", credential, clientData, testAuthData("localhost", flagUserVerified, 5, nil), sign, ErrInvalidResponse},
+		{"truncated authenticator data", credential, clientData, authData[:36], sign, ErrInvalidResponse},
+		{"wrong ceremony", credential, testClientData("webauthn.create", testChallenge, "http://localhost:6157"), authData, sign, ErrInvalidResponse},
+		{"wrong challenge", credential, testClientData("webauthn.get", "other", "http://localhost:6157"), authData, sign, ErrInvalidResponse},
+		{"signed by another key", credential, clientData, authData, func(authData []byte, clientData []byte) []byte {
+			clientDataHash := sha256.Sum256(clientData)
+			hash := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+			signature, _ := ecdsa.SignASN1(rand.Reader, otherKey, hash[:])
+			return signature
+		}, ErrInvalidSignature},
+		{"signature of other data", credential, clientData, authData, func(authData []byte, _ []byte) []byte {
+			return sign(authData, testClientData("webauthn.get", "other", "http://localhost:6157"))
+		}, ErrInvalidSignature},
+		{"malformed signature", credential, clientData, authData, func([]byte, []byte) []byte {
+			return []byte{0x30, 0x01}
+		}, ErrInvalidSignature},
+		{"invalid stored key", &Credential{PublicKey: cose[:len(cose)-1]}, clientData, authData, sign, errInvalidCBOR},
+	}
+	for _, test := range tests {
+		_, err = rp.VerifyAssertion(testChallenge, test.credential, test.clientData, test.authData, test.signature(test.authData, test.clientData))
+		require.ErrorIs(t, err, test.err, test.name)
+	}
+
+	// the authenticators without a counter always send 0
+	withoutCounter := &Credential{PublicKey: cose}
+	authData = testAuthData("localhost", flags, 0, nil)
+	signCount, err = rp.VerifyAssertion(testChallenge, withoutCounter, clientData, authData, sign(authData, clientData))
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), signCount)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	_, es256 := es256Key(t)
+	key, err := parsePublicKey(es256)
+	require.NoError(t, err)
+	require.Equal(t, int64(algES256), key.alg)
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err = parsePublicKey(cborEncode([][2]interface{}{{1, 1}, {3, algEdDSA}, {-1, 6}, {-2, []byte(edKey)}}))
+	require.NoError(t, err)
+	require.Equal(t, int64(algEdDSA), key.alg)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err = parsePublicKey(cborEncode([][2]interface{}{{1, 3}, {3, algRS256}, {-1, rsaKey.N.Bytes()}, {-2, []byte{1, 0, 1}}}))
+	require.NoError(t, err)
+	require.Equal(t, int64(algRS256), key.alg)
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	x[31], y[31] = 1, 1
+	invalid := map[string][]byte{
+		"point not on the curve":     cborEncode([][2]interface{}{{1, 2}, {3, algES256}, {-1, 1}, {-2, x}, {-3, y}}),
+		"short coordinate":           cborEncode([][2]interface{}{{1, 2}, {3, algES256}, {-1, 1}, {-2, x[1:]}, {-3, y}}),
+		"other curve":                cborEncode([][2]interface{}{{1, 2}, {3, algES256}, {-1, 2}, {-2, x}, {-3, y}}),
+		"short Ed25519 key":          cborEncode([][2]interface{}{{1, 1}, {3, algEdDSA}, {-1, 6}, {-2, []byte(edKey)[1:]}}),
+		"short RSA modulus":          cborEncode([][2]interface{}{{1, 3}, {3, algRS256}, {-1, rsaKey.N.Bytes()[:128]}, {-2, []byte{1, 0, 1}}}),
+		"oversized RSA exponent":     cborEncode([][2]interface{}{{1, 3}, {3, algRS256}, {-1, rsaKey.N.Bytes()}, {-2, make([]byte, 5)}}),
+		"unsupported algorithm":      cborEncode([][2]interface{}{{1, 2}, {3, -35}, {-1, 2}, {-2, x}, {-3, y}}),
+		"key type of another alg":    cborEncode([][2]interface{}{{1, 3}, {3, algES256}, {-1, 1}, {-2, x}, {-3, y}}),
+		"not a map":                  cborEncode(x),
+		"trailing bytes after a key": append(append([]byte(nil), es256...), 0),
+	}
+	for name, cose := range invalid {
+		_, err = parsePublicKey(cose)
+		require.ErrorIs(t, err, ErrUnsupportedKey, name)
+	}
+}
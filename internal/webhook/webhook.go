@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/thomiceli/opengist/internal/config"
+	"github.com/thomiceli/opengist/internal/db"
+	"github.com/thomiceli/opengist/internal/utils"
+)
+
+// RetryDelays are the waits before retrying a failed delivery, doubling each time. The retries are kept in memory, so
+// they are lost if Opengist is restarted.
+var RetryDelays = []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+
+const SignatureHeader = "X-Opengist-Signature-256"
+
+// Trigger sends the event of a gist of the user to its webhooks subscribed to it, in the background. The payload is
+// sent as JSON along with the name of the event.
+func Trigger(userId uint, event string, payload map[string]interface{}) {
+	webhooks, err := db.GetWebhooksForEvent(userId, event)
+	if err != nil {
+		log.Error().Err(err).Msgf("Cannot get the webhooks of user %d", userId)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := encode(event, payload)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot encode webhook payload")
+		return
+	}
+
+	for _, webhook := range webhooks {
+		go deliver(webhook, event, body)
+	}
+}
+
+// Ping sends a ping event to the webhook and waits for its delivery, without retrying it
+func Ping(webhook *db.Webhook) (*db.WebhookDelivery, error) {
+	body, err := encode(db.WebhookEventPing, map[string]interface{}{"webhook_id": webhook.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	return send(webhook, db.WebhookEventPing, body, uuid.NewString(), 1), nil
+}
+
+// Sign returns the value of the signature header of a payload sent with the secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func encode(event string, payload map[string]interface{}) ([]byte, error) {
+	data := map[string]interface{}{"event": event}
+	for key, value := range payload {
+		data[key] = value
+	}
+	return json.Marshal(data)
+}
+
+// deliver sends the payload until the webhook accepts it, waiting longer between each attempt
+func deliver(webhook *db.Webhook, event string, body []byte) {
+	deliveryId := uuid.NewString()
+	for attempt := 1; ; attempt++ {
+		if send(webhook, event, body, deliveryId, attempt).Succeeded() || attempt > len(RetryDelays) {
+			return
+		}
+		time.Sleep(RetryDelays[attempt-1])
+	}
+}
+
+// send makes an attempt to deliver the payload, and logs it
+func send(webhook *db.Webhook, event string, body []byte, deliveryId string, attempt int) *db.WebhookDelivery {
+	delivery := &db.WebhookDelivery{
+		WebhookID: webhook.ID,
+		UUID:      deliveryId,
+		Event:     event,
+		Attempt:   attempt,
+	}
+
+	start := time.Now()
+	statusCode, err := post(webhook, event, body, deliveryId)
+	delivery.Duration = time.Since(start).Milliseconds()
+	delivery.StatusCode = statusCode
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if err = db.CreateWebhookDelivery(delivery); err != nil {
+		log.Error().Err(err).Msgf("Cannot log delivery of webhook %d", webhook.ID)
+	}
+	return delivery
+}
+
+func post(webhook *db.Webhook, event string, body []byte, deliveryId string) (int, error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Opengist-Webhook/"+config.OpengistVersion)
+	req.Header.Set("X-Opengist-Event", event)
+	req.Header.Set("X-Opengist-Delivery", deliveryId)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+
+	resp, err := client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", strings.TrimSpace(resp.Status))
+	}
+	return resp.StatusCode, nil
+}
+
+// client returns the HTTP client of the deliveries. The webhooks are set by the users, so they cannot reach the network
+// Opengist is running in unless allowed by the configuration. The redirects are not followed, a POST request would be
+// turned into a GET one.
+func client() *http.Client {
+	c := *utils.PublicHttpClient
+	if config.C.WebhooksAllowPrivateNetwork {
+		c = *utils.HttpClient
+	}
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &c
+}
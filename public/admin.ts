@@ -6,6 +6,15 @@ document.addEventListener('DOMContentLoaded', () => {
         })
     }
 
+    const selectAllUsers = document.getElementById('select-all-users') as HTMLInputElement;
+    if (selectAllUsers) {
+        selectAllUsers.onchange = () => {
+            document.querySelectorAll<HTMLInputElement>('input.user-select').forEach((el) => {
+                el.checked = selectAllUsers.checked;
+            });
+        };
+    }
+
     let copyInviteButtons = Array.from(document.getElementsByClassName("copy-invitation-link"));
     for (let button of copyInviteButtons) {
         button.addEventListener('click', () => {
@@ -2,10 +2,14 @@ import {EditorView, gutter, keymap, lineNumbers} from "@codemirror/view";
 import {Compartment, EditorState, Facet, Line, SelectionRange} from "@codemirror/state";
 import {indentLess} from "@codemirror/commands";
 
+// the extensions rendered as Markdown by the server
+const isMarkdown = (filename: string) => /\.(md|mkd|markdown)$/i.test(filename);
+
 document.addEventListener("DOMContentLoaded", () => {
     EditorView.theme({}, {dark: true});
 
     let editorsjs: EditorView[] = [];
+    let draggedEditor: HTMLElement | null = null;
     let editorsParentdom = document.getElementById("editors")!;
     let allEditorsdom = document.querySelectorAll("#editors > .editor");
     let firstEditordom = allEditorsdom[0];
@@ -20,11 +24,30 @@ document.addEventListener("DOMContentLoaded", () => {
         wrapMode = new Compartment(),
         indentType = new Compartment();
 
+    // same as the "filename:" hint recognized by the server for files submitted without a name
+    const filenameHintRegex = /^\s*(?:\/\/|#|--|;|\/\*|<!--)\s*filename:\s*([^\s\/\\]+?)\s*(?:\*\/|-->)?\s*$/;
+
     const newEditor = (dom: HTMLElement, value: string = ""): EditorView => {
+        let formfilename = dom.querySelector<HTMLInputElement>(".form-filename");
+        // kept in a data attribute as new editors are cloned from the first one
+        if (!formfilename!.dataset.placeholder) {
+            formfilename!.dataset.placeholder = formfilename!.placeholder;
+        }
+        let defaultPlaceholder = formfilename!.dataset.placeholder;
+
+        // suggest the name given by a "filename:" hint on the first line as placeholder
+        const suggestFilename = (state: EditorState) => {
+            let matches = state.doc.line(1).text.match(filenameHintRegex);
+            formfilename!.placeholder = matches ? matches[1] : defaultPlaceholder;
+        };
+
         let editor = new EditorView({
             doc: value,
             parent: dom,
             extensions: [
+                EditorView.updateListener.of((update) => {
+                    if (update.docChanged) suggestFilename(update.state);
+                }),
                 lineNumbers(),
                 gutter({class: "cm-mygutter"}),
                 keymap.of([{key: "Tab", run: customIndentMore, shift: indentLess}]),
@@ -34,21 +57,21 @@ document.addEventListener("DOMContentLoaded", () => {
             ],
         });
 
-        let mdpreview = dom.querySelector(".md-preview") as HTMLElement;
+        suggestFilename(editor.state);
 
-        let formfilename = dom.querySelector<HTMLInputElement>(".form-filename");
+        let mdpreview = dom.querySelector(".md-preview") as HTMLElement;
 
-        // check if file ends with .md on pageload
-        if (formfilename!.value.endsWith(".md")) {
+        // check if file is a Markdown one (.md, .mkd, .markdown) on pageload
+        if (isMarkdown(formfilename!.value)) {
             mdpreview!.classList.remove("hidden");
         } else {
             mdpreview!.classList.add("hidden");
         }
 
-        // event if the filename ends with .md; trigger event
+        // event if the filename is a Markdown one; trigger event
         formfilename!.onkeyup = (e) => {
             let filename = (e.target as HTMLInputElement).value;
-            if (filename.endsWith(".md")) {
+            if (isMarkdown(filename)) {
                 mdpreview!.classList.remove("hidden");
             } else {
                 mdpreview!.classList.add("hidden");
@@ -99,12 +122,42 @@ document.addEventListener("DOMContentLoaded", () => {
 
         dom.addEventListener("drop", (e) => {
             e.preventDefault(); // prevent the browser from opening the dropped file
+            if (draggedEditor !== null) {
+                return;
+            }
             (e.target as HTMLInputElement)
                 .closest(".editor")
                 .querySelector<HTMLInputElement>("input.form-filename")!.value =
                 e.dataTransfer.files[0].name;
         });
 
+        // reorder the files by dragging their handle over another file
+        let dragHandle = dom.querySelector<HTMLElement>(".drag-file");
+        if (dragHandle !== null) {
+            dragHandle.ondragstart = (e) => {
+                draggedEditor = dom;
+                e.dataTransfer!.effectAllowed = "move";
+                e.dataTransfer!.setDragImage(dom, 0, 0);
+            };
+            dragHandle.ondragend = () => {
+                draggedEditor = null;
+            };
+        }
+
+        dom.addEventListener("dragover", (e) => {
+            if (draggedEditor === null || draggedEditor === dom) {
+                return;
+            }
+            e.preventDefault();
+
+            let rect = dom.getBoundingClientRect();
+            if (e.clientY < rect.top + rect.height / 2) {
+                dom.before(draggedEditor);
+            } else {
+                dom.after(draggedEditor);
+            }
+        });
+
         // remove editor on delete
         let deleteBtns = dom.querySelector<HTMLButtonElement>("button.delete-file");
         if (deleteBtns !== null) {
@@ -196,6 +249,11 @@ document.addEventListener("DOMContentLoaded", () => {
 
         // reset the filename of the new cloned element
         newEditorDom.querySelector<HTMLInputElement>('input[name="name"]')!.value = "";
+        // the new file is not a renamed one
+        let originalFilename = newEditorDom.querySelector<HTMLInputElement>('input[name="original-name"]');
+        if (originalFilename !== null) {
+            originalFilename.value = "";
+        }
 
         // removing the previous codemirror editor
         let newEditorDomCM = newEditorDom.querySelector(".cm-editor");
@@ -206,10 +264,78 @@ document.addEventListener("DOMContentLoaded", () => {
         editorsParentdom.append(newEditorDom);
     };
 
+    // prefill a file with the content of a remote text file, fetched by the server
+    let importUrlBtn = document.getElementById("import-url-btn");
+    if (importUrlBtn !== null) {
+        importUrlBtn.onclick = () => {
+            let importUrl = document.getElementById("import-url") as HTMLInputElement;
+            // @ts-ignore
+            const baseUrl = window.opengist_base_url || '';
+
+            fetch(`${baseUrl}/fetch-url?` + new URLSearchParams({url: importUrl.value}), {
+                method: 'GET',
+                credentials: 'same-origin',
+            }).then(r => r.json()).then((r: { filename?: string, content?: string, error?: string }) => {
+                if (r.error) {
+                    alert(r.error);
+                    return;
+                }
+
+                // fill the last file if it is still empty, otherwise add a new one
+                let editorDom = document.querySelector<HTMLElement>("#editors > .editor:last-child")!;
+                let editor = EditorView.findFromDOM(editorDom.querySelector<HTMLElement>(".cm-editor")!)!;
+                let filename = editorDom.querySelector<HTMLInputElement>(".form-filename")!;
+                if (editor.state.doc.length > 0 || filename.value !== "") {
+                    document.getElementById("add-file")!.click();
+                    editorDom = document.querySelector<HTMLElement>("#editors > .editor:last-child")!;
+                    editor = EditorView.findFromDOM(editorDom.querySelector<HTMLElement>(".cm-editor")!)!;
+                    filename = editorDom.querySelector<HTMLInputElement>(".form-filename")!;
+                }
+
+                filename.value = r.filename || "";
+                filename.dispatchEvent(new KeyboardEvent("keyup"));
+                editor.dispatch({changes: {from: 0, to: editor.state.doc.length, insert: r.content || ""}});
+                importUrl.value = "";
+            });
+        };
+    }
+
+    // suggest the existing tags starting like the one being typed, the last of the comma separated list
+    let tagsInput = document.getElementById("tags") as HTMLInputElement | null;
+    let tagsSuggestions = document.getElementById("tags-suggestions");
+    if (tagsInput !== null && tagsSuggestions !== null) {
+        let lastPrefix = "";
+        tagsInput.oninput = () => {
+            let value = tagsInput!.value;
+            let commaIndex = value.lastIndexOf(",");
+            let typed = value.substring(commaIndex + 1).trim();
+            if (typed === "" || typed === lastPrefix) {
+                return;
+            }
+            lastPrefix = typed;
+
+            // @ts-ignore
+            const baseUrl = window.opengist_base_url || '';
+            fetch(`${baseUrl}/tags?` + new URLSearchParams({q: typed}), {
+                method: 'GET',
+                credentials: 'same-origin',
+            }).then(r => r.json()).then((tags: string[]) => {
+                // the options hold the whole value, as picking one replaces the content of the input
+                let before = commaIndex >= 0 ? value.substring(0, commaIndex + 1) + " " : "";
+                tagsSuggestions!.replaceChildren(...tags.map((tag) => {
+                    let option = document.createElement("option");
+                    option.value = before + tag;
+                    return option;
+                }));
+            });
+        };
+    }
+
     document.querySelector<HTMLFormElement>("form#create")!.onsubmit = () => {
-        let j = 0;
-        document.querySelectorAll<HTMLInputElement>(".form-filecontent").forEach((e) => {
-            e.value = encodeURIComponent(editorsjs[j++].state.doc.toString());
+        // files may have been reordered, so each content is taken from the editor of its own block
+        document.querySelectorAll<HTMLElement>("#editors > .editor").forEach((el) => {
+            let editor = EditorView.findFromDOM(el.querySelector<HTMLElement>(".cm-editor")!)!;
+            el.querySelector<HTMLInputElement>(".form-filecontent")!.value = encodeURIComponent(editor.state.doc.toString());
         });
     };
 
@@ -226,6 +352,29 @@ document.addEventListener("DOMContentLoaded", () => {
 
     }
 
+    // the description is rendered with the restricted Markdown of the gist page
+    document.getElementById('description-preview-btn')!.onclick = () => {
+        let divpreview = document.getElementById('description-preview')!;
+        let description = document.getElementById('description') as HTMLInputElement;
+        if (!divpreview.classList.contains('hidden') || description.value.trim() === '') {
+            divpreview.classList.add('hidden');
+            return;
+        }
+
+        // @ts-ignore
+        const baseUrl = window.opengist_base_url || '';
+        fetch(`${baseUrl}/preview?` + new URLSearchParams({
+            content: description.value,
+            description: 'true'
+        }), {
+            method: 'GET',
+            credentials: 'same-origin',
+        }).then(r => r.text()).then(r => {
+            divpreview.innerHTML = r;
+            divpreview.classList.remove('hidden');
+        });
+    }
+
     document.onsubmit = () => {
         window.onbeforeunload = null;
     };
@@ -1,20 +1,143 @@
-document.querySelectorAll<HTMLElement>('.table-code').forEach((el) => {
-    el.addEventListener('click', event => {
-        if (event.target && (event.target as HTMLElement).matches('.line-num')) {
-            Array.from(document.querySelectorAll('.table-code .selected')).forEach((el) => el.classList.remove('selected'));
-
-            const nextSibling = (event.target as HTMLElement).nextSibling;
-            if (nextSibling instanceof HTMLElement) {
-                nextSibling.classList.add('selected');
-            }
+const activeViewClasses = ['bg-gray-100', 'text-slate-700', 'dark:bg-gray-700'];
+const inactiveViewClasses = ['bg-white', 'text-gray-500', 'dark:bg-gray-600'];
+
+const showMarkdownView = (file: HTMLElement, view: string) => {
+    file.querySelector('.markdown-rendered')?.classList.toggle('hidden', view !== 'rendered');
+    file.querySelector('.markdown-source')?.classList.toggle('hidden', view !== 'source');
+    file.querySelectorAll<HTMLElement>('.markdown-toggle button').forEach((button) => {
+        const active = button.dataset.view === view;
+        button.classList.remove(...(active ? inactiveViewClasses : activeViewClasses));
+        button.classList.add(...(active ? activeViewClasses : inactiveViewClasses));
+    });
+};
+
+document.querySelectorAll<HTMLElement>('.markdown-toggle button').forEach((button) => {
+    button.addEventListener('click', () => {
+        showMarkdownView(button.closest<HTMLElement>('div[data-file]'), button.dataset.view);
+    });
+});
+
+// the lines of a file are linked with #file-<slug>-L<start>-L<end>, or #file-<slug>-<line> for a single one, and
+// #L<start>-L<end> links to the lines of the first file
+type LineRange = {table: HTMLElement, start: number, end: number};
+
+const lineHash = (range: LineRange): string => {
+    const lines = range.start === range.end ? `L${range.start}` : `L${range.start}-L${range.end}`;
+    return `#file-${range.table.dataset.filenameSlug}-${lines}`;
+};
+
+const parseLineHash = (hash: string): LineRange | null => {
+    const tables = Array.from(document.querySelectorAll<HTMLElement>('.table-code'));
+    const candidates: {table: HTMLElement, lines: string}[] = [];
+    if (hash.startsWith('L') && tables.length > 0) {
+        candidates.push({table: tables[0], lines: hash});
+    }
+    for (const table of tables) {
+        const prefix = `file-${table.dataset.filenameSlug}-`;
+        if (hash.startsWith(prefix)) {
+            candidates.push({table: table, lines: hash.substring(prefix.length)});
+        }
+    }
+
+    // a slug can end like a line number, the longest one matching wins
+    candidates.sort((a, b) => a.lines.length - b.lines.length);
+    for (const candidate of candidates) {
+        const match = candidate.lines.match(/^L?(\d+)(?:-L?(\d+))?$/);
+        if (!match) {
+            continue;
+        }
+        const nbLines = candidate.table.querySelectorAll('.line-num').length;
+        const first = parseInt(match[1]);
+        const last = match[2] ? parseInt(match[2]) : first;
+        const start = Math.max(1, Math.min(first, last));
+        const end = Math.min(nbLines, Math.max(first, last));
+        if (start <= end) {
+            return {table: candidate.table, start: start, end: end};
+        }
+    }
+    return null;
+};
+
+const lineElement = (table: HTMLElement, line: number): HTMLElement | null =>
+    document.getElementById(`file-${table.dataset.filenameSlug}-${line}`);
+
+let selectedLines: LineRange | null = null;
+// the line the selection is extended from
+let anchorLine = 0;
+
+const selectLines = (range: LineRange | null) => {
+    document.querySelectorAll('.table-code .selected').forEach((el) => el.classList.remove('selected'));
+    document.querySelectorAll('.copy-lines-permalink').forEach((el) => el.classList.add('hidden'));
+    selectedLines = range;
+    if (!range) {
+        return;
+    }
+    anchorLine = range.start;
+
+    for (let i = range.start; i <= range.end; i++) {
+        lineElement(range.table, i)?.nextElementSibling?.classList.add('selected');
+    }
+    range.table.closest('div[data-file]')?.querySelector('.copy-lines-permalink')?.classList.remove('hidden');
+};
+
+// a link to a line of a Markdown file opens its source view
+const showLinkedLines = () => {
+    const range = parseLineHash(location.hash.substring(1));
+    selectLines(range);
+    if (!range) {
+        return;
+    }
+    if (range.table.closest('.markdown-source')) {
+        showMarkdownView(range.table.closest<HTMLElement>('div[data-file]'), 'source');
+    }
+    lineElement(range.table, range.start)?.scrollIntoView({block: 'center'});
+};
 
-            const filename = el.dataset.filenameSlug;
-            const line = (event.target as HTMLElement).textContent;
-            const url = location.protocol + '//' + location.host + location.pathname;
-            const hash = '#file-' + filename + '-' + line;
-            window.history.pushState(null, null, url + hash);
-            location.hash = hash;
+showLinkedLines();
+window.addEventListener('hashchange', showLinkedLines);
+
+// a click on a line number selects it, a shift-click extends the selection of the file up to it
+document.querySelectorAll<HTMLElement>('.table-code').forEach((table) => {
+    table.addEventListener('click', (event) => {
+        const target = event.target as HTMLElement;
+        if (!target || !target.matches('.line-num')) {
+            return;
         }
+
+        const line = parseInt(target.textContent || '');
+        let range: LineRange = {table: table, start: line, end: line};
+        let anchor = line;
+        if (event.shiftKey && selectedLines && selectedLines.table === table) {
+            anchor = anchorLine;
+            range = {table: table, start: Math.min(anchor, line), end: Math.max(anchor, line)};
+            window.getSelection()?.removeAllRanges();
+        }
+
+        selectLines(range);
+        anchorLine = anchor;
+        window.history.pushState(null, '', location.pathname + location.search + lineHash(range));
+    });
+});
+
+document.querySelectorAll<HTMLElement>('.copy-lines-permalink').forEach((button) => {
+    button.addEventListener('click', () => {
+        if (!selectedLines) {
+            return;
+        }
+        navigator.clipboard.writeText(button.dataset.url + lineHash(selectedLines)).then(() => {
+            if (button.dataset.copying) {
+                return;
+            }
+            const label = button.textContent;
+            button.dataset.copying = 'true';
+            button.textContent = button.dataset.copied || '';
+            setTimeout(() => {
+                button.textContent = label;
+                delete button.dataset.copying;
+            }, 1500);
+        }).catch((err) => {
+            console.error('Could not copy text: ', err);
+        });
     });
 });
 
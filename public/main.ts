@@ -13,17 +13,36 @@ import 'dayjs/locale/pt';
 import 'dayjs/locale/ru';
 import 'dayjs/locale/zh';
 import localizedFormat from 'dayjs/plugin/localizedFormat';
+import './palette';
 
 dayjs.extend(relativeTime);
 dayjs.extend(localizedFormat);
 dayjs.locale(window.opengist_locale || 'en');
 
+// the theme chosen in the menu by a logged user is also saved in their settings
+const saveTheme = (theme: string) => {
+    const form = document.getElementById('theme-form') as HTMLFormElement | null;
+    if (!form) {
+        return;
+    }
+
+    // @ts-ignore
+    window.opengist_theme = theme === 'auto' ? '' : theme;
+    (form.elements.namedItem('theme') as HTMLInputElement).value = theme;
+    fetch(form.action, {
+        method: 'POST',
+        credentials: 'same-origin',
+        body: new FormData(form),
+    });
+};
+
 document.addEventListener('DOMContentLoaded', () => {
     const themeMenu = document.getElementById('theme-menu')!;
 
     document.getElementById('light-mode')!.onclick = (e) => {
         e.stopPropagation()
         localStorage.theme = 'light';
+        saveTheme('light');
         themeMenu.classList.toggle('hidden');
         // @ts-ignore
         checkTheme()
@@ -32,6 +51,7 @@ document.addEventListener('DOMContentLoaded', () => {
     document.getElementById('dark-mode')!.onclick = (e) => {
         e.stopPropagation()
         localStorage.theme = 'dark';
+        saveTheme('dark');
         themeMenu.classList.toggle('hidden');
         // @ts-ignore
         checkTheme()
@@ -40,6 +60,7 @@ document.addEventListener('DOMContentLoaded', () => {
     document.getElementById('system-mode')!.onclick = (e) => {
         e.stopPropagation()
         localStorage.removeItem('theme');
+        saveTheme('auto');
         themeMenu.classList.toggle('hidden');
         // @ts-ignore
         checkTheme();
@@ -121,6 +142,15 @@ document.addEventListener('DOMContentLoaded', () => {
         };
     }
 
+    const selectAllGists = document.getElementById('select-all-gists') as HTMLInputElement;
+    if (selectAllGists) {
+        selectAllGists.onchange = () => {
+            document.querySelectorAll<HTMLInputElement>('input.gist-select').forEach((el) => {
+                el.checked = selectAllGists.checked;
+            });
+        };
+    }
+
     const gistmenutoggle = document.getElementById('gist-menu-toggle');
     if (gistmenutoggle) {
         const gistmenucopy = document.getElementById('gist-menu-copy')!;
@@ -128,8 +158,10 @@ document.addEventListener('DOMContentLoaded', () => {
         const gistmenuinput = document.getElementById('gist-menu-input') as HTMLInputElement;
         const gistmenutitle = document.getElementById('gist-menu-title')!;
 
-        gistmenutitle.textContent = gistmenucopy.children[0].firstChild!.textContent;
-        gistmenuinput.value = (gistmenucopy.children[0] as HTMLElement).dataset.link || '';
+        // the clone URL preferred by the user is shown first, if they can use it
+        const defaultItem = gistmenucopy.querySelector<HTMLElement>('[data-default]') || gistmenucopy.children[0] as HTMLElement;
+        gistmenutitle.textContent = defaultItem.firstChild!.textContent;
+        gistmenuinput.value = defaultItem.dataset.link || '';
 
         gistmenutoggle.onclick = () => {
             gistmenucopy.classList.toggle('hidden');
@@ -164,21 +196,56 @@ document.addEventListener('DOMContentLoaded', () => {
     };
 
 
-    document.querySelectorAll('.copy-gist-btn').forEach((e: HTMLElement) => {
-        e.onclick = () => {
-            navigator.clipboard.writeText(e.parentNode!.parentNode!.querySelector<HTMLElement>('.gist-content')!.textContent || '').catch((err) => {
+    // the content is fetched from the server, as the page only shows the beginning of large files
+    const copyFromUrl = (button: HTMLElement, read: (response: Response) => Promise<string>) => {
+        fetch(button.dataset.url!, {credentials: 'same-origin'})
+            .then((response) => {
+                if (!response.ok) {
+                    throw new Error(response.statusText);
+                }
+                return read(response);
+            })
+            .then((text) => navigator.clipboard.writeText(text))
+            .then(() => {
+                if (button.dataset.copying) {
+                    return;
+                }
+                const content = button.innerHTML;
+                button.dataset.copying = 'true';
+                button.textContent = button.dataset.copied || '';
+                setTimeout(() => {
+                    button.innerHTML = content;
+                    delete button.dataset.copying;
+                }, 1500);
+            })
+            .catch((err) => {
                 console.error('Could not copy text: ', err);
             });
-        };
+    };
+
+    document.querySelectorAll('.copy-gist-btn').forEach((e: HTMLElement) => {
+        e.onclick = () => copyFromUrl(e, (response) => response.text());
     });
 
+    const gistcopyall = document.getElementById('gist-copy-all');
+    if (gistcopyall) {
+        gistcopyall.onclick = () => copyFromUrl(gistcopyall, async (response) => {
+            const files: {filename: string, content: string}[] = (await response.json()).files;
+            if (files.length === 1) {
+                return files[0].content;
+            }
+            return files.map((file) => `==> ${file.filename} <==\n${file.content}`).join('\n\n');
+        });
+    }
+
     const gistmenuvisibility = document.getElementById('gist-menu-visibility');
     if (gistmenuvisibility) {
         let submitgistbutton = (document.getElementById('submit-gist') as HTMLInputElement);
         document.getElementById('gist-visibility-menu-button')!.onclick = () => {
             gistmenuvisibility!.classList.toggle('hidden');
         }
-        const lastVisibility = localStorage.getItem('visibility');
+        // the creation form preselects the default visibility of the user instead of the last one chosen
+        const lastVisibility = gistmenuvisibility.dataset.visibility ?? localStorage.getItem('visibility');
         Array.from(document.querySelectorAll('.gist-visibility-option')).forEach((el) => {
             const visibility = (el as HTMLElement).dataset.visibility || '0';
             (el as HTMLElement).onclick = () => {
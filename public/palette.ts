@@ -0,0 +1,193 @@
+// the command palette opens with Ctrl+K, and jumps to the gists of the user or to one of the actions
+
+interface PaletteEntry {
+    label: string;
+    detail: string;
+    url: string;
+}
+
+interface PaletteGist {
+    id: string;
+    owner: string;
+    title: string;
+    visibility: string;
+    url: string;
+}
+
+// the gists of users with a lot of them are only fetched up to this number of pages
+const maxGistPages = 10;
+const maxResults = 50;
+
+// fuzzyScore returns how well the query matches the text, its letters appearing in order, or -1 if it does not.
+// Consecutive letters and letters starting a word score more.
+const fuzzyScore = (query: string, text: string): number => {
+    if (query === '') {
+        return 0;
+    }
+
+    const lowerText = text.toLowerCase();
+    let score = 0;
+    let last = -1;
+    for (const char of query.toLowerCase()) {
+        const index = lowerText.indexOf(char, last + 1);
+        if (index === -1) {
+            return -1;
+        }
+        score += 1;
+        if (index === last + 1) {
+            score += 2;
+        }
+        if (index === 0 || /[\s\/\-_.]/.test(lowerText[index - 1])) {
+            score += 3;
+        }
+        last = index;
+    }
+    // shorter texts matching the same letters come first
+    return score - lowerText.length / 100;
+};
+
+document.addEventListener('DOMContentLoaded', () => {
+    const palette = document.getElementById('command-palette');
+    if (!palette) {
+        return;
+    }
+
+    const input = document.getElementById('command-palette-input') as HTMLInputElement;
+    const results = document.getElementById('command-palette-results')!;
+    const empty = document.getElementById('command-palette-empty')!;
+    // @ts-ignore
+    const baseUrl = window.opengist_base_url || '';
+
+    const actions: PaletteEntry[] = Array.from(document.querySelectorAll<HTMLElement>('#command-palette-actions li')).map((el) => ({
+        label: el.textContent!.trim(),
+        detail: el.dataset.kind || '',
+        url: el.dataset.url || '',
+    }));
+    let gists: PaletteEntry[] = [];
+    let gistsLoaded = false;
+    let matches: PaletteEntry[] = [];
+    let selected = 0;
+
+    const loadGists = async () => {
+        gistsLoaded = true;
+        for (let page = 1; page <= maxGistPages; page++) {
+            const response = await fetch(`${palette.dataset.gistsUrl}?` + new URLSearchParams({page: page.toString()}), {
+                credentials: 'same-origin',
+                headers: {'Accept': 'application/json'},
+            });
+            if (!response.ok) {
+                return;
+            }
+
+            const data: { gists: PaletteGist[], hasMore: boolean } = await response.json();
+            gists = gists.concat(data.gists.map((gist) => ({
+                label: `${gist.owner} / ${gist.title}`,
+                detail: `${palette.dataset.gistKind} · ${gist.visibility}`,
+                url: baseUrl + gist.url,
+            })));
+            render();
+            if (!data.hasMore) {
+                return;
+            }
+        }
+    };
+
+    const render = () => {
+        const query = input.value.trim();
+        matches = actions.concat(gists)
+            .map((entry) => ({entry, score: fuzzyScore(query, entry.label)}))
+            .filter((match) => match.score >= 0)
+            .sort((a, b) => b.score - a.score)
+            .slice(0, maxResults)
+            .map((match) => match.entry);
+        selected = Math.min(selected, Math.max(matches.length - 1, 0));
+
+        results.replaceChildren(...matches.map((entry, i) => {
+            const item = document.createElement('li');
+            item.setAttribute('role', 'option');
+            item.setAttribute('aria-selected', (i === selected).toString());
+            item.className = 'flex cursor-pointer select-none items-center px-4 py-2' +
+                (i === selected ? ' bg-primary-500 text-white' : '');
+
+            const label = document.createElement('span');
+            label.className = 'flex-auto truncate';
+            label.textContent = entry.label;
+            const detail = document.createElement('span');
+            detail.className = 'ml-3 flex-none text-xs ' + (i === selected ? 'text-white' : 'text-gray-500');
+            detail.textContent = entry.detail;
+            item.append(label, detail);
+
+            item.onmousemove = () => {
+                if (selected !== i) {
+                    selected = i;
+                    render();
+                }
+            };
+            item.onclick = () => go(entry);
+            return item;
+        }));
+        results.children[selected]?.scrollIntoView({block: 'nearest'});
+        empty.classList.toggle('hidden', matches.length > 0);
+    };
+
+    const go = (entry: PaletteEntry) => {
+        window.location.href = entry.url;
+    };
+
+    const open = () => {
+        palette.classList.remove('hidden');
+        input.value = '';
+        selected = 0;
+        render();
+        input.focus();
+        if (!gistsLoaded) {
+            loadGists().catch((err) => console.error('Could not load the gists: ', err));
+        }
+    };
+
+    const close = () => {
+        palette.classList.add('hidden');
+    };
+
+    document.addEventListener('keydown', (e) => {
+        if ((e.ctrlKey || e.metaKey) && e.key.toLowerCase() === 'k') {
+            e.preventDefault();
+            if (palette.classList.contains('hidden')) {
+                open();
+            } else {
+                close();
+            }
+        }
+    });
+
+    document.getElementById('command-palette-backdrop')!.onclick = close;
+
+    input.oninput = () => {
+        selected = 0;
+        render();
+    };
+
+    input.onkeydown = (e) => {
+        switch (e.key) {
+            case 'ArrowDown':
+                e.preventDefault();
+                selected = Math.min(selected + 1, matches.length - 1);
+                render();
+                break;
+            case 'ArrowUp':
+                e.preventDefault();
+                selected = Math.max(selected - 1, 0);
+                render();
+                break;
+            case 'Enter':
+                e.preventDefault();
+                if (matches[selected]) {
+                    go(matches[selected]);
+                }
+                break;
+            case 'Escape':
+                close();
+                break;
+        }
+    };
+});
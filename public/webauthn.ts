@@ -0,0 +1,88 @@
+// Binary values are exchanged with the server base64url encoded, without padding
+const toBuffer = (value: string): ArrayBuffer => {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+    return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+};
+
+const toBase64Url = (buffer: ArrayBuffer): string => {
+    const binary = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+};
+
+const fetchOptions = async (path: string): Promise<any> => {
+    // @ts-ignore
+    const baseUrl = window.opengist_base_url || '';
+    const response = await fetch(`${baseUrl}${path}`, {credentials: 'same-origin'});
+    if (!response.ok) {
+        throw new Error(`Cannot get the passkey options: ${response.status}`);
+    }
+    return response.json();
+};
+
+const setField = (form: HTMLFormElement, name: string, value: string) => {
+    (form.elements.namedItem(name) as HTMLInputElement).value = value;
+};
+
+const showError = (form: HTMLFormElement) => {
+    const error = form.querySelector('.passkey-error');
+    if (error) {
+        error.classList.remove('hidden');
+    }
+};
+
+const registerPasskey = async (form: HTMLFormElement) => {
+    const options = await fetchOptions('/settings/passkeys/options');
+    options.challenge = toBuffer(options.challenge);
+    options.user.id = toBuffer(options.user.id);
+    for (const credential of options.excludeCredentials) {
+        credential.id = toBuffer(credential.id);
+    }
+
+    const credential = await navigator.credentials.create({publicKey: options}) as PublicKeyCredential;
+    const response = credential.response as AuthenticatorAttestationResponse;
+    setField(form, 'clientDataJSON', toBase64Url(response.clientDataJSON));
+    setField(form, 'attestationObject', toBase64Url(response.attestationObject));
+    form.submit();
+};
+
+const loginWithPasskey = async (form: HTMLFormElement) => {
+    // the second factor of a login gets its options from its own endpoint
+    const options = await fetchOptions(form.dataset.options || '/login/passkey/options');
+    options.challenge = toBuffer(options.challenge);
+
+    const credential = await navigator.credentials.get({publicKey: options}) as PublicKeyCredential;
+    const response = credential.response as AuthenticatorAssertionResponse;
+    setField(form, 'credentialId', toBase64Url(credential.rawId));
+    setField(form, 'clientDataJSON', toBase64Url(response.clientDataJSON));
+    setField(form, 'authenticatorData', toBase64Url(response.authenticatorData));
+    setField(form, 'signature', toBase64Url(response.signature));
+    form.submit();
+};
+
+document.addEventListener('DOMContentLoaded', () => {
+    const forms: [string, (form: HTMLFormElement) => Promise<void>][] = [
+        ['passkey-register-form', registerPasskey],
+        ['passkey-login-form', loginWithPasskey],
+    ];
+
+    for (const [id, ceremony] of forms) {
+        const form = document.getElementById(id) as HTMLFormElement | null;
+        if (!form) {
+            continue;
+        }
+
+        if (!window.PublicKeyCredential) {
+            showError(form);
+            continue;
+        }
+
+        form.addEventListener('submit', (event) => {
+            event.preventDefault();
+            ceremony(form).catch((err) => {
+                console.error(err);
+                showError(form);
+            });
+        });
+    }
+});